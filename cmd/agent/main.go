@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
 	"log"
+	"os/signal"
+	"syscall"
 
 	"github.com/nais2008/final_project_go_yandex/internal/agent"
 	"github.com/nais2008/final_project_go_yandex/internal/config"
@@ -11,11 +14,12 @@ func main() {
     cfg := config.LoadConfig()
     computingPower := cfg.ComputingPower
 
+    ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+    defer stop()
+
     ag := agent.NewAgent(cfg)
-    for i := 0; i < computingPower; i++ {
-        go ag.Run()
-    }
 
-    log.Printf("Agent started with %d workers", computingPower)
-    select {}
+    log.Printf("Agent %s started with %d workers", ag.ID(), computingPower)
+    ag.Run(ctx)
+    log.Printf("Agent %s stopped", ag.ID())
 }
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/nais2008/final_project_go_yandex/internal/backend"
+	"github.com/nais2008/final_project_go_yandex/internal/config"
+	"github.com/nais2008/final_project_go_yandex/internal/fsck"
+	"github.com/nais2008/final_project_go_yandex/internal/leader"
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+)
+
+const fsckUsage = `usage: orchestrator fsck [--repair] [--tolerance T]
+
+Checks users, expressions and tasks for rows that disagree with each other
+and with a recomputation of the results. Exits with status 1 when problems
+are left unrepaired.
+
+--repair takes the leader lock and refuses to run while an orchestrator
+holds it. With sqlite the lock only covers this process, stop the
+orchestrator before repairing.`
+
+// runFsck implements the "fsck" subcommand
+func runFsck(args []string) {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Println(fsckUsage)
+		flags.PrintDefaults()
+	}
+	repair := flags.Bool("repair", false, "fix the problems found")
+	tolerance := flags.Float64("tolerance", fsck.DefaultTolerance, "relative difference allowed between a stored and a recomputed result")
+	flags.Parse(args)
+
+	st, err := backend.Open(config.LoadStorageConfig())
+	if err != nil {
+		log.Fatalf("Failed to open storage: %v", err)
+	}
+	defer st.Close()
+
+	checker, ok := st.(storage.Checker)
+	if !ok {
+		log.Fatalf("Storage backend cannot be checked")
+	}
+
+	ctx := context.Background()
+	if *repair {
+		// a leader would requeue and finish tasks under the repair
+		lock, err := st.TryLock(ctx, leader.LockKey)
+		if errors.Is(err, storage.ErrLockHeld) {
+			log.Fatalf("An orchestrator is running as leader, stop it before repairing")
+		}
+		if err != nil {
+			log.Fatalf("Failed to take the leader lock: %v", err)
+		}
+		defer lock.Release()
+	}
+
+	problems, err := fsck.Check(ctx, checker, fsck.Options{Repair: *repair, Tolerance: *tolerance})
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if err != nil {
+		log.Fatalf("Check failed: %v", err)
+	}
+
+	switch {
+	case len(problems) == 0:
+		fmt.Println("no problems found")
+	case *repair:
+		fmt.Printf("%d problems repaired\n", len(problems))
+	default:
+		fmt.Printf("%d problems found, run with --repair to fix them\n", len(problems))
+		st.Close()
+		os.Exit(1)
+	}
+}
@@ -1,27 +1,47 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 
 	"github.com/nais2008/final_project_go_yandex/internal/auth"
+	"github.com/nais2008/final_project_go_yandex/internal/backend"
 	"github.com/nais2008/final_project_go_yandex/internal/config"
-	"github.com/nais2008/final_project_go_yandex/internal/db"
+	"github.com/nais2008/final_project_go_yandex/internal/leader"
 	"github.com/nais2008/final_project_go_yandex/internal/orchestrator"
 	"github.com/nais2008/final_project_go_yandex/internal/renderer"
 	customMiddleware "github.com/nais2008/final_project_go_yandex/internal/middleware"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrate(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "fsck" {
+		runFsck(os.Args[2:])
+		return
+	}
+
 	cfg := config.LoadConfig()
+	storageCfg := config.LoadStorageConfig()
 
-	storage, err := db.ConnectDB()
+	storage, err := backend.Open(storageCfg)
 	if err != nil {
-		panic("not db connetct")
+		log.Fatalf("Failed to open storage: %v", err)
 	}
+	defer storage.Close()
+
+	autoMigrate(storage, storageCfg)
 
 	e := echo.New()
 
@@ -31,7 +51,23 @@ func main() {
 	e.Use(middleware.Recover())
 
 
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// background work outlives ctx until in-flight requests are done
+	background, cancelBackground := context.WithCancel(context.Background())
+	defer cancelBackground()
+
 	orch := orchestrator.NewOrchestrator(cfg, storage)
+	go orch.Listen(background)
+
+	// every instance serves traffic, background duties run on the elected leader only
+	elector := leader.New(storage, leader.LockKey, time.Duration(cfg.LeaderRetryMS)*time.Millisecond, orch.Duties()...)
+	electorDone := make(chan struct{})
+	go func() {
+		elector.Run(background)
+		close(electorDone)
+	}()
 
 	e.GET("/", func(c echo.Context) error {
 		return c.Render(http.StatusOK, "index.html", nil)
@@ -45,11 +81,82 @@ func main() {
 	api.POST("/calculate", orch.CalculateHandler)
 	api.GET("/expressions", orch.GetExpressionsHandler)
 	api.GET("/expressions/:id", orch.GetExpressionByIDHandler)
+	api.DELETE("/expressions/:id", orch.CancelExpressionHandler)
+	api.POST("/expressions/:id/cancel", orch.CancelExpressionHandler)
+	api.GET("/expressions/:id/timeline", orch.GetExpressionTimelineHandler)
+	api.GET("/expressions/:id/events", orch.ExpressionEventsHandler)
+	api.GET("/events", orch.EventsHandler)
+	api.GET("/webhooks", orch.WebhooksHandler)
+	api.POST("/webhooks", orch.WebhooksHandler)
+	api.DELETE("/webhooks/:id", orch.DeleteWebhookHandler)
+	api.GET("/webhooks/secret", orch.WebhookSecretHandler)
+	api.POST("/webhooks/secret", orch.WebhookSecretHandler)
+	api.GET("/webhooks/deliveries", orch.WebhookDeliveriesHandler)
+	api.GET("/webhooks/deliveries/:id", orch.WebhookDeliveryHandler)
+	api.POST("/webhooks/deliveries/:id/redeliver", orch.RedeliverWebhookHandler)
+	api.GET("/quota", orch.QuotaHandler)
+	api.GET("/admin/users/:username/quota", orch.AdminQuotaHandler)
+	api.PUT("/admin/users/:username/quota", orch.AdminQuotaHandler)
+	api.DELETE("/admin/users/:username/quota", orch.AdminQuotaHandler)
+	api.POST("/admin/agents/:id/token", orch.AdminAgentTokenHandler)
+	api.DELETE("/admin/agents/:id/token", orch.AdminAgentTokenHandler)
+
+	// agents sign in with the token an admin issued them unless AGENT_AUTH is off
+	var agentAuth []echo.MiddlewareFunc
+	if cfg.AgentAuth {
+		agentAuth = append(agentAuth, customMiddleware.AgentAuthMiddleware(storage))
+	} else {
+		log.Printf("AGENT_AUTH is off, any client may claim tasks and submit results")
+	}
+	agents := e.Group("/internal", agentAuth...)
+	agents.GET("/tasks", orch.TaskHandler)
+	agents.POST("/tasks", orch.TaskHandler)
+	agents.GET("/tasks/batch", orch.TaskBatchHandler)
+	agents.POST("/tasks/batch", orch.TaskBatchHandler)
+	agents.POST("/tasks/release", orch.ReleaseTasksHandler)
+	agents.POST("/agents/:id/heartbeat", orch.AgentHeartbeatHandler)
+	agents.POST("/agents/:id/offline", orch.AgentOfflineHandler)
+
+	// operational stats, handlers check ADMIN_USERS
+	admin := e.Group("/internal", customMiddleware.AuthMiddleware(storage))
+	admin.GET("/cache", orch.CacheStatsHandler)
+	admin.GET("/verification", orch.VerificationStatsHandler)
+
+	// load balancers cannot hold a user token, the handler checks ADMISSION_TOKEN
+	e.GET("/internal/admission", orch.AdmissionHandler)
+
+	queue := e.Group("/internal/queue")
+	queue.Use(customMiddleware.AuthMiddleware(storage))
+	queue.GET("", orch.QueueHandler)
+	queue.POST("/tasks/:id/:action", orch.QueueTaskHandler)
+	queue.POST("/expressions/:id/:action", orch.QueueExpressionHandler)
+	queue.POST("/agents/:id/:action", orch.QueueAgentHandler)
 
-	internal := e.Group("/internal")
-	internal.GET("/tasks", orch.TaskHandler)
-	internal.POST("/tasks", orch.TaskHandler)
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Printf("Orchestrator listening on %s", cfg.OrchestratorAddr)
+		serverErr <- e.Start(cfg.OrchestratorAddr)
+	}()
+
+	select {
+	case err := <-serverErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Server stopped: %v", err)
+		}
+	case <-ctx.Done():
+		log.Printf("Shutting down")
+	}
+
+	// refuse new work and wake long-polling agents, then let requests finish
+	orch.Drain()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeoutMS)*time.Millisecond)
+	defer cancel()
+	if err := e.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Failed to finish in-flight requests: %v", err)
+	}
 
-	log.Printf("Orchestrator listening on %s", cfg.OrchestratorAddr)
-	log.Fatal(e.Start(cfg.OrchestratorAddr))
+	// the elector releases the leader lock once its duties have stopped
+	cancelBackground()
+	<-electorDone
+	log.Printf("Orchestrator stopped")
 }
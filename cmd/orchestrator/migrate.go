@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/nais2008/final_project_go_yandex/internal/backend"
+	"github.com/nais2008/final_project_go_yandex/internal/config"
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+)
+
+const migrateUsage = `usage: orchestrator migrate <command>
+
+commands:
+  up          apply every pending migration
+  down [N]    roll back the last N migrations (default 1)
+  status      list migrations and when they were applied`
+
+// runMigrate implements the "migrate" subcommand
+func runMigrate(args []string) {
+	if len(args) == 0 {
+		fmt.Println(migrateUsage)
+		os.Exit(2)
+	}
+
+	st, err := backend.Open(config.LoadStorageConfig())
+	if err != nil {
+		log.Fatalf("Failed to open storage: %v", err)
+	}
+	defer st.Close()
+
+	migrator, ok := st.(storage.Migrator)
+	if !ok {
+		log.Fatalf("Storage backend has no schema to migrate")
+	}
+
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Migrate(ctx)
+		for _, m := range applied {
+			fmt.Printf("applied  %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		if len(applied) == 0 {
+			fmt.Println("schema is up to date")
+		}
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				log.Fatalf("Invalid number of steps %q", args[1])
+			}
+		}
+
+		reverted, err := migrator.Rollback(ctx, steps)
+		for _, m := range reverted {
+			fmt.Printf("reverted %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			log.Fatalf("Rollback failed: %v", err)
+		}
+
+	case "status":
+		status, err := migrator.MigrationStatus(ctx)
+		if err != nil {
+			log.Fatalf("Failed to read migration status: %v", err)
+		}
+		for _, m := range status {
+			applied := "pending"
+			if m.AppliedAt != nil {
+				applied = m.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d_%-30s %s\n", m.Version, m.Name, applied)
+		}
+
+	default:
+		fmt.Println(migrateUsage)
+		os.Exit(2)
+	}
+}
+
+// autoMigrate applies pending migrations on startup when enabled
+func autoMigrate(st storage.Storage, cfg config.StorageConfig) {
+	migrator, ok := st.(storage.Migrator)
+	if !ok || !cfg.AutoMigrate {
+		return
+	}
+
+	applied, err := migrator.Migrate(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to migrate storage: %v", err)
+	}
+	for _, m := range applied {
+		log.Printf("Applied migration %04d_%s", m.Version, m.Name)
+	}
+}
@@ -2,90 +2,307 @@ package agent
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/nais2008/final_project_go_yandex/internal/config"
-	"github.com/nais2008/final_project_go_yandex/internal/db"
 	"github.com/nais2008/final_project_go_yandex/internal/models"
 )
 
+// agentIDHeader identifies the agent to the orchestrator
+const agentIDHeader = "X-Agent-ID"
+
+// retryDelay is the pause after a failed request to the orchestrator
+const retryDelay = time.Second
+
 // Agent ...
 type Agent struct {
 	cfg              config.Config
-	s                *db.Storage
+	id               string
 	orchestratorAddr string
+	taskWait         time.Duration
+	shutdownTimeout  time.Duration
+	heartbeat        time.Duration
 }
 
 // NewAgent ...
 func NewAgent(cfg config.Config) *Agent {
-	st, err := db.ConnectDB()
-	if err != nil {
-		log.Fatal("Failed to connect to database: ", err)
+	id := cfg.AgentID
+	if id == "" {
+		host, _ := os.Hostname()
+		id = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+
+	return &Agent{
+		cfg:              cfg,
+		id:               id,
+		orchestratorAddr: cfg.OrchestratorAddr,
+		taskWait:         time.Duration(cfg.TaskWaitMS) * time.Millisecond,
+		shutdownTimeout:  time.Duration(cfg.ShutdownTimeoutMS) * time.Millisecond,
+		heartbeat:        time.Duration(cfg.HeartbeatIntervalMS) * time.Millisecond,
 	}
+}
+
+// ID ...
+func (a *Agent) ID() string {
+	return a.id
+}
 
-	return &Agent{cfg: cfg, s: st, orchestratorAddr: cfg.OrchestratorAddr}
+type taskResult struct {
+	ID        uint      `json:"id"`
+	Result    float64   `json:"result"`
+	StartedAt time.Time `json:"started_at"`
 }
 
-// Run ...
-func (a *Agent) Run() {
+// Run claims tasks for every free worker slot in one request and
+// submits finished results in batches. When ctx is cancelled it stops
+// claiming, lets running tasks finish within the shutdown timeout, hands
+// the rest back and reports the agent offline.
+func (a *Agent) Run(ctx context.Context) {
+	workers := a.cfg.ComputingPower
+	if workers < 1 {
+		workers = 1
+	}
+
+	slots := make(chan struct{}, workers)
+	releaseSlots(slots, workers)
+
+	results := make(chan taskResult, workers)
+	submitted := make(chan struct{})
+	go func() {
+		a.submitResults(results)
+		close(submitted)
+	}()
+
+	tracker := newRunningTasks()
+	go a.sendHeartbeats(ctx, workers, tracker)
+
+	// running tasks get shutdownTimeout more after ctx is cancelled
+	execCtx, cancelExec := context.WithCancel(context.Background())
+	defer cancelExec()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-execCtx.Done():
+			return
+		}
+		select {
+		case <-time.After(a.shutdownTimeout):
+			cancelExec()
+		case <-execCtx.Done():
+		}
+	}()
+
+	var (
+		running   sync.WaitGroup
+		mu        sync.Mutex
+		abandoned []uint
+	)
+
 	for {
-		task, err := a.getTask()
+		free, ok := acquireSlots(ctx, slots)
+		if !ok {
+			break
+		}
+
+		tasks, err := a.claimTasks(ctx, free)
 		if err != nil {
-			log.Printf("Error getting task: %v", err)
-			time.Sleep(1 * time.Second)
+			releaseSlots(slots, free)
+			if ctx.Err() != nil {
+				break
+			}
+			log.Printf("Error getting tasks: %v", err)
+			sleep(ctx, retryDelay)
 			continue
 		}
 
-		if task.ID == 0 {
-			time.Sleep(1 * time.Second)
-			continue
+		for _, task := range tasks {
+			running.Add(1)
+			go func(task models.Task) {
+				defer running.Done()
+
+				res, ok := a.execute(tracker.start(execCtx, task.ID), task)
+				dropped := tracker.finish(task.ID)
+				switch {
+				case ok:
+					results <- res
+				case dropped:
+					log.Printf("Task %d was cancelled, abandoning it", task.ID)
+				default:
+					mu.Lock()
+					abandoned = append(abandoned, task.ID)
+					mu.Unlock()
+				}
+				slots <- struct{}{}
+			}(task)
 		}
 
-		var expr models.Expression
-		if err := a.s.DB.First(&expr, task.ExpressionID).Error; err != nil {
-			log.Printf("Expression not found for task %d: %v", task.ID, err)
-			continue
+		// the orchestrator held the request for taskWait and found fewer tasks
+		releaseSlots(slots, free-len(tasks))
+		if len(tasks) == 0 && a.taskWait <= 0 {
+			// without long polling the orchestrator answers at once, pause
+			// instead of asking again in a busy loop
+			sleep(ctx, retryDelay)
 		}
+	}
 
-		if task.Status != "pending" {
-			log.Printf("Skipping task %d as it is not in 'pending' status", task.ID)
-			continue
+	log.Printf("Shutting down, waiting up to %s for running tasks", a.shutdownTimeout)
+	running.Wait()
+	close(results)
+	<-submitted
+
+	if len(abandoned) > 0 {
+		log.Printf("Handing back %d unfinished tasks", len(abandoned))
+		a.releaseTasks(abandoned)
+	}
+	a.reportOffline()
+}
+
+// runningTasks tracks the tasks being computed so that the orchestrator can
+// call them off
+type runningTasks struct {
+	mu      sync.Mutex
+	cancels map[uint]context.CancelFunc
+	dropped map[uint]bool
+}
+
+func newRunningTasks() *runningTasks {
+	return &runningTasks{cancels: make(map[uint]context.CancelFunc), dropped: make(map[uint]bool)}
+}
+
+// start returns the context the task runs in
+func (r *runningTasks) start(ctx context.Context, id uint) context.Context {
+	ctx, cancel := context.WithCancel(ctx)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cancels[id] = cancel
+
+	return ctx
+}
+
+// finish forgets the task and reports whether it was dropped
+func (r *runningTasks) finish(id uint) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if cancel, ok := r.cancels[id]; ok {
+		cancel()
+	}
+	dropped := r.dropped[id]
+	delete(r.cancels, id)
+	delete(r.dropped, id)
+
+	return dropped
+}
+
+func (r *runningTasks) ids() []uint {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ids := make([]uint, 0, len(r.cancels))
+	for id := range r.cancels {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// drop stops the given tasks
+func (r *runningTasks) drop(ids []uint) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, id := range ids {
+		if cancel, ok := r.cancels[id]; ok {
+			r.dropped[id] = true
+			cancel()
 		}
+	}
+}
 
-		result := a.ComputeTask(task)
-		task.Result = &result
-		task.Status = "completed"
+// acquireSlots blocks until at least one slot is free and takes every free
+// one, it reports false once ctx is cancelled
+func acquireSlots(ctx context.Context, slots chan struct{}) (int, bool) {
+	select {
+	case <-slots:
+	case <-ctx.Done():
+		return 0, false
+	}
 
-		if err := a.s.DB.Save(&task).Error; err != nil {
-			log.Printf("Error saving task %d with result: %v", task.ID, err)
-			continue
+	free := 1
+	for {
+		select {
+		case <-slots:
+			free++
+		default:
+			return free, true
 		}
+	}
+}
 
-		time.Sleep(time.Duration(task.OperationTime) * time.Millisecond)
+func releaseSlots(slots chan struct{}, n int) {
+	for i := 0; i < n; i++ {
+		slots <- struct{}{}
+	}
+}
 
-		a.submitResult(task.ID, result)
+func sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-ctx.Done():
 	}
 }
 
-func (a *Agent) getTask() (models.Task, error) {
-    resp, err := http.Get("http://" + a.orchestratorAddr + "/internal/tasks")
-    if err != nil || resp.StatusCode != http.StatusOK {
-        return models.Task{}, err
-    }
-    defer resp.Body.Close()
+// execute computes the task, it reports false when ctx is cancelled first
+func (a *Agent) execute(ctx context.Context, task models.Task) (taskResult, bool) {
+	startedAt := time.Now()
+	result := a.ComputeTask(task)
 
-    var data struct {
-        Task models.Task `json:"task"`
-    }
+	select {
+	case <-time.After(time.Duration(task.OperationTime) * time.Millisecond):
+		return taskResult{ID: task.ID, Result: result, StartedAt: startedAt}, true
+	case <-ctx.Done():
+		return taskResult{}, false
+	}
+}
 
-    if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
-        return models.Task{}, err
-    }
+func (a *Agent) claimTasks(ctx context.Context, limit int) ([]models.Task, error) {
+	url := fmt.Sprintf("http://%s/internal/tasks/batch?limit=%d&wait=%s", a.orchestratorAddr, limit, a.taskWait)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	a.authorize(req)
 
-    return data.Task, nil
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var data struct {
+		Tasks []models.Task `json:"tasks"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+
+	return data.Tasks, nil
 }
 
 // ComputeTask ...
@@ -110,15 +327,144 @@ func (a *Agent) ComputeTask(task models.Task) float64 {
 	}
 }
 
-func (a *Agent) submitResult(taskID uint, result float64) {
-	payload := map[string]interface{}{
-		"id":     taskID,
-		"result": result,
+// submitResults sends everything finished so far in one request
+func (a *Agent) submitResults(results <-chan taskResult) {
+	for res := range results {
+		batch := []taskResult{res}
+	drain:
+		for {
+			select {
+			case res := <-results:
+				batch = append(batch, res)
+			default:
+				break drain
+			}
+		}
+
+		a.submitBatch(batch)
 	}
-	body, _ := json.Marshal(payload)
+}
 
-	_, err := http.Post("http://" + a.orchestratorAddr + "/internal/tasks", "application/json", bytes.NewBuffer(body))
+func (a *Agent) submitBatch(batch []taskResult) {
+	body, _ := json.Marshal(map[string]interface{}{"results": batch})
+
+	resp, err := a.post("/internal/tasks/batch", body)
 	if err != nil {
-		log.Printf("Error submitting result for task %d: %v", taskID, err)
+		log.Printf("Error submitting %d results: %v", len(batch), err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Error submitting %d results: unexpected status %d", len(batch), resp.StatusCode)
+		return
+	}
+
+	var data struct {
+		Results []struct {
+			ID     uint   `json:"id"`
+			Status string `json:"status"`
+			Error  string `json:"error"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		log.Printf("Error decoding result outcomes: %v", err)
+		return
+	}
+
+	for _, outcome := range data.Results {
+		if outcome.Status != "ok" {
+			log.Printf("Result for task %d rejected: %s", outcome.ID, outcome.Error)
+		}
+	}
+}
+
+// sendHeartbeats tells the orchestrator the agent is alive until ctx is
+// cancelled and stops the running tasks it no longer wants
+func (a *Agent) sendHeartbeats(ctx context.Context, workers int, tracker *runningTasks) {
+	if a.heartbeat <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(a.heartbeat)
+	defer ticker.Stop()
+
+	for {
+		if cancel, err := a.sendHeartbeat(workers, tracker.ids()); err != nil {
+			log.Printf("Error sending heartbeat: %v", err)
+		} else {
+			tracker.drop(cancel)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sendHeartbeat returns the ids of running tasks the orchestrator cancelled
+func (a *Agent) sendHeartbeat(workers int, running []uint) ([]uint, error) {
+	body, _ := json.Marshal(map[string]interface{}{"workers": workers, "tasks": running})
+
+	resp, err := a.post("/internal/agents/"+url.PathEscape(a.id)+"/heartbeat", body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var data struct {
+		Cancel []uint `json:"cancel"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+
+	return data.Cancel, nil
+}
+
+func (a *Agent) releaseTasks(ids []uint) {
+	body, _ := json.Marshal(map[string][]uint{"ids": ids})
+
+	resp, err := a.post("/internal/tasks/release", body)
+	if err != nil {
+		log.Printf("Error handing back tasks: %v", err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// reportOffline marks the agent offline, the orchestrator requeues whatever
+// it still holds
+func (a *Agent) reportOffline() {
+	resp, err := a.post("/internal/agents/"+url.PathEscape(a.id)+"/offline", nil)
+	if err != nil {
+		log.Printf("Error reporting agent offline: %v", err)
+		return
+	}
+	resp.Body.Close()
+}
+
+func (a *Agent) post(path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, "http://"+a.orchestratorAddr+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	a.authorize(req)
+
+	return http.DefaultClient.Do(req)
+}
+
+// authorize names the agent and adds its token when it has one
+func (a *Agent) authorize(req *http.Request) {
+	req.Header.Set(agentIDHeader, a.id)
+	if a.cfg.AgentToken != "" {
+		req.Header.Set("Authorization", "Bearer "+a.cfg.AgentToken)
 	}
 }
@@ -1,10 +1,19 @@
 package agent
 
 import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/nais2008/final_project_go_yandex/internal/config"
 	"github.com/nais2008/final_project_go_yandex/internal/models"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 )
 
@@ -84,6 +93,170 @@ func TestAgent_ComputeTask_UnknownOperation(t *testing.T) {
 	assert.Equal(t, 0.0, result)
 }
 
+func TestAgent_ClaimTasks(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/internal/tasks/batch", r.URL.Path)
+		assert.Equal(t, "3", r.URL.Query().Get("limit"))
+		assert.Equal(t, "agent-1", r.Header.Get(agentIDHeader))
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"tasks": []models.Task{{ID: 1}, {ID: 2}},
+		})
+	}))
+	defer srv.Close()
+
+	agent := Agent{cfg: config.Config{AgentToken: "secret"}, id: "agent-1", orchestratorAddr: strings.TrimPrefix(srv.URL, "http://")}
+	tasks, err := agent.claimTasks(context.Background(), 3)
+	assert.NoError(t, err)
+	assert.Len(t, tasks, 2)
+}
+
+func TestAgent_ClaimTasks_NoTasks(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	agent := Agent{orchestratorAddr: strings.TrimPrefix(srv.URL, "http://")}
+	tasks, err := agent.claimTasks(context.Background(), 3)
+	assert.NoError(t, err)
+	assert.Empty(t, tasks)
+}
+
+func TestAcquireSlots_TakesAllFree(t *testing.T) {
+	slots := make(chan struct{}, 4)
+	releaseSlots(slots, 3)
+
+	free, ok := acquireSlots(context.Background(), slots)
+	assert.True(t, ok)
+	assert.Equal(t, 3, free)
+	assert.Len(t, slots, 0)
+}
+
+func TestAcquireSlots_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, ok := acquireSlots(ctx, make(chan struct{}, 1))
+	assert.False(t, ok)
+}
+
+func TestAgent_Run_ShutdownHandsBackTasks(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		released []uint
+		offline  bool
+	)
+	// the second claim shows the first batch was received and started
+	claims := 0
+	claimed := make(chan struct{})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch r.URL.Path {
+		case "/internal/tasks/batch":
+			claims++
+			if claims == 1 {
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"tasks": []models.Task{{ID: 7, OperationTime: 60000}},
+				})
+				return
+			}
+			if claims == 2 {
+				close(claimed)
+			}
+			w.WriteHeader(http.StatusNotFound)
+		case "/internal/tasks/release":
+			var req struct {
+				IDs []uint `json:"ids"`
+			}
+			json.NewDecoder(r.Body).Decode(&req)
+			released = append(released, req.IDs...)
+		case "/internal/agents/agent-1/offline":
+			offline = true
+		}
+	}))
+	defer srv.Close()
+
+	agent := NewAgent(config.Config{
+		AgentID:           "agent-1",
+		OrchestratorAddr:  strings.TrimPrefix(srv.URL, "http://"),
+		ComputingPower:    2,
+		ShutdownTimeoutMS: 10,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		agent.Run(ctx)
+		close(done)
+	}()
+
+	<-claimed
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not stop")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []uint{7}, released)
+	assert.True(t, offline)
+}
+
+func TestAgent_Run_PausesWithoutLongPolling(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		claims int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/internal/tasks/batch" {
+			mu.Lock()
+			claims++
+			mu.Unlock()
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	agent := NewAgent(config.Config{
+		AgentID:          "agent-1",
+		OrchestratorAddr: strings.TrimPrefix(srv.URL, "http://"),
+		ComputingPower:   1,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), retryDelay/2)
+	defer cancel()
+	agent.Run(ctx)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 1, claims)
+}
+
+func TestRunningTasks_Drop(t *testing.T) {
+	tracker := newRunningTasks()
+	agent := Agent{}
+
+	done := make(chan bool)
+	go func() {
+		_, ok := agent.execute(tracker.start(context.Background(), 7), models.Task{ID: 7, OperationTime: 60000})
+		done <- ok
+	}()
+
+	require.Eventually(t, func() bool { return len(tracker.ids()) == 1 }, time.Second, time.Millisecond)
+	tracker.drop([]uint{7, 8})
+
+	assert.False(t, <-done)
+	assert.True(t, tracker.finish(7))
+	assert.Empty(t, tracker.ids())
+}
+
 func ptr[T any](v T) *T {
 	return &v
 }
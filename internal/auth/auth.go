@@ -3,7 +3,7 @@ package auth
 import (
 	"net/http"
 
-	"github.com/nais2008/final_project_go_yandex/internal/db"
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
 	"github.com/nais2008/final_project_go_yandex/internal/utils"
 
 	"github.com/labstack/echo/v4"
@@ -23,7 +23,7 @@ type RegisterRequest struct {
 }
 
 // LoginUser ...
-func LoginUser(storage *db.Storage) echo.HandlerFunc {
+func LoginUser(users storage.Users) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		var req LoginRequest
 
@@ -31,7 +31,7 @@ func LoginUser(storage *db.Storage) echo.HandlerFunc {
 			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request format"})
 		}
 
-		user, err := storage.User(c.Request().Context(), req.Login)
+		user, err := users.User(c.Request().Context(), req.Login)
 		if err != nil {
 			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid login or password"})
 		}
@@ -51,7 +51,7 @@ func LoginUser(storage *db.Storage) echo.HandlerFunc {
 }
 
 // RegisterUser ...
-func RegisterUser(storage *db.Storage) echo.HandlerFunc {
+func RegisterUser(users storage.Users) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		var req RegisterRequest
 
@@ -66,7 +66,7 @@ func RegisterUser(storage *db.Storage) echo.HandlerFunc {
 			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error hashing password"})
 		}
 
-		_, err = storage.SaveUser(c.Request().Context(), req.Username, req.Email, hash)
+		_, err = users.SaveUser(c.Request().Context(), req.Username, req.Email, hash)
 		if err != nil {
 			return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
 		}
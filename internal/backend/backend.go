@@ -0,0 +1,46 @@
+package backend
+
+import (
+	"fmt"
+
+	"github.com/nais2008/final_project_go_yandex/internal/config"
+	"github.com/nais2008/final_project_go_yandex/internal/db"
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+	"github.com/nais2008/final_project_go_yandex/internal/storage/memory"
+)
+
+const (
+	// Postgres ...
+	Postgres = "postgres"
+	// SQLite ...
+	SQLite = "sqlite"
+	// Memory ...
+	Memory = "memory"
+)
+
+// Open connects the storage backend selected by cfg.Backend
+func Open(cfg config.StorageConfig) (storage.Storage, error) {
+	const op string = "backend.Open"
+
+	var (
+		st  *db.Storage
+		err error
+	)
+
+	switch cfg.Backend {
+	case Postgres:
+		st, err = db.ConnectDB()
+	case SQLite:
+		st, err = db.ConnectSQLite(cfg.SQLitePath)
+	case Memory:
+		return memory.New(), nil
+	default:
+		return nil, fmt.Errorf("%s: unknown storage backend %q", op, cfg.Backend)
+	}
+
+	// a nil *db.Storage must not leak out as a non-nil interface
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
@@ -4,6 +4,7 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/joho/godotenv"
 )
@@ -15,8 +16,49 @@ type Config struct {
 	TimeMultiplicationMS int
 	TimeDivisionMS       int
 	ComputingPower       int
-	AgentAddr            string
-	OrchestratorAddr     string
+	TaskWaitMS           int
+	TaskLeaseMS          int
+	LeaseReapIntervalMS  int
+	LeaderRetryMS        int
+	ShutdownTimeoutMS    int
+	HeartbeatIntervalMS  int
+	AgentID              string
+	AgentToken           string
+	AgentAuth            bool
+	WebhookIntervalMS    int
+	WebhookTimeoutMS     int
+	WebhookMaxAttempts   int
+	WebhookRetryBaseMS   int
+	WebhookRetryMaxMS    int
+	// WebhookAllowedNets are networks webhooks may reach even though they
+	// are not public, e.g. 10.0.0.0/8
+	WebhookAllowedNets   []string
+	DefaultTimeoutMS     int
+	MaxTimeoutMS         int
+	DeadlineIntervalMS   int
+	InteractiveWeight    int
+	BatchWeight          int
+	ExpressionsPerMinute int
+	ActiveExpressions    int
+	TasksPerDay          int
+	AdminUsers           []string
+	ResultCacheSize      int
+	ResultCacheTTLMS     int
+	ExpressionCacheSize  int
+	ExpressionCacheTTLMS int
+	IdempotencyTTLMS     int
+	IdempotencyCleanupMS int
+	MaxQueueDepth        int
+	MaxQueueWaitMS       int
+	// AdmissionToken is the bearer token load balancers send to
+	// /internal/admission, empty leaves the endpoint open
+	AdmissionToken      string
+	ReconcileIntervalMS int
+	VerifyResults       bool
+	VerifyTolerance     float64
+	QuarantineAfter     int
+	AgentAddr           string
+	OrchestratorAddr    string
 }
 
 // PostgresConfig ...
@@ -28,6 +70,13 @@ type PostgresConfig struct {
 	Port     string
 }
 
+// StorageConfig ...
+type StorageConfig struct {
+	Backend     string
+	SQLitePath  string
+	AutoMigrate bool
+}
+
 var envLoaded bool
 
 func loadEnvOnce() {
@@ -52,6 +101,43 @@ func LoadConfig() Config {
 		TimeMultiplicationMS: loadEnvInt("TIME_MULTIPLICATIONS_MS", 5000),
 		TimeDivisionMS:       loadEnvInt("TIME_DIVISIONS_MS", 5000),
 		ComputingPower:       loadEnvInt("COMPUTING_POWER", 4),
+		TaskWaitMS:           loadEnvInt("TASK_WAIT_MS", 30000),
+		TaskLeaseMS:          loadEnvInt("TASK_LEASE_MS", 60000),
+		LeaseReapIntervalMS:  loadEnvInt("LEASE_REAP_INTERVAL_MS", 5000),
+		LeaderRetryMS:        loadEnvInt("LEADER_RETRY_MS", 5000),
+		ShutdownTimeoutMS:    loadEnvInt("SHUTDOWN_TIMEOUT_MS", 10000),
+		HeartbeatIntervalMS:  loadEnvInt("HEARTBEAT_INTERVAL_MS", 10000),
+		AgentID:              loadEnvString("AGENT_ID", ""),
+		AgentToken:           loadEnvString("AGENT_TOKEN", ""),
+		AgentAuth:            loadEnvBool("AGENT_AUTH", true),
+		WebhookIntervalMS:    loadEnvInt("WEBHOOK_INTERVAL_MS", 1000),
+		WebhookTimeoutMS:     loadEnvInt("WEBHOOK_TIMEOUT_MS", 5000),
+		WebhookMaxAttempts:   loadEnvInt("WEBHOOK_MAX_ATTEMPTS", 8),
+		WebhookRetryBaseMS:   loadEnvInt("WEBHOOK_RETRY_BASE_MS", 1000),
+		WebhookRetryMaxMS:    loadEnvInt("WEBHOOK_RETRY_MAX_MS", 3600000),
+		WebhookAllowedNets:   loadEnvList("WEBHOOK_ALLOWED_NETS"),
+		DefaultTimeoutMS:     loadEnvInt("DEFAULT_TIMEOUT_MS", 0),
+		MaxTimeoutMS:         loadEnvInt("MAX_TIMEOUT_MS", 0),
+		DeadlineIntervalMS:   loadEnvInt("DEADLINE_INTERVAL_MS", 1000),
+		InteractiveWeight:    loadEnvInt("INTERACTIVE_WEIGHT", 4),
+		BatchWeight:          loadEnvInt("BATCH_WEIGHT", 1),
+		ExpressionsPerMinute: loadEnvInt("EXPRESSIONS_PER_MINUTE", 60),
+		ActiveExpressions:    loadEnvInt("ACTIVE_EXPRESSIONS", 20),
+		TasksPerDay:          loadEnvInt("TASKS_PER_DAY", 100000),
+		AdminUsers:           loadEnvList("ADMIN_USERS"),
+		ResultCacheSize:      loadEnvInt("RESULT_CACHE_SIZE", 10000),
+		ResultCacheTTLMS:     loadEnvInt("RESULT_CACHE_TTL_MS", 3600000),
+		ExpressionCacheSize:  loadEnvInt("EXPRESSION_CACHE_SIZE", 1000),
+		ExpressionCacheTTLMS: loadEnvInt("EXPRESSION_CACHE_TTL_MS", 3600000),
+		IdempotencyTTLMS:     loadEnvInt("IDEMPOTENCY_TTL_MS", 86400000),
+		IdempotencyCleanupMS: loadEnvInt("IDEMPOTENCY_CLEANUP_INTERVAL_MS", 60000),
+		MaxQueueDepth:        loadEnvInt("MAX_QUEUE_DEPTH", 100000),
+		MaxQueueWaitMS:       loadEnvInt("MAX_QUEUE_WAIT_MS", 600000),
+		AdmissionToken:       loadEnvString("ADMISSION_TOKEN", ""),
+		ReconcileIntervalMS:  loadEnvInt("RECONCILE_INTERVAL_MS", 60000),
+		VerifyResults:        loadEnvBool("VERIFY_RESULTS", false),
+		VerifyTolerance:      loadEnvFloat("VERIFY_TOLERANCE", 1e-9),
+		QuarantineAfter:      loadEnvInt("QUARANTINE_AFTER", 0),
 		AgentAddr:            loadEnvString("AGENT_ADDR", "localhost:8081"),
 		OrchestratorAddr:     loadEnvString("ORCHESTRATOR_ADDR", "localhost:8080"),
 	}
@@ -74,6 +160,19 @@ func LoadPostgresConfig() PostgresConfig {
 	return cfg
 }
 
+// LoadStorageConfig ...
+func LoadStorageConfig() StorageConfig {
+	loadEnvOnce()
+
+	cfg := StorageConfig{
+		Backend:     loadEnvString("STORAGE_BACKEND", "postgres"),
+		SQLitePath:  loadEnvString("SQLITE_PATH", "calc.db"),
+		AutoMigrate: loadEnvBool("AUTO_MIGRATE", true),
+	}
+
+	return cfg
+}
+
 // loadEnvString ...
 func loadEnvString(key, defaultValue string) string {
 	val := os.Getenv(key)
@@ -96,3 +195,42 @@ func loadEnvInt(key string, defaultValue int) int {
 	}
 	return intVal
 }
+
+// loadEnvFloat ...
+func loadEnvFloat(key string, defaultValue float64) float64 {
+	val := os.Getenv(key)
+	if val == "" {
+		return defaultValue
+	}
+	floatVal, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		log.Printf("Invalid value for %s, using default: %g", key, defaultValue)
+		return defaultValue
+	}
+	return floatVal
+}
+
+// loadEnvList reads a comma-separated list
+func loadEnvList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// loadEnvBool ...
+func loadEnvBool(key string, defaultValue bool) bool {
+	val := os.Getenv(key)
+	if val == "" {
+		return defaultValue
+	}
+	boolVal, err := strconv.ParseBool(val)
+	if err != nil {
+		log.Printf("Invalid value for %s, using default: %t", key, defaultValue)
+		return defaultValue
+	}
+	return boolVal
+}
@@ -15,16 +15,20 @@ func TestLoadConfig_WithEnvVariables(t *testing.T) {
 	os.Setenv("TIME_MULTIPLICATIONS_MS", "3000")
 	os.Setenv("TIME_DIVISIONS_MS", "4000")
 	os.Setenv("COMPUTING_POWER", "8")
+	os.Setenv("TASK_WAIT_MS", "10000")
 	os.Setenv("AGENT_ADDR", "agent.example.com:8082")
 	os.Setenv("ORCHESTRATOR_ADDR", "orch.example.com:8081")
+	os.Setenv("ADMIN_USERS", "root, ops")
 
 	defer os.Unsetenv("TIME_ADDITION_MS")
 	defer os.Unsetenv("TIME_SUBTRACTION_MS")
 	defer os.Unsetenv("TIME_MULTIPLICATIONS_MS")
 	defer os.Unsetenv("TIME_DIVISIONS_MS")
 	defer os.Unsetenv("COMPUTING_POWER")
+	defer os.Unsetenv("TASK_WAIT_MS")
 	defer os.Unsetenv("AGENT_ADDR")
 	defer os.Unsetenv("ORCHESTRATOR_ADDR")
+	defer os.Unsetenv("ADMIN_USERS")
 
 	cfg := config.LoadConfig()
 
@@ -33,8 +37,10 @@ func TestLoadConfig_WithEnvVariables(t *testing.T) {
 	assert.Equal(t, 3000, cfg.TimeMultiplicationMS)
 	assert.Equal(t, 4000, cfg.TimeDivisionMS)
 	assert.Equal(t, 8, cfg.ComputingPower)
+	assert.Equal(t, 10000, cfg.TaskWaitMS)
 	assert.Equal(t, "agent.example.com:8082", cfg.AgentAddr)
 	assert.Equal(t, "orch.example.com:8081", cfg.OrchestratorAddr)
+	assert.Equal(t, []string{"root", "ops"}, cfg.AdminUsers)
 }
 
 func TestLoadConfig_WithDefaultValues(t *testing.T) {
@@ -46,6 +52,40 @@ func TestLoadConfig_WithDefaultValues(t *testing.T) {
 	assert.Equal(t, 5000, cfg.TimeMultiplicationMS)
 	assert.Equal(t, 5000, cfg.TimeDivisionMS)
 	assert.Equal(t, 4, cfg.ComputingPower)
+	assert.Equal(t, 30000, cfg.TaskWaitMS)
+	assert.Equal(t, 60000, cfg.TaskLeaseMS)
+	assert.Equal(t, 5000, cfg.LeaseReapIntervalMS)
+	assert.Equal(t, 5000, cfg.LeaderRetryMS)
+	assert.Equal(t, 10000, cfg.ShutdownTimeoutMS)
+	assert.Equal(t, 10000, cfg.HeartbeatIntervalMS)
+	assert.Equal(t, "", cfg.AgentID)
+	assert.Equal(t, "", cfg.AgentToken)
+	assert.True(t, cfg.AgentAuth)
+	assert.Equal(t, 8, cfg.WebhookMaxAttempts)
+	assert.Equal(t, 1000, cfg.WebhookRetryBaseMS)
+	assert.Empty(t, cfg.WebhookAllowedNets)
+	assert.Equal(t, 0, cfg.DefaultTimeoutMS)
+	assert.Equal(t, 0, cfg.MaxTimeoutMS)
+	assert.Equal(t, 1000, cfg.DeadlineIntervalMS)
+	assert.Equal(t, 4, cfg.InteractiveWeight)
+	assert.Equal(t, 1, cfg.BatchWeight)
+	assert.Equal(t, 60, cfg.ExpressionsPerMinute)
+	assert.Equal(t, 20, cfg.ActiveExpressions)
+	assert.Equal(t, 100000, cfg.TasksPerDay)
+	assert.Empty(t, cfg.AdminUsers)
+	assert.Equal(t, 10000, cfg.ResultCacheSize)
+	assert.Equal(t, 3600000, cfg.ResultCacheTTLMS)
+	assert.Equal(t, 1000, cfg.ExpressionCacheSize)
+	assert.Equal(t, 3600000, cfg.ExpressionCacheTTLMS)
+	assert.Equal(t, 86400000, cfg.IdempotencyTTLMS)
+	assert.Equal(t, 60000, cfg.IdempotencyCleanupMS)
+	assert.Equal(t, 100000, cfg.MaxQueueDepth)
+	assert.Equal(t, 600000, cfg.MaxQueueWaitMS)
+	assert.Empty(t, cfg.AdmissionToken)
+	assert.Equal(t, 60000, cfg.ReconcileIntervalMS)
+	assert.False(t, cfg.VerifyResults)
+	assert.Equal(t, 1e-9, cfg.VerifyTolerance)
+	assert.Equal(t, 0, cfg.QuarantineAfter)
 	assert.Equal(t, "localhost:8081", cfg.AgentAddr)
 	assert.Equal(t, "localhost:8080", cfg.OrchestratorAddr)
 }
@@ -91,3 +131,28 @@ func TestLoadPostgresConfig_WithDefaultValues(t *testing.T) {
 	assert.Equal(t, "localhost", cfg.Host)
 	assert.Equal(t, "5432", cfg.Port)
 }
+
+func TestLoadStorageConfig_WithEnvVariables(t *testing.T) {
+	os.Setenv("STORAGE_BACKEND", "sqlite")
+	os.Setenv("SQLITE_PATH", "/tmp/test.db")
+	os.Setenv("AUTO_MIGRATE", "false")
+
+	defer os.Unsetenv("STORAGE_BACKEND")
+	defer os.Unsetenv("SQLITE_PATH")
+	defer os.Unsetenv("AUTO_MIGRATE")
+
+	cfg := config.LoadStorageConfig()
+
+	assert.Equal(t, "sqlite", cfg.Backend)
+	assert.Equal(t, "/tmp/test.db", cfg.SQLitePath)
+	assert.False(t, cfg.AutoMigrate)
+}
+
+func TestLoadStorageConfig_WithDefaultValues(t *testing.T) {
+
+	cfg := config.LoadStorageConfig()
+
+	assert.Equal(t, "postgres", cfg.Backend)
+	assert.Equal(t, "calc.db", cfg.SQLitePath)
+	assert.True(t, cfg.AutoMigrate)
+}
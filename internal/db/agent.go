@@ -0,0 +1,141 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+)
+
+// SaveAgent ...
+func (s *Storage) SaveAgent(ctx context.Context, agent models.Agent) error {
+	const op string = "db.SaveAgent"
+
+	agent.LastSeenAt = agent.LastSeenAt.UTC()
+	err := s.DB.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"workers", "status", "last_seen_at"}),
+	}).Create(&agent).Error
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// Agents ...
+func (s *Storage) Agents(ctx context.Context) ([]models.Agent, error) {
+	const op string = "db.Agents"
+
+	var agents []models.Agent
+	if err := s.DB.WithContext(ctx).Order("id").Find(&agents).Error; err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return agents, nil
+}
+
+// RecordDisagreement ...
+func (s *Storage) RecordDisagreement(ctx context.Context, id string, quarantineAfter int) (models.Agent, error) {
+	const op string = "db.RecordDisagreement"
+
+	agent, err := s.updateAgent(ctx, id, func(agent *models.Agent) map[string]interface{} {
+		agent.Disagreements++
+		updates := map[string]interface{}{"disagreements": agent.Disagreements}
+		if quarantineAfter > 0 && agent.Disagreements >= quarantineAfter {
+			agent.Quarantined = true
+			updates["quarantined"] = true
+		}
+		return updates
+	})
+	if err != nil {
+		return models.Agent{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return agent, nil
+}
+
+// SetAgentQuarantine ...
+func (s *Storage) SetAgentQuarantine(ctx context.Context, id string, quarantined bool) (models.Agent, error) {
+	const op string = "db.SetAgentQuarantine"
+
+	agent, err := s.updateAgent(ctx, id, func(agent *models.Agent) map[string]interface{} {
+		agent.Quarantined = quarantined
+		updates := map[string]interface{}{"quarantined": quarantined}
+		if !quarantined {
+			agent.Disagreements = 0
+			updates["disagreements"] = 0
+		}
+		return updates
+	})
+	if err != nil {
+		return models.Agent{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return agent, nil
+}
+
+// SaveAgentCredential ...
+func (s *Storage) SaveAgentCredential(ctx context.Context, credential models.AgentCredential) error {
+	const op string = "db.SaveAgentCredential"
+
+	credential.CreatedAt = credential.CreatedAt.UTC()
+	err := s.DB.WithContext(ctx).Clauses(clause.OnConflict{UpdateAll: true}).Create(&credential).Error
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// AgentCredential ...
+func (s *Storage) AgentCredential(ctx context.Context, agentID string) (models.AgentCredential, error) {
+	const op string = "db.AgentCredential"
+
+	var credential models.AgentCredential
+	err := s.DB.WithContext(ctx).Where("agent_id = ?", agentID).First(&credential).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return models.AgentCredential{}, fmt.Errorf("%s: %w", op, storage.ErrCredentialNotFound)
+		}
+		return models.AgentCredential{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return credential, nil
+}
+
+// DeleteAgentCredential ...
+func (s *Storage) DeleteAgentCredential(ctx context.Context, agentID string) error {
+	const op string = "db.DeleteAgentCredential"
+
+	result := s.DB.WithContext(ctx).Where("agent_id = ?", agentID).Delete(&models.AgentCredential{})
+	if result.Error != nil {
+		return fmt.Errorf("%s: %w", op, result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrCredentialNotFound)
+	}
+
+	return nil
+}
+
+// updateAgent locks the agent and saves the columns change returns
+func (s *Storage) updateAgent(ctx context.Context, id string, change func(*models.Agent) map[string]interface{}) (models.Agent, error) {
+	var agent models.Agent
+	err := s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", id).First(&agent).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.Agent{}).Where("id = ?", id).Updates(change(&agent)).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return models.Agent{}, storage.ErrAgentNotFound
+	}
+
+	return agent, err
+}
@@ -3,19 +3,22 @@ package db
 import (
 	"fmt"
 
+	"github.com/glebarez/sqlite"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 
 	"github.com/nais2008/final_project_go_yandex/internal/config"
-	"github.com/nais2008/final_project_go_yandex/internal/models"
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
 )
 
 // Storage ...
 type Storage struct{
-	DB *gorm.DB
+	DB    *gorm.DB
+	dsn   string
+	local storage.LocalLocker
 }
 
-// ConnectDB connected database(psql)
+// ConnectDB connected database(psql), the schema is managed by Migrate
 func ConnectDB() (*Storage, error) {
 	const op string = "db.ConnectDB"
 
@@ -36,12 +39,30 @@ func ConnectDB() (*Storage, error) {
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
-	if err := db.AutoMigrate(
-		&models.User{},
-		&models.Task{},
-	); err != nil {
+	return &Storage{DB: db, dsn: dbURL}, nil
+}
+
+// ConnectSQLite opens (or creates) an embedded sqlite database file
+func ConnectSQLite(path string) (*Storage, error) {
+	const op string = "db.ConnectSQLite"
+
+	// immediate transactions make concurrent claims wait on busy_timeout
+	// instead of failing when a read lock is upgraded
+	dsn := path + "?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate"
+
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+	if err != nil {
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
-	return &Storage{DB: db}, nil
+	return &Storage{DB: db, dsn: dsn}, nil
+}
+
+// Close ...
+func (s *Storage) Close() error {
+	sqlDB, err := s.DB.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
 }
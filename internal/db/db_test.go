@@ -0,0 +1,113 @@
+package db_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nais2008/final_project_go_yandex/internal/db"
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+	"github.com/nais2008/final_project_go_yandex/internal/storage/storagetest"
+)
+
+func openSQLite(t *testing.T) *db.Storage {
+	st, err := db.ConnectSQLite(filepath.Join(t.TempDir(), "calc.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { st.Close() })
+
+	return st
+}
+
+func TestSQLiteStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		st := openSQLite(t)
+		_, err := st.Migrate(context.Background())
+		require.NoError(t, err)
+
+		return st
+	})
+}
+
+func TestMigrate_UpDownStatus(t *testing.T) {
+	ctx := context.Background()
+	st := openSQLite(t)
+
+	status, err := st.MigrationStatus(ctx)
+	require.NoError(t, err)
+	require.NotEmpty(t, status)
+	for _, m := range status {
+		assert.Nil(t, m.AppliedAt, m.Name)
+	}
+
+	applied, err := st.Migrate(ctx)
+	require.NoError(t, err)
+	assert.Len(t, applied, len(status))
+
+	applied, err = st.Migrate(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, applied)
+
+	status, err = st.MigrationStatus(ctx)
+	require.NoError(t, err)
+	for _, m := range status {
+		assert.NotNil(t, m.AppliedAt, m.Name)
+	}
+
+	reverted, err := st.Rollback(ctx, len(status))
+	require.NoError(t, err)
+	assert.Len(t, reverted, len(status))
+	assert.False(t, st.DB.Migrator().HasTable("tasks"))
+
+	applied, err = st.Migrate(ctx)
+	require.NoError(t, err)
+	assert.Len(t, applied, len(status))
+	assert.True(t, st.DB.Migrator().HasTable("tasks"))
+}
+
+func TestChecker_Orphans(t *testing.T) {
+	ctx := context.Background()
+	st := openSQLite(t)
+	_, err := st.Migrate(ctx)
+	require.NoError(t, err)
+
+	user := storagetest.NewUser(t, st, "alice")
+	kept := storagetest.NewExpression(t, st, user, "+")
+
+	// rows left behind by a schema without foreign keys
+	require.NoError(t, st.DB.Exec("PRAGMA foreign_keys = OFF").Error)
+	require.NoError(t, st.DB.Exec(
+		"INSERT INTO tasks (arg1, operation, status, operation_time, expression_id, user_id, class, priority, created_at) VALUES (1, '+', 'pending', 1, 999, ?, '', 0, CURRENT_TIMESTAMP)",
+		user,
+	).Error)
+	require.NoError(t, st.DB.Exec(
+		"INSERT INTO expressions (expr, status, user_id, class, priority, created_at) VALUES ('1+1', 'pending', 999, '', 0, CURRENT_TIMESTAMP)",
+	).Error)
+
+	tasks, err := st.OrphanTasks(ctx)
+	require.NoError(t, err)
+	require.Len(t, tasks, 1)
+	assert.Equal(t, uint(999), tasks[0].ExpressionID)
+
+	exprs, err := st.OrphanExpressions(ctx)
+	require.NoError(t, err)
+	require.Len(t, exprs, 1)
+
+	require.NoError(t, st.DeleteTasks(ctx, []uint{tasks[0].ID}))
+	require.NoError(t, st.DeleteExpressions(ctx, []uint{exprs[0].ID}))
+
+	tasks, err = st.OrphanTasks(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, tasks)
+	exprs, err = st.OrphanExpressions(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, exprs)
+
+	scanned, err := st.ScanExpressions(ctx, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, scanned, 1)
+	assert.Equal(t, kept.ID, scanned[0].ID)
+	assert.Len(t, scanned[0].Tasks, 1)
+}
@@ -0,0 +1,32 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"gorm.io/gorm"
+
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+)
+
+// ExpressionEvents ...
+func (s *Storage) ExpressionEvents(ctx context.Context, id uint) ([]models.ExpressionEvent, error) {
+	const op string = "db.ExpressionEvents"
+
+	var events []models.ExpressionEvent
+	err := s.DB.WithContext(ctx).Where("expression_id = ?", id).Order("at, id").Find(&events).Error
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return events, nil
+}
+
+// logEvents appends to the expression timeline within the caller's transaction
+func logEvents(tx *gorm.DB, events []models.ExpressionEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	return tx.Create(&events).Error
+}
@@ -0,0 +1,431 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+)
+
+// CreateExpression ...
+func (s *Storage) CreateExpression(ctx context.Context, expr *models.Expression) error {
+	const op string = "db.CreateExpression"
+
+	err := s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return createExpression(tx, expr)
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// createExpression saves the expression with its tasks and creation events
+func createExpression(tx *gorm.DB, expr *models.Expression) error {
+	now := time.Now().UTC()
+	expr.CreatedAt = now
+	// sqlite compares timestamps as text, keep them all in one zone
+	if expr.Deadline != nil {
+		deadline := expr.Deadline.UTC()
+		expr.Deadline = &deadline
+	}
+	for i := range expr.Tasks {
+		expr.Tasks[i].UserID = expr.UserID
+		expr.Tasks[i].Class = expr.Class
+		expr.Tasks[i].Priority = expr.Priority
+		expr.Tasks[i].Replicas = expr.Replicas
+		expr.Tasks[i].CreatedAt = now
+		switch expr.Tasks[i].Status {
+		case "pending":
+			expr.Tasks[i].QueuedAt = &now
+		case "completed":
+			expr.Tasks[i].CompletedAt = &now
+		}
+	}
+
+	if err := tx.Create(expr).Error; err != nil {
+		return err
+	}
+	return logEvents(tx, storage.CreationEvents(expr, now))
+}
+
+// Expression ...
+func (s *Storage) Expression(ctx context.Context, id uint) (models.Expression, error) {
+	const op string = "db.Expression"
+
+	var expression models.Expression
+	err := s.DB.WithContext(ctx).Preload("Tasks").First(&expression, id).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return models.Expression{}, fmt.Errorf("%s: %w", op, storage.ErrExpressionNotFound)
+		}
+		return models.Expression{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return expression, nil
+}
+
+// UserExpressions ...
+func (s *Storage) UserExpressions(ctx context.Context, query storage.ExpressionQuery) ([]models.Expression, error) {
+	const op string = "db.UserExpressions"
+
+	tx := s.DB.WithContext(ctx).Where("user_id = ?", query.UserID)
+	if len(query.Statuses) > 0 {
+		tx = tx.Where("status IN ?", query.Statuses)
+	}
+	if query.CreatedFrom != nil {
+		tx = tx.Where("created_at >= ?", query.CreatedFrom.UTC())
+	}
+	if query.CreatedTo != nil {
+		tx = tx.Where("created_at < ?", query.CreatedTo.UTC())
+	}
+	if query.ResultMin != nil {
+		tx = tx.Where("result >= ?", *query.ResultMin)
+	}
+	if query.ResultMax != nil {
+		tx = tx.Where("result <= ?", *query.ResultMax)
+	}
+
+	dir, cmp := "ASC", ">"
+	if query.Desc {
+		dir, cmp = "DESC", "<"
+	}
+
+	after := query.After
+	switch query.SortBy {
+	case storage.SortByCreatedAt:
+		if after != nil {
+			at := after.CreatedAt.UTC()
+			tx = tx.Where("created_at "+cmp+" ? OR (created_at = ? AND id "+cmp+" ?)", at, at, after.ID)
+		}
+		tx = tx.Order("created_at " + dir)
+	case storage.SortByResult:
+		if after != nil && after.Result == nil {
+			tx = tx.Where("result IS NULL AND id "+cmp+" ?", after.ID)
+		} else if after != nil {
+			r := *after.Result
+			tx = tx.Where("result "+cmp+" ? OR (result = ? AND id "+cmp+" ?) OR result IS NULL", r, r, after.ID)
+		}
+		// expressions without a result go last in both directions
+		tx = tx.Order("result IS NULL").Order("result " + dir)
+	default:
+		if after != nil {
+			tx = tx.Where("id "+cmp+" ?", after.ID)
+		}
+	}
+	tx = tx.Order("id " + dir)
+
+	if query.WithTasks {
+		tx = tx.Preload("Tasks")
+	}
+
+	var expressions []models.Expression
+	if err := tx.Limit(query.Limit).Find(&expressions).Error; err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return expressions, nil
+}
+
+// UpdateExpression ...
+func (s *Storage) UpdateExpression(ctx context.Context, id uint, status string, result *float64) (bool, error) {
+	const op string = "db.UpdateExpression"
+
+	var changed bool
+	err := s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		changed = false
+		var expr models.Expression
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "status", "finished_at").First(&expr, id).Error
+		if err != nil {
+			return err
+		}
+
+		if storage.IsFinished(expr.Status) {
+			if expr.Status == status {
+				return nil
+			}
+			return storage.ErrExpressionFinished
+		}
+		updates := map[string]interface{}{"status": status, "result": result}
+		if expr.Status == status {
+			return tx.Model(&expr).Updates(updates).Error
+		}
+
+		now := time.Now().UTC()
+		updates["finished_at"] = nil
+		if storage.IsFinished(status) {
+			updates["finished_at"] = now
+		}
+		// only one caller finishes the expression, a second one updates nothing
+		res := tx.Model(&models.Expression{}).
+			Where("id = ? AND status NOT IN ?", id, storage.FinishedStatuses).
+			Updates(updates)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return storage.ErrExpressionFinished
+		}
+		changed = true
+
+		return logEvents(tx, []models.ExpressionEvent{
+			{ExpressionID: id, Type: models.EventStatus, Status: status, At: now},
+		})
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return false, fmt.Errorf("%s: %w", op, storage.ErrExpressionNotFound)
+		}
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return changed, nil
+}
+
+// RecordVerification ...
+func (s *Storage) RecordVerification(ctx context.Context, id uint, verification string, localResult *float64, detail string) error {
+	const op string = "db.RecordVerification"
+
+	err := s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var expr models.Expression
+		if err := tx.Select("id", "status").First(&expr, id).Error; err != nil {
+			return err
+		}
+
+		err := tx.Model(&expr).Updates(map[string]interface{}{
+			"verification": verification,
+			"local_result": localResult,
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		return logEvents(tx, []models.ExpressionEvent{
+			{ExpressionID: id, Type: models.EventVerified, Status: expr.Status, Detail: detail, At: time.Now().UTC()},
+		})
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("%s: %w", op, storage.ErrExpressionNotFound)
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// CancelExpression ...
+func (s *Storage) CancelExpression(ctx context.Context, id uint, reason string) (models.Expression, error) {
+	const op string = "db.CancelExpression"
+
+	now := time.Now().UTC()
+
+	var expr models.Expression
+	err := s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&expr, id).Error; err != nil {
+			return err
+		}
+		if storage.IsFinished(expr.Status) {
+			return storage.ErrExpressionFinished
+		}
+
+		return stopExpression(tx, &expr, "cancelled", reason, now)
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return models.Expression{}, fmt.Errorf("%s: %w", op, storage.ErrExpressionNotFound)
+		}
+		return models.Expression{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return expr, nil
+}
+
+// FailExpression ...
+func (s *Storage) FailExpression(ctx context.Context, id uint, reason string) (models.Expression, error) {
+	const op string = "db.FailExpression"
+
+	now := time.Now().UTC()
+
+	var expr models.Expression
+	err := s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&expr, id).Error; err != nil {
+			return err
+		}
+		if storage.IsFinished(expr.Status) {
+			return storage.ErrExpressionFinished
+		}
+
+		return stopExpression(tx, &expr, "error", reason, now)
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return models.Expression{}, fmt.Errorf("%s: %w", op, storage.ErrExpressionNotFound)
+		}
+		return models.Expression{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return expr, nil
+}
+
+// StuckExpressions ...
+func (s *Storage) StuckExpressions(ctx context.Context, now time.Time, limit int) ([]models.Expression, error) {
+	const op string = "db.StuckExpressions"
+
+	unfinished := []string{"pending", "in_progress"}
+
+	var exprs []models.Expression
+	err := s.DB.WithContext(ctx).Preload("Tasks").
+		Where("status IN ?", unfinished).
+		Where("(deadline IS NULL OR deadline > ?)", now.UTC()).
+		Where("EXISTS (SELECT 1 FROM tasks WHERE tasks.expression_id = expressions.id)").
+		Where("(NOT EXISTS (SELECT 1 FROM tasks WHERE tasks.expression_id = expressions.id AND tasks.status IN ?)"+
+			" OR EXISTS (SELECT 1 FROM tasks WHERE tasks.expression_id = expressions.id AND tasks.status = ?))",
+			unfinished, "cancelled").
+		Order("id").
+		Limit(limit).
+		Find(&exprs).Error
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return exprs, nil
+}
+
+// UnfinishedExpressions ...
+func (s *Storage) UnfinishedExpressions(ctx context.Context, after uint, limit int) ([]uint, error) {
+	const op string = "db.UnfinishedExpressions"
+
+	var ids []uint
+	err := s.DB.WithContext(ctx).Model(&models.Expression{}).
+		Where("status IN ? AND id > ?", []string{"pending", "in_progress"}, after).
+		Order("id").
+		Limit(limit).
+		Pluck("id", &ids).Error
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return ids, nil
+}
+
+// PrioritizeExpression ...
+func (s *Storage) PrioritizeExpression(ctx context.Context, id uint, class string, priority int) (models.Expression, error) {
+	const op string = "db.PrioritizeExpression"
+
+	var expr models.Expression
+	err := s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&expr, id).Error; err != nil {
+			return err
+		}
+		if storage.IsFinished(expr.Status) {
+			return storage.ErrExpressionFinished
+		}
+
+		changes := map[string]interface{}{"class": class, "priority": priority}
+		if err := tx.Model(&models.Expression{}).Where("id = ?", id).Updates(changes).Error; err != nil {
+			return err
+		}
+		err := tx.Model(&models.Task{}).
+			Where("expression_id = ? AND status IN ?", id, []string{"pending", "in_progress"}).
+			Updates(changes).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Preload("Tasks").First(&expr, id).Error
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return models.Expression{}, fmt.Errorf("%s: %w", op, storage.ErrExpressionNotFound)
+		}
+		return models.Expression{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return expr, nil
+}
+
+// ExpireExpressions ...
+func (s *Storage) ExpireExpressions(ctx context.Context, now time.Time, limit int) ([]models.Expression, error) {
+	const op string = "db.ExpireExpressions"
+
+	now = now.UTC()
+
+	var expressions []models.Expression
+	err := s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("deadline < ? AND status IN ?", now, []string{"pending", "in_progress"}).
+			Order("deadline").
+			Limit(limit).
+			Find(&expressions).Error
+		if err != nil {
+			return err
+		}
+
+		for i := range expressions {
+			if err := stopExpression(tx, &expressions[i], "timed_out", storage.ReasonDeadline, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return expressions, nil
+}
+
+// stopExpression finishes the locked expression with status and cancels its
+// pending and in_progress tasks, expr is reloaded with its tasks
+func stopExpression(tx *gorm.DB, expr *models.Expression, status, reason string, at time.Time) error {
+	var tasks []models.Task
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("expression_id = ? AND status IN ?", expr.ID, []string{"pending", "in_progress"}).
+		Select("id", "expression_id", "agent_id").
+		Find(&tasks).Error
+	if err != nil {
+		return err
+	}
+
+	events := []models.ExpressionEvent{{ExpressionID: expr.ID, Type: models.EventStatus, Status: status, Detail: reason, At: at}}
+	if len(tasks) > 0 {
+		ids := make([]uint, len(tasks))
+		for i, task := range tasks {
+			ids[i] = task.ID
+			events = append(events, storage.CancelEvents(task, reason, at)...)
+		}
+
+		// agent_id stays so the holder can be told to stop
+		err = tx.Model(&models.Task{}).Where("id IN ?", ids).Updates(map[string]interface{}{
+			"status":           "cancelled",
+			"lease_expires_at": nil,
+		}).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Where("task_id IN ?", ids).Delete(&models.ReplicaLease{}).Error; err != nil {
+			return err
+		}
+	}
+
+	err = tx.Model(&models.Expression{}).Where("id = ?", expr.ID).Updates(map[string]interface{}{
+		"status":      status,
+		"finished_at": at,
+	}).Error
+	if err != nil {
+		return err
+	}
+	if err := logEvents(tx, events); err != nil {
+		return err
+	}
+
+	return tx.Preload("Tasks").First(expr, expr.ID).Error
+}
@@ -0,0 +1,184 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+)
+
+// ScanExpressions ...
+func (s *Storage) ScanExpressions(ctx context.Context, after uint, limit int) ([]models.Expression, error) {
+	const op string = "db.ScanExpressions"
+
+	var exprs []models.Expression
+	err := s.DB.WithContext(ctx).Preload("Tasks").
+		Where("id > ?", after).
+		Order("id").
+		Limit(limit).
+		Find(&exprs).Error
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return exprs, nil
+}
+
+// OrphanTasks ...
+func (s *Storage) OrphanTasks(ctx context.Context) ([]models.Task, error) {
+	const op string = "db.OrphanTasks"
+
+	var tasks []models.Task
+	err := s.DB.WithContext(ctx).
+		Where("NOT EXISTS (SELECT 1 FROM expressions WHERE expressions.id = tasks.expression_id)").
+		Order("id").
+		Find(&tasks).Error
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return tasks, nil
+}
+
+// OrphanExpressions ...
+func (s *Storage) OrphanExpressions(ctx context.Context) ([]models.Expression, error) {
+	const op string = "db.OrphanExpressions"
+
+	var exprs []models.Expression
+	err := s.DB.WithContext(ctx).
+		Where("NOT EXISTS (SELECT 1 FROM users WHERE users.id = expressions.user_id)").
+		Order("id").
+		Find(&exprs).Error
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return exprs, nil
+}
+
+// DeleteTasks ...
+func (s *Storage) DeleteTasks(ctx context.Context, ids []uint) error {
+	const op string = "db.DeleteTasks"
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	err := s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("task_id IN ?", ids).Delete(&models.ExpressionEvent{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id IN ?", ids).Delete(&models.Task{}).Error
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// DeleteExpressions ...
+func (s *Storage) DeleteExpressions(ctx context.Context, ids []uint) error {
+	const op string = "db.DeleteExpressions"
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	err := s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("expression_id IN ?", ids).Delete(&models.ExpressionEvent{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("expression_id IN ?", ids).Delete(&models.Task{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id IN ?", ids).Delete(&models.Expression{}).Error
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// RepairTask ...
+func (s *Storage) RepairTask(ctx context.Context, id uint, status string, result *float64) error {
+	const op string = "db.RepairTask"
+
+	now := time.Now().UTC()
+
+	err := s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var task models.Task
+		if err := tx.First(&task, id).Error; err != nil {
+			return err
+		}
+
+		previous := task.Status
+		updates := map[string]interface{}{"status": status, "result": result}
+		if status != "pending" && status != "in_progress" {
+			updates["lease_expires_at"] = nil
+			if err := tx.Where("task_id = ?", id).Delete(&models.ReplicaLease{}).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Model(&task).Updates(updates).Error; err != nil {
+			return err
+		}
+		if previous == status {
+			return nil
+		}
+
+		task.Status = status
+		return logEvents(tx, []models.ExpressionEvent{storage.RepairEvent(task, now)})
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("%s: %w", op, storage.ErrTaskNotFound)
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// RepairExpression ...
+func (s *Storage) RepairExpression(ctx context.Context, id uint, status string, result *float64) error {
+	const op string = "db.RepairExpression"
+
+	now := time.Now().UTC()
+
+	err := s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var expr models.Expression
+		if err := tx.Select("id", "status", "finished_at").First(&expr, id).Error; err != nil {
+			return err
+		}
+
+		updates := map[string]interface{}{"status": status, "result": result}
+		if storage.IsFinished(status) && expr.FinishedAt == nil {
+			updates["finished_at"] = now
+		}
+		if !storage.IsFinished(status) {
+			updates["finished_at"] = nil
+		}
+		if err := tx.Model(&expr).Updates(updates).Error; err != nil {
+			return err
+		}
+
+		return logEvents(tx, []models.ExpressionEvent{
+			{ExpressionID: id, Type: models.EventStatus, Status: status, Detail: storage.ReasonRepaired, At: now},
+		})
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("%s: %w", op, storage.ErrExpressionNotFound)
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,99 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+)
+
+// ReserveIdempotencyKey ...
+func (s *Storage) ReserveIdempotencyKey(
+	ctx context.Context,
+	key models.IdempotencyKey,
+	now time.Time,
+) (models.IdempotencyKey, bool, error) {
+	const op string = "db.ReserveIdempotencyKey"
+
+	key.CreatedAt = key.CreatedAt.UTC()
+	key.ExpiresAt = key.ExpiresAt.UTC()
+
+	var stored models.IdempotencyKey
+	var created bool
+	err := s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("user_id = ? AND key = ? AND expires_at <= ?", key.UserID, key.Key, now.UTC()).
+			Delete(&models.IdempotencyKey{}).Error
+		if err != nil {
+			return err
+		}
+
+		res := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&key)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 1 {
+			stored, created = key, true
+			return nil
+		}
+
+		return tx.First(&stored, "user_id = ? AND key = ?", key.UserID, key.Key).Error
+	})
+	if err != nil {
+		return models.IdempotencyKey{}, false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return stored, created, nil
+}
+
+// CompleteIdempotencyKey ...
+func (s *Storage) CompleteIdempotencyKey(
+	ctx context.Context,
+	userID uint,
+	key string,
+	statusCode int,
+	expressionID uint,
+	expiresAt time.Time,
+) error {
+	const op string = "db.CompleteIdempotencyKey"
+
+	err := s.DB.WithContext(ctx).Model(&models.IdempotencyKey{}).
+		Where("user_id = ? AND key = ?", userID, key).
+		Updates(map[string]interface{}{
+			"status_code":   statusCode,
+			"expression_id": expressionID,
+			"expires_at":    expiresAt.UTC(),
+		}).Error
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// ReleaseIdempotencyKey ...
+func (s *Storage) ReleaseIdempotencyKey(ctx context.Context, userID uint, key string) error {
+	const op string = "db.ReleaseIdempotencyKey"
+
+	err := s.DB.WithContext(ctx).Where("user_id = ? AND key = ?", userID, key).Delete(&models.IdempotencyKey{}).Error
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// DeleteExpiredIdempotencyKeys ...
+func (s *Storage) DeleteExpiredIdempotencyKeys(ctx context.Context, now time.Time) (int64, error) {
+	const op string = "db.DeleteExpiredIdempotencyKeys"
+
+	res := s.DB.WithContext(ctx).Where("expires_at <= ?", now.UTC()).Delete(&models.IdempotencyKey{})
+	if res.Error != nil {
+		return 0, fmt.Errorf("%s: %w", op, res.Error)
+	}
+
+	return res.RowsAffected, nil
+}
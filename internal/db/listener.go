@@ -0,0 +1,91 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+)
+
+// taskEventsChannel is the NOTIFY channel fed by the tasks_notify trigger
+const taskEventsChannel = "task_events"
+
+const listenRetryDelay = 2 * time.Second
+
+// ListenTaskEvents passes task notifications to handle until ctx is done,
+// reconnecting whenever the listening connection drops
+func (s *Storage) ListenTaskEvents(ctx context.Context, handle func(storage.TaskEvent)) error {
+	if s.DB.Dialector.Name() != "postgres" {
+		return storage.ErrNotSupported
+	}
+
+	for {
+		err := s.listenTaskEvents(ctx, handle)
+		if ctx.Err() != nil {
+			return nil
+		}
+		log.Printf("Task event listener disconnected: %v", err)
+
+		select {
+		case <-time.After(listenRetryDelay):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (s *Storage) listenTaskEvents(ctx context.Context, handle func(storage.TaskEvent)) error {
+	const op string = "db.ListenTaskEvents"
+
+	conn, err := pgx.Connect(ctx, s.dsn)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+taskEventsChannel); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	handle(storage.TaskEvent{Type: storage.TaskEventSubscribed})
+	defer handle(storage.TaskEvent{Type: storage.TaskEventUnsubscribed})
+
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+
+		event, err := parseTaskEvent(n.Payload)
+		if err != nil {
+			log.Printf("Malformed task event %q: %v", n.Payload, err)
+			continue
+		}
+		handle(event)
+	}
+}
+
+// parseTaskEvent decodes a payload of the notify_task_event trigger
+func parseTaskEvent(payload string) (storage.TaskEvent, error) {
+	var event storage.TaskEvent
+	if err := json.Unmarshal([]byte(payload), &event); err != nil {
+		return storage.TaskEvent{}, err
+	}
+
+	switch event.Type {
+	case storage.TaskEventReady:
+	case storage.TaskEventCompleted, storage.TaskEventCancelled:
+		if event.ExpressionID == 0 {
+			return storage.TaskEvent{}, fmt.Errorf("%s event without expression_id", event.Type)
+		}
+	default:
+		return storage.TaskEvent{}, fmt.Errorf("unknown type %q", event.Type)
+	}
+
+	return event, nil
+}
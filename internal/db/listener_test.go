@@ -0,0 +1,48 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+)
+
+func TestParseTaskEvent(t *testing.T) {
+	// payloads as json_build_object in notify_task_event renders them
+	tests := []struct {
+		payload string
+		want    storage.TaskEvent
+	}{
+		{
+			payload: `{"type" : "ready", "task_id" : 7, "expression_id" : 3}`,
+			want:    storage.TaskEvent{Type: storage.TaskEventReady, TaskID: 7, ExpressionID: 3},
+		},
+		{
+			payload: `{"type" : "completed", "task_id" : 8, "expression_id" : 3}`,
+			want:    storage.TaskEvent{Type: storage.TaskEventCompleted, TaskID: 8, ExpressionID: 3},
+		},
+		{
+			payload: `{"type" : "cancelled", "expression_id" : 4}`,
+			want:    storage.TaskEvent{Type: storage.TaskEventCancelled, ExpressionID: 4},
+		},
+	}
+	for _, tt := range tests {
+		event, err := parseTaskEvent(tt.payload)
+		require.NoError(t, err, tt.payload)
+		assert.Equal(t, tt.want, event)
+	}
+
+	for _, payload := range []string{
+		``,
+		`not json`,
+		`{"type" : "completed", "task_id" : 8}`,
+		`{"type" : "cancelled"}`,
+		`{"type" : "subscribed"}`,
+		`{"type" : "exploded", "expression_id" : 1}`,
+	} {
+		_, err := parseTaskEvent(payload)
+		assert.Error(t, err, payload)
+	}
+}
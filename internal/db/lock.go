@@ -0,0 +1,91 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+)
+
+// lockPingInterval is how often a held advisory lock checks its session
+const lockPingInterval = 5 * time.Second
+
+// TryLock takes a session-level advisory lock on a dedicated connection;
+// sqlite is single-process so it falls back to an in-process lock
+func (s *Storage) TryLock(ctx context.Context, key int64) (storage.Lock, error) {
+	const op string = "db.TryLock"
+
+	if s.DB.Dialector.Name() != "postgres" {
+		return s.local.TryLock(ctx, key)
+	}
+
+	sqlDB, err := s.DB.DB()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&locked); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	if !locked {
+		conn.Close()
+		return nil, storage.ErrLockHeld
+	}
+
+	l := &advisoryLock{conn: conn, key: key, lost: make(chan struct{}), done: make(chan struct{})}
+	go l.watch()
+
+	return l, nil
+}
+
+// advisoryLock lives as long as the session of its connection
+type advisoryLock struct {
+	conn *sql.Conn
+	key  int64
+	lost chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+func (l *advisoryLock) watch() {
+	ticker := time.NewTicker(lockPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), lockPingInterval)
+			err := l.conn.PingContext(ctx)
+			cancel()
+			if err != nil {
+				close(l.lost)
+				return
+			}
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// Lost ...
+func (l *advisoryLock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Release ...
+func (l *advisoryLock) Release() error {
+	l.once.Do(func() {
+		close(l.done)
+		unlock(l.conn, l.key)
+	})
+	return nil
+}
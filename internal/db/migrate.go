@@ -0,0 +1,277 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+)
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+// migrationLockKey is the pg_advisory_lock key that serialises migrators
+const migrationLockKey int64 = 0x63616c63
+
+const schemaMigrationsSQL = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version BIGINT PRIMARY KEY,
+	name TEXT NOT NULL,
+	applied_at TIMESTAMP NOT NULL
+)`
+
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+type schemaMigration struct {
+	Version   int
+	Name      string
+	AppliedAt time.Time
+}
+
+// loadMigrations reads the up/down scripts for a dialect, ordered by version
+func loadMigrations(dialect string) ([]migration, error) {
+	dir := path.Join("migrations", dialect)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*migration)
+	for _, entry := range entries {
+		// 0001_init.up.sql -> version 1, name init, direction up
+		base := strings.TrimSuffix(entry.Name(), ".sql")
+		direction := path.Ext(base)
+		base = strings.TrimSuffix(base, direction)
+
+		prefix, name, ok := strings.Cut(base, "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil || (direction != ".up" && direction != ".down") {
+			return nil, fmt.Errorf("malformed migration file name %q", entry.Name())
+		}
+
+		body, err := fs.ReadFile(migrationFiles, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, name: name}
+			byVersion[version] = m
+		}
+		if direction == ".up" {
+			m.up = string(body)
+		} else {
+			m.down = string(body)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %04d_%s needs both up and down scripts", m.version, m.name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+
+	return migrations, nil
+}
+
+// Migrate ...
+func (s *Storage) Migrate(ctx context.Context) ([]storage.Migration, error) {
+	const op string = "db.Migrate"
+
+	var applied []storage.Migration
+	err := s.withMigrationLock(ctx, func(migrations []migration, done map[int]schemaMigration) error {
+		for _, m := range migrations {
+			if _, ok := done[m.version]; ok {
+				continue
+			}
+
+			now := time.Now().UTC()
+			skipped := false
+			err := s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+				// another sqlite process may have applied it since done was read
+				var count int64
+				if err := tx.Table("schema_migrations").Where("version = ?", m.version).Count(&count).Error; err != nil {
+					return err
+				}
+				if count > 0 {
+					skipped = true
+					return nil
+				}
+
+				if err := tx.Exec(m.up).Error; err != nil {
+					return err
+				}
+				return tx.Exec(
+					"INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+					m.version, m.name, now,
+				).Error
+			})
+			if err != nil {
+				return fmt.Errorf("apply %04d_%s: %w", m.version, m.name, err)
+			}
+			if skipped {
+				continue
+			}
+
+			applied = append(applied, storage.Migration{Version: m.version, Name: m.name, AppliedAt: &now})
+		}
+		return nil
+	})
+	if err != nil {
+		return applied, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return applied, nil
+}
+
+// Rollback ...
+func (s *Storage) Rollback(ctx context.Context, steps int) ([]storage.Migration, error) {
+	const op string = "db.Rollback"
+
+	var reverted []storage.Migration
+	err := s.withMigrationLock(ctx, func(migrations []migration, done map[int]schemaMigration) error {
+		for i := len(migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+			m := migrations[i]
+			if _, ok := done[m.version]; !ok {
+				continue
+			}
+
+			err := s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+				if err := tx.Exec(m.down).Error; err != nil {
+					return err
+				}
+				return tx.Exec("DELETE FROM schema_migrations WHERE version = ?", m.version).Error
+			})
+			if err != nil {
+				return fmt.Errorf("revert %04d_%s: %w", m.version, m.name, err)
+			}
+
+			reverted = append(reverted, storage.Migration{Version: m.version, Name: m.name})
+		}
+		return nil
+	})
+	if err != nil {
+		return reverted, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return reverted, nil
+}
+
+// MigrationStatus ...
+func (s *Storage) MigrationStatus(ctx context.Context) ([]storage.Migration, error) {
+	const op string = "db.MigrationStatus"
+
+	migrations, err := loadMigrations(s.DB.Dialector.Name())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	done, err := s.appliedMigrations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	status := make([]storage.Migration, len(migrations))
+	for i, m := range migrations {
+		status[i] = storage.Migration{Version: m.version, Name: m.name}
+		if applied, ok := done[m.version]; ok {
+			appliedAt := applied.AppliedAt
+			status[i].AppliedAt = &appliedAt
+		}
+	}
+
+	return status, nil
+}
+
+// withMigrationLock runs fn while holding the migration lock, so that
+// orchestrators starting at the same time apply every migration once
+func (s *Storage) withMigrationLock(
+	ctx context.Context,
+	fn func(migrations []migration, done map[int]schemaMigration) error,
+) error {
+	migrations, err := loadMigrations(s.DB.Dialector.Name())
+	if err != nil {
+		return err
+	}
+
+	if s.DB.Dialector.Name() == "postgres" {
+		release, err := s.advisoryLock(ctx, migrationLockKey)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+
+	// sqlite has no advisory locks, but its immediate transactions already
+	// serialise writers and applied versions are re-read under the lock
+	if err := s.DB.WithContext(ctx).Exec(schemaMigrationsSQL).Error; err != nil {
+		return err
+	}
+	done, err := s.appliedMigrations(ctx)
+	if err != nil {
+		return err
+	}
+
+	return fn(migrations, done)
+}
+
+func (s *Storage) appliedMigrations(ctx context.Context) (map[int]schemaMigration, error) {
+	done := make(map[int]schemaMigration)
+	if !s.DB.Migrator().HasTable("schema_migrations") {
+		return done, nil
+	}
+
+	var rows []schemaMigration
+	if err := s.DB.WithContext(ctx).Table("schema_migrations").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		done[row.Version] = row
+	}
+
+	return done, nil
+}
+
+// advisoryLock blocks until the session-level lock is taken on a dedicated
+// connection; release unlocks it and returns the connection to the pool
+func (s *Storage) advisoryLock(ctx context.Context, key int64) (func(), error) {
+	sqlDB, err := s.DB.DB()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", key); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return func() { unlock(conn, key) }, nil
+}
+
+func unlock(conn *sql.Conn, key int64) {
+	conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", key)
+	conn.Close()
+}
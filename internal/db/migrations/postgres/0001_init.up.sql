@@ -0,0 +1,30 @@
+CREATE TABLE IF NOT EXISTS users (
+	id BIGSERIAL PRIMARY KEY,
+	username TEXT NOT NULL UNIQUE,
+	email TEXT NOT NULL UNIQUE,
+	password BYTEA NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS expressions (
+	id BIGSERIAL PRIMARY KEY,
+	expr TEXT NOT NULL,
+	status TEXT NOT NULL,
+	result DOUBLE PRECISION,
+	user_id BIGINT NOT NULL REFERENCES users (id)
+);
+
+CREATE TABLE IF NOT EXISTS tasks (
+	id BIGSERIAL PRIMARY KEY,
+	arg1 DOUBLE PRECISION NOT NULL,
+	arg2 DOUBLE PRECISION,
+	operation TEXT NOT NULL,
+	status TEXT NOT NULL DEFAULT 'pending',
+	result DOUBLE PRECISION,
+	operation_time BIGINT NOT NULL,
+	"order" BIGINT NOT NULL DEFAULT 0,
+	expression_id BIGINT NOT NULL REFERENCES expressions (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_expressions_user_id ON expressions (user_id);
+CREATE INDEX IF NOT EXISTS idx_tasks_expression_id ON tasks (expression_id);
+CREATE INDEX IF NOT EXISTS idx_tasks_status ON tasks (status, id);
@@ -0,0 +1,2 @@
+DROP TRIGGER IF EXISTS tasks_notify ON tasks;
+DROP FUNCTION IF EXISTS notify_task_event();
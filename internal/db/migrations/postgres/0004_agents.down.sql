@@ -0,0 +1,3 @@
+ALTER TABLE tasks DROP COLUMN agent_id;
+
+DROP TABLE IF EXISTS agents;
@@ -0,0 +1,11 @@
+DROP TABLE IF EXISTS expression_events;
+
+ALTER TABLE tasks DROP COLUMN failed_at;
+ALTER TABLE tasks DROP COLUMN completed_at;
+ALTER TABLE tasks DROP COLUMN started_at;
+ALTER TABLE tasks DROP COLUMN leased_at;
+ALTER TABLE tasks DROP COLUMN queued_at;
+ALTER TABLE tasks DROP COLUMN created_at;
+
+ALTER TABLE expressions DROP COLUMN finished_at;
+ALTER TABLE expressions DROP COLUMN created_at;
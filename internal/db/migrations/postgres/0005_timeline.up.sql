@@ -0,0 +1,22 @@
+ALTER TABLE expressions ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE expressions ADD COLUMN finished_at TIMESTAMPTZ;
+
+ALTER TABLE tasks ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE tasks ADD COLUMN queued_at TIMESTAMPTZ;
+ALTER TABLE tasks ADD COLUMN leased_at TIMESTAMPTZ;
+ALTER TABLE tasks ADD COLUMN started_at TIMESTAMPTZ;
+ALTER TABLE tasks ADD COLUMN completed_at TIMESTAMPTZ;
+ALTER TABLE tasks ADD COLUMN failed_at TIMESTAMPTZ;
+
+CREATE TABLE IF NOT EXISTS expression_events (
+	id BIGSERIAL PRIMARY KEY,
+	expression_id BIGINT NOT NULL REFERENCES expressions (id) ON DELETE CASCADE,
+	task_id BIGINT,
+	type TEXT NOT NULL,
+	status TEXT NOT NULL,
+	agent_id TEXT NOT NULL DEFAULT '',
+	detail TEXT NOT NULL DEFAULT '',
+	at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_expression_events_expression_id ON expression_events (expression_id, id);
@@ -0,0 +1,2 @@
+CREATE INDEX IF NOT EXISTS idx_expressions_user_created ON expressions (user_id, created_at, id);
+CREATE INDEX IF NOT EXISTS idx_expressions_user_result ON expressions (user_id, result, id);
@@ -0,0 +1,17 @@
+CREATE OR REPLACE FUNCTION notify_task_event() RETURNS trigger AS $$
+BEGIN
+	IF TG_OP = 'UPDATE' THEN
+		IF OLD.status IS NOT DISTINCT FROM NEW.status THEN
+			RETURN NULL;
+		END IF;
+	END IF;
+
+	IF NEW.status IN ('pending', 'completed') THEN
+		PERFORM pg_notify('task_events', json_build_object(
+			'type', CASE NEW.status WHEN 'pending' THEN 'ready' ELSE 'completed' END,
+			'task_id', NEW.id,
+			'expression_id', NEW.expression_id)::text);
+	END IF;
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
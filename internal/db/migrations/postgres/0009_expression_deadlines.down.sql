@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_expressions_deadline;
+
+ALTER TABLE expressions DROP COLUMN deadline;
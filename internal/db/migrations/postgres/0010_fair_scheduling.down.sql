@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS idx_tasks_running_share;
+DROP INDEX IF EXISTS idx_tasks_pending_share;
+
+ALTER TABLE tasks DROP COLUMN priority;
+ALTER TABLE tasks DROP COLUMN class;
+ALTER TABLE tasks DROP COLUMN user_id;
+
+ALTER TABLE expressions DROP COLUMN priority;
+ALTER TABLE expressions DROP COLUMN class;
@@ -0,0 +1,10 @@
+ALTER TABLE expressions ADD COLUMN class TEXT NOT NULL DEFAULT 'interactive';
+ALTER TABLE expressions ADD COLUMN priority INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE tasks ADD COLUMN user_id BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE tasks ADD COLUMN class TEXT NOT NULL DEFAULT 'interactive';
+ALTER TABLE tasks ADD COLUMN priority INTEGER NOT NULL DEFAULT 0;
+UPDATE tasks SET user_id = expressions.user_id FROM expressions WHERE expressions.id = tasks.expression_id;
+
+CREATE INDEX IF NOT EXISTS idx_tasks_pending_share ON tasks (class, user_id, priority DESC, id) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS idx_tasks_running_share ON tasks (class, user_id) WHERE status = 'in_progress';
@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS idx_task_votes_task_agent;
+DROP TABLE IF EXISTS task_votes;
+
+ALTER TABLE agents DROP COLUMN quarantined;
+ALTER TABLE agents DROP COLUMN disagreements;
+
+ALTER TABLE tasks DROP COLUMN replicas;
+ALTER TABLE expressions DROP COLUMN replicas;
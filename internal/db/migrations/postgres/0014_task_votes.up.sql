@@ -0,0 +1,16 @@
+ALTER TABLE expressions ADD COLUMN replicas INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE tasks ADD COLUMN replicas INTEGER NOT NULL DEFAULT 1;
+
+ALTER TABLE agents ADD COLUMN disagreements INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE agents ADD COLUMN quarantined BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS task_votes (
+	id BIGSERIAL PRIMARY KEY,
+	task_id BIGINT NOT NULL REFERENCES tasks (id) ON DELETE CASCADE,
+	expression_id BIGINT NOT NULL,
+	agent_id TEXT NOT NULL,
+	result DOUBLE PRECISION NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_task_votes_task_agent ON task_votes (task_id, agent_id);
@@ -0,0 +1,6 @@
+DROP TRIGGER IF EXISTS replica_leases_notify ON replica_leases;
+DROP FUNCTION IF EXISTS notify_replica_released();
+
+DROP INDEX IF EXISTS idx_replica_leases_expires;
+DROP INDEX IF EXISTS idx_replica_leases_agent;
+DROP TABLE IF EXISTS replica_leases;
@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS replica_leases (
+	task_id BIGINT NOT NULL REFERENCES tasks (id) ON DELETE CASCADE,
+	agent_id TEXT NOT NULL,
+	leased_at TIMESTAMPTZ NOT NULL,
+	lease_expires_at TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (task_id, agent_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_replica_leases_agent ON replica_leases (agent_id);
+CREATE INDEX IF NOT EXISTS idx_replica_leases_expires ON replica_leases (lease_expires_at);
+
+-- a replica given up while other agents still hold the task frees a slot
+-- without changing the status of the task
+CREATE OR REPLACE FUNCTION notify_replica_released() RETURNS trigger AS $$
+BEGIN
+	PERFORM pg_notify('task_events', json_build_object(
+		'type', 'ready',
+		'task_id', OLD.task_id)::text);
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS replica_leases_notify ON replica_leases;
+CREATE TRIGGER replica_leases_notify
+	AFTER DELETE ON replica_leases
+	FOR EACH ROW EXECUTE FUNCTION notify_replica_released();
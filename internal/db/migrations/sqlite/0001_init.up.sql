@@ -0,0 +1,30 @@
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	username TEXT NOT NULL UNIQUE,
+	email TEXT NOT NULL UNIQUE,
+	password BLOB NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS expressions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	expr TEXT NOT NULL,
+	status TEXT NOT NULL,
+	result REAL,
+	user_id INTEGER NOT NULL REFERENCES users (id)
+);
+
+CREATE TABLE IF NOT EXISTS tasks (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	arg1 REAL NOT NULL,
+	arg2 REAL,
+	operation TEXT NOT NULL,
+	status TEXT NOT NULL DEFAULT 'pending',
+	result REAL,
+	operation_time INTEGER NOT NULL,
+	"order" INTEGER NOT NULL DEFAULT 0,
+	expression_id INTEGER NOT NULL REFERENCES expressions (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_expressions_user_id ON expressions (user_id);
+CREATE INDEX IF NOT EXISTS idx_tasks_expression_id ON tasks (expression_id);
+CREATE INDEX IF NOT EXISTS idx_tasks_status ON tasks (status, id);
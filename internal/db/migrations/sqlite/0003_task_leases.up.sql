@@ -0,0 +1,4 @@
+ALTER TABLE tasks ADD COLUMN lease_expires_at DATETIME;
+
+CREATE INDEX IF NOT EXISTS idx_tasks_lease_expires_at ON tasks (lease_expires_at)
+	WHERE status = 'in_progress';
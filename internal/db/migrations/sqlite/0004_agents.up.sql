@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS agents (
+	id TEXT PRIMARY KEY,
+	workers INTEGER NOT NULL DEFAULT 0,
+	status TEXT NOT NULL,
+	last_seen_at DATETIME NOT NULL
+);
+
+ALTER TABLE tasks ADD COLUMN agent_id TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,25 @@
+-- sqlite cannot add a column with a non-constant default, backfill instead
+ALTER TABLE expressions ADD COLUMN created_at DATETIME NOT NULL DEFAULT '1970-01-01 00:00:00';
+ALTER TABLE expressions ADD COLUMN finished_at DATETIME;
+UPDATE expressions SET created_at = CURRENT_TIMESTAMP;
+
+ALTER TABLE tasks ADD COLUMN created_at DATETIME NOT NULL DEFAULT '1970-01-01 00:00:00';
+ALTER TABLE tasks ADD COLUMN queued_at DATETIME;
+ALTER TABLE tasks ADD COLUMN leased_at DATETIME;
+ALTER TABLE tasks ADD COLUMN started_at DATETIME;
+ALTER TABLE tasks ADD COLUMN completed_at DATETIME;
+ALTER TABLE tasks ADD COLUMN failed_at DATETIME;
+UPDATE tasks SET created_at = CURRENT_TIMESTAMP;
+
+CREATE TABLE IF NOT EXISTS expression_events (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	expression_id INTEGER NOT NULL REFERENCES expressions (id) ON DELETE CASCADE,
+	task_id INTEGER,
+	type TEXT NOT NULL,
+	status TEXT NOT NULL,
+	agent_id TEXT NOT NULL DEFAULT '',
+	detail TEXT NOT NULL DEFAULT '',
+	at DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_expression_events_expression_id ON expression_events (expression_id, id);
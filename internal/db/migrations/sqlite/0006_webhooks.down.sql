@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS webhook_attempts;
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhook_secrets;
+DROP TABLE IF EXISTS webhooks;
+
+ALTER TABLE expressions DROP COLUMN webhook_url;
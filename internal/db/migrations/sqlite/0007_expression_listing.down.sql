@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_expressions_user_result;
+DROP INDEX IF EXISTS idx_expressions_user_created;
@@ -0,0 +1,3 @@
+ALTER TABLE expressions ADD COLUMN deadline DATETIME;
+
+CREATE INDEX IF NOT EXISTS idx_expressions_deadline ON expressions (deadline) WHERE deadline IS NOT NULL;
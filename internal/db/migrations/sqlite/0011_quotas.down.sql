@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_tasks_user_created;
+DROP TABLE IF EXISTS quotas;
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS quotas (
+	user_id INTEGER PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+	expressions_per_minute INTEGER,
+	active_expressions INTEGER,
+	tasks_per_day INTEGER,
+	updated_at DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_tasks_user_created ON tasks (user_id, created_at);
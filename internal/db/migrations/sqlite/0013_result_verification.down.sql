@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_expressions_mismatch;
+
+ALTER TABLE expressions DROP COLUMN local_result;
+ALTER TABLE expressions DROP COLUMN verification;
+ALTER TABLE expressions DROP COLUMN verify;
@@ -0,0 +1,5 @@
+ALTER TABLE expressions ADD COLUMN verify BOOLEAN NOT NULL DEFAULT 0;
+ALTER TABLE expressions ADD COLUMN verification TEXT NOT NULL DEFAULT '';
+ALTER TABLE expressions ADD COLUMN local_result REAL;
+
+CREATE INDEX IF NOT EXISTS idx_expressions_mismatch ON expressions (id) WHERE verification = 'mismatch';
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS agent_credentials (
+	agent_id TEXT PRIMARY KEY,
+	token_hash TEXT NOT NULL,
+	created_at DATETIME NOT NULL
+);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_replica_leases_expires;
+DROP INDEX IF EXISTS idx_replica_leases_agent;
+DROP TABLE IF EXISTS replica_leases;
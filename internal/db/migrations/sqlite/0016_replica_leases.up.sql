@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS replica_leases (
+	task_id INTEGER NOT NULL REFERENCES tasks (id) ON DELETE CASCADE,
+	agent_id TEXT NOT NULL,
+	leased_at DATETIME NOT NULL,
+	lease_expires_at DATETIME NOT NULL,
+	PRIMARY KEY (task_id, agent_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_replica_leases_agent ON replica_leases (agent_id);
+CREATE INDEX IF NOT EXISTS idx_replica_leases_expires ON replica_leases (lease_expires_at);
@@ -0,0 +1,141 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+)
+
+// Quota ...
+func (s *Storage) Quota(ctx context.Context, userID uint) (models.Quota, error) {
+	const op string = "db.Quota"
+
+	var quota models.Quota
+	if err := s.DB.WithContext(ctx).First(&quota, "user_id = ?", userID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return models.Quota{}, fmt.Errorf("%s: %w", op, storage.ErrQuotaNotFound)
+		}
+		return models.Quota{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return quota, nil
+}
+
+// SaveQuota ...
+func (s *Storage) SaveQuota(ctx context.Context, quota models.Quota) error {
+	const op string = "db.SaveQuota"
+
+	quota.UpdatedAt = time.Now().UTC()
+	err := s.DB.WithContext(ctx).Clauses(clause.OnConflict{UpdateAll: true}).Create(&quota).Error
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// DeleteQuota ...
+func (s *Storage) DeleteQuota(ctx context.Context, userID uint) error {
+	const op string = "db.DeleteQuota"
+
+	res := s.DB.WithContext(ctx).Where("user_id = ?", userID).Delete(&models.Quota{})
+	if res.Error != nil {
+		return fmt.Errorf("%s: %w", op, res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrQuotaNotFound)
+	}
+
+	return nil
+}
+
+// QuotaUsage ...
+func (s *Storage) QuotaUsage(ctx context.Context, userID uint, minuteStart, dayStart time.Time) (storage.Usage, error) {
+	const op string = "db.QuotaUsage"
+
+	usage, err := quotaUsage(s.DB.WithContext(ctx), userID, minuteStart, dayStart)
+	if err != nil {
+		return storage.Usage{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return usage, nil
+}
+
+// CreateExpressionWithinQuota ...
+func (s *Storage) CreateExpressionWithinQuota(ctx context.Context, expr *models.Expression, minuteStart, dayStart time.Time, check func(storage.Usage) error) error {
+	const op string = "db.CreateExpressionWithinQuota"
+
+	err := s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// the user row serializes the creations of one user on postgres,
+		// sqlite transactions are immediate and serialize every writer
+		var user models.User
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").First(&user, expr.UserID).Error; err != nil {
+			return err
+		}
+
+		usage, err := quotaUsage(tx, expr.UserID, minuteStart, dayStart)
+		if err != nil {
+			return err
+		}
+		if err := check(usage); err != nil {
+			return err
+		}
+		return createExpression(tx, expr)
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// quotaUsage counts what the user spent of the quotas
+func quotaUsage(db *gorm.DB, userID uint, minuteStart, dayStart time.Time) (storage.Usage, error) {
+	var recent int64
+	err := db.Model(&models.Expression{}).
+		Where("user_id = ? AND created_at >= ?", userID, minuteStart.UTC()).
+		Count(&recent).Error
+	if err != nil {
+		return storage.Usage{}, err
+	}
+
+	var active, tasks int64
+	err = db.Model(&models.Expression{}).
+		Where("user_id = ? AND status IN ?", userID, []string{"pending", "in_progress"}).
+		Count(&active).Error
+	if err != nil {
+		return storage.Usage{}, err
+	}
+
+	err = db.Model(&models.Task{}).
+		Where("user_id = ? AND created_at >= ?", userID, dayStart.UTC()).
+		Count(&tasks).Error
+	if err != nil {
+		return storage.Usage{}, err
+	}
+
+	usage := storage.Usage{Recent: int(recent), Active: int(active), TasksToday: int(tasks)}
+	if recent > 0 {
+		var first models.Expression
+		err := db.Select("created_at").
+			Where("user_id = ? AND created_at >= ?", userID, minuteStart.UTC()).
+			Order("created_at").
+			First(&first).Error
+		if err != nil {
+			return storage.Usage{}, err
+		}
+		usage.OldestRecent = first.CreatedAt
+	}
+
+	return usage, nil
+}
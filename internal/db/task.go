@@ -0,0 +1,798 @@
+package db
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+)
+
+// claimRounds bounds how often ClaimTasks replans after other orchestrators
+// took the tasks it picked
+const claimRounds = 3
+
+// ClaimTasks ...
+func (s *Storage) ClaimTasks(ctx context.Context, req storage.ClaimRequest) ([]models.Task, error) {
+	const op string = "db.ClaimTasks"
+
+	// sqlite compares timestamps as text, keep them all in one zone
+	leaseUntil := req.LeaseUntil.UTC()
+	now := time.Now().UTC()
+
+	var tasks []models.Task
+	err := s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if req.AgentID != "" {
+			var quarantined int64
+			err := tx.Model(&models.Agent{}).Where("id = ? AND quarantined = ?", req.AgentID, true).Count(&quarantined).Error
+			if err != nil {
+				return err
+			}
+			if quarantined > 0 {
+				return storage.ErrAgentQuarantined
+			}
+		}
+
+		var err error
+		tasks, err = scheduleTasks(tx, req)
+		if err != nil || len(tasks) == 0 {
+			return err
+		}
+
+		var ids, replicated []uint
+		var leases []models.ReplicaLease
+		events := make([]models.ExpressionEvent, len(tasks))
+		for i := range tasks {
+			if tasks[i].Replicas > 1 {
+				lease := models.ReplicaLease{TaskID: tasks[i].ID, AgentID: req.AgentID, LeasedAt: now, LeaseExpiresAt: leaseUntil}
+				leases = append(leases, lease)
+				replicated = append(replicated, tasks[i].ID)
+				tasks[i] = storage.ReplicaTask(tasks[i], lease)
+			} else {
+				ids = append(ids, tasks[i].ID)
+				tasks[i].Status = "in_progress"
+				tasks[i].LeaseExpiresAt = &leaseUntil
+				tasks[i].AgentID = req.AgentID
+				tasks[i].LeasedAt = &now
+			}
+			events[i] = storage.LeaseEvent(tasks[i], now)
+		}
+
+		if len(ids) > 0 {
+			err = tx.Model(&models.Task{}).Where("id IN ?", ids).Updates(map[string]interface{}{
+				"status":           "in_progress",
+				"lease_expires_at": leaseUntil,
+				"agent_id":         req.AgentID,
+				"leased_at":        now,
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+		// the agents of a replicated task hold it through their own leases
+		if len(replicated) > 0 {
+			if err := tx.Create(&leases).Error; err != nil {
+				return err
+			}
+			err = tx.Model(&models.Task{}).Where("id IN ?", replicated).Updates(map[string]interface{}{
+				"status":    "in_progress",
+				"leased_at": now,
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return logEvents(tx, events)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	if len(tasks) == 0 {
+		return nil, fmt.Errorf("%s: %w", op, storage.ErrTaskNotFound)
+	}
+
+	return tasks, nil
+}
+
+// scheduleTasks locks the pending tasks storage.Schedule picks. The plan is
+// made from each queue's head without locks, tasks another transaction
+// took meanwhile are skipped and the rest is planned again. Replicated
+// tasks are candidates while they have a free replica the agent neither
+// holds nor voted on, pending or not.
+func scheduleTasks(tx *gorm.DB, req storage.ClaimRequest) ([]models.Task, error) {
+	var counts []struct {
+		Class  string
+		UserID uint
+		N      int
+	}
+	err := tx.Model(&models.Task{}).
+		Select("class, user_id, COUNT(*) AS n").
+		Where("status = ?", "in_progress").
+		Group("class, user_id").
+		Scan(&counts).Error
+	if err != nil {
+		return nil, err
+	}
+
+	running := make(map[storage.ShareKey]int)
+	for _, c := range counts {
+		running[storage.ShareKey{Class: c.Class, UserID: c.UserID}] = c.N
+	}
+
+	unfinished := []string{"pending", "in_progress"}
+
+	var claimed []models.Task
+	// no task has id 0, it keeps NOT IN valid before anything is skipped
+	skip := []uint{0}
+	for round := 0; round < claimRounds && len(claimed) < req.Limit; round++ {
+		limit := req.Limit - len(claimed)
+
+		var candidates []models.Task
+		err := tx.Raw(`SELECT * FROM tasks WHERE id IN (
+			SELECT id FROM (
+				SELECT id, ROW_NUMBER() OVER (PARTITION BY class, user_id ORDER BY priority DESC, id) AS rn
+				FROM tasks WHERE id NOT IN ? AND (
+					(replicas <= 1 AND status = ?) OR
+					(replicas > 1 AND status IN ? AND ? <> ''
+						AND NOT EXISTS (SELECT 1 FROM task_votes WHERE task_votes.task_id = tasks.id AND task_votes.agent_id = ?)
+						AND NOT EXISTS (SELECT 1 FROM replica_leases WHERE replica_leases.task_id = tasks.id AND replica_leases.agent_id = ?)
+						AND (SELECT COUNT(*) FROM task_votes WHERE task_votes.task_id = tasks.id) +
+							(SELECT COUNT(*) FROM replica_leases WHERE replica_leases.task_id = tasks.id) < replicas)
+				)
+			) ranked WHERE rn <= ?
+		)`, skip, "pending", unfinished, req.AgentID, req.AgentID, req.AgentID, limit).Scan(&candidates).Error
+		if err != nil || len(candidates) == 0 {
+			return claimed, err
+		}
+
+		plan := storage.Schedule(candidates, running, req.Weights, limit)
+		ids := make([]uint, len(plan))
+		for i, task := range plan {
+			ids[i] = task.ID
+		}
+
+		var locked []models.Task
+		err = tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("id IN ? AND status IN ?", ids, unfinished).
+			Find(&locked).Error
+		if err != nil {
+			return nil, err
+		}
+		// the replicas are counted again now that nobody else can lease them
+		holders, err := replicaHolders(tx, ids)
+		if err != nil {
+			return nil, err
+		}
+
+		got := make(map[uint]models.Task, len(locked))
+		for _, task := range locked {
+			open := task.Status == "pending"
+			if task.Replicas > 1 {
+				open = storage.ReplicaOpen(task.Replicas, holders[task.ID], req.AgentID)
+			}
+			if open {
+				got[task.ID] = task
+			}
+		}
+		for _, task := range plan {
+			if lockedTask, ok := got[task.ID]; ok {
+				claimed = append(claimed, lockedTask)
+				continue
+			}
+			running[storage.KeyOf(task)]--
+			skip = append(skip, task.ID)
+		}
+		if len(got) == len(plan) {
+			break
+		}
+	}
+
+	return claimed, nil
+}
+
+// replicaHolders returns the agents that hold or voted on each of the tasks
+func replicaHolders(tx *gorm.DB, ids []uint) (map[uint][]string, error) {
+	var rows []struct {
+		TaskID  uint
+		AgentID string
+	}
+	err := tx.Raw(
+		"SELECT task_id, agent_id FROM task_votes WHERE task_id IN ? UNION ALL SELECT task_id, agent_id FROM replica_leases WHERE task_id IN ?",
+		ids, ids,
+	).Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	holders := make(map[uint][]string)
+	for _, row := range rows {
+		holders[row.TaskID] = append(holders[row.TaskID], row.AgentID)
+	}
+	return holders, nil
+}
+
+// CompleteTask stores the result of an in_progress task
+func (s *Storage) CompleteTask(ctx context.Context, res storage.TaskResult) (models.Task, error) {
+	const op string = "db.CompleteTask"
+
+	now := time.Now().UTC()
+	startedAt := res.StartedAt.UTC()
+
+	var task models.Task
+	err := s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&task, res.ID).Error; err != nil {
+			return err
+		}
+		if task.Status == "cancelled" {
+			return storage.ErrTaskCancelled
+		}
+		if task.Status != "in_progress" {
+			return storage.ErrTaskNotInProgress
+		}
+		if task.Replicas > 1 {
+			return vote(tx, &task, res, startedAt, now)
+		}
+		if task.AgentID != res.AgentID {
+			return storage.ErrLeaseNotHeld
+		}
+
+		task.Status = "completed"
+		task.Result = &res.Result
+		task.LeaseExpiresAt = nil
+		task.CompletedAt = &now
+		updates := map[string]interface{}{
+			"status":           task.Status,
+			"result":           res.Result,
+			"lease_expires_at": nil,
+			"completed_at":     now,
+		}
+		if !res.StartedAt.IsZero() {
+			task.StartedAt = &startedAt
+			updates["started_at"] = startedAt
+		}
+
+		if err := tx.Model(&task).Updates(updates).Error; err != nil {
+			return err
+		}
+		return logEvents(tx, storage.CompletionEvents(task, startedAt, now))
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return models.Task{}, fmt.Errorf("%s: %w", op, storage.ErrTaskNotFound)
+		}
+		return models.Task{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return task, nil
+}
+
+// vote records the result as the vote of the agent, which gives up its
+// replica lease, and moves the task on according to the tally
+func vote(tx *gorm.DB, task *models.Task, res storage.TaskResult, startedAt, now time.Time) error {
+	released := tx.Where("task_id = ? AND agent_id = ?", task.ID, res.AgentID).Delete(&models.ReplicaLease{})
+	if released.Error != nil {
+		return released.Error
+	}
+	if released.RowsAffected == 0 {
+		return storage.ErrLeaseNotHeld
+	}
+
+	err := tx.Create(&models.TaskVote{
+		TaskID:       task.ID,
+		ExpressionID: task.ExpressionID,
+		AgentID:      res.AgentID,
+		Result:       res.Result,
+		CreatedAt:    now,
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	var votes []models.TaskVote
+	if err := tx.Where("task_id = ?", task.ID).Order("id").Find(&votes).Error; err != nil {
+		return err
+	}
+	var holders int64
+	if err := tx.Model(&models.ReplicaLease{}).Where("task_id = ?", task.ID).Count(&holders).Error; err != nil {
+		return err
+	}
+	tally := storage.CountVotes(votes, task.Replicas, res.Tolerance)
+
+	voter := *task
+	voter.AgentID = res.AgentID
+	events := storage.VoteEvents(voter, tally, holders == 0, res.Result, startedAt, now)
+
+	updates := map[string]interface{}{}
+	if !res.StartedAt.IsZero() {
+		task.StartedAt = &startedAt
+		updates["started_at"] = startedAt
+	}
+	switch {
+	case tally.Result != nil:
+		task.Status = "completed"
+		task.Result = tally.Result
+		task.CompletedAt = &now
+		updates["result"] = *tally.Result
+		updates["completed_at"] = now
+	case tally.Failed:
+		task.Status = "cancelled"
+	case holders == 0:
+		task.Status = "pending"
+		task.QueuedAt = &now
+		updates["queued_at"] = now
+	}
+	updates["status"] = task.Status
+
+	// the agents still computing a decided task are told to stop on their
+	// next heartbeat
+	if tally.Result != nil || tally.Failed {
+		if err := tx.Where("task_id = ?", task.ID).Delete(&models.ReplicaLease{}).Error; err != nil {
+			return err
+		}
+	}
+	if err := tx.Model(&models.Task{}).Where("id = ?", task.ID).Updates(updates).Error; err != nil {
+		return err
+	}
+	return logEvents(tx, events)
+}
+
+// TaskVotes ...
+func (s *Storage) TaskVotes(ctx context.Context, id uint) ([]models.TaskVote, error) {
+	const op string = "db.TaskVotes"
+
+	var votes []models.TaskVote
+	if err := s.DB.WithContext(ctx).Where("task_id = ?", id).Order("id").Find(&votes).Error; err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return votes, nil
+}
+
+// Tasks ...
+func (s *Storage) Tasks(ctx context.Context, ids []uint) ([]models.Task, error) {
+	const op string = "db.Tasks"
+
+	var tasks []models.Task
+	if len(ids) == 0 {
+		return tasks, nil
+	}
+	if err := s.DB.WithContext(ctx).Where("id IN ?", ids).Order("id").Find(&tasks).Error; err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return tasks, nil
+}
+
+// ReleaseTasks ...
+func (s *Storage) ReleaseTasks(ctx context.Context, agentID string, ids []uint, reason string) (int64, error) {
+	const op string = "db.ReleaseTasks"
+
+	released, err := s.requeueTasks(ctx, reason, func(tx *gorm.DB) *gorm.DB {
+		tx = tx.Where("status = ? AND agent_id = ?", "in_progress", agentID)
+		if ids != nil {
+			tx = tx.Where("id IN ?", ids)
+		}
+		return tx
+	}, func(tx *gorm.DB) *gorm.DB {
+		tx = tx.Where("agent_id = ?", agentID)
+		if ids != nil {
+			tx = tx.Where("task_id IN ?", ids)
+		}
+		return tx
+	})
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return released, nil
+}
+
+// ExtendLeases ...
+func (s *Storage) ExtendLeases(ctx context.Context, agentID string, ids []uint, until time.Time) ([]uint, error) {
+	const op string = "db.ExtendLeases"
+
+	held := []uint{}
+	if len(ids) == 0 {
+		return held, nil
+	}
+
+	err := s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		scope := func() *gorm.DB {
+			return tx.Model(&models.Task{}).Where("id IN ? AND status = ? AND agent_id = ?", ids, "in_progress", agentID)
+		}
+		replicas := func() *gorm.DB {
+			return tx.Model(&models.ReplicaLease{}).Where("task_id IN ? AND agent_id = ?", ids, agentID)
+		}
+		// updating first keeps the reaper off the rows until the commit
+		if err := scope().Update("lease_expires_at", until.UTC()).Error; err != nil {
+			return err
+		}
+		if err := replicas().Update("lease_expires_at", until.UTC()).Error; err != nil {
+			return err
+		}
+
+		var replicated []uint
+		if err := replicas().Pluck("task_id", &replicated).Error; err != nil {
+			return err
+		}
+		if err := scope().Pluck("id", &held).Error; err != nil {
+			return err
+		}
+		held = append(held, replicated...)
+		slices.Sort(held)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return held, nil
+}
+
+// ReapExpiredLeases ...
+func (s *Storage) ReapExpiredLeases(ctx context.Context, now time.Time) (int64, error) {
+	const op string = "db.ReapExpiredLeases"
+
+	reaped, err := s.requeueTasks(ctx, storage.ReasonLeaseExpired, func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("status = ? AND lease_expires_at < ?", "in_progress", now.UTC())
+	}, func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("lease_expires_at < ?", now.UTC())
+	})
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return reaped, nil
+}
+
+// requeueTasks takes the selected in_progress tasks and replica leases from
+// their agents in one transaction, see requeueLeased and releaseReplicas
+func (s *Storage) requeueTasks(ctx context.Context, reason string, tasks, leases func(*gorm.DB) *gorm.DB) (int64, error) {
+	now := time.Now().UTC()
+
+	var requeued int64
+	err := s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		n, err := requeueLeased(tx, reason, now, tasks)
+		if err != nil {
+			return err
+		}
+		released, err := releaseReplicas(tx, reason, now, leases)
+		requeued = n + released
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return requeued, nil
+}
+
+// requeueLeased puts the selected in_progress tasks back to pending and
+// records the failed attempt in their timelines
+func requeueLeased(tx *gorm.DB, reason string, now time.Time, scope func(*gorm.DB) *gorm.DB) (int64, error) {
+	var tasks []models.Task
+	err := scope(tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"})).
+		Where("replicas <= 1").
+		Select("id", "expression_id", "agent_id").
+		Find(&tasks).Error
+	if err != nil || len(tasks) == 0 {
+		return 0, err
+	}
+
+	ids := make([]uint, len(tasks))
+	var events []models.ExpressionEvent
+	for i, task := range tasks {
+		ids[i] = task.ID
+		events = append(events, storage.RequeueEvents(task, reason, now)...)
+	}
+
+	err = tx.Model(&models.Task{}).Where("id IN ?", ids).Updates(map[string]interface{}{
+		"status":           "pending",
+		"lease_expires_at": nil,
+		"agent_id":         "",
+		"queued_at":        now,
+		"failed_at":        now,
+	}).Error
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(tasks)), logEvents(tx, events)
+}
+
+// releaseReplicas drops the selected replica leases and records the failed
+// attempts, tasks no agent holds any more go back to pending. The tasks are
+// locked before their leases like CompleteTask does.
+func releaseReplicas(tx *gorm.DB, reason string, now time.Time, scope func(*gorm.DB) *gorm.DB) (int64, error) {
+	var ids []uint
+	if err := scope(tx.Model(&models.ReplicaLease{})).Distinct().Pluck("task_id", &ids).Error; err != nil || len(ids) == 0 {
+		return 0, err
+	}
+
+	var tasks []models.Task
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+		Where("id IN ? AND status = ?", ids, "in_progress").
+		Select("id", "expression_id").
+		Find(&tasks).Error
+	if err != nil || len(tasks) == 0 {
+		return 0, err
+	}
+
+	locked := make(map[uint]models.Task, len(tasks))
+	ids = ids[:0]
+	for _, task := range tasks {
+		locked[task.ID] = task
+		ids = append(ids, task.ID)
+	}
+
+	var leases []models.ReplicaLease
+	err = scope(tx.Clauses(clause.Locking{Strength: "UPDATE"})).Where("task_id IN ?", ids).Find(&leases).Error
+	if err != nil || len(leases) == 0 {
+		return 0, err
+	}
+
+	var events []models.ExpressionEvent
+	for _, lease := range leases {
+		err := tx.Where("task_id = ? AND agent_id = ?", lease.TaskID, lease.AgentID).Delete(&models.ReplicaLease{}).Error
+		if err != nil {
+			return 0, err
+		}
+		task := locked[lease.TaskID]
+		task.AgentID = lease.AgentID
+		events = append(events, storage.FailureEvent(task, reason, now))
+	}
+
+	var held []uint
+	if err := tx.Model(&models.ReplicaLease{}).Where("task_id IN ?", ids).Distinct().Pluck("task_id", &held).Error; err != nil {
+		return 0, err
+	}
+	var idle []uint
+	for _, task := range tasks {
+		if !slices.Contains(held, task.ID) {
+			idle = append(idle, task.ID)
+			events = append(events, storage.QueueEvent(task, now))
+		}
+	}
+
+	if err := tx.Model(&models.Task{}).Where("id IN ?", ids).Update("failed_at", now).Error; err != nil {
+		return 0, err
+	}
+	if len(idle) > 0 {
+		err := tx.Model(&models.Task{}).Where("id IN ?", idle).Updates(map[string]interface{}{
+			"status":    "pending",
+			"queued_at": now,
+		}).Error
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return int64(len(leases)), logEvents(tx, events)
+}
+
+// QueueDepth ...
+func (s *Storage) QueueDepth(ctx context.Context) (storage.QueueDepth, error) {
+	const op string = "db.QueueDepth"
+
+	var rows []struct {
+		Status string
+		Count  int
+		Work   int64
+	}
+	err := s.DB.WithContext(ctx).Model(&models.Task{}).
+		Select("status, COUNT(*) AS count, COALESCE(SUM(operation_time), 0) AS work").
+		Where("status IN ?", []string{"pending", "in_progress"}).
+		Group("status").
+		Scan(&rows).Error
+	if err != nil {
+		return storage.QueueDepth{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var depth storage.QueueDepth
+	for _, row := range rows {
+		switch row.Status {
+		case "pending":
+			depth.Pending = row.Count
+			depth.PendingWorkMS = row.Work
+		case "in_progress":
+			depth.Running = row.Count
+		}
+	}
+
+	return depth, nil
+}
+
+// LeasedTasks ...
+func (s *Storage) LeasedTasks(ctx context.Context) ([]models.Task, error) {
+	const op string = "db.LeasedTasks"
+
+	tasks, err := leasedTasks(s.DB.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return tasks, nil
+}
+
+// leasedTasks returns the in_progress tasks, a replicated one once for
+// each of its replica leases
+func leasedTasks(db *gorm.DB) ([]models.Task, error) {
+	var tasks []models.Task
+	if err := db.Where("status = ? AND replicas <= 1", "in_progress").Find(&tasks).Error; err != nil {
+		return nil, err
+	}
+
+	var leases []models.ReplicaLease
+	if err := db.Order("task_id, agent_id").Find(&leases).Error; err != nil {
+		return nil, err
+	}
+	if len(leases) > 0 {
+		ids := make([]uint, len(leases))
+		for i, lease := range leases {
+			ids[i] = lease.TaskID
+		}
+		var replicated []models.Task
+		if err := db.Where("id IN ?", ids).Find(&replicated).Error; err != nil {
+			return nil, err
+		}
+		byID := make(map[uint]models.Task, len(replicated))
+		for _, task := range replicated {
+			byID[task.ID] = task
+		}
+		for _, lease := range leases {
+			if task, ok := byID[lease.TaskID]; ok {
+				tasks = append(tasks, storage.ReplicaTask(task, lease))
+			}
+		}
+	}
+	slices.SortStableFunc(tasks, func(a, b models.Task) int { return cmp.Compare(a.ID, b.ID) })
+
+	return tasks, nil
+}
+
+// QueueStats ...
+func (s *Storage) QueueStats(ctx context.Context, query storage.QueueStatsQuery) (storage.QueueStats, error) {
+	const op string = "db.QueueStats"
+
+	db := s.DB.WithContext(ctx)
+	unfinished := []string{"pending", "in_progress"}
+
+	var stats storage.QueueStats
+	err := db.Model(&models.Task{}).
+		Select("status, operation, COUNT(*) AS count").
+		Group("status, operation").
+		Order("status, operation").
+		Scan(&stats.Counts).Error
+	if err != nil {
+		return storage.QueueStats{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var oldest models.Task
+	err = db.Where("status = ?", "pending").Order("queued_at, id").Limit(1).Find(&oldest).Error
+	if err != nil {
+		return storage.QueueStats{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if oldest.ID != 0 {
+		stats.OldestPending = &oldest
+	}
+
+	// at most a batch per agent is in progress, grouping them here keeps
+	// the timestamps out of SQL aggregates that sqlite returns as text
+	leased, err := leasedTasks(db)
+	if err != nil {
+		return storage.QueueStats{}, fmt.Errorf("%s: %w", op, err)
+	}
+	stats.Leases = storage.LeaseHolders(leased)
+
+	backlog := db.Model(&models.Task{}).
+		Select("user_id, "+
+			"SUM(CASE WHEN status = 'pending' THEN 1 ELSE 0 END) AS pending, "+
+			"SUM(CASE WHEN status = 'in_progress' THEN 1 ELSE 0 END) AS running").
+		Where("status IN ?", unfinished).
+		Group("user_id").
+		Order("pending DESC, user_id")
+	if query.Users > 0 {
+		backlog = backlog.Limit(query.Users)
+	}
+	if err := backlog.Scan(&stats.Backlog).Error; err != nil {
+		return storage.QueueStats{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if query.Minutes > 0 {
+		stats.Throughput, err = s.throughput(ctx, query.Now.UTC().Truncate(time.Minute).Add(time.Minute), query.Minutes)
+		if err != nil {
+			return storage.QueueStats{}, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	return stats, nil
+}
+
+// throughput counts the tasks completed in each of the minutes before end
+// in one pass over the window
+func (s *Storage) throughput(ctx context.Context, end time.Time, minutes int) ([]int, error) {
+	start := end.Add(-time.Duration(minutes) * time.Minute)
+
+	columns := make([]string, minutes)
+	args := make([]interface{}, 0, 2*minutes+2)
+	for i := range minutes {
+		from := start.Add(time.Duration(i) * time.Minute)
+		columns[i] = "COALESCE(SUM(CASE WHEN completed_at >= ? AND completed_at < ? THEN 1 ELSE 0 END), 0)"
+		args = append(args, from, from.Add(time.Minute))
+	}
+	args = append(args, "completed", start)
+
+	row := s.DB.WithContext(ctx).Raw(
+		"SELECT "+strings.Join(columns, ", ")+" FROM tasks WHERE status = ? AND completed_at >= ?",
+		args...,
+	).Row()
+
+	counts := make([]int, minutes)
+	dest := make([]interface{}, minutes)
+	for i := range counts {
+		dest[i] = &counts[i]
+	}
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+// RequeueTasks ...
+func (s *Storage) RequeueTasks(ctx context.Context, ids []uint, reason string) (int64, error) {
+	const op string = "db.RequeueTasks"
+
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	requeued, err := s.requeueTasks(ctx, reason, func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("status = ? AND id IN ?", "in_progress", ids)
+	}, func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("task_id IN ?", ids)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return requeued, nil
+}
+
+// PrioritizeTask ...
+func (s *Storage) PrioritizeTask(ctx context.Context, id uint, class string, priority int) (models.Task, error) {
+	const op string = "db.PrioritizeTask"
+
+	var task models.Task
+	err := s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&task, id).Error; err != nil {
+			return err
+		}
+		if task.Status != "pending" && task.Status != "in_progress" {
+			return storage.ErrTaskFinished
+		}
+
+		task.Class = class
+		task.Priority = priority
+		return tx.Model(&task).Updates(map[string]interface{}{
+			"class":    class,
+			"priority": priority,
+		}).Error
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return models.Task{}, fmt.Errorf("%s: %w", op, storage.ErrTaskNotFound)
+		}
+		return models.Task{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return task, nil
+}
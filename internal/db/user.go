@@ -12,13 +12,6 @@ import (
 	"github.com/nais2008/final_project_go_yandex/internal/storage"
 )
 
-var (
-	// ErrUserEmailExists ...
-	ErrUserEmailExists  = errors.New("user with this email already exists")
-	// ErrUsernameExists ...
-	ErrUsernameExists   = errors.New("user with this username already exists")
-)
-
 // SaveUser ...
 func (s *Storage) SaveUser(
 	ctx context.Context,
@@ -38,10 +31,10 @@ func (s *Storage) SaveUser(
 
 	if res.Error != nil {
 		if isDuplicateError(res.Error, "email") {
-			return 0, fmt.Errorf("%s: %w", op, ErrUserEmailExists)
+			return 0, fmt.Errorf("%s: %w", op, storage.ErrUserEmailExists)
 		}
 		if isDuplicateError(res.Error, "username") {
-			return 0, fmt.Errorf("%s: %w", op, ErrUsernameExists)
+			return 0, fmt.Errorf("%s: %w", op, storage.ErrUsernameExists)
 		}
 		return 0, fmt.Errorf("%s: %w", op, res.Error)
 	}
@@ -69,7 +62,7 @@ func (s *Storage) User(
 	).First(&user).Error
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return models.User{}, fmt.Errorf("%s: %w", op, storage.ErrExpressionNotFound)
+			return models.User{}, fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
 		}
 		return models.User{}, fmt.Errorf("%s: %w", op, err)
 	}
@@ -0,0 +1,235 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+)
+
+// CreateWebhook ...
+func (s *Storage) CreateWebhook(ctx context.Context, hook *models.Webhook) error {
+	const op string = "db.CreateWebhook"
+
+	hook.CreatedAt = time.Now().UTC()
+	if err := s.DB.WithContext(ctx).Create(hook).Error; err != nil {
+		if isDuplicateError(err, "url") {
+			return fmt.Errorf("%s: %w", op, storage.ErrWebhookExists)
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// Webhooks ...
+func (s *Storage) Webhooks(ctx context.Context, userID uint) ([]models.Webhook, error) {
+	const op string = "db.Webhooks"
+
+	var hooks []models.Webhook
+	if err := s.DB.WithContext(ctx).Where("user_id = ?", userID).Order("id").Find(&hooks).Error; err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return hooks, nil
+}
+
+// DeleteWebhook ...
+func (s *Storage) DeleteWebhook(ctx context.Context, userID, id uint) error {
+	const op string = "db.DeleteWebhook"
+
+	res := s.DB.WithContext(ctx).Where("id = ? AND user_id = ?", id, userID).Delete(&models.Webhook{})
+	if res.Error != nil {
+		return fmt.Errorf("%s: %w", op, res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrWebhookNotFound)
+	}
+
+	return nil
+}
+
+// EnsureWebhookSecret ...
+func (s *Storage) EnsureWebhookSecret(ctx context.Context, userID uint, candidate string) (string, error) {
+	const op string = "db.EnsureWebhookSecret"
+
+	secret := models.WebhookSecret{UserID: userID, Secret: candidate, CreatedAt: time.Now().UTC()}
+	err := s.DB.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&secret).Error
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := s.DB.WithContext(ctx).First(&secret, "user_id = ?", userID).Error; err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	return secret.Secret, nil
+}
+
+// SetWebhookSecret ...
+func (s *Storage) SetWebhookSecret(ctx context.Context, userID uint, secret string) error {
+	const op string = "db.SetWebhookSecret"
+
+	row := models.WebhookSecret{UserID: userID, Secret: secret, CreatedAt: time.Now().UTC()}
+	err := s.DB.WithContext(ctx).Clauses(clause.OnConflict{UpdateAll: true}).Create(&row).Error
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// EnqueueWebhookDeliveries ...
+func (s *Storage) EnqueueWebhookDeliveries(ctx context.Context, deliveries []models.WebhookDelivery) error {
+	const op string = "db.EnqueueWebhookDeliveries"
+
+	for _, delivery := range deliveries {
+		delivery.CreatedAt = delivery.CreatedAt.UTC()
+		if delivery.NextAttemptAt != nil {
+			next := delivery.NextAttemptAt.UTC()
+			delivery.NextAttemptAt = &next
+		}
+
+		err := s.DB.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&delivery).Error
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	return nil
+}
+
+// ClaimWebhookDeliveries ...
+func (s *Storage) ClaimWebhookDeliveries(
+	ctx context.Context,
+	now, leaseUntil time.Time,
+	limit int,
+) ([]models.WebhookDelivery, error) {
+	const op string = "db.ClaimWebhookDeliveries"
+
+	var deliveries []models.WebhookDelivery
+	err := s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND next_attempt_at <= ?", models.DeliveryPending, now.UTC()).
+			Order("next_attempt_at, id").
+			Limit(limit).
+			Find(&deliveries).Error
+		if err != nil || len(deliveries) == 0 {
+			return err
+		}
+
+		ids := make([]uint, len(deliveries))
+		for i := range deliveries {
+			ids[i] = deliveries[i].ID
+		}
+		return tx.Model(&models.WebhookDelivery{}).Where("id IN ?", ids).
+			Update("next_attempt_at", leaseUntil.UTC()).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return deliveries, nil
+}
+
+// RecordWebhookAttempt ...
+func (s *Storage) RecordWebhookAttempt(
+	ctx context.Context,
+	attempt models.WebhookAttempt,
+	status string,
+	nextAttemptAt *time.Time,
+) error {
+	const op string = "db.RecordWebhookAttempt"
+
+	attempt.At = attempt.At.UTC()
+	var next interface{}
+	if nextAttemptAt != nil {
+		next = nextAttemptAt.UTC()
+	}
+
+	err := s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&attempt).Error; err != nil {
+			return err
+		}
+
+		res := tx.Model(&models.WebhookDelivery{}).Where("id = ?", attempt.DeliveryID).Updates(map[string]interface{}{
+			"status":             status,
+			"attempts":           attempt.Attempt,
+			"next_attempt_at":    next,
+			"last_response_code": attempt.ResponseCode,
+			"last_error":         attempt.Error,
+		})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return storage.ErrDeliveryNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// WebhookDeliveries ...
+func (s *Storage) WebhookDeliveries(ctx context.Context, userID, expressionID uint, limit int) ([]models.WebhookDelivery, error) {
+	const op string = "db.WebhookDeliveries"
+
+	query := s.DB.WithContext(ctx).Where("user_id = ?", userID)
+	if expressionID != 0 {
+		query = query.Where("expression_id = ?", expressionID)
+	}
+
+	var deliveries []models.WebhookDelivery
+	if err := query.Order("id DESC").Limit(limit).Find(&deliveries).Error; err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return deliveries, nil
+}
+
+// WebhookDelivery ...
+func (s *Storage) WebhookDelivery(ctx context.Context, id uint) (models.WebhookDelivery, error) {
+	const op string = "db.WebhookDelivery"
+
+	var delivery models.WebhookDelivery
+	err := s.DB.WithContext(ctx).
+		Preload("AttemptLog", func(tx *gorm.DB) *gorm.DB { return tx.Order("id") }).
+		First(&delivery, id).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return models.WebhookDelivery{}, fmt.Errorf("%s: %w", op, storage.ErrDeliveryNotFound)
+		}
+		return models.WebhookDelivery{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return delivery, nil
+}
+
+// RedeliverWebhook ...
+func (s *Storage) RedeliverWebhook(ctx context.Context, id uint, now time.Time) error {
+	const op string = "db.RedeliverWebhook"
+
+	res := s.DB.WithContext(ctx).Model(&models.WebhookDelivery{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"status":          models.DeliveryPending,
+		"attempts":        0,
+		"next_attempt_at": now.UTC(),
+	})
+	if res.Error != nil {
+		return fmt.Errorf("%s: %w", op, res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrDeliveryNotFound)
+	}
+
+	return nil
+}
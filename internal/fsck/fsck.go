@@ -0,0 +1,234 @@
+// Package fsck finds rows of the storage that disagree with each other
+package fsck
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+	"github.com/nais2008/final_project_go_yandex/internal/parser"
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+)
+
+// kinds of problems
+const (
+	// KindOrphanTask is a task whose expression does not exist, repaired by
+	// deleting the task
+	KindOrphanTask = "orphan_task"
+	// KindOrphanExpression is an expression whose user does not exist,
+	// repaired by deleting it with its tasks
+	KindOrphanExpression = "orphan_expression"
+	// KindUnfinishedTask is a pending or in_progress task of a finished
+	// expression, repaired by cancelling it
+	KindUnfinishedTask = "unfinished_task"
+	// KindStrayResult is a result on a task that is not completed,
+	// repaired by clearing it
+	KindStrayResult = "stray_result"
+	// KindWrongResult is a completed expression whose result is missing or
+	// disagrees with parser.Solve, repaired by storing the recomputed
+	// result or failing the expression when it cannot be computed
+	KindWrongResult = "wrong_result"
+)
+
+// DefaultTolerance is the relative difference allowed between a stored
+// result and the recomputed one
+const DefaultTolerance = 1e-9
+
+// scanBatch is the number of expressions read at once
+const scanBatch = 500
+
+// Problem ...
+type Problem struct {
+	Kind         string
+	ExpressionID uint
+	// TaskID is 0 for problems of the expression itself
+	TaskID   uint
+	Detail   string
+	Repaired bool
+}
+
+func (p Problem) String() string {
+	subject := fmt.Sprintf("expression %d", p.ExpressionID)
+	if p.TaskID != 0 {
+		subject = fmt.Sprintf("task %d of expression %d", p.TaskID, p.ExpressionID)
+	}
+
+	s := fmt.Sprintf("%-17s %s: %s", p.Kind, subject, p.Detail)
+	if p.Repaired {
+		s += " (repaired)"
+	}
+	return s
+}
+
+// Options ...
+type Options struct {
+	// Repair fixes every problem found
+	Repair bool
+	// Tolerance defaults to DefaultTolerance
+	Tolerance float64
+}
+
+// Check scans st and returns the problems found, it stops at the first
+// storage error
+func Check(ctx context.Context, st storage.Checker, opts Options) ([]Problem, error) {
+	const op string = "fsck.Check"
+
+	if opts.Tolerance <= 0 {
+		opts.Tolerance = DefaultTolerance
+	}
+	c := checker{st: st, opts: opts}
+
+	if err := c.orphans(ctx); err != nil {
+		return c.problems, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var after uint
+	for {
+		exprs, err := st.ScanExpressions(ctx, after, scanBatch)
+		if err != nil {
+			return c.problems, fmt.Errorf("%s: %w", op, err)
+		}
+		for _, expr := range exprs {
+			if err := c.expression(ctx, expr); err != nil {
+				return c.problems, fmt.Errorf("%s: %w", op, err)
+			}
+			after = expr.ID
+		}
+		if len(exprs) < scanBatch {
+			return c.problems, nil
+		}
+	}
+}
+
+type checker struct {
+	st       storage.Checker
+	opts     Options
+	problems []Problem
+}
+
+func (c *checker) orphans(ctx context.Context) error {
+	tasks, err := c.st.OrphanTasks(ctx)
+	if err != nil {
+		return err
+	}
+	ids := make([]uint, len(tasks))
+	for i, task := range tasks {
+		ids[i] = task.ID
+	}
+	if c.opts.Repair {
+		if err := c.st.DeleteTasks(ctx, ids); err != nil {
+			return err
+		}
+	}
+	for _, task := range tasks {
+		c.add(Problem{Kind: KindOrphanTask, ExpressionID: task.ExpressionID, TaskID: task.ID, Detail: "expression does not exist"})
+	}
+
+	exprs, err := c.st.OrphanExpressions(ctx)
+	if err != nil {
+		return err
+	}
+	ids = make([]uint, len(exprs))
+	for i, expr := range exprs {
+		ids[i] = expr.ID
+	}
+	if c.opts.Repair {
+		if err := c.st.DeleteExpressions(ctx, ids); err != nil {
+			return err
+		}
+	}
+	for _, expr := range exprs {
+		c.add(Problem{Kind: KindOrphanExpression, ExpressionID: expr.ID, Detail: fmt.Sprintf("user %d does not exist", expr.UserID)})
+	}
+
+	return nil
+}
+
+func (c *checker) expression(ctx context.Context, expr models.Expression) error {
+	for _, task := range expr.Tasks {
+		if err := c.task(ctx, expr, task); err != nil {
+			return err
+		}
+	}
+
+	if expr.Status != "completed" {
+		return nil
+	}
+
+	solved, err := parser.Solve(expr.Expr)
+	switch {
+	case err != nil:
+		return c.repairExpression(ctx, Problem{
+			Kind:         KindWrongResult,
+			ExpressionID: expr.ID,
+			Detail:       fmt.Sprintf("completed but the parser fails: %v", err),
+		}, "error", nil)
+	case expr.Result == nil:
+		return c.repairExpression(ctx, Problem{
+			Kind:         KindWrongResult,
+			ExpressionID: expr.ID,
+			Detail:       fmt.Sprintf("completed without a result, the parser gives %g", solved),
+		}, "completed", &solved)
+	case !parser.Agree(*expr.Result, solved, c.opts.Tolerance):
+		return c.repairExpression(ctx, Problem{
+			Kind:         KindWrongResult,
+			ExpressionID: expr.ID,
+			Detail:       fmt.Sprintf("stored result %g, the parser gives %g", *expr.Result, solved),
+		}, "completed", &solved)
+	}
+
+	return nil
+}
+
+func (c *checker) task(ctx context.Context, expr models.Expression, task models.Task) error {
+	status, result := task.Status, task.Result
+
+	var found []Problem
+	unfinished := task.Status == "pending" || task.Status == "in_progress"
+	if unfinished && storage.IsFinished(expr.Status) {
+		found = append(found, Problem{
+			Kind:         KindUnfinishedTask,
+			ExpressionID: expr.ID,
+			TaskID:       task.ID,
+			Detail:       fmt.Sprintf("task is %s but the expression is %s", task.Status, expr.Status),
+		})
+		status = "cancelled"
+	}
+	if task.Status != "completed" && task.Result != nil {
+		found = append(found, Problem{
+			Kind:         KindStrayResult,
+			ExpressionID: expr.ID,
+			TaskID:       task.ID,
+			Detail:       fmt.Sprintf("%s task has result %g", task.Status, *task.Result),
+		})
+		result = nil
+	}
+	if len(found) == 0 {
+		return nil
+	}
+
+	if c.opts.Repair {
+		if err := c.st.RepairTask(ctx, task.ID, status, result); err != nil {
+			return err
+		}
+	}
+	for _, problem := range found {
+		c.add(problem)
+	}
+	return nil
+}
+
+func (c *checker) repairExpression(ctx context.Context, problem Problem, status string, result *float64) error {
+	if c.opts.Repair {
+		if err := c.st.RepairExpression(ctx, problem.ExpressionID, status, result); err != nil {
+			return err
+		}
+	}
+	c.add(problem)
+	return nil
+}
+
+func (c *checker) add(problem Problem) {
+	problem.Repaired = c.opts.Repair
+	c.problems = append(c.problems, problem)
+}
@@ -0,0 +1,107 @@
+package fsck_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nais2008/final_project_go_yandex/internal/fsck"
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+	"github.com/nais2008/final_project_go_yandex/internal/storage/memory"
+	"github.com/nais2008/final_project_go_yandex/internal/storage/storagetest"
+)
+
+func ptr(f float64) *float64 { return &f }
+
+func save(t *testing.T, st *memory.Storage, expr models.Expression) uint {
+	require.NoError(t, st.CreateExpression(context.Background(), &expr))
+	return expr.ID
+}
+
+func kinds(problems []fsck.Problem) map[string]uint {
+	found := map[string]uint{}
+	for _, p := range problems {
+		found[p.Kind] = p.ExpressionID
+	}
+	return found
+}
+
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+	st := memory.New()
+	user := storagetest.NewUser(t, st, "alice")
+
+	save(t, st, models.Expression{Expr: "1 + 1", Status: "completed", Result: ptr(2), UserID: user, Tasks: []models.Task{
+		{Arg1: 1, Arg2: ptr(1), Operation: "+", Status: "completed", Result: ptr(2)},
+	}})
+	wrong := save(t, st, models.Expression{Expr: "2 * 3", Status: "completed", Result: ptr(7), UserID: user})
+	unfinished := save(t, st, models.Expression{Expr: "4 - 1", Status: "cancelled", UserID: user, Tasks: []models.Task{
+		{Arg1: 4, Arg2: ptr(1), Operation: "-", Status: "pending"},
+	}})
+	stray := save(t, st, models.Expression{Expr: "5 + 5", Status: "in_progress", UserID: user, Tasks: []models.Task{
+		{Arg1: 5, Arg2: ptr(5), Operation: "+", Status: "pending", Result: ptr(10)},
+	}})
+	orphan := save(t, st, models.Expression{Expr: "1 + 2", Status: "in_progress", UserID: 999})
+
+	want := map[string]uint{
+		fsck.KindWrongResult:      wrong,
+		fsck.KindUnfinishedTask:   unfinished,
+		fsck.KindStrayResult:      stray,
+		fsck.KindOrphanExpression: orphan,
+	}
+
+	problems, err := fsck.Check(ctx, st, fsck.Options{})
+	require.NoError(t, err)
+	assert.Equal(t, want, kinds(problems))
+	for _, p := range problems {
+		assert.False(t, p.Repaired, p)
+	}
+
+	expr, err := st.Expression(ctx, wrong)
+	require.NoError(t, err)
+	assert.Equal(t, 7.0, *expr.Result)
+
+	problems, err = fsck.Check(ctx, st, fsck.Options{Repair: true})
+	require.NoError(t, err)
+	assert.Equal(t, want, kinds(problems))
+	for _, p := range problems {
+		assert.True(t, p.Repaired, p)
+	}
+
+	problems, err = fsck.Check(ctx, st, fsck.Options{})
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+
+	expr, err = st.Expression(ctx, wrong)
+	require.NoError(t, err)
+	assert.Equal(t, 6.0, *expr.Result)
+
+	expr, err = st.Expression(ctx, unfinished)
+	require.NoError(t, err)
+	assert.Equal(t, "cancelled", expr.Tasks[0].Status)
+
+	expr, err = st.Expression(ctx, stray)
+	require.NoError(t, err)
+	assert.Equal(t, "pending", expr.Tasks[0].Status)
+	assert.Nil(t, expr.Tasks[0].Result)
+
+	_, err = st.Expression(ctx, orphan)
+	assert.Error(t, err)
+}
+
+func TestCheck_Tolerance(t *testing.T) {
+	ctx := context.Background()
+	st := memory.New()
+	user := storagetest.NewUser(t, st, "alice")
+	save(t, st, models.Expression{Expr: "1 / 3", Status: "completed", Result: ptr(0.3333), UserID: user})
+
+	problems, err := fsck.Check(ctx, st, fsck.Options{})
+	require.NoError(t, err)
+	assert.Len(t, problems, 1)
+
+	problems, err = fsck.Check(ctx, st, fsck.Options{Tolerance: 1e-3})
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+}
@@ -0,0 +1,116 @@
+package leader
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+)
+
+// LockKey is the advisory lock key held by the leading orchestrator
+const LockKey int64 = 0x6c656164
+
+// Duty is a background job that runs on the leader only
+type Duty struct {
+	Name     string
+	Interval time.Duration
+	Run      func(ctx context.Context) error
+}
+
+// Elector competes for leadership through a storage lock and runs the
+// duties while it leads; every other instance keeps retrying so one of
+// them takes over when the leader dies
+type Elector struct {
+	locker storage.Locker
+	key    int64
+	retry  time.Duration
+	duties []Duty
+	leader atomic.Bool
+}
+
+// New ...
+func New(locker storage.Locker, key int64, retry time.Duration, duties ...Duty) *Elector {
+	return &Elector{locker: locker, key: key, retry: retry, duties: duties}
+}
+
+// IsLeader ...
+func (e *Elector) IsLeader() bool {
+	return e.leader.Load()
+}
+
+// Run campaigns for leadership until ctx is cancelled
+func (e *Elector) Run(ctx context.Context) {
+	for {
+		lock, err := e.locker.TryLock(ctx, e.key)
+		switch {
+		case err == nil:
+			log.Printf("Became leader, running %d background duties", len(e.duties))
+			e.lead(ctx, lock)
+			log.Printf("Stepped down as leader")
+		case !errors.Is(err, storage.ErrLockHeld) && ctx.Err() == nil:
+			log.Printf("Leader election failed: %v", err)
+		}
+
+		select {
+		case <-time.After(e.retry):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (e *Elector) lead(ctx context.Context, lock storage.Lock) {
+	dutyCtx, cancel := context.WithCancel(ctx)
+	e.leader.Store(true)
+
+	var wg sync.WaitGroup
+	for _, duty := range e.duties {
+		wg.Add(1)
+		go func(duty Duty) {
+			defer wg.Done()
+			runDuty(dutyCtx, duty)
+		}(duty)
+	}
+
+	select {
+	case <-lock.Lost():
+		log.Printf("Leader lock lost")
+	case <-ctx.Done():
+	}
+
+	cancel()
+	wg.Wait()
+	e.leader.Store(false)
+
+	if err := lock.Release(); err != nil {
+		log.Printf("Failed to release leader lock: %v", err)
+	}
+}
+
+// runDuty runs the duty right away and then every Interval, a duty
+// without a positive Interval is disabled
+func runDuty(ctx context.Context, duty Duty) {
+	if duty.Interval <= 0 {
+		log.Printf("Duty %q is disabled, interval %v", duty.Name, duty.Interval)
+		return
+	}
+
+	ticker := time.NewTicker(duty.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := duty.Run(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Duty %q failed: %v", duty.Name, err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package leader
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+)
+
+func countingDuty(runs *atomic.Int32) Duty {
+	return Duty{
+		Name:     "count",
+		Interval: time.Millisecond,
+		Run: func(ctx context.Context) error {
+			runs.Add(1)
+			return nil
+		},
+	}
+}
+
+func TestElector_OnlyOneLeader(t *testing.T) {
+	var locker storage.LocalLocker
+	var firstRuns, secondRuns atomic.Int32
+
+	first := New(&locker, LockKey, time.Millisecond, countingDuty(&firstRuns))
+	second := New(&locker, LockKey, time.Millisecond, countingDuty(&secondRuns))
+
+	ctx1, stop1 := context.WithCancel(context.Background())
+	defer stop1()
+	go first.Run(ctx1)
+	assert.Eventually(t, first.IsLeader, time.Second, time.Millisecond)
+
+	ctx2, stop2 := context.WithCancel(context.Background())
+	defer stop2()
+	go second.Run(ctx2)
+
+	time.Sleep(20 * time.Millisecond)
+	assert.False(t, second.IsLeader())
+	assert.Zero(t, secondRuns.Load())
+	assert.NotZero(t, firstRuns.Load())
+
+	// the first instance goes away, the second one takes over
+	stop1()
+	assert.Eventually(t, second.IsLeader, time.Second, time.Millisecond)
+	assert.Eventually(t, func() bool { return secondRuns.Load() > 0 }, time.Second, time.Millisecond)
+	assert.False(t, first.IsLeader())
+}
+
+func TestElector_SkipsDisabledDuty(t *testing.T) {
+	var locker storage.LocalLocker
+	var disabledRuns, runs atomic.Int32
+	disabled := countingDuty(&disabledRuns)
+	disabled.Interval = 0
+
+	elector := New(&locker, LockKey, time.Millisecond, disabled, countingDuty(&runs))
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go elector.Run(ctx)
+
+	assert.Eventually(t, func() bool { return runs.Load() > 1 }, time.Second, time.Millisecond)
+	assert.True(t, elector.IsLeader())
+	assert.Zero(t, disabledRuns.Load())
+}
@@ -1,17 +1,18 @@
 package middleware
 
 import (
+	"errors"
 	"net/http"
 	"strings"
 
 	"github.com/labstack/echo/v4"
 
-	"github.com/nais2008/final_project_go_yandex/internal/db"
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
 	"github.com/nais2008/final_project_go_yandex/internal/utils"
 )
 
 // AuthMiddleware ...
-func AuthMiddleware(storage *db.Storage) echo.MiddlewareFunc {
+func AuthMiddleware(users storage.Users) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 			authHeader := c.Request().Header.Get("Authorization")
@@ -24,7 +25,7 @@ func AuthMiddleware(storage *db.Storage) echo.MiddlewareFunc {
 				return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid token"})
 			}
 
-			user, err := storage.User(c.Request().Context(), claims.Login)
+			user, err := users.User(c.Request().Context(), claims.Login)
 			if err != nil {
 				return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid user"})
 			}
@@ -35,3 +36,34 @@ func AuthMiddleware(storage *db.Storage) echo.MiddlewareFunc {
 		}
 	}
 }
+
+// agentIDHeader names the agent making the request
+const agentIDHeader = "X-Agent-ID"
+
+// AgentAuthMiddleware lets through agents that send their id in X-Agent-ID
+// and the token issued to it as a bearer token, the id is then in agent_id
+func AgentAuthMiddleware(agents storage.Agents) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			agentID := c.Request().Header.Get(agentIDHeader)
+			authHeader := c.Request().Header.Get("Authorization")
+			if agentID == "" || !strings.HasPrefix(authHeader, "Bearer ") {
+				return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+			}
+
+			credential, err := agents.AgentCredential(c.Request().Context(), agentID)
+			if err != nil {
+				if errors.Is(err, storage.ErrCredentialNotFound) {
+					return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unknown agent"})
+				}
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch agent credential"})
+			}
+			if !utils.CompareAgentToken(credential.TokenHash, strings.TrimPrefix(authHeader, "Bearer ")) {
+				return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid token"})
+			}
+
+			c.Set("agent_id", agentID)
+			return next(c)
+		}
+	}
+}
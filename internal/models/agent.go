@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// Agent ...
+type Agent struct {
+	ID         string    `gorm:"primaryKey"`
+	Workers    int       `gorm:"not null;default:0"`
+	Status     string    `gorm:"not null"`
+	LastSeenAt time.Time `gorm:"not null"`
+	// Disagreements counts votes the agent lost, a Quarantined agent gets
+	// no tasks
+	Disagreements int  `gorm:"not null;default:0"`
+	Quarantined   bool `gorm:"not null;default:false"`
+}
+
+// AgentCredential is the token an agent authenticates with, only its
+// SHA-256 is kept
+type AgentCredential struct {
+	AgentID   string    `gorm:"primaryKey"`
+	TokenHash string    `gorm:"not null"`
+	CreatedAt time.Time `gorm:"not null"`
+}
@@ -0,0 +1,30 @@
+package models
+
+import "time"
+
+// expression and task transitions recorded in the timeline
+const (
+	EventCreated   = "created"
+	EventQueued    = "queued"
+	EventLeased    = "leased"
+	EventStarted   = "started"
+	EventCompleted = "completed"
+	EventFailed    = "failed"
+	EventStatus    = "status"
+	EventCancelled = "cancelled"
+	EventVerified  = "verified"
+	EventVoted     = "voted"
+)
+
+// ExpressionEvent is one entry of the expression transition log,
+// TaskID is nil for events of the expression itself
+type ExpressionEvent struct {
+	ID           uint `gorm:"primaryKey"`
+	ExpressionID uint `gorm:"not null"`
+	TaskID       *uint
+	Type         string    `gorm:"not null"`
+	Status       string    `gorm:"not null"`
+	AgentID      string    `gorm:"not null"`
+	Detail       string    `gorm:"not null"`
+	At           time.Time `gorm:"not null"`
+}
@@ -1,5 +1,7 @@
 package models
 
+import "time"
+
 // Expression ...
 type Expression struct {
 	ID          uint     `gorm:"primaryKey"`
@@ -9,6 +11,25 @@ type Expression struct {
 	UserID      uint     `gorm:"not null"`
 	User        User     `gorm:"foreignKey:UserID"`
 	Tasks       []Task   `gorm:"foreignKey:ExpressionID;constraint:OnDelete:CASCADE"`
+	CreatedAt   time.Time
+	// FinishedAt is set once the expression is completed or failed
+	FinishedAt *time.Time `gorm:"default:null"`
+	// WebhookURL is notified when this expression finishes
+	WebhookURL string `gorm:"not null;default:''"`
+	// Deadline is when an unfinished expression times out
+	Deadline *time.Time `gorm:"default:null"`
+	// Class is the priority class, Priority orders the user's own expressions
+	Class    string `gorm:"not null"`
+	Priority int    `gorm:"not null"`
+	// Verify asks for the result to be checked against a local evaluation,
+	// Verification is then match, mismatch or error and LocalResult holds
+	// the local value
+	Verify       bool     `gorm:"not null;default:false"`
+	Verification string   `gorm:"not null;default:''"`
+	LocalResult  *float64 `gorm:"default:null"`
+	// Replicas is how many distinct agents compute each task, more than one
+	// makes the result subject to a vote
+	Replicas int `gorm:"not null"`
 }
 
 // Task ...
@@ -23,4 +44,21 @@ type Task struct {
 	Order         int        `gorm:"not null;default:0"`
 	ExpressionID  uint     	 `gorm:"not null"`
 	Expression    Expression `gorm:"foreignKey:ExpressionID"`
+	// LeaseExpiresAt is when an in_progress task goes back to the queue
+	LeaseExpiresAt *time.Time `gorm:"default:null"`
+	AgentID        string     `gorm:"not null;default:''"`
+	CreatedAt      time.Time
+	// QueuedAt is the last time the task became pending
+	QueuedAt    *time.Time `gorm:"default:null"`
+	LeasedAt    *time.Time `gorm:"default:null"`
+	StartedAt   *time.Time `gorm:"default:null"`
+	CompletedAt *time.Time `gorm:"default:null"`
+	// FailedAt is the last time an attempt was abandoned or its lease expired
+	FailedAt *time.Time `gorm:"default:null"`
+	// UserID, Class, Priority and Replicas are copied from the expression
+	// for the scheduler
+	UserID   uint   `gorm:"not null"`
+	Class    string `gorm:"not null"`
+	Priority int    `gorm:"not null"`
+	Replicas int    `gorm:"not null"`
 }
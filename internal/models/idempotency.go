@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// IdempotencyKey remembers a calculation request sent with an
+// Idempotency-Key header so that its retries get the same answer
+type IdempotencyKey struct {
+	UserID      uint   `gorm:"primaryKey"`
+	Key         string `gorm:"primaryKey"`
+	RequestHash string `gorm:"not null"`
+	// StatusCode and ExpressionID stay 0 while the request is handled
+	StatusCode   int       `gorm:"not null"`
+	ExpressionID uint      `gorm:"not null"`
+	CreatedAt    time.Time `gorm:"not null"`
+	ExpiresAt    time.Time `gorm:"not null"`
+}
@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// Quota overrides the default limits of one user, a nil limit keeps the
+// default and 0 lifts it
+type Quota struct {
+	UserID               uint `gorm:"primaryKey"`
+	ExpressionsPerMinute *int
+	ActiveExpressions    *int
+	TasksPerDay          *int
+	UpdatedAt            time.Time `gorm:"not null"`
+}
+
+// TableName ...
+func (Quota) TableName() string {
+	return "quotas"
+}
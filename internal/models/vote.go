@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// TaskVote is the result one agent returned for a replicated task
+type TaskVote struct {
+	ID           uint      `gorm:"primaryKey"`
+	TaskID       uint      `gorm:"not null"`
+	ExpressionID uint      `gorm:"not null"`
+	AgentID      string    `gorm:"not null"`
+	Result       float64   `gorm:"not null"`
+	CreatedAt    time.Time `gorm:"not null"`
+}
+
+// ReplicaLease is the lease of one agent computing a replicated task, the
+// agents of a task work on it at the same time
+type ReplicaLease struct {
+	TaskID         uint      `gorm:"primaryKey;autoIncrement:false"`
+	AgentID        string    `gorm:"primaryKey"`
+	LeasedAt       time.Time `gorm:"not null"`
+	LeaseExpiresAt time.Time `gorm:"not null"`
+}
@@ -0,0 +1,55 @@
+package models
+
+import "time"
+
+// webhook delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+// Webhook is a URL notified about every finished expression of the user
+type Webhook struct {
+	ID        uint      `gorm:"primaryKey"`
+	UserID    uint      `gorm:"not null"`
+	URL       string    `gorm:"not null"`
+	CreatedAt time.Time `gorm:"not null"`
+}
+
+// WebhookSecret signs the webhook payloads of a user
+type WebhookSecret struct {
+	UserID    uint      `gorm:"primaryKey"`
+	Secret    string    `gorm:"not null"`
+	CreatedAt time.Time `gorm:"not null"`
+}
+
+// WebhookDelivery is one notification about an expression for one URL
+type WebhookDelivery struct {
+	ID           uint   `gorm:"primaryKey"`
+	UserID       uint   `gorm:"not null"`
+	ExpressionID uint   `gorm:"not null"`
+	URL          string `gorm:"not null"`
+	Event        string `gorm:"not null"`
+	Payload      string `gorm:"not null"`
+	Status       string `gorm:"not null"`
+	Attempts     int    `gorm:"not null"`
+	// NextAttemptAt is when the sender picks the delivery up, nil once it
+	// succeeded or gave up
+	NextAttemptAt    *time.Time
+	LastResponseCode int              `gorm:"not null"`
+	LastError        string           `gorm:"not null"`
+	CreatedAt        time.Time        `gorm:"not null"`
+	AttemptLog       []WebhookAttempt `gorm:"foreignKey:DeliveryID;constraint:OnDelete:CASCADE"`
+}
+
+// WebhookAttempt records one POST of a delivery
+type WebhookAttempt struct {
+	ID           uint      `gorm:"primaryKey"`
+	DeliveryID   uint      `gorm:"not null"`
+	Attempt      int       `gorm:"not null"`
+	At           time.Time `gorm:"not null"`
+	ResponseCode int       `gorm:"not null"`
+	Error        string    `gorm:"not null"`
+	DurationMS   int64     `gorm:"not null"`
+}
@@ -0,0 +1,149 @@
+package orchestrator
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+)
+
+// admissionRefresh is how long one measurement of the queue is reused
+const admissionRefresh = time.Second
+
+// overloadRetryAfter is suggested when there is no telling how fast the
+// queue drains
+const overloadRetryAfter = 5 * time.Second
+
+type admissionResponse struct {
+	Accepting bool   `json:"accepting"`
+	Reason    string `json:"reason,omitempty"`
+	Pending   int    `json:"pending"`
+	Running   int    `json:"running"`
+	Workers   int    `json:"workers"`
+	// EstimatedWaitMS is omitted while no agent is online
+	EstimatedWaitMS *int64    `json:"estimated_wait_ms,omitempty"`
+	MaxQueueDepth   int       `json:"max_queue_depth"`
+	MaxQueueWaitMS  int       `json:"max_queue_wait_ms"`
+	RetryAfterMS    int64     `json:"retry_after_ms,omitempty"`
+	MeasuredAt      time.Time `json:"measured_at"`
+}
+
+// admit decides whether new work fits into the queue. The estimated wait
+// spreads the pending work over the live workers; without workers it is
+// unknown and only the depth limit applies.
+func admit(depth storage.QueueDepth, workers, maxDepth, maxWaitMS int) admissionResponse {
+	resp := admissionResponse{
+		Accepting:      true,
+		Pending:        depth.Pending,
+		Running:        depth.Running,
+		Workers:        workers,
+		MaxQueueDepth:  maxDepth,
+		MaxQueueWaitMS: maxWaitMS,
+	}
+
+	var perTaskMS int64
+	if depth.Pending > 0 {
+		perTaskMS = depth.PendingWorkMS / int64(depth.Pending)
+	}
+	if workers > 0 {
+		wait := depth.PendingWorkMS / int64(workers)
+		resp.EstimatedWaitMS = &wait
+	}
+
+	switch {
+	case maxDepth > 0 && depth.Pending >= maxDepth:
+		resp.Accepting = false
+		resp.Reason = "Task queue is full"
+		resp.RetryAfterMS = overloadRetryAfter.Milliseconds()
+		if workers > 0 {
+			// until the excess is worked off
+			resp.RetryAfterMS = max(int64(depth.Pending-maxDepth+1)*perTaskMS/int64(workers), resp.RetryAfterMS)
+		}
+	case maxWaitMS > 0 && resp.EstimatedWaitMS != nil && *resp.EstimatedWaitMS > int64(maxWaitMS):
+		resp.Accepting = false
+		resp.Reason = "Estimated queue wait is too long"
+		resp.RetryAfterMS = *resp.EstimatedWaitMS - int64(maxWaitMS)
+	}
+
+	return resp
+}
+
+// admission measures the queue at most once per admissionRefresh
+func (o *Orchestrator) admission(ctx context.Context) (admissionResponse, error) {
+	o.admissionMu.Lock()
+	defer o.admissionMu.Unlock()
+
+	now := time.Now()
+	if o.lastAdmission != nil && now.Sub(o.lastAdmission.MeasuredAt) < admissionRefresh {
+		return *o.lastAdmission, nil
+	}
+
+	depth, err := o.storage.QueueDepth(ctx)
+	if err != nil {
+		return admissionResponse{}, err
+	}
+
+	resp := admit(depth, o.liveWorkers(ctx, now), o.cfg.MaxQueueDepth, o.cfg.MaxQueueWaitMS)
+	resp.MeasuredAt = now
+	o.lastAdmission = &resp
+
+	return resp, nil
+}
+
+// admitWork answers 503 and reports false when the queue takes no more work
+func (o *Orchestrator) admitWork(c echo.Context) (bool, error) {
+	if o.cfg.MaxQueueDepth <= 0 && o.cfg.MaxQueueWaitMS <= 0 {
+		return true, nil
+	}
+
+	state, err := o.admission(c.Request().Context())
+	if err != nil {
+		// an unreadable queue is no reason to turn users away
+		return true, nil
+	}
+	if state.Accepting {
+		return true, nil
+	}
+
+	retryAfter := (state.RetryAfterMS + 999) / 1000
+	c.Response().Header().Set("Retry-After", strconv.FormatInt(max(retryAfter, 1), 10))
+	return false, c.JSON(http.StatusServiceUnavailable, map[string]string{"error": state.Reason})
+}
+
+// AdmissionHandler reports the queue depth and whether new expressions are
+// accepted, 503 while they are not so that load balancers can shed traffic.
+// When ADMISSION_TOKEN is set the probe must send it as a bearer token
+func (o *Orchestrator) AdmissionHandler(c echo.Context) error {
+	if !o.admissionProbe(c.Request().Header.Get("Authorization")) {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+
+	state, err := o.admission(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to measure the queue"})
+	}
+
+	if o.draining.Load() {
+		state.Accepting = false
+		state.Reason = "Server is shutting down"
+	}
+	if !state.Accepting {
+		return c.JSON(http.StatusServiceUnavailable, state)
+	}
+	return c.JSON(http.StatusOK, state)
+}
+
+// admissionProbe reports whether the Authorization header carries the
+// admission token, any request passes when none is configured
+func (o *Orchestrator) admissionProbe(header string) bool {
+	if o.cfg.AdmissionToken == "" {
+		return true
+	}
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(o.cfg.AdmissionToken)) == 1
+}
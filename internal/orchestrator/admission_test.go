@@ -0,0 +1,82 @@
+package orchestrator
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+)
+
+func TestAdmit(t *testing.T) {
+	depth := storage.QueueDepth{Pending: 10, Running: 2, PendingWorkMS: 30000}
+
+	resp := admit(depth, 2, 0, 0)
+	assert.True(t, resp.Accepting)
+	require.NotNil(t, resp.EstimatedWaitMS)
+	assert.Equal(t, int64(15000), *resp.EstimatedWaitMS)
+
+	// 6 tasks over the limit at 3s each on 2 workers
+	resp = admit(depth, 2, 5, 0)
+	assert.False(t, resp.Accepting)
+	assert.Equal(t, int64(9000), resp.RetryAfterMS)
+
+	resp = admit(depth, 2, 0, 10000)
+	assert.False(t, resp.Accepting)
+	assert.Equal(t, int64(5000), resp.RetryAfterMS)
+
+	// without workers the wait is unknown
+	resp = admit(depth, 0, 0, 10000)
+	assert.True(t, resp.Accepting)
+	assert.Nil(t, resp.EstimatedWaitMS)
+	resp = admit(depth, 0, 10, 0)
+	assert.False(t, resp.Accepting)
+	assert.Equal(t, overloadRetryAfter.Milliseconds(), resp.RetryAfterMS)
+}
+
+func TestCalculate_RejectsWhenQueueIsFull(t *testing.T) {
+	s := newTestServer(t)
+	s.orch.cfg.MaxQueueDepth = 1
+	s.calculate("1 + 1")
+
+	s.orch.lastAdmission = nil
+	rec := s.do(s.orch.CalculateHandler, http.MethodPost, "/api/v1/calculate", `{"expression": "2 + 2"}`)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "5", rec.Header().Get("Retry-After"))
+
+	rec = s.do(s.orch.AdmissionHandler, http.MethodGet, "/internal/admission", "")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"pending":1`)
+
+	s.orch.cfg.MaxQueueDepth = 2
+	s.orch.lastAdmission = nil
+	rec = s.do(s.orch.AdmissionHandler, http.MethodGet, "/internal/admission", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestAdmissionHandler_ProbeToken(t *testing.T) {
+	s := newTestServer(t)
+	s.orch.cfg.AdmissionToken = "probe-secret"
+
+	probe := func(header string) int {
+		req := httptest.NewRequest(http.MethodGet, "/internal/admission", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		rec := httptest.NewRecorder()
+		require.NoError(t, s.orch.AdmissionHandler(echo.New().NewContext(req, rec)))
+		return rec.Code
+	}
+
+	// no user token is needed, only the probe token
+	assert.Equal(t, http.StatusUnauthorized, probe(""))
+	assert.Equal(t, http.StatusUnauthorized, probe("Bearer wrong"))
+	assert.Equal(t, http.StatusOK, probe("Bearer probe-secret"))
+
+	s.orch.cfg.AdmissionToken = ""
+	assert.Equal(t, http.StatusOK, probe(""))
+}
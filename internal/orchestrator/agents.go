@@ -0,0 +1,214 @@
+package orchestrator
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+	"github.com/nais2008/final_project_go_yandex/internal/utils"
+)
+
+// agentIDHeader identifies the agent that claims tasks
+const agentIDHeader = "X-Agent-ID"
+
+const (
+	agentOnline  = "online"
+	agentOffline = "offline"
+)
+
+type heartbeatRequest struct {
+	Workers int `json:"workers"`
+	// Tasks are the ids the agent is computing
+	Tasks []uint `json:"tasks"`
+}
+
+type heartbeatResponse struct {
+	// Cancel lists the reported tasks the agent no longer holds, they were
+	// cancelled or their lease went to someone else. The leases of the
+	// others are extended
+	Cancel []uint `json:"cancel"`
+}
+
+type releaseRequest struct {
+	IDs []uint `json:"ids"`
+}
+
+type releaseResponse struct {
+	Released int64 `json:"released"`
+}
+
+type agentTokenResponse struct {
+	AgentID string `json:"agent_id"`
+	// Token is only shown when it is issued
+	Token string `json:"token"`
+}
+
+// requestAgent is the agent making the request, the authenticated one when
+// AGENT_AUTH is on
+func requestAgent(c echo.Context) string {
+	if agentID, ok := c.Get("agent_id").(string); ok {
+		return agentID
+	}
+	return c.Request().Header.Get(agentIDHeader)
+}
+
+// sameAgent reports whether an authenticated request comes from the :id agent
+func sameAgent(c echo.Context) bool {
+	agentID, ok := c.Get("agent_id").(string)
+	return !ok || agentID == c.Param("id")
+}
+
+// AgentHeartbeatHandler ...
+func (o *Orchestrator) AgentHeartbeatHandler(c echo.Context) error {
+	if !sameAgent(c) {
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "Forbidden"})
+	}
+
+	var req heartbeatRequest
+	if err := c.Bind(&req); err != nil || req.Workers < 0 {
+		return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": "Invalid data"})
+	}
+
+	ctx := c.Request().Context()
+	now := time.Now()
+
+	agent := models.Agent{
+		ID:         c.Param("id"),
+		Workers:    req.Workers,
+		Status:     agentOnline,
+		LastSeenAt: now,
+	}
+	if err := o.storage.SaveAgent(ctx, agent); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to save agent"})
+	}
+
+	// a task may take longer than one lease, the agent keeps it while it
+	// reports it
+	extended, err := o.storage.ExtendLeases(ctx, agent.ID, req.Tasks, o.leaseUntil(now))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to extend leases"})
+	}
+
+	resp := heartbeatResponse{Cancel: []uint{}}
+	held := make(map[uint]bool, len(extended))
+	for _, id := range extended {
+		held[id] = true
+	}
+	for _, id := range req.Tasks {
+		if !held[id] {
+			resp.Cancel = append(resp.Cancel, id)
+		}
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+// AgentOfflineHandler marks the agent offline and hands its unfinished tasks
+// back to the queue
+func (o *Orchestrator) AgentOfflineHandler(c echo.Context) error {
+	if !sameAgent(c) {
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "Forbidden"})
+	}
+
+	ctx := c.Request().Context()
+	agentID := c.Param("id")
+
+	agent := models.Agent{ID: agentID, Status: agentOffline, LastSeenAt: time.Now()}
+	if err := o.storage.SaveAgent(ctx, agent); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to save agent"})
+	}
+
+	released, err := o.releaseTasks(c, agentID, nil)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to release tasks"})
+	}
+
+	return c.JSON(http.StatusOK, releaseResponse{Released: released})
+}
+
+// ReleaseTasksHandler returns tasks the agent will not finish to the queue
+func (o *Orchestrator) ReleaseTasksHandler(c echo.Context) error {
+	var req releaseRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": "Invalid data"})
+	}
+	agentID := requestAgent(c)
+	if agentID == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": agentIDHeader + " header is required"})
+	}
+	if len(req.IDs) == 0 {
+		return c.JSON(http.StatusOK, releaseResponse{})
+	}
+
+	released, err := o.releaseTasks(c, agentID, req.IDs)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to release tasks"})
+	}
+
+	return c.JSON(http.StatusOK, releaseResponse{Released: released})
+}
+
+func (o *Orchestrator) releaseTasks(c echo.Context, agentID string, ids []uint) (int64, error) {
+	ctx := c.Request().Context()
+
+	released, err := o.storage.ReleaseTasks(ctx, agentID, ids, storage.ReasonReleased)
+	if err != nil {
+		return 0, err
+	}
+
+	if released > 0 {
+		log.Printf("Agent %q handed back %d tasks", agentID, released)
+		o.publish(ctx, storage.TaskEvent{Type: storage.TaskEventReady})
+	}
+	return released, nil
+}
+
+// AdminAgentTokenHandler lets admins issue the :id agent a new token on
+// POST, which replaces the previous one, and revoke it on DELETE
+func (o *Orchestrator) AdminAgentTokenHandler(c echo.Context) error {
+	if ok, err := o.requireAdmin(c); !ok {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	agentID := c.Param("id")
+	if agentID == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+	}
+
+	switch c.Request().Method {
+	case http.MethodPost:
+		token, err := utils.GenerateAgentToken()
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate token"})
+		}
+		credential := models.AgentCredential{
+			AgentID:   agentID,
+			TokenHash: utils.HashAgentToken(token),
+			CreatedAt: time.Now(),
+		}
+		if err := o.storage.SaveAgentCredential(ctx, credential); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to save token"})
+		}
+		log.Printf("Issued a token to agent %q", agentID)
+
+		return c.JSON(http.StatusCreated, agentTokenResponse{AgentID: agentID, Token: token})
+
+	case http.MethodDelete:
+		if err := o.storage.DeleteAgentCredential(ctx, agentID); err != nil {
+			if errors.Is(err, storage.ErrCredentialNotFound) {
+				return c.JSON(http.StatusNotFound, map[string]string{"error": "Token not found"})
+			}
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to revoke token"})
+		}
+		log.Printf("Revoked the token of agent %q", agentID)
+
+		return c.NoContent(http.StatusNoContent)
+	}
+
+	return c.JSON(http.StatusMethodNotAllowed, map[string]string{"error": "Method not allowed"})
+}
@@ -0,0 +1,75 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+)
+
+// expireBatch is how many overdue expressions one transaction times out
+const expireBatch = 100
+
+// expressionDeadline resolves the requested timeout or deadline against the
+// server default and maximum, nil means the expression never times out
+func (o *Orchestrator) expressionDeadline(req calculateRequest, now time.Time) (*time.Time, error) {
+	if req.Timeout != "" && req.Deadline != nil {
+		return nil, errors.New("Set either timeout or deadline")
+	}
+
+	var deadline time.Time
+	switch {
+	case req.Timeout != "":
+		timeout, err := time.ParseDuration(req.Timeout)
+		if err != nil || timeout <= 0 {
+			return nil, errors.New("Invalid timeout")
+		}
+		deadline = now.Add(timeout)
+	case req.Deadline != nil:
+		if !req.Deadline.After(now) {
+			return nil, errors.New("Deadline is in the past")
+		}
+		deadline = *req.Deadline
+	case o.cfg.DefaultTimeoutMS > 0:
+		deadline = now.Add(time.Duration(o.cfg.DefaultTimeoutMS) * time.Millisecond)
+	}
+
+	if o.cfg.MaxTimeoutMS > 0 {
+		latest := now.Add(time.Duration(o.cfg.MaxTimeoutMS) * time.Millisecond)
+		if deadline.IsZero() || deadline.After(latest) {
+			deadline = latest
+		}
+	}
+
+	if deadline.IsZero() {
+		return nil, nil
+	}
+	return &deadline, nil
+}
+
+func pastDeadline(expr models.Expression, now time.Time) bool {
+	return expr.Deadline != nil && expr.Deadline.Before(now)
+}
+
+// expireExpressions times out overdue expressions and drops their tasks
+func (o *Orchestrator) expireExpressions(ctx context.Context) error {
+	for {
+		expired, err := o.storage.ExpireExpressions(ctx, time.Now(), expireBatch)
+		if err != nil {
+			return err
+		}
+
+		for _, expr := range expired {
+			log.Printf("Expression %d timed out", expr.ID)
+			o.enqueueWebhooks(ctx, expr)
+			o.publish(ctx, storage.TaskEvent{Type: storage.TaskEventCancelled, ExpressionID: expr.ID})
+		}
+
+		if len(expired) < expireBatch {
+			return nil
+		}
+	}
+}
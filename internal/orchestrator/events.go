@@ -0,0 +1,218 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+)
+
+// sseKeepAlive is how often an idle stream gets a comment line so that
+// proxies do not close it
+const sseKeepAlive = 15 * time.Second
+
+// expressionUpdate is pushed to event stream subscribers
+type expressionUpdate struct {
+	ID       uint               `json:"id"`
+	UserID   uint               `json:"-"`
+	Expr     string             `json:"expression"`
+	Status   string             `json:"status"`
+	Result   *float64           `json:"result"`
+	Progress expressionProgress `json:"progress"`
+}
+
+func (u expressionUpdate) finished() bool {
+	return storage.IsFinished(u.Status)
+}
+
+type subscription struct {
+	userID uint
+	// exprID is 0 for a stream of every expression of the user
+	exprID  uint
+	updates chan expressionUpdate
+}
+
+// updateHub fans expression updates out to the event streams of this instance
+type updateHub struct {
+	mu   sync.Mutex
+	subs map[*subscription]struct{}
+}
+
+func newUpdateHub() *updateHub {
+	return &updateHub{subs: make(map[*subscription]struct{})}
+}
+
+func (h *updateHub) subscribe(userID, exprID uint) *subscription {
+	sub := &subscription{userID: userID, exprID: exprID, updates: make(chan expressionUpdate, 16)}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subs[sub] = struct{}{}
+
+	return sub
+}
+
+func (h *updateHub) unsubscribe(sub *subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs, sub)
+}
+
+// watched reports whether anyone streams the user's expressions
+func (h *updateHub) watched(userID uint) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subs {
+		if sub.userID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// publish never blocks, a slow subscriber loses its oldest update since
+// every update carries the full state
+func (h *updateHub) publish(update expressionUpdate) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subs {
+		if sub.userID != update.UserID || (sub.exprID != 0 && sub.exprID != update.ID) {
+			continue
+		}
+
+		select {
+		case sub.updates <- update:
+		default:
+			select {
+			case <-sub.updates:
+			default:
+			}
+			select {
+			case sub.updates <- update:
+			default:
+			}
+		}
+	}
+}
+
+// broadcast sends the current state of the expression to its subscribers
+func (o *Orchestrator) broadcast(ctx context.Context, expr models.Expression) {
+	if !o.updates.watched(expr.UserID) {
+		return
+	}
+	o.updates.publish(o.snapshot(ctx, expr))
+}
+
+func (o *Orchestrator) snapshot(ctx context.Context, expr models.Expression) expressionUpdate {
+	now := time.Now()
+	return expressionUpdate{
+		ID:       expr.ID,
+		UserID:   expr.UserID,
+		Expr:     expr.Expr,
+		Status:   expr.Status,
+		Result:   expr.Result,
+		Progress: estimateProgress(expr, o.liveWorkers(ctx, now), now),
+	}
+}
+
+// ExpressionEventsHandler streams updates of one expression as Server-Sent
+// Events and ends after the final result
+func (o *Orchestrator) ExpressionEventsHandler(c echo.Context) error {
+	expression, ok, err := o.userExpression(c)
+	if !ok {
+		return err
+	}
+
+	sub := o.updates.subscribe(expression.UserID, expression.ID)
+	defer o.updates.unsubscribe(sub)
+
+	// reload after subscribing so an update in between is not lost
+	ctx := c.Request().Context()
+	expression, err = o.storage.Expression(ctx, expression.ID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch expression"})
+	}
+
+	return o.stream(c, sub, []expressionUpdate{o.snapshot(ctx, expression)})
+}
+
+// EventsHandler streams updates of every expression of the user as
+// Server-Sent Events
+func (o *Orchestrator) EventsHandler(c echo.Context) error {
+	userID := c.Get("user_id").(uint)
+
+	sub := o.updates.subscribe(userID, 0)
+	defer o.updates.unsubscribe(sub)
+
+	return o.stream(c, sub, nil)
+}
+
+func (o *Orchestrator) stream(c echo.Context, sub *subscription, initial []expressionUpdate) error {
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set(echo.HeaderCacheControl, "no-cache")
+	w.Header().Set(echo.HeaderConnection, "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	w.Flush()
+
+	send := func(update expressionUpdate) (bool, error) {
+		event := "expression"
+		done := sub.exprID != 0 && update.finished()
+		if done {
+			event = "done"
+		}
+		if err := writeEvent(w, event, update); err != nil {
+			return false, err
+		}
+		return done, nil
+	}
+
+	for _, update := range initial {
+		if done, err := send(update); done || err != nil {
+			return err
+		}
+	}
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case update := <-sub.updates:
+			if done, err := send(update); done || err != nil {
+				return err
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return err
+			}
+			w.Flush()
+		case <-o.stopping:
+			return nil
+		case <-c.Request().Context().Done():
+			return nil
+		}
+	}
+}
+
+func writeEvent(w *echo.Response, event string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload); err != nil {
+		return err
+	}
+	w.Flush()
+
+	return nil
+}
@@ -0,0 +1,130 @@
+package orchestrator
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type sseEvent struct {
+	name   string
+	update expressionUpdate
+}
+
+// streamServer serves the event handlers for the test user over real HTTP
+func (s *testServer) streamServer() *httptest.Server {
+	e := echo.New()
+	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set("user_id", s.user)
+			return next(c)
+		}
+	})
+	e.GET("/api/v1/expressions/:id/events", s.orch.ExpressionEventsHandler)
+	e.GET("/api/v1/events", s.orch.EventsHandler)
+
+	srv := httptest.NewServer(e)
+	s.t.Cleanup(srv.Close)
+	return srv
+}
+
+func readEvents(t *testing.T, resp *http.Response) <-chan sseEvent {
+	events := make(chan sseEvent, 16)
+	go func() {
+		defer close(events)
+
+		var name string
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				var update expressionUpdate
+				assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &update))
+				events <- sseEvent{name: name, update: update}
+			}
+		}
+	}()
+
+	return events
+}
+
+func nextEvent(t *testing.T, events <-chan sseEvent) sseEvent {
+	select {
+	case event, ok := <-events:
+		require.True(t, ok, "stream closed")
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+		return sseEvent{}
+	}
+}
+
+func TestExpressionEvents_StreamsUntilDone(t *testing.T) {
+	s := newTestServer(t)
+	id := s.calculate("2 + 3")
+	srv := s.streamServer()
+
+	resp, err := http.Get(srv.URL + "/api/v1/expressions/" + jsonID(id) + "/events")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get(echo.HeaderContentType))
+	events := readEvents(t, resp)
+
+	first := nextEvent(t, events)
+	assert.Equal(t, "expression", first.name)
+	assert.Equal(t, "in_progress", first.update.Status)
+
+	rec := s.do(s.orch.TaskBatchHandler, http.MethodGet, "/internal/tasks/batch", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var claimed tasksResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &claimed))
+	s.do(s.orch.TaskBatchHandler, http.MethodPost, "/internal/tasks/batch",
+		`{"results": [{"id": `+jsonID(claimed.Tasks[0].ID)+`, "result": 5}]}`)
+
+	last := nextEvent(t, events)
+	assert.Equal(t, "done", last.name)
+	assert.Equal(t, "completed", last.update.Status)
+	require.NotNil(t, last.update.Result)
+	assert.Equal(t, 5.0, *last.update.Result)
+
+	_, open := <-events
+	assert.False(t, open, "stream must end after the final result")
+}
+
+func TestEvents_UserStream(t *testing.T) {
+	s := newTestServer(t)
+	srv := s.streamServer()
+
+	resp, err := http.Get(srv.URL + "/api/v1/events")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	events := readEvents(t, resp)
+
+	// wait for the subscription before creating the expression
+	require.Eventually(t, func() bool { return s.orch.updates.watched(s.user) }, time.Second, 5*time.Millisecond)
+	id := s.calculate("1 + 1")
+
+	event := nextEvent(t, events)
+	assert.Equal(t, "expression", event.name)
+	assert.Equal(t, id, event.update.ID)
+	assert.Equal(t, "1 + 1", event.update.Expr)
+
+	s.orch.Drain()
+	select {
+	case _, open := <-events:
+		assert.False(t, open)
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream was not closed on drain")
+	}
+}
@@ -0,0 +1,93 @@
+package orchestrator
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+)
+
+// idempotencyKeyHeader makes retries of POST /api/v1/calculate safe
+const idempotencyKeyHeader = "Idempotency-Key"
+
+const maxIdempotencyKeyLength = 255
+
+// idempotencyLease holds the key of a request being handled, a key left
+// behind by a crashed orchestrator frees up after it
+const idempotencyLease = time.Minute
+
+func requestHash(req calculateRequest) string {
+	body, _ := json.Marshal(req)
+	sum := sha256.Sum256(body)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// calculateOnce creates the expression for the first request with the key
+// and answers its repeats the same way
+func (o *Orchestrator) calculateOnce(c echo.Context, userID uint, key string, req calculateRequest) error {
+	if len(key) > maxIdempotencyKeyLength {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": idempotencyKeyHeader + " is too long"})
+	}
+
+	// the outcome is recorded even if the client has gone away
+	ctx := context.WithoutCancel(c.Request().Context())
+	hash := requestHash(req)
+	now := time.Now()
+
+	stored, created, err := o.storage.ReserveIdempotencyKey(ctx, models.IdempotencyKey{
+		UserID:      userID,
+		Key:         key,
+		RequestHash: hash,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(idempotencyLease),
+	}, now)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to check idempotency key"})
+	}
+
+	if !created {
+		switch {
+		case stored.RequestHash != hash:
+			return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": idempotencyKeyHeader + " was used with a different request"})
+		case stored.StatusCode == 0:
+			return c.JSON(http.StatusConflict, map[string]string{"error": "A request with this " + idempotencyKeyHeader + " is in progress"})
+		}
+		c.Response().Header().Set("Idempotent-Replayed", "true")
+		return c.JSON(stored.StatusCode, calculateResponse{ID: stored.ExpressionID})
+	}
+
+	id, err := o.calculate(c, userID, req)
+	if id == 0 {
+		// nothing was created, a retry gets another chance
+		if err := o.storage.ReleaseIdempotencyKey(ctx, userID, key); err != nil {
+			log.Printf("Failed to release idempotency key of user %d: %v", userID, err)
+		}
+		return err
+	}
+
+	expiresAt := time.Now().Add(time.Duration(o.cfg.IdempotencyTTLMS) * time.Millisecond)
+	if err := o.storage.CompleteIdempotencyKey(ctx, userID, key, http.StatusCreated, id, expiresAt); err != nil {
+		log.Printf("Failed to save idempotency key of user %d: %v", userID, err)
+	}
+	return err
+}
+
+// deleteExpiredIdempotencyKeys forgets keys past their retention window
+func (o *Orchestrator) deleteExpiredIdempotencyKeys(ctx context.Context) error {
+	deleted, err := o.storage.DeleteExpiredIdempotencyKeys(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if deleted > 0 {
+		log.Printf("Deleted %d expired idempotency keys", deleted)
+	}
+	return nil
+}
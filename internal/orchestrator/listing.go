@@ -0,0 +1,154 @@
+package orchestrator
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+)
+
+// page sizes of the expression listing
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+var (
+	expressionStatuses = []string{"pending", "in_progress", "completed", "error", "cancelled", "timed_out"}
+	sortKeys           = []string{storage.SortByID, storage.SortByCreatedAt, storage.SortByResult}
+)
+
+// listCursor is the opaque next_cursor, it remembers the sort it was made
+// for so it cannot be replayed against another order
+type listCursor struct {
+	Sort      string    `json:"s"`
+	Desc      bool      `json:"d,omitempty"`
+	ID        uint      `json:"id"`
+	CreatedAt time.Time `json:"c"`
+	Result    *float64  `json:"r,omitempty"`
+}
+
+// parseExpressionQuery reads the listing parameters:
+//
+//	limit                    page size, 50 by default and at most 500
+//	cursor                   next_cursor of the previous page
+//	status                   comma separated statuses
+//	created_from, created_to RFC 3339 creation range, the end is exclusive
+//	result_min, result_max   inclusive result range
+//	sort                     id, created_at or result, a leading - sorts descending
+//	tasks                    false leaves the tasks out
+func parseExpressionQuery(c echo.Context) (storage.ExpressionQuery, error) {
+	query := storage.ExpressionQuery{SortBy: storage.SortByID, Limit: defaultPageSize, WithTasks: true}
+
+	if raw := c.QueryParam("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return query, errors.New("Invalid limit")
+		}
+		query.Limit = limit
+	}
+
+	if raw := c.QueryParam("status"); raw != "" {
+		for _, status := range strings.Split(raw, ",") {
+			if !slices.Contains(expressionStatuses, status) {
+				return query, errors.New("Invalid status")
+			}
+			query.Statuses = append(query.Statuses, status)
+		}
+	}
+
+	var err error
+	if query.CreatedFrom, err = timeParam(c, "created_from"); err != nil {
+		return query, err
+	}
+	if query.CreatedTo, err = timeParam(c, "created_to"); err != nil {
+		return query, err
+	}
+	if query.ResultMin, err = floatParam(c, "result_min"); err != nil {
+		return query, err
+	}
+	if query.ResultMax, err = floatParam(c, "result_max"); err != nil {
+		return query, err
+	}
+
+	if raw := c.QueryParam("sort"); raw != "" {
+		query.Desc = strings.HasPrefix(raw, "-")
+		query.SortBy = strings.TrimPrefix(raw, "-")
+		if !slices.Contains(sortKeys, query.SortBy) {
+			return query, errors.New("Invalid sort")
+		}
+	}
+
+	if raw := c.QueryParam("tasks"); raw != "" {
+		if query.WithTasks, err = strconv.ParseBool(raw); err != nil {
+			return query, errors.New("Invalid tasks")
+		}
+	}
+
+	if raw := c.QueryParam("cursor"); raw != "" {
+		cursor, err := decodeCursor(raw)
+		if err != nil {
+			return query, errors.New("Invalid cursor")
+		}
+		if cursor.Sort != query.SortBy || cursor.Desc != query.Desc {
+			return query, errors.New("Cursor was issued for another sort")
+		}
+		query.After = &storage.ExpressionCursor{ID: cursor.ID, CreatedAt: cursor.CreatedAt, Result: cursor.Result}
+	}
+
+	return query, nil
+}
+
+func encodeCursor(query storage.ExpressionQuery, pos storage.ExpressionCursor) string {
+	b, _ := json.Marshal(listCursor{
+		Sort:      query.SortBy,
+		Desc:      query.Desc,
+		ID:        pos.ID,
+		CreatedAt: pos.CreatedAt,
+		Result:    pos.Result,
+	})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(raw string) (listCursor, error) {
+	var cursor listCursor
+
+	b, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return cursor, err
+	}
+	err = json.Unmarshal(b, &cursor)
+	return cursor, err
+}
+
+func timeParam(c echo.Context, name string) (*time.Time, error) {
+	raw := c.QueryParam(name)
+	if raw == "" {
+		return nil, nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, raw)
+	if err != nil {
+		return nil, errors.New("Invalid " + name)
+	}
+	return &t, nil
+}
+
+func floatParam(c echo.Context, name string) (*float64, error) {
+	raw := c.QueryParam(name)
+	if raw == "" {
+		return nil, nil
+	}
+
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return nil, errors.New("Invalid " + name)
+	}
+	return &v, nil
+}
@@ -0,0 +1,118 @@
+package orchestrator
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nais2008/final_project_go_yandex/internal/cache"
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+	"github.com/nais2008/final_project_go_yandex/internal/parser"
+)
+
+// precisionFloat64 is the precision mode of every result so far, agents
+// compute in float64
+const precisionFloat64 = "float64"
+
+// resultKey identifies the computation of a task
+type resultKey struct {
+	Precision string
+	Operation string
+	Arg1      float64
+	Arg2      float64
+}
+
+type cacheStatsResponse struct {
+	Results     cache.Stats `json:"results"`
+	Expressions cache.Stats `json:"expressions"`
+}
+
+func resultKeyOf(task models.Task) (resultKey, bool) {
+	if task.Arg2 == nil {
+		return resultKey{}, false
+	}
+	return resultKey{Precision: precisionFloat64, Operation: task.Operation, Arg1: task.Arg1, Arg2: *task.Arg2}, true
+}
+
+func expressionKey(expr string) (string, error) {
+	normalized, err := parser.Normalize(expr)
+	if err != nil {
+		return "", err
+	}
+	return precisionFloat64 + ":" + normalized, nil
+}
+
+func completeFromCache(task *models.Task, result float64) {
+	task.Status = "completed"
+	task.Result = &result
+}
+
+// useCachedResults completes the tasks of a new expression whose results
+// are cached and reports whether none is left for the agents
+func (o *Orchestrator) useCachedResults(expr string, tasks []models.Task) bool {
+	if len(tasks) == 0 {
+		return false
+	}
+
+	if key, err := expressionKey(expr); err == nil {
+		if results, ok := o.expressionCache.Get(key); ok && len(results) == len(tasks) {
+			for i := range tasks {
+				completeFromCache(&tasks[i], results[tasks[i].Order])
+			}
+			return true
+		}
+	}
+
+	all := true
+	for i := range tasks {
+		key, ok := resultKeyOf(tasks[i])
+		if !ok {
+			all = false
+			continue
+		}
+		result, ok := o.resultCache.Get(key)
+		if !ok {
+			all = false
+			continue
+		}
+		completeFromCache(&tasks[i], result)
+	}
+
+	return all
+}
+
+func (o *Orchestrator) rememberResult(task models.Task) {
+	if key, ok := resultKeyOf(task); ok && task.Result != nil {
+		o.resultCache.Put(key, *task.Result)
+	}
+}
+
+// rememberExpression caches the task results of a completed expression by
+// task order
+func (o *Orchestrator) rememberExpression(expr models.Expression) {
+	key, err := expressionKey(expr.Expr)
+	if err != nil {
+		return
+	}
+
+	results := make([]float64, len(expr.Tasks))
+	for _, task := range expr.Tasks {
+		if task.Order < 0 || task.Order >= len(results) || task.Result == nil {
+			return
+		}
+		results[task.Order] = *task.Result
+	}
+	o.expressionCache.Put(key, results)
+}
+
+// CacheStatsHandler reports the hit and miss counters of the result
+// caches, it is open to ADMIN_USERS only
+func (o *Orchestrator) CacheStatsHandler(c echo.Context) error {
+	if ok, err := o.requireAdmin(c); !ok {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, cacheStatsResponse{
+		Results:     o.resultCache.Stats(),
+		Expressions: o.expressionCache.Stats(),
+	})
+}
@@ -0,0 +1,30 @@
+package orchestrator
+
+import "sync"
+
+// taskNotifier wakes up agents that are long-polling for tasks.
+type taskNotifier struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+func newTaskNotifier() *taskNotifier {
+	return &taskNotifier{ch: make(chan struct{})}
+}
+
+// wait returns a channel that is closed on the next notify call
+func (n *taskNotifier) wait() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.ch
+}
+
+// notify ...
+func (n *taskNotifier) notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	close(n.ch)
+	n.ch = make(chan struct{})
+}
@@ -0,0 +1,55 @@
+package orchestrator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTaskNotifier_NotifyWakesWaiters(t *testing.T) {
+	n := newTaskNotifier()
+	first := n.wait()
+	second := n.wait()
+
+	n.notify()
+
+	for _, ch := range []<-chan struct{}{first, second} {
+		select {
+		case <-ch:
+		case <-time.After(time.Second):
+			t.Fatal("waiter was not woken")
+		}
+	}
+}
+
+func TestTaskNotifier_WaitAfterNotifyBlocks(t *testing.T) {
+	n := newTaskNotifier()
+	n.notify()
+
+	select {
+	case <-n.wait():
+		t.Fatal("new waiter must not see a past notification")
+	default:
+	}
+}
+
+func TestParseWait(t *testing.T) {
+	wait, err := parseWait("")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), wait)
+
+	wait, err = parseWait("30s")
+	assert.NoError(t, err)
+	assert.Equal(t, 30*time.Second, wait)
+
+	wait, err = parseWait("10m")
+	assert.NoError(t, err)
+	assert.Equal(t, maxTaskWait, wait)
+
+	_, err = parseWait("soon")
+	assert.Error(t, err)
+
+	_, err = parseWait("-1s")
+	assert.Error(t, err)
+}
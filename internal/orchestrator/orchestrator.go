@@ -1,32 +1,119 @@
 package orchestrator
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"sort"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/labstack/echo/v4"
+	"github.com/nais2008/final_project_go_yandex/internal/cache"
 	"github.com/nais2008/final_project_go_yandex/internal/config"
-	"github.com/nais2008/final_project_go_yandex/internal/db"
+	"github.com/nais2008/final_project_go_yandex/internal/leader"
 	"github.com/nais2008/final_project_go_yandex/internal/models"
 	"github.com/nais2008/final_project_go_yandex/internal/parser"
-	"gorm.io/gorm"
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+	"github.com/nais2008/final_project_go_yandex/internal/webhook"
 )
 
+// maxTaskWait caps how long GET /internal/tasks may block
+const maxTaskWait = time.Minute
+
 // Orchestrator ...
 type Orchestrator struct {
-	cfg     config.Config
-	storage *db.Storage
+	cfg      config.Config
+	storage  storage.Storage
+	notifier *taskNotifier
+
+	// remoteEvents is set while task events arrive from the database,
+	// otherwise handlers apply them in-process
+	remoteEvents atomic.Bool
+
+	// refreshMu guards the expressions refreshLoop recomputes next, the
+	// listener only marks them and wakes it through refreshWake
+	refreshMu   sync.Mutex
+	dirty       map[uint]bool
+	refreshAll  bool
+	refreshWake chan struct{}
+
+	// draining is set on shutdown, no new work is accepted or handed out,
+	// stopping is closed at the same time to end event streams
+	draining  atomic.Bool
+	stopping  chan struct{}
+	drainOnce sync.Once
+
+	updates  *updateHub
+	webhooks *webhook.Sender
+
+	// resultCache and expressionCache let repeated computations skip the agents
+	resultCache     *cache.Cache[resultKey, float64]
+	expressionCache *cache.Cache[string, []float64]
+
+	// lastAdmission is the latest queue measurement, see admission
+	admissionMu   sync.Mutex
+	lastAdmission *admissionResponse
+
+	// verified, mismatches and verifyErrors count the local checks of
+	// completed results, see verifyExpression
+	verified     atomic.Uint64
+	mismatches   atomic.Uint64
+	verifyErrors atomic.Uint64
+}
+
+// errDraining is returned to callers while the orchestrator shuts down
+var errDraining = errors.New("orchestrator is shutting down")
+
+// Drain stops accepting expressions and handing out tasks, waiting agents
+// are woken up so their requests finish before the server stops
+func (o *Orchestrator) Drain() {
+	o.drainOnce.Do(func() {
+		o.draining.Store(true)
+		close(o.stopping)
+		o.notifier.notify()
+	})
 }
 
 // NewOrchestrator ...
-func NewOrchestrator(cfg config.Config, storage *db.Storage) *Orchestrator {
-	return &Orchestrator{cfg: cfg, storage: storage}
+func NewOrchestrator(cfg config.Config, st storage.Storage) *Orchestrator {
+	return &Orchestrator{
+		cfg:         cfg,
+		storage:     st,
+		notifier:    newTaskNotifier(),
+		dirty:       make(map[uint]bool),
+		refreshWake: make(chan struct{}, 1),
+		stopping:    make(chan struct{}),
+		updates:     newUpdateHub(),
+		webhooks:    webhook.NewSender(st, cfg),
+
+		resultCache:     cache.New[resultKey, float64](cfg.ResultCacheSize, time.Duration(cfg.ResultCacheTTLMS)*time.Millisecond),
+		expressionCache: cache.New[string, []float64](cfg.ExpressionCacheSize, time.Duration(cfg.ExpressionCacheTTLMS)*time.Millisecond),
+	}
 }
 
 type calculateRequest struct {
 	Expression string `json:"expression"`
+	// WebhookURL is notified when this expression finishes, in addition
+	// to the account webhooks
+	WebhookURL string `json:"webhook_url"`
+	// Timeout ("30s") or Deadline (RFC 3339) bound how long the expression
+	// may take, at most one of them is set
+	Timeout  string     `json:"timeout"`
+	Deadline *time.Time `json:"deadline"`
+	// Class is interactive (default) or batch, Priority orders the user's
+	// own expressions within a class, higher first
+	Class    string `json:"class"`
+	Priority int    `json:"priority"`
+	// Verify checks the result against a local evaluation on completion
+	Verify bool `json:"verify"`
+	// Replicas is how many distinct agents compute each task, a result is
+	// accepted when most of them agree
+	Replicas int `json:"replicas"`
 }
 
 type calculateResponse struct {
@@ -37,84 +124,529 @@ type calculateResponse struct {
 func (o *Orchestrator) CalculateHandler(c echo.Context) error {
 	userID := c.Get("user_id").(uint)
 
+	if o.draining.Load() {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Server is shutting down"})
+	}
+
 	var req calculateRequest
 	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": "Invalid data"})
 	}
 
+	if key := c.Request().Header.Get(idempotencyKeyHeader); key != "" && o.cfg.IdempotencyTTLMS > 0 {
+		return o.calculateOnce(c, userID, key, req)
+	}
+	_, err := o.calculate(c, userID, req)
+	return err
+}
+
+// calculate validates the request and saves the expression, it returns the
+// id of the created expression or 0 when it answered with an error
+func (o *Orchestrator) calculate(c echo.Context, userID uint, req calculateRequest) (uint, error) {
+	if req.WebhookURL != "" && !o.validWebhookURL(c.Request().Context(), req.WebhookURL) {
+		return 0, c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": "Invalid webhook URL"})
+	}
+
+	switch req.Class {
+	case "":
+		req.Class = storage.ClassInteractive
+	case storage.ClassInteractive, storage.ClassBatch:
+	default:
+		return 0, c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": "Invalid class"})
+	}
+
+	if req.Replicas < 0 || req.Replicas > maxReplicas {
+		return 0, c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": "Invalid replicas"})
+	}
+	if req.Replicas == 0 {
+		req.Replicas = 1
+	}
+	if req.Replicas > 1 {
+		agents, err := o.replicaAgents(c.Request().Context(), time.Now())
+		if err != nil {
+			return 0, c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to count agents"})
+		}
+		// each replica needs an agent of its own
+		if req.Replicas > agents {
+			return 0, c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": fmt.Sprintf("Replicas exceed the %d available agents", agents)})
+		}
+	}
+
+	deadline, err := o.expressionDeadline(req, time.Now())
+	if err != nil {
+		return 0, c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+	}
+
 	tasks, err := parser.ParseAndCreateTasks(req.Expression)
 	if err != nil {
-		return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": fmt.Sprintf("Invalid expression: %v", err)})
+		return 0, c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": fmt.Sprintf("Invalid expression: %v", err)})
+	}
+
+	if ok, err := o.admitWork(c); !ok {
+		return 0, err
 	}
 
 	expr := models.Expression{
-		Expr:   req.Expression,
-		Status: "in_progress",
-		Tasks:  tasks,
-		UserID: userID,
+		Expr:       req.Expression,
+		Status:     "in_progress",
+		Tasks:      tasks,
+		UserID:     userID,
+		WebhookURL: req.WebhookURL,
+		Deadline:   deadline,
+		Class:      req.Class,
+		Priority:   req.Priority,
+		Verify:     req.Verify,
+		Replicas:   req.Replicas,
 	}
 
-	dbResult := o.storage.DB.Create(&expr)
-	if dbResult.Error != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to save expression with tasks"})
+	// replicated expressions do not trust results computed by a single agent
+	cached := expr.Replicas == 1 && o.useCachedResults(req.Expression, expr.Tasks)
+
+	if ok, err := o.createWithinQuota(c, &expr); !ok {
+		return 0, err
+	}
+	if cached {
+		// every result is known, nothing goes to the agents
+		o.updateExpressionStatus(c.Request().Context(), &expr)
+	} else {
+		o.publish(c.Request().Context(), storage.TaskEvent{Type: storage.TaskEventReady, ExpressionID: expr.ID})
+		o.broadcast(c.Request().Context(), expr)
 	}
 
-	return c.JSON(http.StatusCreated, calculateResponse{ID: expr.ID})
+	return expr.ID, c.JSON(http.StatusCreated, calculateResponse{ID: expr.ID})
 }
 
 type taskResponse struct {
 	Task models.Task `json:"task"`
 }
 
+type taskResultRequest struct {
+	ID        uint      `json:"id"`
+	Result    float64   `json:"result"`
+	StartedAt time.Time `json:"started_at"`
+}
+
 // TaskHandler ...
 func (o *Orchestrator) TaskHandler(c echo.Context) error {
 	switch c.Request().Method {
 	case http.MethodGet:
-		var task models.Task
-		result := o.storage.DB.Where("status = ?", "pending").First(&task)
-		if result.Error != nil {
-			if result.Error == gorm.ErrRecordNotFound {
+		wait, err := parseWait(c.QueryParam("wait"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid wait duration"})
+		}
+
+		tasks, err := o.waitForTasks(c.Request().Context(), requestAgent(c), 1, wait)
+		if err != nil {
+			if errors.Is(err, storage.ErrTaskNotFound) {
 				return c.JSON(http.StatusNotFound, map[string]string{"error": "No tasks available"})
 			}
+			if errors.Is(err, errDraining) {
+				return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Server is shutting down"})
+			}
+			if errors.Is(err, storage.ErrAgentQuarantined) {
+				return c.JSON(http.StatusForbidden, map[string]string{"error": "Agent is quarantined"})
+			}
 			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch pending task"})
 		}
-		task.Status = "pending"
-		o.storage.DB.Save(&task)
-		return c.JSON(http.StatusOK, taskResponse{Task: task})
+		return c.JSON(http.StatusOK, taskResponse{Task: tasks[0]})
 
 	case http.MethodPost:
-		var req struct {
-			ID     uint    `json:"id"`
-			Result float64 `json:"result"`
-		}
+		var req taskResultRequest
 		if err := c.Bind(&req); err != nil {
 			return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": "Invalid data"})
 		}
 
-		var task models.Task
-		if result := o.storage.DB.First(&task, req.ID); result.Error != nil {
-			return c.JSON(http.StatusNotFound, map[string]string{"error": "Task not found"})
+		outcome := o.submitResults(c.Request().Context(), requestAgent(c), []taskResultRequest{req})[0]
+		switch outcome.Status {
+		case outcomeNotFound:
+			return c.JSON(http.StatusNotFound, map[string]string{"error": outcome.Error})
+		case outcomeConflict:
+			return c.JSON(http.StatusConflict, map[string]string{"error": outcome.Error})
+		case outcomeError:
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": outcome.Error})
 		}
 
-		task.Result = &req.Result
-		task.Status = "completed"
-		o.storage.DB.Save(&task)
+		// the result of a cancelled task is accepted and dropped
+		return c.NoContent(http.StatusOK)
 
-		var expression models.Expression
-		o.storage.DB.Preload("Tasks").First(&expression, task.ExpressionID)
+	default:
+		return c.JSON(http.StatusMethodNotAllowed, map[string]string{"error": "Method not allowed"})
+	}
+}
 
-		o.updateExpressionStatus(&expression)
+// maxTaskBatch caps how many tasks one batch request may claim
+const maxTaskBatch = 100
 
-		return c.NoContent(http.StatusOK)
+const (
+	outcomeOK       = "ok"
+	outcomeNotFound = "not_found"
+	outcomeConflict = "conflict"
+	outcomeError    = "error"
+	// outcomeCancelled means the result was dropped with its expression
+	outcomeCancelled = "cancelled"
+)
+
+type tasksResponse struct {
+	Tasks []models.Task `json:"tasks"`
+}
+
+type batchResultsRequest struct {
+	Results []taskResultRequest `json:"results"`
+}
+
+type resultOutcome struct {
+	ID     uint   `json:"id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type batchResultsResponse struct {
+	Results []resultOutcome `json:"results"`
+}
+
+// TaskBatchHandler ...
+func (o *Orchestrator) TaskBatchHandler(c echo.Context) error {
+	switch c.Request().Method {
+	case http.MethodGet:
+		wait, err := parseWait(c.QueryParam("wait"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid wait duration"})
+		}
+
+		limit := 1
+		if raw := c.QueryParam("limit"); raw != "" {
+			limit, err = strconv.Atoi(raw)
+			if err != nil || limit < 1 {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid limit"})
+			}
+		}
+		if limit > maxTaskBatch {
+			limit = maxTaskBatch
+		}
+
+		tasks, err := o.waitForTasks(c.Request().Context(), requestAgent(c), limit, wait)
+		if err != nil {
+			if errors.Is(err, storage.ErrTaskNotFound) {
+				return c.JSON(http.StatusNotFound, map[string]string{"error": "No tasks available"})
+			}
+			if errors.Is(err, errDraining) {
+				return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Server is shutting down"})
+			}
+			if errors.Is(err, storage.ErrAgentQuarantined) {
+				return c.JSON(http.StatusForbidden, map[string]string{"error": "Agent is quarantined"})
+			}
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch pending tasks"})
+		}
+		return c.JSON(http.StatusOK, tasksResponse{Tasks: tasks})
+
+	case http.MethodPost:
+		var req batchResultsRequest
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": "Invalid data"})
+		}
+		if len(req.Results) > maxTaskBatch {
+			return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": "Too many results"})
+		}
+
+		outcomes := o.submitResults(c.Request().Context(), requestAgent(c), req.Results)
+		return c.JSON(http.StatusOK, batchResultsResponse{Results: outcomes})
 
 	default:
 		return c.JSON(http.StatusMethodNotAllowed, map[string]string{"error": "Method not allowed"})
 	}
 }
 
-func (o *Orchestrator) updateExpressionStatus(expr *models.Expression) {
+// submitResults completes every task agentID holds and reports the outcome
+// per item
+func (o *Orchestrator) submitResults(ctx context.Context, agentID string, results []taskResultRequest) []resultOutcome {
+	outcomes := make([]resultOutcome, len(results))
+	touched := make(map[uint]bool)
+	requeued := false
+
+	for i, res := range results {
+		outcomes[i] = resultOutcome{ID: res.ID, Status: outcomeOK}
+
+		task, err := o.storage.CompleteTask(ctx, storage.TaskResult{ID: res.ID, Result: res.Result, AgentID: agentID, StartedAt: res.StartedAt, Tolerance: o.verifyTolerance()})
+		switch {
+		case err == nil && task.Status == "pending":
+			// a vote that did not decide, the task waits for another agent
+			requeued = true
+		case err == nil && task.Status == "in_progress":
+			// a vote that did not decide, other agents are still computing
+		case err == nil:
+			touched[task.ExpressionID] = true
+			if task.Replicas > 1 {
+				o.settleVote(ctx, task)
+			}
+			if task.Status == "completed" {
+				o.rememberResult(task)
+			}
+		case errors.Is(err, storage.ErrTaskNotFound):
+			outcomes[i].Status = outcomeNotFound
+			outcomes[i].Error = "Task not found"
+		case errors.Is(err, storage.ErrTaskCancelled):
+			outcomes[i].Status = outcomeCancelled
+		case errors.Is(err, storage.ErrTaskNotInProgress):
+			outcomes[i].Status = outcomeConflict
+			outcomes[i].Error = "Task is not in progress"
+		case errors.Is(err, storage.ErrLeaseNotHeld):
+			outcomes[i].Status = outcomeConflict
+			outcomes[i].Error = "Task is leased to another agent"
+		default:
+			outcomes[i].Status = outcomeError
+			outcomes[i].Error = "Failed to save task result"
+		}
+	}
+
+	for exprID := range touched {
+		o.publish(ctx, storage.TaskEvent{Type: storage.TaskEventCompleted, ExpressionID: exprID})
+	}
+	if requeued {
+		o.publish(ctx, storage.TaskEvent{Type: storage.TaskEventReady})
+	}
+
+	return outcomes
+}
+
+// Listen subscribes to task events from the database so that waiting agents
+// and expression statuses react to changes made by any orchestrator instance.
+// It returns when ctx is cancelled.
+func (o *Orchestrator) Listen(ctx context.Context) {
+	go o.refreshLoop(ctx)
+
+	err := o.storage.ListenTaskEvents(ctx, o.handleTaskEvent)
+	if errors.Is(err, storage.ErrNotSupported) {
+		log.Printf("Storage backend does not deliver task events, handling them in-process")
+		return
+	}
+	if err != nil {
+		log.Printf("Task event listener stopped: %v", err)
+	}
+}
+
+// Duties lists the background jobs that must run on a single orchestrator
+func (o *Orchestrator) Duties() []leader.Duty {
+	return []leader.Duty{
+		{
+			Name:     "lease reaper",
+			Interval: time.Duration(o.cfg.LeaseReapIntervalMS) * time.Millisecond,
+			Run:      o.reapExpiredLeases,
+		},
+		{
+			Name:     "deadline enforcer",
+			Interval: time.Duration(o.cfg.DeadlineIntervalMS) * time.Millisecond,
+			Run:      o.expireExpressions,
+		},
+		{
+			Name:     "webhook sender",
+			Interval: time.Duration(o.cfg.WebhookIntervalMS) * time.Millisecond,
+			Run:      o.webhooks.Run,
+		},
+		{
+			Name:     "idempotency key cleaner",
+			Interval: time.Duration(o.cfg.IdempotencyCleanupMS) * time.Millisecond,
+			Run:      o.deleteExpiredIdempotencyKeys,
+		},
+		{
+			Name:     "reconciler",
+			Interval: time.Duration(o.cfg.ReconcileIntervalMS) * time.Millisecond,
+			Run:      o.reconcile,
+		},
+	}
+}
+
+// reapExpiredLeases puts tasks held by agents that went silent back in the queue
+func (o *Orchestrator) reapExpiredLeases(ctx context.Context) error {
+	reaped, err := o.storage.ReapExpiredLeases(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if reaped > 0 {
+		log.Printf("Requeued %d tasks with expired leases", reaped)
+		o.publish(ctx, storage.TaskEvent{Type: storage.TaskEventReady})
+	}
+	return nil
+}
+
+// publish applies a task event in-process unless the database delivers it
+func (o *Orchestrator) publish(ctx context.Context, event storage.TaskEvent) {
+	if o.remoteEvents.Load() {
+		return
+	}
+
+	if event.Type == storage.TaskEventCompleted || event.Type == storage.TaskEventCancelled {
+		o.refreshExpression(ctx, event.ExpressionID)
+	}
+	o.notifier.notify()
+}
+
+// handleTaskEvent runs on the listener goroutine, it must not block
+func (o *Orchestrator) handleTaskEvent(event storage.TaskEvent) {
+	switch event.Type {
+	case storage.TaskEventSubscribed:
+		o.remoteEvents.Store(true)
+		// completions sent while the connection was down are lost
+		o.queueRefresh(0)
+		o.notifier.notify()
+	case storage.TaskEventUnsubscribed:
+		o.remoteEvents.Store(false)
+	case storage.TaskEventReady:
+		o.notifier.notify()
+	case storage.TaskEventCompleted:
+		o.queueRefresh(event.ExpressionID)
+		o.notifier.notify()
+	case storage.TaskEventCancelled:
+		o.queueRefresh(event.ExpressionID)
+	}
+}
+
+// queueRefresh marks the expression for refreshLoop, 0 marks every
+// unfinished one
+func (o *Orchestrator) queueRefresh(id uint) {
+	o.refreshMu.Lock()
+	if id == 0 {
+		o.refreshAll = true
+	} else {
+		o.dirty[id] = true
+	}
+	o.refreshMu.Unlock()
+
+	select {
+	case o.refreshWake <- struct{}{}:
+	default:
+	}
+}
+
+// refreshLoop recomputes expression statuses, coalescing events that
+// arrive for the same expression while the previous pass runs
+func (o *Orchestrator) refreshLoop(ctx context.Context) {
+	for {
+		select {
+		case <-o.refreshWake:
+		case <-ctx.Done():
+			return
+		}
+
+		o.refreshMu.Lock()
+		dirty, all := o.dirty, o.refreshAll
+		o.dirty, o.refreshAll = make(map[uint]bool), false
+		o.refreshMu.Unlock()
+
+		if all {
+			o.refreshUnfinished(ctx, dirty)
+		}
+		for id := range dirty {
+			o.refreshExpression(ctx, id)
+		}
+	}
+}
+
+// refreshUnfinished recomputes every unfinished expression and drops them
+// from dirty
+func (o *Orchestrator) refreshUnfinished(ctx context.Context, dirty map[uint]bool) {
+	var after uint
+	for {
+		ids, err := o.storage.UnfinishedExpressions(ctx, after, reconcileBatch)
+		if err != nil {
+			log.Printf("Failed to list unfinished expressions: %v", err)
+			return
+		}
+		for _, id := range ids {
+			o.refreshExpression(ctx, id)
+			delete(dirty, id)
+		}
+		if len(ids) < reconcileBatch {
+			return
+		}
+		after = ids[len(ids)-1]
+	}
+}
+
+func (o *Orchestrator) refreshExpression(ctx context.Context, id uint) {
+	expression, err := o.storage.Expression(ctx, id)
+	if err != nil {
+		log.Printf("Failed to load expression %d: %v", id, err)
+		return
+	}
+	o.updateExpressionStatus(ctx, &expression)
+}
+
+func parseWait(raw string) (time.Duration, error) {
+	if raw == "" {
+		return 0, nil
+	}
+
+	wait, err := time.ParseDuration(raw)
+	if err != nil || wait < 0 {
+		return 0, fmt.Errorf("invalid wait %q", raw)
+	}
+	if wait > maxTaskWait {
+		wait = maxTaskWait
+	}
+
+	return wait, nil
+}
+
+// waitForTasks claims up to limit pending tasks, blocking up to wait until one appears
+func (o *Orchestrator) waitForTasks(ctx context.Context, agentID string, limit int, wait time.Duration) ([]models.Task, error) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		// subscribe before claiming so a notify between the two is not lost
+		wake := o.notifier.wait()
+		if o.draining.Load() {
+			return nil, errDraining
+		}
+
+		tasks, err := o.storage.ClaimTasks(ctx, storage.ClaimRequest{
+			Limit:      limit,
+			AgentID:    agentID,
+			LeaseUntil: o.leaseUntil(time.Now()),
+			Weights: map[string]int{
+				storage.ClassInteractive: o.cfg.InteractiveWeight,
+				storage.ClassBatch:       o.cfg.BatchWeight,
+			},
+		})
+		if !errors.Is(err, storage.ErrTaskNotFound) {
+			return tasks, err
+		}
+
+		select {
+		case <-wake:
+		case <-timer.C:
+			return nil, err
+		case <-ctx.Done():
+			return nil, err
+		}
+	}
+}
+
+// leaseUntil is when a lease taken or extended at now expires
+func (o *Orchestrator) leaseUntil(now time.Time) time.Time {
+	return now.Add(time.Duration(o.cfg.TaskLeaseMS) * time.Millisecond)
+}
+
+func (o *Orchestrator) updateExpressionStatus(ctx context.Context, expr *models.Expression) {
+	// only the call that finishes the expression verifies it and tells the
+	// webhooks, every instance refreshing it broadcasts
+	var finished bool
+	defer func() {
+		o.broadcast(ctx, *expr)
+		if finished {
+			o.enqueueWebhooks(ctx, *expr)
+		}
+	}()
+
+	// a finished expression only needs its subscribers told, an overdue
+	// one is left to the deadline enforcer
+	if storage.IsFinished(expr.Status) || pastDeadline(*expr, time.Now()) {
+		return
+	}
+
 	if len(expr.Tasks) == 0 {
-		o.storage.DB.Model(expr).Updates(map[string]interface{}{"status": "pending", "result": nil})
+		o.setExpressionStatus(ctx, expr, "pending", nil)
 		return
 	}
 
@@ -129,15 +661,41 @@ func (o *Orchestrator) updateExpressionStatus(expr *models.Expression) {
 	if completed {
 		result := o.computeFinalResult(expr.Tasks)
 		if result != nil {
-			o.storage.DB.Model(expr).Updates(map[string]interface{}{"status": "completed", "result": result})
+			finished = o.setExpressionStatus(ctx, expr, "completed", result)
+			if finished {
+				// a result that disagrees with the parser is not reused
+				if !o.shouldVerify(*expr) || o.verifyExpression(ctx, expr) {
+					o.rememberExpression(*expr)
+				}
+			}
 		} else {
-			o.storage.DB.Model(expr).Update("status", "error")
+			finished = o.setExpressionStatus(ctx, expr, "error", nil)
 		}
 	} else {
-		o.storage.DB.Model(expr).Update("status", "in_progress")
+		o.setExpressionStatus(ctx, expr, "in_progress", nil)
 	}
 }
 
+// setExpressionStatus stores the status and reports whether this call
+// changed it
+func (o *Orchestrator) setExpressionStatus(ctx context.Context, expr *models.Expression, status string, result *float64) bool {
+	changed, err := o.storage.UpdateExpression(ctx, expr.ID, status, result)
+	if errors.Is(err, storage.ErrExpressionFinished) {
+		// finished meanwhile, report what is stored
+		if stored, err := o.storage.Expression(ctx, expr.ID); err == nil {
+			*expr = stored
+		}
+		return false
+	}
+	if err != nil {
+		log.Printf("Failed to update expression %d: %v", expr.ID, err)
+		return false
+	}
+	expr.Status = status
+	expr.Result = result
+	return changed
+}
+
 func (o *Orchestrator) computeFinalResult(tasks []models.Task) *float64 {
 	if len(tasks) == 0 {
 		return nil
@@ -187,50 +745,121 @@ func (o *Orchestrator) computeFinalResult(tasks []models.Task) *float64 {
 
 type expressionsResponse struct {
 	Expressions []models.Expression `json:"expressions"`
+	// NextCursor fetches the following page, it is empty on the last one
+	NextCursor string `json:"next_cursor,omitempty"`
 }
 
 // GetExpressionsHandler ...
 func (o *Orchestrator) GetExpressionsHandler(c echo.Context) error {
 	userID := c.Get("user_id").(uint)
-	
-	var expressions []models.Expression
-	result := o.storage.DB.Where("user_id = ?", userID).Preload("Tasks").Find(&expressions)
 
-	if result.Error != nil {
+	query, err := parseExpressionQuery(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	query.UserID = userID
+
+	// one extra row tells whether there is a next page
+	limit := query.Limit
+	query.Limit++
+	expressions, err := o.storage.UserExpressions(c.Request().Context(), query)
+	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch expressions"})
 	}
 
-	return c.JSON(http.StatusOK, expressionsResponse{Expressions: expressions})
+	resp := expressionsResponse{Expressions: expressions}
+	if len(expressions) > limit {
+		resp.Expressions = expressions[:limit]
+		resp.NextCursor = encodeCursor(query, storage.CursorOf(expressions[limit-1]))
+	}
+
+	return c.JSON(http.StatusOK, resp)
 }
 
 type expressionResponse struct {
-	Expression models.Expression `json:"expression"`
+	Expression models.Expression  `json:"expression"`
+	Progress   expressionProgress `json:"progress"`
 }
 
 // GetExpressionByIDHandler ...
 func (o *Orchestrator) GetExpressionByIDHandler(c echo.Context) error {
+	expression, ok, err := o.userExpression(c)
+	if !ok {
+		return err
+	}
+
+	now := time.Now()
+	progress := estimateProgress(expression, o.liveWorkers(c.Request().Context(), now), now)
+
+	return c.JSON(http.StatusOK, expressionResponse{Expression: expression, Progress: progress})
+}
+
+// CancelExpressionHandler stops an unfinished expression, its queued tasks
+// are dropped and agents computing the rest are told to abandon them
+func (o *Orchestrator) CancelExpressionHandler(c echo.Context) error {
+	expression, ok, err := o.userExpression(c)
+	if !ok {
+		return err
+	}
+	ctx := c.Request().Context()
+
+	expression, err = o.cancelExpression(ctx, expression.ID, "")
+	if err != nil {
+		if errors.Is(err, storage.ErrExpressionFinished) {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Expression is already finished"})
+		}
+		if errors.Is(err, storage.ErrExpressionNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Expression not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to cancel expression"})
+	}
+
+	return c.JSON(http.StatusOK, expressionResponse{
+		Expression: expression,
+		Progress:   estimateProgress(expression, 0, time.Now()),
+	})
+}
+
+// cancelExpression stops the expression and tells webhooks and the agents
+// holding its tasks
+func (o *Orchestrator) cancelExpression(ctx context.Context, id uint, reason string) (models.Expression, error) {
+	expression, err := o.storage.CancelExpression(ctx, id, reason)
+	if err != nil {
+		return models.Expression{}, err
+	}
+
+	o.enqueueWebhooks(ctx, expression)
+	o.publish(ctx, storage.TaskEvent{Type: storage.TaskEventCancelled, ExpressionID: expression.ID})
+
+	return expression, nil
+}
+
+// userExpression loads the :id expression of the current user, when it
+// cannot it writes the error response and reports false
+func (o *Orchestrator) userExpression(c echo.Context) (models.Expression, bool, error) {
 	userID := c.Get("user_id").(uint)
 	idStr := c.Param("id")
 
 	if idStr == "" {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "ID is required"})
+		return models.Expression{}, false, c.JSON(http.StatusBadRequest, map[string]string{"error": "ID is required"})
 	}
 
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+		return models.Expression{}, false, c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
 	}
 
-	var expression models.Expression
-	result := o.storage.DB.Where("id = ? AND user_id = ?", id, userID).Preload("Tasks").First(&expression)
-
-	if result.Error != nil {
-		if result.Error == gorm.ErrRecordNotFound {
-			return c.JSON(http.StatusNotFound, map[string]string{"error": "Expression not found"})
+	expression, err := o.storage.Expression(c.Request().Context(), uint(id))
+	if err != nil {
+		if errors.Is(err, storage.ErrExpressionNotFound) {
+			return models.Expression{}, false, c.JSON(http.StatusNotFound, map[string]string{"error": "Expression not found"})
 		}
 
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch expression"})
+		return models.Expression{}, false, c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch expression"})
+	}
+	if expression.UserID != userID {
+		return models.Expression{}, false, c.JSON(http.StatusNotFound, map[string]string{"error": "Expression not found"})
 	}
 
-	return c.JSON(http.StatusOK, expressionResponse{Expression: expression})
+	return expression, true, nil
 }
@@ -0,0 +1,723 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nais2008/final_project_go_yandex/internal/config"
+	"github.com/nais2008/final_project_go_yandex/internal/middleware"
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+	"github.com/nais2008/final_project_go_yandex/internal/storage/memory"
+	"github.com/nais2008/final_project_go_yandex/internal/storage/storagetest"
+)
+
+type testServer struct {
+	t     *testing.T
+	e     *echo.Echo
+	orch  *Orchestrator
+	user  uint
+	agent string
+}
+
+func newTestServer(t *testing.T) *testServer {
+	st := memory.New()
+	return &testServer{
+		t:    t,
+		e:    echo.New(),
+		orch: NewOrchestrator(config.Config{}, st),
+		user: storagetest.NewUser(t, st, "alice"),
+	}
+}
+
+func (s *testServer) do(handler echo.HandlerFunc, method, target, body string, params ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	if s.agent != "" {
+		req.Header.Set(agentIDHeader, s.agent)
+	}
+	rec := httptest.NewRecorder()
+
+	c := s.e.NewContext(req, rec)
+	c.Set("user_id", s.user)
+	c.Set("username", "alice")
+	var names, values []string
+	for i := 0; i+1 < len(params); i += 2 {
+		names = append(names, params[i])
+		values = append(values, params[i+1])
+	}
+	c.SetParamNames(names...)
+	c.SetParamValues(values...)
+
+	require.NoError(s.t, handler(c))
+	return rec
+}
+
+func (s *testServer) calculate(expr string) uint {
+	rec := s.do(s.orch.CalculateHandler, http.MethodPost, "/api/v1/calculate", `{"expression": "`+expr+`"}`)
+	require.Equal(s.t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	var resp calculateResponse
+	require.NoError(s.t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	return resp.ID
+}
+
+func TestCalculateAndSubmitBatch(t *testing.T) {
+	s := newTestServer(t)
+	id := s.calculate("2 + 3")
+
+	rec := s.do(s.orch.TaskBatchHandler, http.MethodGet, "/internal/tasks/batch?limit=4", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var claimed tasksResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &claimed))
+	require.Len(t, claimed.Tasks, 1)
+	assert.Equal(t, "in_progress", claimed.Tasks[0].Status)
+
+	body := `{"results": [{"id": ` + jsonID(claimed.Tasks[0].ID) + `, "result": 5}, {"id": 999, "result": 1}]}`
+	rec = s.do(s.orch.TaskBatchHandler, http.MethodPost, "/internal/tasks/batch", body)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var outcomes batchResultsResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &outcomes))
+	require.Len(t, outcomes.Results, 2)
+	assert.Equal(t, outcomeOK, outcomes.Results[0].Status)
+	assert.Equal(t, outcomeNotFound, outcomes.Results[1].Status)
+
+	rec = s.do(s.orch.GetExpressionByIDHandler, http.MethodGet, "/api/v1/expressions/"+jsonID(id), "", "id", jsonID(id))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var resp expressionResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, "completed", resp.Expression.Status)
+	require.NotNil(t, resp.Expression.Result)
+	assert.Equal(t, 5.0, *resp.Expression.Result)
+	assert.Equal(t, 100.0, resp.Progress.Percent)
+}
+
+func TestCalculate_CachedResults(t *testing.T) {
+	s := newTestServer(t)
+	s.orch = NewOrchestrator(config.Config{ResultCacheSize: 10, ExpressionCacheSize: 10}, s.orch.storage)
+	s.calculate("2 + 3")
+
+	rec := s.do(s.orch.TaskBatchHandler, http.MethodGet, "/internal/tasks/batch", "")
+	var claimed tasksResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &claimed))
+	require.Len(t, claimed.Tasks, 1)
+	rec = s.do(s.orch.TaskBatchHandler, http.MethodPost, "/internal/tasks/batch", `{"results": [{"id": `+jsonID(claimed.Tasks[0].ID)+`, "result": 5}]}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	// the same expression written differently completes without an agent
+	id := s.calculate("2.0+3")
+	ctx := context.Background()
+	expr, err := s.orch.storage.Expression(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, "completed", expr.Status)
+	require.NotNil(t, expr.Result)
+	assert.Equal(t, 5.0, *expr.Result)
+
+	events, err := s.orch.storage.ExpressionEvents(ctx, id)
+	require.NoError(t, err)
+	var cached int
+	for _, event := range events {
+		if event.Type == models.EventCompleted && event.Detail == storage.ReasonCached {
+			cached++
+		}
+	}
+	assert.Equal(t, 1, cached)
+
+	// only the known task of a new expression is skipped
+	id = s.calculate("(2 + 3) * 2")
+	expr, err = s.orch.storage.Expression(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, "in_progress", expr.Status)
+	statuses := map[string]int{}
+	for _, task := range expr.Tasks {
+		statuses[task.Status]++
+	}
+	assert.Equal(t, map[string]int{"completed": 1, "pending": 1}, statuses)
+
+	rec = s.do(s.orch.CacheStatsHandler, http.MethodGet, "/internal/cache", "")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	s.orch.cfg.AdminUsers = []string{"alice"}
+	rec = s.do(s.orch.CacheStatsHandler, http.MethodGet, "/internal/cache", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var stats cacheStatsResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &stats))
+	assert.Equal(t, uint64(1), stats.Expressions.Hits)
+	assert.Equal(t, uint64(2), stats.Expressions.Misses)
+	assert.Equal(t, uint64(1), stats.Results.Hits)
+}
+
+func TestGetExpressions_Pages(t *testing.T) {
+	s := newTestServer(t)
+	var ids []uint
+	for i := 0; i < 3; i++ {
+		ids = append(ids, s.calculate("1 + 1"))
+	}
+
+	list := func(target string) (int, expressionsResponse) {
+		rec := s.do(s.orch.GetExpressionsHandler, http.MethodGet, target, "")
+		var resp expressionsResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp
+	}
+
+	code, page := list("/api/v1/expressions?sort=-created_at&limit=2&tasks=false")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, page.Expressions, 2)
+	assert.Equal(t, ids[2], page.Expressions[0].ID)
+	assert.Empty(t, page.Expressions[0].Tasks)
+	require.NotEmpty(t, page.NextCursor)
+
+	code, page = list("/api/v1/expressions?sort=-created_at&limit=2&tasks=false&cursor=" + page.NextCursor)
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, page.Expressions, 1)
+	assert.Equal(t, ids[0], page.Expressions[0].ID)
+	assert.Empty(t, page.NextCursor)
+
+	_, first := list("/api/v1/expressions?limit=1")
+	require.Len(t, first.Expressions, 1)
+	assert.NotEmpty(t, first.Expressions[0].Tasks)
+
+	code, _ = list("/api/v1/expressions?sort=result&cursor=" + first.NextCursor)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = list("/api/v1/expressions?status=done")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = list("/api/v1/expressions?limit=1000")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, page = list("/api/v1/expressions?status=completed,error")
+	require.Equal(t, http.StatusOK, code)
+	assert.Empty(t, page.Expressions)
+}
+
+func TestCancelExpression(t *testing.T) {
+	s := newTestServer(t)
+	id := s.calculate("2 + 3")
+	s.agent = "agent-1"
+
+	rec := s.do(s.orch.TaskBatchHandler, http.MethodGet, "/internal/tasks/batch", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var claimed tasksResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &claimed))
+	taskID := jsonID(claimed.Tasks[0].ID)
+
+	heartbeat := func() heartbeatResponse {
+		rec := s.do(s.orch.AgentHeartbeatHandler, http.MethodPost, "/internal/agents/agent-1/heartbeat",
+			`{"workers": 1, "tasks": [`+taskID+`]}`, "id", "agent-1")
+		require.Equal(t, http.StatusOK, rec.Code)
+		var resp heartbeatResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		return resp
+	}
+	assert.Empty(t, heartbeat().Cancel)
+
+	rec = s.do(s.orch.CancelExpressionHandler, http.MethodDelete, "/api/v1/expressions/"+jsonID(id), "", "id", jsonID(id))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var resp expressionResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, "cancelled", resp.Expression.Status)
+	assert.Equal(t, 1, resp.Progress.Cancelled)
+
+	assert.Equal(t, []uint{claimed.Tasks[0].ID}, heartbeat().Cancel)
+
+	rec = s.do(s.orch.TaskHandler, http.MethodPost, "/internal/tasks", `{"id": `+taskID+`, "result": 5}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = s.do(s.orch.TaskBatchHandler, http.MethodPost, "/internal/tasks/batch", `{"results": [{"id": `+taskID+`, "result": 5}]}`)
+	var outcomes batchResultsResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &outcomes))
+	assert.Equal(t, outcomeCancelled, outcomes.Results[0].Status)
+
+	rec = s.do(s.orch.GetExpressionByIDHandler, http.MethodGet, "/api/v1/expressions/"+jsonID(id), "", "id", jsonID(id))
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, "cancelled", resp.Expression.Status)
+	assert.Nil(t, resp.Expression.Result)
+
+	rec = s.do(s.orch.CancelExpressionHandler, http.MethodDelete, "/api/v1/expressions/"+jsonID(id), "", "id", jsonID(id))
+	assert.Equal(t, http.StatusConflict, rec.Code)
+}
+
+func TestExpressionDeadline(t *testing.T) {
+	now := time.Now()
+	orch := &Orchestrator{cfg: config.Config{DefaultTimeoutMS: 1000, MaxTimeoutMS: 60000}}
+
+	deadline, err := orch.expressionDeadline(calculateRequest{}, now)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(time.Second), *deadline)
+
+	deadline, err = orch.expressionDeadline(calculateRequest{Timeout: "1h"}, now)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(time.Minute), *deadline)
+
+	at := now.Add(30 * time.Second)
+	deadline, err = orch.expressionDeadline(calculateRequest{Deadline: &at}, now)
+	require.NoError(t, err)
+	assert.Equal(t, at, *deadline)
+
+	past := now.Add(-time.Second)
+	for _, req := range []calculateRequest{{Timeout: "1s", Deadline: &at}, {Timeout: "soon"}, {Deadline: &past}} {
+		_, err = orch.expressionDeadline(req, now)
+		assert.Error(t, err)
+	}
+
+	orch.cfg = config.Config{}
+	deadline, err = orch.expressionDeadline(calculateRequest{}, now)
+	require.NoError(t, err)
+	assert.Nil(t, deadline)
+}
+
+func TestExpireExpressions(t *testing.T) {
+	s := newTestServer(t)
+	rec := s.do(s.orch.CalculateHandler, http.MethodPost, "/api/v1/calculate", `{"expression": "2 + 3", "timeout": "1ms"}`)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var created calculateResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &created))
+	id := jsonID(created.ID)
+
+	rec = s.do(s.orch.TaskBatchHandler, http.MethodGet, "/internal/tasks/batch", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var claimed tasksResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &claimed))
+
+	time.Sleep(5 * time.Millisecond)
+	// a result after the deadline does not complete the expression
+	rec = s.do(s.orch.TaskBatchHandler, http.MethodPost, "/internal/tasks/batch",
+		`{"results": [{"id": `+jsonID(claimed.Tasks[0].ID)+`, "result": 5}]}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, s.orch.expireExpressions(context.Background()))
+
+	rec = s.do(s.orch.GetExpressionByIDHandler, http.MethodGet, "/api/v1/expressions/"+id, "", "id", id)
+	var resp expressionResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, "timed_out", resp.Expression.Status)
+	assert.Nil(t, resp.Expression.Result)
+	assert.Nil(t, resp.Progress.ETAMS)
+}
+
+func TestCalculate_InvalidClass(t *testing.T) {
+	s := newTestServer(t)
+
+	rec := s.do(s.orch.CalculateHandler, http.MethodPost, "/api/v1/calculate", `{"expression": "1 + 1", "class": "urgent"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+
+	rec = s.do(s.orch.CalculateHandler, http.MethodPost, "/api/v1/calculate", `{"expression": "1 + 1", "class": "batch", "priority": 3}`)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	rec = s.do(s.orch.TaskBatchHandler, http.MethodGet, "/internal/tasks/batch", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var claimed tasksResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &claimed))
+	assert.Equal(t, "batch", claimed.Tasks[0].Class)
+	assert.Equal(t, 3, claimed.Tasks[0].Priority)
+}
+
+func TestCalculate_Quotas(t *testing.T) {
+	s := newTestServer(t)
+	s.orch.cfg.ExpressionsPerMinute = 2
+	s.orch.cfg.TasksPerDay = 3
+
+	rec := s.do(s.orch.CalculateHandler, http.MethodPost, "/api/v1/calculate", `{"expression": "1 + 1"}`)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, "2", rec.Header().Get("X-RateLimit-Limit"))
+	assert.Equal(t, "1", rec.Header().Get("X-RateLimit-Remaining"))
+	assert.NotEmpty(t, rec.Header().Get("X-RateLimit-Reset"))
+
+	// two more tasks would break the daily quota
+	rec = s.do(s.orch.CalculateHandler, http.MethodPost, "/api/v1/calculate", `{"expression": "1 + 2 * 3 - 4"}`)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "3", rec.Header().Get("X-RateLimit-Limit"))
+	assert.Equal(t, "2", rec.Header().Get("X-RateLimit-Remaining"))
+
+	s.calculate("2 + 2")
+	rec = s.do(s.orch.CalculateHandler, http.MethodPost, "/api/v1/calculate", `{"expression": "3 + 3"}`)
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "0", rec.Header().Get("X-RateLimit-Remaining"))
+	retryAfter, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+	require.NoError(t, err)
+	assert.True(t, retryAfter >= 1 && retryAfter <= 60, retryAfter)
+
+	// only admins may lift the limits
+	override := `{"expressions_per_minute": 0, "tasks_per_day": null}`
+	rec = s.do(s.orch.AdminQuotaHandler, http.MethodPut, "/api/v1/admin/users/alice/quota", override, "username", "alice")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	s.orch.cfg.AdminUsers = []string{"alice"}
+	rec = s.do(s.orch.AdminQuotaHandler, http.MethodPut, "/api/v1/admin/users/bob/quota", override, "username", "bob")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = s.do(s.orch.AdminQuotaHandler, http.MethodPut, "/api/v1/admin/users/alice/quota", override, "username", "alice")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var quota quotaResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &quota))
+	assert.Equal(t, quotaLimits{ExpressionsPerMinute: 0, TasksPerDay: 3}, quota.Limits)
+	assert.Equal(t, quotaUsage{ExpressionsLastMinute: 2, ActiveExpressions: 2, TasksToday: 2}, quota.Usage)
+
+	s.calculate("3 + 3")
+	rec = s.do(s.orch.CalculateHandler, http.MethodPost, "/api/v1/calculate", `{"expression": "4 + 4"}`)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+
+	rec = s.do(s.orch.AdminQuotaHandler, http.MethodDelete, "/api/v1/admin/users/alice/quota", "", "username", "alice")
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = s.do(s.orch.QuotaHandler, http.MethodGet, "/api/v1/quota", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var own quotaResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &own))
+	assert.Nil(t, own.Override)
+	assert.Equal(t, 2, own.Limits.ExpressionsPerMinute)
+}
+
+func TestCalculate_QuotasConcurrent(t *testing.T) {
+	s := newTestServer(t)
+	s.orch.cfg.ExpressionsPerMinute = 3
+
+	var wg sync.WaitGroup
+	codes := make([]int, 20)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = s.do(s.orch.CalculateHandler, http.MethodPost, "/api/v1/calculate", `{"expression": "1 + 1"}`).Code
+		}(i)
+	}
+	wg.Wait()
+
+	created := 0
+	for _, code := range codes {
+		if code == http.StatusCreated {
+			created++
+		} else {
+			assert.Equal(t, http.StatusTooManyRequests, code)
+		}
+	}
+	assert.Equal(t, 3, created)
+}
+
+func TestCalculate_IdempotencyKey(t *testing.T) {
+	s := newTestServer(t)
+	s.orch.cfg.IdempotencyTTLMS = 60000
+
+	post := func(key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(idempotencyKeyHeader, key)
+		rec := httptest.NewRecorder()
+		c := s.e.NewContext(req, rec)
+		c.Set("user_id", s.user)
+		require.NoError(t, s.orch.CalculateHandler(c))
+		return rec
+	}
+
+	first := post("k1", `{"expression": "1 + 1"}`)
+	require.Equal(t, http.StatusCreated, first.Code)
+	again := post("k1", `{"expression":"1 + 1"}`)
+	assert.Equal(t, http.StatusCreated, again.Code)
+	assert.Equal(t, "true", again.Header().Get("Idempotent-Replayed"))
+	assert.JSONEq(t, first.Body.String(), again.Body.String())
+
+	assert.Equal(t, http.StatusUnprocessableEntity, post("k1", `{"expression": "2 + 2"}`).Code)
+
+	// a rejected request does not use the key up
+	assert.Equal(t, http.StatusUnprocessableEntity, post("k2", `{"expression": "2 +"}`).Code)
+	assert.Equal(t, http.StatusCreated, post("k2", `{"expression": "2 + 2"}`).Code)
+
+	list, err := s.orch.storage.UserExpressions(context.Background(), storage.ExpressionQuery{UserID: s.user, Limit: 10})
+	require.NoError(t, err)
+	assert.Len(t, list, 2)
+}
+
+func TestTaskHandler_NoTasks(t *testing.T) {
+	s := newTestServer(t)
+
+	rec := s.do(s.orch.TaskHandler, http.MethodGet, "/internal/tasks", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestTaskHandler_ResultTwice(t *testing.T) {
+	s := newTestServer(t)
+	s.calculate("2 * 3")
+
+	rec := s.do(s.orch.TaskHandler, http.MethodGet, "/internal/tasks", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var claimed taskResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &claimed))
+
+	body := `{"id": ` + jsonID(claimed.Task.ID) + `, "result": 6}`
+	rec = s.do(s.orch.TaskHandler, http.MethodPost, "/internal/tasks", body)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = s.do(s.orch.TaskHandler, http.MethodPost, "/internal/tasks", body)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+}
+
+func TestGetExpressionByID_OtherUser(t *testing.T) {
+	s := newTestServer(t)
+	id := s.calculate("1 + 1")
+	s.user++
+
+	rec := s.do(s.orch.GetExpressionByIDHandler, http.MethodGet, "/api/v1/expressions/"+jsonID(id), "", "id", jsonID(id))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestHandleTaskEvent(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+
+	// complete is what another orchestrator does, its notification is
+	// left to the test
+	complete := func(result float64) uint {
+		rec := s.do(s.orch.TaskHandler, http.MethodGet, "/internal/tasks", "")
+		require.Equal(t, http.StatusOK, rec.Code)
+		var claimed taskResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &claimed))
+		_, err := s.orch.storage.CompleteTask(ctx, storage.TaskResult{ID: claimed.Task.ID, Result: result})
+		require.NoError(t, err)
+		return claimed.Task.ExpressionID
+	}
+	status := func(id uint) string {
+		expr, err := s.orch.storage.Expression(ctx, id)
+		require.NoError(t, err)
+		return expr.Status
+	}
+
+	// completed while the listener was disconnected, nobody was told
+	s.calculate("2 + 3")
+	missed := complete(5)
+	assert.Equal(t, "in_progress", status(missed))
+
+	s.orch.handleTaskEvent(storage.TaskEvent{Type: storage.TaskEventSubscribed})
+	assert.True(t, s.orch.remoteEvents.Load())
+
+	s.calculate("4 * 2")
+	id := complete(8)
+	// the listener never waits for the refresh loop
+	for range 1000 {
+		s.orch.handleTaskEvent(storage.TaskEvent{Type: storage.TaskEventCompleted, ExpressionID: id})
+	}
+	assert.Equal(t, "in_progress", status(id))
+
+	loopCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go s.orch.refreshLoop(loopCtx)
+
+	assert.Eventually(t, func() bool {
+		return status(missed) == "completed" && status(id) == "completed"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	s.orch.handleTaskEvent(storage.TaskEvent{Type: storage.TaskEventUnsubscribed})
+	assert.False(t, s.orch.remoteEvents.Load())
+}
+
+func TestDrain_RefusesNewWork(t *testing.T) {
+	s := newTestServer(t)
+	s.calculate("1 + 1")
+	s.orch.Drain()
+
+	rec := s.do(s.orch.CalculateHandler, http.MethodPost, "/api/v1/calculate", `{"expression": "2 + 2"}`)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	rec = s.do(s.orch.TaskBatchHandler, http.MethodGet, "/internal/tasks/batch?wait=1m", "")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
+
+func TestAgentOffline_ReleasesTasks(t *testing.T) {
+	s := newTestServer(t)
+	s.calculate("1 + 1")
+	s.agent = "agent-1"
+
+	rec := s.do(s.orch.AgentHeartbeatHandler, http.MethodPost, "/internal/agents/agent-1/heartbeat", `{"workers": 2}`, "id", "agent-1")
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = s.do(s.orch.TaskBatchHandler, http.MethodGet, "/internal/tasks/batch", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = s.do(s.orch.AgentOfflineHandler, http.MethodPost, "/internal/agents/agent-1/offline", "", "id", "agent-1")
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var released releaseResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &released))
+	assert.Equal(t, int64(1), released.Released)
+
+	agents, err := s.orch.storage.Agents(context.Background())
+	require.NoError(t, err)
+	require.Len(t, agents, 1)
+	assert.Equal(t, agentOffline, agents[0].Status)
+
+	s.agent = "agent-2"
+	rec = s.do(s.orch.TaskBatchHandler, http.MethodGet, "/internal/tasks/batch", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestGetExpressionTimeline(t *testing.T) {
+	s := newTestServer(t)
+	id := s.calculate("2 + 3")
+	s.agent = "agent-1"
+
+	rec := s.do(s.orch.TaskBatchHandler, http.MethodGet, "/internal/tasks/batch", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var claimed tasksResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &claimed))
+
+	body := `{"results": [{"id": ` + jsonID(claimed.Tasks[0].ID) + `, "result": 5, "started_at": "` +
+		time.Now().UTC().Format(time.RFC3339Nano) + `"}]}`
+	rec = s.do(s.orch.TaskBatchHandler, http.MethodPost, "/internal/tasks/batch", body)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = s.do(s.orch.GetExpressionTimelineHandler, http.MethodGet, "/api/v1/expressions/"+jsonID(id)+"/timeline", "", "id", jsonID(id))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var timeline timelineResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &timeline))
+	assert.Equal(t, "completed", timeline.Expression.Status)
+	require.NotNil(t, timeline.Expression.FinishedAt)
+	require.Len(t, timeline.Tasks, 1)
+	assert.Equal(t, "agent-1", timeline.Tasks[0].AgentID)
+	assert.Equal(t, 1, timeline.Tasks[0].Attempts)
+	assert.NotNil(t, timeline.Tasks[0].StartedAt)
+	assert.Equal(t, "created", timeline.Events[0].Type)
+	assert.Equal(t, "status", timeline.Events[len(timeline.Events)-1].Type)
+
+	s.user++
+	rec = s.do(s.orch.GetExpressionTimelineHandler, http.MethodGet, "/api/v1/expressions/"+jsonID(id)+"/timeline", "", "id", jsonID(id))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestFinishedExpression_QueuesWebhooks(t *testing.T) {
+	s := newTestServer(t)
+
+	rec := s.do(s.orch.WebhooksHandler, http.MethodPost, "/api/v1/webhooks", `{"url": "http://example.com/account"}`)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	rec = s.do(s.orch.WebhooksHandler, http.MethodPost, "/api/v1/webhooks", `{"url": "http://example.com/account"}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	rec = s.do(s.orch.WebhooksHandler, http.MethodPost, "/api/v1/webhooks", `{"url": "ftp://example.com"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	rec = s.do(s.orch.WebhooksHandler, http.MethodPost, "/api/v1/webhooks", `{"url": "http://169.254.169.254/latest"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	rec = s.do(s.orch.CalculateHandler, http.MethodPost, "/api/v1/calculate",
+		`{"expression": "2 + 3", "webhook_url": "http://127.0.0.1:8080/"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+
+	rec = s.do(s.orch.CalculateHandler, http.MethodPost, "/api/v1/calculate",
+		`{"expression": "2 + 3", "webhook_url": "http://example.com/once"}`)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var created calculateResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &created))
+
+	rec = s.do(s.orch.TaskBatchHandler, http.MethodGet, "/internal/tasks/batch", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var claimed tasksResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &claimed))
+
+	body := `{"results": [{"id": ` + jsonID(claimed.Tasks[0].ID) + `, "result": 5}]}`
+	rec = s.do(s.orch.TaskBatchHandler, http.MethodPost, "/internal/tasks/batch", body)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = s.do(s.orch.WebhookDeliveriesHandler, http.MethodGet, "/api/v1/webhooks/deliveries?expression_id="+jsonID(created.ID), "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var listed deliveriesResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &listed))
+	require.Len(t, listed.Deliveries, 2)
+	var urls []string
+	for _, delivery := range listed.Deliveries {
+		urls = append(urls, delivery.URL)
+		assert.Contains(t, delivery.Payload, `"event":"expression.completed"`)
+		assert.Contains(t, delivery.Payload, `"finished_at"`)
+	}
+	assert.ElementsMatch(t, []string{"http://example.com/account", "http://example.com/once"}, urls)
+
+	id := jsonID(listed.Deliveries[0].ID)
+	rec = s.do(s.orch.RedeliverWebhookHandler, http.MethodPost, "/api/v1/webhooks/deliveries/"+id+"/redeliver", "", "id", id)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+
+	s.user++
+	rec = s.do(s.orch.WebhookDeliveryHandler, http.MethodGet, "/api/v1/webhooks/deliveries/"+id, "", "id", id)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestAgentAuth(t *testing.T) {
+	s := newTestServer(t)
+	s.calculate("2 + 3")
+
+	e := echo.New()
+	agents := e.Group("/internal", middleware.AgentAuthMiddleware(s.orch.storage))
+	agents.GET("/tasks", s.orch.TaskHandler)
+	agents.POST("/tasks", s.orch.TaskHandler)
+	agents.POST("/agents/:id/heartbeat", s.orch.AgentHeartbeatHandler)
+
+	call := func(method, target, agentID, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(agentIDHeader, agentID)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// tokens are issued by admins only
+	rec := s.do(s.orch.AdminAgentTokenHandler, http.MethodPost, "/api/v1/admin/agents/agent-1/token", "", "id", "agent-1")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	s.orch.cfg.AdminUsers = []string{"alice"}
+
+	issue := func(agentID string) string {
+		rec := s.do(s.orch.AdminAgentTokenHandler, http.MethodPost, "/api/v1/admin/agents/"+agentID+"/token", "", "id", agentID)
+		require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+		var resp agentTokenResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		require.NotEmpty(t, resp.Token)
+		return resp.Token
+	}
+	token1 := issue("agent-1")
+	token2 := issue("agent-2")
+
+	assert.Equal(t, http.StatusUnauthorized, call(http.MethodGet, "/internal/tasks", "agent-1", "", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, call(http.MethodGet, "/internal/tasks", "agent-3", token1, "").Code)
+	assert.Equal(t, http.StatusUnauthorized, call(http.MethodGet, "/internal/tasks", "agent-2", token1, "").Code)
+
+	// an agent speaks only for itself
+	rec = call(http.MethodPost, "/internal/agents/agent-2/heartbeat", "agent-1", token1, `{"workers": 1}`)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec = call(http.MethodPost, "/internal/agents/agent-1/heartbeat", "agent-1", token1, `{"workers": 1}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = call(http.MethodGet, "/internal/tasks", "agent-1", token1, "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var claimed taskResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &claimed))
+	assert.Equal(t, "agent-1", claimed.Task.AgentID)
+
+	// the result is only taken from the agent holding the lease
+	body := `{"id": ` + jsonID(claimed.Task.ID) + `, "result": 5}`
+	rec = call(http.MethodPost, "/internal/tasks", "agent-2", token2, body)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	rec = call(http.MethodPost, "/internal/tasks", "agent-1", token1, body)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// a new token replaces the old one, a revoked agent is unknown
+	token1 = issue("agent-1")
+	assert.Equal(t, http.StatusUnauthorized, call(http.MethodGet, "/internal/tasks", "agent-1", token2, "").Code)
+	rec = s.do(s.orch.AdminAgentTokenHandler, http.MethodDelete, "/api/v1/admin/agents/agent-1/token", "", "id", "agent-1")
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, http.StatusUnauthorized, call(http.MethodGet, "/internal/tasks", "agent-1", token1, "").Code)
+	rec = s.do(s.orch.AdminAgentTokenHandler, http.MethodDelete, "/api/v1/admin/agents/agent-1/token", "", "id", "agent-1")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func jsonID(id uint) string {
+	b, _ := json.Marshal(id)
+	return string(b)
+}
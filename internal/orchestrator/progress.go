@@ -0,0 +1,146 @@
+package orchestrator
+
+import (
+	"container/heap"
+	"context"
+	"sort"
+	"time"
+
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+)
+
+// agentLiveIntervals is how many missed heartbeats make an agent count as gone
+const agentLiveIntervals = 3
+
+type expressionProgress struct {
+	Total     int     `json:"total"`
+	Completed int     `json:"completed"`
+	Running   int     `json:"running"`
+	Pending   int     `json:"pending"`
+	Cancelled int     `json:"cancelled"`
+	Percent   float64 `json:"percent"`
+	// Workers is the number of live agent workers the estimate assumes
+	Workers int `json:"workers"`
+	// ETAMS and EstimatedCompletionAt are omitted while no agent can run
+	// the pending tasks
+	ETAMS                 *int64     `json:"eta_ms,omitempty"`
+	EstimatedCompletionAt *time.Time `json:"estimated_completion_at,omitempty"`
+}
+
+// liveWorkers sums the workers of agents that sent a heartbeat recently
+func (o *Orchestrator) liveWorkers(ctx context.Context, now time.Time) int {
+	agents, err := o.storage.Agents(ctx)
+	if err != nil {
+		return 0
+	}
+
+	cutoff := now.Add(-agentLiveIntervals * time.Duration(o.cfg.HeartbeatIntervalMS) * time.Millisecond)
+	workers := 0
+	for _, agent := range agents {
+		if agent.Status == agentOnline && agent.LastSeenAt.After(cutoff) {
+			workers += agent.Workers
+		}
+	}
+
+	return workers
+}
+
+// estimateProgress counts tasks by status and estimates when the expression
+// finishes. Tasks do not depend on each other, so the remaining critical
+// path is the longest remaining task; with fewer workers than tasks the
+// pending ones are scheduled in queue order on the first free worker.
+func estimateProgress(expr models.Expression, workers int, now time.Time) expressionProgress {
+	p := expressionProgress{Total: len(expr.Tasks), Workers: workers}
+
+	var running []time.Duration
+	var pending []models.Task
+	for _, task := range expr.Tasks {
+		switch task.Status {
+		case "completed":
+			p.Completed++
+		case "in_progress":
+			p.Running++
+			running = append(running, remaining(task, now))
+		case "cancelled":
+			p.Cancelled++
+		default:
+			p.Pending++
+			pending = append(pending, task)
+		}
+	}
+
+	if p.Total > 0 {
+		p.Percent = float64(p.Completed) * 100 / float64(p.Total)
+	}
+
+	if expr.Status != "in_progress" {
+		// a cancelled or timed out expression never completes
+		if expr.FinishedAt != nil && (expr.Status == "completed" || expr.Status == "error") {
+			eta := int64(0)
+			p.ETAMS = &eta
+			p.EstimatedCompletionAt = expr.FinishedAt
+		}
+		return p
+	}
+
+	// running tasks already hold a worker even if the agent is not registered
+	if workers < len(running) {
+		workers = len(running)
+	}
+	if workers == 0 {
+		return p
+	}
+
+	free := make(durationHeap, workers)
+	copy(free, running)
+	heap.Init(&free)
+
+	sort.Slice(pending, func(i, j int) bool { return pending[i].ID < pending[j].ID })
+	for _, task := range pending {
+		start := heap.Pop(&free).(time.Duration)
+		heap.Push(&free, start+time.Duration(task.OperationTime)*time.Millisecond)
+	}
+
+	var eta time.Duration
+	for _, d := range free {
+		if d > eta {
+			eta = d
+		}
+	}
+
+	etaMS := eta.Milliseconds()
+	at := now.Add(eta)
+	p.ETAMS = &etaMS
+	p.EstimatedCompletionAt = &at
+
+	return p
+}
+
+// remaining is how much of the operation time a running task still needs
+func remaining(task models.Task, now time.Time) time.Duration {
+	left := time.Duration(task.OperationTime) * time.Millisecond
+	if task.LeasedAt != nil {
+		left -= now.Sub(*task.LeasedAt)
+	}
+	if left < 0 {
+		return 0
+	}
+
+	return left
+}
+
+// durationHeap holds the times at which workers become free
+type durationHeap []time.Duration
+
+func (h durationHeap) Len() int           { return len(h) }
+func (h durationHeap) Less(i, j int) bool { return h[i] < h[j] }
+func (h durationHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *durationHeap) Push(x interface{}) { *h = append(*h, x.(time.Duration)) }
+
+func (h *durationHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,57 @@
+package orchestrator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+)
+
+func TestEstimateProgress_SchedulesPendingOnFreeWorkers(t *testing.T) {
+	now := time.Now()
+	leased := now.Add(-time.Second)
+	expr := models.Expression{Status: "in_progress", Tasks: []models.Task{
+		{ID: 1, Status: "completed", OperationTime: 3000},
+		{ID: 2, Status: "in_progress", OperationTime: 3000, LeasedAt: &leased},
+		{ID: 3, Status: "pending", OperationTime: 5000},
+		{ID: 4, Status: "pending", OperationTime: 5000},
+	}}
+
+	p := estimateProgress(expr, 2, now)
+	assert.Equal(t, 4, p.Total)
+	assert.Equal(t, 1, p.Completed)
+	assert.Equal(t, 1, p.Running)
+	assert.Equal(t, 2, p.Pending)
+	assert.Equal(t, 25.0, p.Percent)
+
+	// task 3 starts right away, task 4 after task 2 frees its worker in 2s
+	require.NotNil(t, p.ETAMS)
+	assert.Equal(t, int64(7000), *p.ETAMS)
+	assert.Equal(t, now.Add(7*time.Second), *p.EstimatedCompletionAt)
+}
+
+func TestEstimateProgress_NoWorkers(t *testing.T) {
+	expr := models.Expression{Status: "in_progress", Tasks: []models.Task{
+		{ID: 1, Status: "pending", OperationTime: 1000},
+	}}
+
+	p := estimateProgress(expr, 0, time.Now())
+	assert.Nil(t, p.ETAMS)
+	assert.Nil(t, p.EstimatedCompletionAt)
+}
+
+func TestEstimateProgress_Finished(t *testing.T) {
+	finished := time.Now().Add(-time.Minute)
+	expr := models.Expression{Status: "completed", FinishedAt: &finished, Tasks: []models.Task{
+		{ID: 1, Status: "completed"},
+	}}
+
+	p := estimateProgress(expr, 0, time.Now())
+	assert.Equal(t, 100.0, p.Percent)
+	require.NotNil(t, p.ETAMS)
+	assert.Equal(t, int64(0), *p.ETAMS)
+	assert.Equal(t, finished, *p.EstimatedCompletionAt)
+}
@@ -0,0 +1,367 @@
+package orchestrator
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+)
+
+const (
+	// queueMinutes is the default throughput window of GET /internal/queue
+	queueMinutes    = 10
+	maxQueueMinutes = 60
+	// queueUsers is the default number of users in the backlog
+	queueUsers    = 20
+	maxQueueUsers = 1000
+)
+
+type oldestPending struct {
+	TaskID       uint      `json:"task_id"`
+	ExpressionID uint      `json:"expression_id"`
+	UserID       uint      `json:"user_id"`
+	Operation    string    `json:"operation"`
+	QueuedAt     time.Time `json:"queued_at"`
+	AgeMS        int64     `json:"age_ms"`
+}
+
+type leaseHolder struct {
+	AgentID        string     `json:"agent_id"`
+	Tasks          int        `json:"tasks"`
+	OldestLeasedAt *time.Time `json:"oldest_leased_at"`
+	NextExpiry     *time.Time `json:"next_expiry"`
+}
+
+type userBacklog struct {
+	UserID  uint `json:"user_id"`
+	Pending int  `json:"pending"`
+	Running int  `json:"running"`
+}
+
+type throughputMinute struct {
+	Minute    time.Time `json:"minute"`
+	Completed int       `json:"completed"`
+}
+
+type queueResponse struct {
+	// Tasks counts tasks by status and operation, Totals by status only
+	Tasks         map[string]map[string]int `json:"tasks"`
+	Totals        map[string]int            `json:"totals"`
+	OldestPending *oldestPending            `json:"oldest_pending"`
+	Leases        []leaseHolder             `json:"leases"`
+	Backlog       []userBacklog             `json:"backlog"`
+	Throughput    []throughputMinute        `json:"throughput"`
+	MeasuredAt    time.Time                 `json:"measured_at"`
+}
+
+// priorityRequest moves work to another class and priority, an empty
+// class keeps the current one
+type priorityRequest struct {
+	Class    string `json:"class"`
+	Priority int    `json:"priority"`
+}
+
+// requireAdmin answers 403 and reports false unless the user is one of
+// ADMIN_USERS
+func (o *Orchestrator) requireAdmin(c echo.Context) (bool, error) {
+	username, _ := c.Get("username").(string)
+	if !slices.Contains(o.cfg.AdminUsers, username) {
+		return false, c.JSON(http.StatusForbidden, map[string]string{"error": "Forbidden"})
+	}
+	return true, nil
+}
+
+// queryLimit reads a positive integer query parameter, def when it is absent
+func queryLimit(c echo.Context, name string, def, maximum int) (int, bool) {
+	value := c.QueryParam(name)
+	if value == "" {
+		return def, true
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, false
+	}
+	return min(n, maximum), true
+}
+
+// QueueHandler describes the task queue to admins: counts by status and
+// operation, the oldest pending task, lease holders, the per-user backlog
+// and the tasks completed per minute
+func (o *Orchestrator) QueueHandler(c echo.Context) error {
+	if ok, err := o.requireAdmin(c); !ok {
+		return err
+	}
+
+	minutes, ok := queryLimit(c, "minutes", queueMinutes, maxQueueMinutes)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid minutes"})
+	}
+	users, ok := queryLimit(c, "users", queueUsers, maxQueueUsers)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid users"})
+	}
+
+	now := time.Now().UTC()
+	stats, err := o.storage.QueueStats(c.Request().Context(), storage.QueueStatsQuery{
+		Now:     now,
+		Minutes: minutes,
+		Users:   users,
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch queue stats"})
+	}
+
+	return c.JSON(http.StatusOK, newQueueResponse(stats, now, minutes))
+}
+
+func newQueueResponse(stats storage.QueueStats, now time.Time, minutes int) queueResponse {
+	resp := queueResponse{
+		Tasks:      make(map[string]map[string]int),
+		Totals:     make(map[string]int),
+		Leases:     make([]leaseHolder, len(stats.Leases)),
+		Backlog:    make([]userBacklog, len(stats.Backlog)),
+		Throughput: make([]throughputMinute, len(stats.Throughput)),
+		MeasuredAt: now,
+	}
+
+	for _, count := range stats.Counts {
+		if resp.Tasks[count.Status] == nil {
+			resp.Tasks[count.Status] = make(map[string]int)
+		}
+		resp.Tasks[count.Status][count.Operation] += count.Count
+		resp.Totals[count.Status] += count.Count
+	}
+
+	if task := stats.OldestPending; task != nil {
+		queuedAt := task.CreatedAt
+		if task.QueuedAt != nil {
+			queuedAt = *task.QueuedAt
+		}
+		resp.OldestPending = &oldestPending{
+			TaskID:       task.ID,
+			ExpressionID: task.ExpressionID,
+			UserID:       task.UserID,
+			Operation:    task.Operation,
+			QueuedAt:     queuedAt,
+			AgeMS:        max(now.Sub(queuedAt).Milliseconds(), 0),
+		}
+	}
+
+	for i, holder := range stats.Leases {
+		resp.Leases[i] = leaseHolder(holder)
+	}
+	for i, user := range stats.Backlog {
+		resp.Backlog[i] = userBacklog(user)
+	}
+
+	start := now.Truncate(time.Minute).Add(-time.Duration(minutes-1) * time.Minute)
+	for i, completed := range stats.Throughput {
+		resp.Throughput[i] = throughputMinute{Minute: start.Add(time.Duration(i) * time.Minute), Completed: completed}
+	}
+
+	return resp
+}
+
+// QueueTaskHandler lets admins requeue, drop or reprioritise the :id task.
+// A task is only dropped together with its expression, which cannot
+// finish without it
+func (o *Orchestrator) QueueTaskHandler(c echo.Context) error {
+	if ok, err := o.requireAdmin(c); !ok {
+		return err
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id < 1 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+	}
+	ctx := c.Request().Context()
+
+	tasks, err := o.storage.Tasks(ctx, []uint{uint(id)})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch task"})
+	}
+	if len(tasks) == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Task not found"})
+	}
+	task := tasks[0]
+
+	switch c.Param("action") {
+	case "requeue":
+		return o.requeue(c, []uint{task.ID})
+
+	case "drop":
+		return o.drop(c, task.ExpressionID)
+
+	case "priority":
+		var req priorityRequest
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": "Invalid data"})
+		}
+		class, ok := priorityClass(req.Class, task.Class)
+		if !ok {
+			return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": "Invalid class"})
+		}
+
+		task, err = o.storage.PrioritizeTask(ctx, task.ID, class, req.Priority)
+		if err != nil {
+			if errors.Is(err, storage.ErrTaskFinished) {
+				return c.JSON(http.StatusConflict, map[string]string{"error": "Task is already finished"})
+			}
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to reprioritise task"})
+		}
+		log.Printf("Task %d moved to class %q priority %d", task.ID, task.Class, task.Priority)
+
+		return c.JSON(http.StatusOK, task)
+	}
+
+	return c.JSON(http.StatusNotFound, map[string]string{"error": "Unknown action"})
+}
+
+// QueueExpressionHandler lets admins requeue the in_progress tasks of the
+// :id expression, drop it or reprioritise it with its unfinished tasks
+func (o *Orchestrator) QueueExpressionHandler(c echo.Context) error {
+	if ok, err := o.requireAdmin(c); !ok {
+		return err
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id < 1 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+	}
+	ctx := c.Request().Context()
+
+	expression, err := o.storage.Expression(ctx, uint(id))
+	if err != nil {
+		if errors.Is(err, storage.ErrExpressionNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Expression not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch expression"})
+	}
+
+	switch c.Param("action") {
+	case "requeue":
+		var ids []uint
+		for _, task := range expression.Tasks {
+			if task.Status == "in_progress" {
+				ids = append(ids, task.ID)
+			}
+		}
+		return o.requeue(c, ids)
+
+	case "drop":
+		return o.drop(c, expression.ID)
+
+	case "priority":
+		var req priorityRequest
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": "Invalid data"})
+		}
+		class, ok := priorityClass(req.Class, expression.Class)
+		if !ok {
+			return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": "Invalid class"})
+		}
+
+		expression, err = o.storage.PrioritizeExpression(ctx, expression.ID, class, req.Priority)
+		if err != nil {
+			if errors.Is(err, storage.ErrExpressionFinished) {
+				return c.JSON(http.StatusConflict, map[string]string{"error": "Expression is already finished"})
+			}
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to reprioritise expression"})
+		}
+		log.Printf("Expression %d moved to class %q priority %d", expression.ID, expression.Class, expression.Priority)
+
+		return c.JSON(http.StatusOK, expressionResponse{
+			Expression: expression,
+			Progress:   estimateProgress(expression, 0, time.Now()),
+		})
+	}
+
+	return c.JSON(http.StatusNotFound, map[string]string{"error": "Unknown action"})
+}
+
+// QueueAgentHandler lets admins quarantine the :id agent, which then gets
+// no tasks, or release it with its disagreements forgotten
+func (o *Orchestrator) QueueAgentHandler(c echo.Context) error {
+	if ok, err := o.requireAdmin(c); !ok {
+		return err
+	}
+
+	var quarantined bool
+	switch c.Param("action") {
+	case "quarantine":
+		quarantined = true
+	case "release":
+	default:
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Unknown action"})
+	}
+	ctx := c.Request().Context()
+
+	agent, err := o.storage.SetAgentQuarantine(ctx, c.Param("id"), quarantined)
+	if err != nil {
+		if errors.Is(err, storage.ErrAgentNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Agent not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update agent"})
+	}
+	if quarantined {
+		log.Printf("Agent %q quarantined by admin request", agent.ID)
+		o.requeueAgentTasks(ctx, agent.ID)
+	} else {
+		log.Printf("Agent %q released from quarantine by admin request", agent.ID)
+	}
+
+	return c.JSON(http.StatusOK, agent)
+}
+
+// priorityClass validates the requested class, empty keeps current
+func priorityClass(class, current string) (string, bool) {
+	switch class {
+	case "":
+		return current, true
+	case storage.ClassInteractive, storage.ClassBatch:
+		return class, true
+	}
+	return "", false
+}
+
+// requeue takes the in_progress tasks from their agents and queues them again
+func (o *Orchestrator) requeue(c echo.Context, ids []uint) error {
+	ctx := c.Request().Context()
+
+	requeued, err := o.storage.RequeueTasks(ctx, ids, storage.ReasonRequeued)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to requeue tasks"})
+	}
+	if requeued > 0 {
+		log.Printf("Requeued %d tasks by admin request", requeued)
+		o.publish(ctx, storage.TaskEvent{Type: storage.TaskEventReady})
+	}
+
+	return c.JSON(http.StatusOK, map[string]int64{"requeued": requeued})
+}
+
+// drop cancels the expression with its unfinished tasks
+func (o *Orchestrator) drop(c echo.Context, id uint) error {
+	expression, err := o.cancelExpression(c.Request().Context(), id, storage.ReasonDropped)
+	if err != nil {
+		if errors.Is(err, storage.ErrExpressionFinished) {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Expression is already finished"})
+		}
+		if errors.Is(err, storage.ErrExpressionNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Expression not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to drop expression"})
+	}
+	log.Printf("Expression %d dropped by admin request", expression.ID)
+
+	return c.JSON(http.StatusOK, expressionResponse{
+		Expression: expression,
+		Progress:   estimateProgress(expression, 0, time.Now()),
+	})
+}
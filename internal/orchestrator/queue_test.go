@@ -0,0 +1,70 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+)
+
+func TestQueue(t *testing.T) {
+	s := newTestServer(t)
+	s.agent = "agent-1"
+	id := s.calculate("1 + 2 * 3 - 4")
+
+	rec := s.do(s.orch.TaskBatchHandler, http.MethodGet, "/internal/tasks/batch?limit=1", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var claimed tasksResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &claimed))
+	require.Len(t, claimed.Tasks, 1)
+	taskID := jsonID(claimed.Tasks[0].ID)
+
+	rec = s.do(s.orch.QueueHandler, http.MethodGet, "/internal/queue", "")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	s.orch.cfg.AdminUsers = []string{"alice"}
+	rec = s.do(s.orch.QueueHandler, http.MethodGet, "/internal/queue?minutes=x", "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = s.do(s.orch.QueueHandler, http.MethodGet, "/internal/queue?minutes=3", "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var queue queueResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &queue))
+	assert.Equal(t, map[string]int{"pending": 2, "in_progress": 1}, queue.Totals)
+	require.NotNil(t, queue.OldestPending)
+	assert.Equal(t, id, queue.OldestPending.ExpressionID)
+	require.Len(t, queue.Leases, 1)
+	assert.Equal(t, "agent-1", queue.Leases[0].AgentID)
+	assert.Equal(t, []userBacklog{{UserID: s.user, Pending: 2, Running: 1}}, queue.Backlog)
+	assert.Len(t, queue.Throughput, 3)
+
+	rec = s.do(s.orch.QueueTaskHandler, http.MethodPost, "/internal/queue/tasks/"+taskID+"/requeue", "", "id", taskID, "action", "requeue")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.JSONEq(t, `{"requeued": 1}`, rec.Body.String())
+
+	rec = s.do(s.orch.QueueTaskHandler, http.MethodPost, "/internal/queue/tasks/"+taskID+"/priority", `{"class": "nope"}`, "id", taskID, "action", "priority")
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	rec = s.do(s.orch.QueueTaskHandler, http.MethodPost, "/internal/queue/tasks/"+taskID+"/shuffle", "", "id", taskID, "action", "shuffle")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	exprID := jsonID(id)
+	rec = s.do(s.orch.QueueExpressionHandler, http.MethodPost, "/internal/queue/expressions/"+exprID+"/priority", `{"class": "batch", "priority": 3}`, "id", exprID, "action", "priority")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var resp expressionResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, storage.ClassBatch, resp.Expression.Class)
+	assert.Equal(t, 3, resp.Expression.Priority)
+
+	rec = s.do(s.orch.QueueExpressionHandler, http.MethodPost, "/internal/queue/expressions/"+exprID+"/drop", "", "id", exprID, "action", "drop")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	resp = expressionResponse{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, "cancelled", resp.Expression.Status)
+
+	rec = s.do(s.orch.QueueTaskHandler, http.MethodPost, "/internal/queue/tasks/"+taskID+"/drop", "", "id", taskID, "action", "drop")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+}
@@ -0,0 +1,297 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+)
+
+// activeRetryAfter is suggested to users at their limit of unfinished
+// expressions, there is no telling when one finishes
+const activeRetryAfter = 5 * time.Second
+
+// quotaLimits are the effective limits of a user, 0 means unlimited
+type quotaLimits struct {
+	ExpressionsPerMinute int `json:"expressions_per_minute"`
+	ActiveExpressions    int `json:"active_expressions"`
+	TasksPerDay          int `json:"tasks_per_day"`
+}
+
+// quotaOverride is what an admin sets for a user, null keeps the default
+type quotaOverride struct {
+	ExpressionsPerMinute *int `json:"expressions_per_minute"`
+	ActiveExpressions    *int `json:"active_expressions"`
+	TasksPerDay          *int `json:"tasks_per_day"`
+}
+
+type quotaUsage struct {
+	ExpressionsLastMinute int `json:"expressions_last_minute"`
+	ActiveExpressions     int `json:"active_expressions"`
+	TasksToday            int `json:"tasks_today"`
+}
+
+type quotaResponse struct {
+	Limits   quotaLimits    `json:"limits"`
+	Override *quotaOverride `json:"override,omitempty"`
+	Usage    quotaUsage     `json:"usage"`
+}
+
+// rateLimit describes one limit for the X-RateLimit-* headers
+type rateLimit struct {
+	Limit     int
+	Remaining int
+	Reset     time.Time
+}
+
+// quotaExceeded is the limit a new expression would break
+type quotaExceeded struct {
+	rateLimit
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *quotaExceeded) Error() string {
+	return e.Message
+}
+
+// quotaWindows returns the start of the minute and of the UTC day before now
+func quotaWindows(now time.Time) (minuteStart, dayStart time.Time) {
+	now = now.UTC()
+	return now.Add(-time.Minute), time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// userLimits applies the overrides of the user to the configured defaults
+func (o *Orchestrator) userLimits(ctx context.Context, userID uint) (quotaLimits, *quotaOverride, error) {
+	limits := quotaLimits{
+		ExpressionsPerMinute: o.cfg.ExpressionsPerMinute,
+		ActiveExpressions:    o.cfg.ActiveExpressions,
+		TasksPerDay:          o.cfg.TasksPerDay,
+	}
+
+	quota, err := o.storage.Quota(ctx, userID)
+	if errors.Is(err, storage.ErrQuotaNotFound) {
+		return limits, nil, nil
+	}
+	if err != nil {
+		return quotaLimits{}, nil, err
+	}
+
+	override := &quotaOverride{
+		ExpressionsPerMinute: quota.ExpressionsPerMinute,
+		ActiveExpressions:    quota.ActiveExpressions,
+		TasksPerDay:          quota.TasksPerDay,
+	}
+	if override.ExpressionsPerMinute != nil {
+		limits.ExpressionsPerMinute = *override.ExpressionsPerMinute
+	}
+	if override.ActiveExpressions != nil {
+		limits.ActiveExpressions = *override.ActiveExpressions
+	}
+	if override.TasksPerDay != nil {
+		limits.TasksPerDay = *override.TasksPerDay
+	}
+
+	return limits, override, nil
+}
+
+// checkQuota decides whether the user may create an expression of tasks
+// tasks, the returned rate limit describes the per-minute limit after it
+func checkQuota(limits quotaLimits, usage storage.Usage, tasks int, now time.Time) (*rateLimit, *quotaExceeded) {
+	_, dayStart := quotaWindows(now)
+
+	var perMinute *rateLimit
+	if limits.ExpressionsPerMinute > 0 {
+		reset := now.Add(time.Minute)
+		if usage.Recent > 0 {
+			reset = usage.OldestRecent.Add(time.Minute)
+		}
+		perMinute = &rateLimit{
+			Limit:     limits.ExpressionsPerMinute,
+			Remaining: max(limits.ExpressionsPerMinute-usage.Recent-1, 0),
+			Reset:     reset,
+		}
+		if usage.Recent >= limits.ExpressionsPerMinute {
+			perMinute.Remaining = 0
+			return nil, &quotaExceeded{
+				rateLimit:  *perMinute,
+				Message:    "Too many expressions per minute",
+				RetryAfter: reset.Sub(now),
+			}
+		}
+	}
+
+	if limits.ActiveExpressions > 0 && usage.Active >= limits.ActiveExpressions {
+		return nil, &quotaExceeded{
+			rateLimit:  rateLimit{Limit: limits.ActiveExpressions, Reset: now.Add(activeRetryAfter)},
+			Message:    "Too many unfinished expressions",
+			RetryAfter: activeRetryAfter,
+		}
+	}
+
+	if limits.TasksPerDay > 0 && usage.TasksToday+tasks > limits.TasksPerDay {
+		reset := dayStart.Add(24 * time.Hour)
+		return nil, &quotaExceeded{
+			rateLimit: rateLimit{
+				Limit:     limits.TasksPerDay,
+				Remaining: max(limits.TasksPerDay-usage.TasksToday, 0),
+				Reset:     reset,
+			},
+			Message:    "Daily task quota exceeded",
+			RetryAfter: reset.Sub(now),
+		}
+	}
+
+	return perMinute, nil
+}
+
+func setRateLimitHeaders(c echo.Context, limit rateLimit) {
+	h := c.Response().Header()
+	h.Set("X-RateLimit-Limit", strconv.Itoa(limit.Limit))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(limit.Remaining))
+	h.Set("X-RateLimit-Reset", strconv.FormatInt(limit.Reset.Unix(), 10))
+}
+
+// tooManyRequests answers 429 for the exceeded limit
+func tooManyRequests(c echo.Context, exceeded *quotaExceeded) error {
+	setRateLimitHeaders(c, exceeded.rateLimit)
+	// whole seconds, rounded up so that a retry is not early
+	retryAfter := int((exceeded.RetryAfter + time.Second - 1) / time.Second)
+	c.Response().Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+
+	return c.JSON(http.StatusTooManyRequests, map[string]string{"error": exceeded.Message})
+}
+
+// createWithinQuota saves the expression unless its user may not create
+// one right now, then it answers 429 and reports false. The usage is
+// counted in the transaction that saves the expression, so concurrent
+// requests cannot all pass the limits
+func (o *Orchestrator) createWithinQuota(c echo.Context, expr *models.Expression) (bool, error) {
+	ctx := c.Request().Context()
+	now := time.Now()
+
+	limits, _, err := o.userLimits(ctx, expr.UserID)
+	if err != nil {
+		return false, c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch quota"})
+	}
+	if limits == (quotaLimits{}) {
+		if err := o.storage.CreateExpression(ctx, expr); err != nil {
+			return false, c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to save expression with tasks"})
+		}
+		return true, nil
+	}
+
+	minuteStart, dayStart := quotaWindows(now)
+	var perMinute *rateLimit
+	err = o.storage.CreateExpressionWithinQuota(ctx, expr, minuteStart, dayStart, func(usage storage.Usage) error {
+		var exceeded *quotaExceeded
+		perMinute, exceeded = checkQuota(limits, usage, len(expr.Tasks), now)
+		if exceeded != nil {
+			return exceeded
+		}
+		return nil
+	})
+	var exceeded *quotaExceeded
+	if errors.As(err, &exceeded) {
+		return false, tooManyRequests(c, exceeded)
+	}
+	if err != nil {
+		return false, c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to save expression with tasks"})
+	}
+	if perMinute != nil {
+		setRateLimitHeaders(c, *perMinute)
+	}
+
+	return true, nil
+}
+
+func (o *Orchestrator) quotaResponse(ctx context.Context, userID uint) (quotaResponse, error) {
+	limits, override, err := o.userLimits(ctx, userID)
+	if err != nil {
+		return quotaResponse{}, err
+	}
+
+	minuteStart, dayStart := quotaWindows(time.Now())
+	usage, err := o.storage.QuotaUsage(ctx, userID, minuteStart, dayStart)
+	if err != nil {
+		return quotaResponse{}, err
+	}
+
+	return quotaResponse{
+		Limits:   limits,
+		Override: override,
+		Usage: quotaUsage{
+			ExpressionsLastMinute: usage.Recent,
+			ActiveExpressions:     usage.Active,
+			TasksToday:            usage.TasksToday,
+		},
+	}, nil
+}
+
+// QuotaHandler shows the user their limits and usage
+func (o *Orchestrator) QuotaHandler(c echo.Context) error {
+	resp, err := o.quotaResponse(c.Request().Context(), c.Get("user_id").(uint))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch quota"})
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+// AdminQuotaHandler shows (GET), overrides (PUT) or resets (DELETE) the
+// limits of the user named in the path, it is open to ADMIN_USERS only
+func (o *Orchestrator) AdminQuotaHandler(c echo.Context) error {
+	if ok, err := o.requireAdmin(c); !ok {
+		return err
+	}
+
+	ctx := c.Request().Context()
+
+	user, err := o.storage.User(ctx, c.Param("username"))
+	if err != nil {
+		if errors.Is(err, storage.ErrUserNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch user"})
+	}
+
+	switch c.Request().Method {
+	case http.MethodPut:
+		var req quotaOverride
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": "Invalid data"})
+		}
+		for _, limit := range []*int{req.ExpressionsPerMinute, req.ActiveExpressions, req.TasksPerDay} {
+			if limit != nil && *limit < 0 {
+				return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": "Limits must not be negative"})
+			}
+		}
+
+		quota := models.Quota{
+			UserID:               user.ID,
+			ExpressionsPerMinute: req.ExpressionsPerMinute,
+			ActiveExpressions:    req.ActiveExpressions,
+			TasksPerDay:          req.TasksPerDay,
+		}
+		if err := o.storage.SaveQuota(ctx, quota); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to save quota"})
+		}
+
+	case http.MethodDelete:
+		if err := o.storage.DeleteQuota(ctx, user.ID); err != nil && !errors.Is(err, storage.ErrQuotaNotFound) {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete quota"})
+		}
+	}
+
+	resp, err := o.quotaResponse(ctx, user.ID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch quota"})
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,135 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+)
+
+// reconcileBatch bounds the stuck expressions fixed per round
+const reconcileBatch = 100
+
+// reconcile repairs what a crash or a vanished agent left behind: leases
+// held by agents that are gone, expressions whose tasks are all finished
+// but whose status was never updated, and expressions that can no longer
+// finish. It runs when an instance takes the lead and then periodically.
+func (o *Orchestrator) reconcile(ctx context.Context) error {
+	now := time.Now()
+
+	if err := o.requeueOrphanedLeases(ctx, now); err != nil {
+		return err
+	}
+
+	for {
+		stuck, err := o.storage.StuckExpressions(ctx, now, reconcileBatch)
+		if err != nil {
+			return err
+		}
+		fixed := 0
+		for _, expr := range stuck {
+			if o.reconcileExpression(ctx, expr) {
+				fixed++
+			}
+		}
+		// what could not be fixed is retried next round
+		if len(stuck) < reconcileBatch || fixed == 0 {
+			return nil
+		}
+	}
+}
+
+// orphaned reports whether nobody will finish the leased task: its lease
+// never expires or its agent went offline or stopped sending heartbeats.
+// Agents that never sent one are left to the lease reaper.
+func (o *Orchestrator) orphaned(task models.Task, agents map[string]models.Agent, now time.Time) bool {
+	if task.LeaseExpiresAt == nil {
+		return true
+	}
+
+	agent, ok := agents[task.AgentID]
+	if !ok {
+		return false
+	}
+	if agent.Status == agentOffline {
+		return true
+	}
+	if o.cfg.HeartbeatIntervalMS <= 0 {
+		return false
+	}
+	cutoff := now.Add(-agentLiveIntervals * time.Duration(o.cfg.HeartbeatIntervalMS) * time.Millisecond)
+	return agent.LastSeenAt.Before(cutoff)
+}
+
+func (o *Orchestrator) requeueOrphanedLeases(ctx context.Context, now time.Time) error {
+	leased, err := o.storage.LeasedTasks(ctx)
+	if err != nil || len(leased) == 0 {
+		return err
+	}
+
+	list, err := o.storage.Agents(ctx)
+	if err != nil {
+		return err
+	}
+	agents := make(map[string]models.Agent, len(list))
+	for _, agent := range list {
+		agents[agent.ID] = agent
+	}
+
+	// the agents of a replicated task lose only their own lease
+	orphaned := make(map[string][]uint)
+	for _, task := range leased {
+		if o.orphaned(task, agents, now) {
+			log.Printf("Reconcile: task %d of expression %d is leased to gone agent %q, requeueing", task.ID, task.ExpressionID, task.AgentID)
+			orphaned[task.AgentID] = append(orphaned[task.AgentID], task.ID)
+		}
+	}
+
+	var requeued int64
+	for agentID, ids := range orphaned {
+		n, err := o.storage.ReleaseTasks(ctx, agentID, ids, storage.ReasonOrphaned)
+		if err != nil {
+			return err
+		}
+		requeued += n
+	}
+	if requeued > 0 {
+		o.publish(ctx, storage.TaskEvent{Type: storage.TaskEventReady})
+	}
+	return nil
+}
+
+// reconcileExpression finishes a stuck expression: with a cancelled task it
+// fails, otherwise its status is recomputed from the finished tasks. It
+// reports whether the expression changed.
+func (o *Orchestrator) reconcileExpression(ctx context.Context, expr models.Expression) bool {
+	for _, task := range expr.Tasks {
+		if task.Status != "cancelled" {
+			continue
+		}
+
+		failed, err := o.storage.FailExpression(ctx, expr.ID, storage.ReasonUnfinishable)
+		if errors.Is(err, storage.ErrExpressionFinished) {
+			return true
+		}
+		if err != nil {
+			log.Printf("Reconcile: failed to fail expression %d: %v", expr.ID, err)
+			return false
+		}
+		log.Printf("Reconcile: expression %d cannot finish, task %d was cancelled; %s -> error", expr.ID, task.ID, expr.Status)
+		o.enqueueWebhooks(ctx, failed)
+		o.publish(ctx, storage.TaskEvent{Type: storage.TaskEventCancelled, ExpressionID: expr.ID})
+		return true
+	}
+
+	previous := expr.Status
+	o.updateExpressionStatus(ctx, &expr)
+	if expr.Status == previous {
+		return false
+	}
+	log.Printf("Reconcile: expression %d had every task finished; %s -> %s", expr.ID, previous, expr.Status)
+	return true
+}
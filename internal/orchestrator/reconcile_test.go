@@ -0,0 +1,67 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+)
+
+func TestReconcile(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	st := s.orch.storage
+
+	// the result was saved but the orchestrator died before the expression
+	// status was updated
+	crashed := s.calculate("2 + 3")
+	s.agent = "agent-1"
+	rec := s.do(s.orch.TaskBatchHandler, http.MethodGet, "/internal/tasks/batch?limit=1", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var claimed tasksResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &claimed))
+	require.Len(t, claimed.Tasks, 1)
+	_, err := st.CompleteTask(ctx, storage.TaskResult{ID: claimed.Tasks[0].ID, Result: 5, AgentID: "agent-1"})
+	require.NoError(t, err)
+
+	// the agent holding this task went offline without handing it back
+	orphan := s.calculate("1 + 1")
+	s.agent = "agent-2"
+	rec = s.do(s.orch.TaskBatchHandler, http.MethodGet, "/internal/tasks/batch?limit=1", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, st.SaveAgent(ctx, models.Agent{ID: "agent-2", Status: agentOffline, LastSeenAt: time.Now()}))
+
+	broken := models.Expression{Expr: "4 + 4", Status: "in_progress", UserID: s.user, Tasks: []models.Task{
+		{Arg1: 4, Operation: "+", Status: "cancelled", OperationTime: 1},
+	}}
+	require.NoError(t, st.CreateExpression(ctx, &broken))
+
+	require.NoError(t, s.orch.reconcile(ctx))
+
+	expr, err := st.Expression(ctx, crashed)
+	require.NoError(t, err)
+	assert.Equal(t, "completed", expr.Status)
+	require.NotNil(t, expr.Result)
+	assert.Equal(t, 5.0, *expr.Result)
+
+	expr, err = st.Expression(ctx, orphan)
+	require.NoError(t, err)
+	assert.Equal(t, "in_progress", expr.Status)
+	assert.Equal(t, "pending", expr.Tasks[0].Status)
+
+	expr, err = st.Expression(ctx, broken.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "error", expr.Status)
+
+	// nothing is left to fix
+	stuck, err := st.StuckExpressions(ctx, time.Now(), 10)
+	require.NoError(t, err)
+	assert.Empty(t, stuck)
+}
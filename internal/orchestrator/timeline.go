@@ -0,0 +1,148 @@
+package orchestrator
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+)
+
+type timelineExpression struct {
+	ID         uint       `json:"id"`
+	Status     string     `json:"status"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	DurationMS int64      `json:"duration_ms"`
+}
+
+type timelineTask struct {
+	ID          uint       `json:"id"`
+	Operation   string     `json:"operation"`
+	Status      string     `json:"status"`
+	AgentID     string     `json:"agent_id,omitempty"`
+	Attempts    int        `json:"attempts"`
+	CreatedAt   time.Time  `json:"created_at"`
+	QueuedAt    *time.Time `json:"queued_at,omitempty"`
+	LeasedAt    *time.Time `json:"leased_at,omitempty"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	FailedAt    *time.Time `json:"failed_at,omitempty"`
+	// QueueMS is how long the last attempt waited for an agent, RunMS how
+	// long the agent worked on it
+	QueueMS int64 `json:"queue_ms"`
+	RunMS   int64 `json:"run_ms"`
+}
+
+type timelineEvent struct {
+	At      time.Time `json:"at"`
+	Type    string    `json:"type"`
+	Status  string    `json:"status"`
+	TaskID  *uint     `json:"task_id,omitempty"`
+	AgentID string    `json:"agent_id,omitempty"`
+	Detail  string    `json:"detail,omitempty"`
+}
+
+type timelineResponse struct {
+	Expression timelineExpression `json:"expression"`
+	Tasks      []timelineTask     `json:"tasks"`
+	Events     []timelineEvent    `json:"events"`
+}
+
+// GetExpressionTimelineHandler shows when every task was queued, leased,
+// started and finished and the transition log of the expression
+func (o *Orchestrator) GetExpressionTimelineHandler(c echo.Context) error {
+	expression, ok, err := o.userExpression(c)
+	if !ok {
+		return err
+	}
+
+	events, err := o.storage.ExpressionEvents(c.Request().Context(), expression.ID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch timeline"})
+	}
+
+	return c.JSON(http.StatusOK, buildTimeline(expression, events, time.Now()))
+}
+
+func buildTimeline(expr models.Expression, events []models.ExpressionEvent, now time.Time) timelineResponse {
+	resp := timelineResponse{
+		Expression: timelineExpression{
+			ID:         expr.ID,
+			Status:     expr.Status,
+			CreatedAt:  expr.CreatedAt,
+			FinishedAt: expr.FinishedAt,
+			DurationMS: millisBetween(&expr.CreatedAt, expr.FinishedAt, now),
+		},
+		Tasks:  make([]timelineTask, 0, len(expr.Tasks)),
+		Events: make([]timelineEvent, 0, len(events)),
+	}
+
+	attempts := make(map[uint]int)
+	for _, event := range events {
+		if event.Type == models.EventLeased && event.TaskID != nil {
+			attempts[*event.TaskID]++
+		}
+		resp.Events = append(resp.Events, timelineEvent{
+			At:      event.At,
+			Type:    event.Type,
+			Status:  event.Status,
+			TaskID:  event.TaskID,
+			AgentID: event.AgentID,
+			Detail:  event.Detail,
+		})
+	}
+
+	tasks := append([]models.Task(nil), expr.Tasks...)
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].Order < tasks[j].Order })
+
+	for _, task := range tasks {
+		item := timelineTask{
+			ID:          task.ID,
+			Operation:   task.Operation,
+			Status:      task.Status,
+			AgentID:     task.AgentID,
+			Attempts:    attempts[task.ID],
+			CreatedAt:   task.CreatedAt,
+			QueuedAt:    task.QueuedAt,
+			LeasedAt:    task.LeasedAt,
+			StartedAt:   task.StartedAt,
+			CompletedAt: task.CompletedAt,
+			FailedAt:    task.FailedAt,
+		}
+
+		switch task.Status {
+		case "pending":
+			item.QueueMS = millisBetween(task.QueuedAt, nil, now)
+		default:
+			item.QueueMS = millisBetween(task.QueuedAt, task.LeasedAt, now)
+			started := task.StartedAt
+			if started == nil {
+				started = task.LeasedAt
+			}
+			item.RunMS = millisBetween(started, task.CompletedAt, now)
+		}
+
+		resp.Tasks = append(resp.Tasks, item)
+	}
+
+	return resp
+}
+
+// millisBetween measures from start to end, or to now while end is unknown
+func millisBetween(start, end *time.Time, now time.Time) int64 {
+	if start == nil {
+		return 0
+	}
+
+	to := now
+	if end != nil {
+		to = *end
+	}
+	if to.Before(*start) {
+		return 0
+	}
+
+	return to.Sub(*start).Milliseconds()
+}
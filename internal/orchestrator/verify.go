@@ -0,0 +1,94 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nais2008/final_project_go_yandex/internal/fsck"
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+	"github.com/nais2008/final_project_go_yandex/internal/parser"
+)
+
+// Verification outcomes stored on the expression
+const (
+	VerificationMatch    = "match"
+	VerificationMismatch = "mismatch"
+	VerificationError    = "error"
+)
+
+type verificationStatsResponse struct {
+	Verified   uint64 `json:"verified"`
+	Mismatches uint64 `json:"mismatches"`
+	Errors     uint64 `json:"errors"`
+}
+
+// shouldVerify reports whether the completed expression is checked
+// against a local evaluation
+func (o *Orchestrator) shouldVerify(expr models.Expression) bool {
+	return expr.Verify || o.cfg.VerifyResults
+}
+
+// verifyExpression evaluates the completed expression with the parser and
+// records whether the distributed result agrees, it reports false on a
+// mismatch
+func (o *Orchestrator) verifyExpression(ctx context.Context, expr *models.Expression) bool {
+	if expr.Result == nil {
+		return true
+	}
+	o.verified.Add(1)
+
+	verification := VerificationMatch
+	var localResult *float64
+	var detail string
+
+	solved, err := parser.Solve(expr.Expr)
+	switch {
+	case err != nil:
+		o.verifyErrors.Add(1)
+		verification = VerificationError
+		detail = fmt.Sprintf("local evaluation failed: %v", err)
+	case !parser.Agree(*expr.Result, solved, o.verifyTolerance()):
+		o.mismatches.Add(1)
+		verification = VerificationMismatch
+		localResult = &solved
+		detail = fmt.Sprintf("distributed %g, local %g", *expr.Result, solved)
+		log.Printf("Expression %d result mismatch: %s", expr.ID, detail)
+	default:
+		localResult = &solved
+		detail = fmt.Sprintf("distributed %g, local %g", *expr.Result, solved)
+	}
+
+	if err := o.storage.RecordVerification(ctx, expr.ID, verification, localResult, detail); err != nil {
+		log.Printf("Failed to record verification of expression %d: %v", expr.ID, err)
+	} else {
+		expr.Verification = verification
+		expr.LocalResult = localResult
+	}
+
+	return verification != VerificationMismatch
+}
+
+func (o *Orchestrator) verifyTolerance() float64 {
+	if o.cfg.VerifyTolerance > 0 {
+		return o.cfg.VerifyTolerance
+	}
+	return fsck.DefaultTolerance
+}
+
+// VerificationStatsHandler reports how many completed results were checked
+// against a local evaluation and how many of them disagreed, it is open to
+// ADMIN_USERS only
+func (o *Orchestrator) VerificationStatsHandler(c echo.Context) error {
+	if ok, err := o.requireAdmin(c); !ok {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, verificationStatsResponse{
+		Verified:   o.verified.Load(),
+		Mismatches: o.mismatches.Load(),
+		Errors:     o.verifyErrors.Load(),
+	})
+}
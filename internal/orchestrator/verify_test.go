@@ -0,0 +1,126 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nais2008/final_project_go_yandex/internal/config"
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+)
+
+func TestVerifyResults(t *testing.T) {
+	s := newTestServer(t)
+	s.orch = NewOrchestrator(config.Config{ExpressionCacheSize: 10}, s.orch.storage)
+
+	// solve runs the only task of a new expression with the given result
+	solve := func(body string, result string) models.Expression {
+		rec := s.do(s.orch.CalculateHandler, http.MethodPost, "/api/v1/calculate", body)
+		require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+		var created calculateResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &created))
+
+		rec = s.do(s.orch.TaskHandler, http.MethodGet, "/internal/tasks", "")
+		require.Equal(t, http.StatusOK, rec.Code)
+		var claimed taskResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &claimed))
+		rec = s.do(s.orch.TaskHandler, http.MethodPost, "/internal/tasks", `{"id": `+jsonID(claimed.Task.ID)+`, "result": `+result+`}`)
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		expr, err := s.orch.storage.Expression(context.Background(), created.ID)
+		require.NoError(t, err)
+		require.Equal(t, "completed", expr.Status)
+		return expr
+	}
+
+	// not asked for, nothing is checked
+	expr := solve(`{"expression": "2 * 3"}`, "7")
+	assert.Empty(t, expr.Verification)
+	assert.Nil(t, expr.LocalResult)
+
+	expr = solve(`{"expression": "2 + 3", "verify": true}`, "5")
+	assert.Equal(t, VerificationMatch, expr.Verification)
+	require.NotNil(t, expr.LocalResult)
+	assert.Equal(t, 5.0, *expr.LocalResult)
+
+	// a faulty agent is caught and its result is not reused
+	expr = solve(`{"expression": "4 - 1", "verify": true}`, "5")
+	assert.Equal(t, VerificationMismatch, expr.Verification)
+	require.NotNil(t, expr.Result)
+	assert.Equal(t, 5.0, *expr.Result)
+	require.NotNil(t, expr.LocalResult)
+	assert.Equal(t, 3.0, *expr.LocalResult)
+	_ = solve(`{"expression": "4 - 1"}`, "3")
+
+	events, err := s.orch.storage.ExpressionEvents(context.Background(), expr.ID)
+	require.NoError(t, err)
+	require.NotEmpty(t, events)
+	last := events[len(events)-1]
+	assert.Equal(t, models.EventVerified, last.Type)
+	assert.Equal(t, "distributed 5, local 3", last.Detail)
+
+	rec := s.do(s.orch.VerificationStatsHandler, http.MethodGet, "/internal/verification", "")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	s.orch.cfg.AdminUsers = []string{"alice"}
+	rec = s.do(s.orch.VerificationStatsHandler, http.MethodGet, "/internal/verification", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var stats verificationStatsResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &stats))
+	assert.Equal(t, verificationStatsResponse{Verified: 2, Mismatches: 1}, stats)
+}
+
+func TestVerifyResults_Global(t *testing.T) {
+	s := newTestServer(t)
+	s.orch = NewOrchestrator(config.Config{VerifyResults: true}, s.orch.storage)
+	id := s.calculate("6 / 2")
+
+	rec := s.do(s.orch.TaskHandler, http.MethodGet, "/internal/tasks", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var claimed taskResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &claimed))
+	rec = s.do(s.orch.TaskHandler, http.MethodPost, "/internal/tasks", `{"id": `+jsonID(claimed.Task.ID)+`, "result": 3.0000000000001}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	expr, err := s.orch.storage.Expression(context.Background(), id)
+	require.NoError(t, err)
+	assert.Equal(t, VerificationMatch, expr.Verification)
+}
+
+func TestVerifyResults_OncePerExpression(t *testing.T) {
+	s := newTestServer(t)
+	s.orch = NewOrchestrator(config.Config{VerifyResults: true}, s.orch.storage)
+	ctx := context.Background()
+	id := s.calculate("2 + 3")
+
+	rec := s.do(s.orch.TaskHandler, http.MethodGet, "/internal/tasks", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var claimed taskResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &claimed))
+	// another instance loaded the expression before it finished
+	stale, err := s.orch.storage.Expression(ctx, id)
+	require.NoError(t, err)
+	rec = s.do(s.orch.TaskHandler, http.MethodPost, "/internal/tasks", `{"id": `+jsonID(claimed.Task.ID)+`, "result": 5}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	// and refreshes it once it hears the task completed
+	result := 5.0
+	stale.Tasks[0].Status = "completed"
+	stale.Tasks[0].Result = &result
+	s.orch.updateExpressionStatus(ctx, &stale)
+	assert.Equal(t, "completed", stale.Status)
+
+	events, err := s.orch.storage.ExpressionEvents(ctx, id)
+	require.NoError(t, err)
+	var verified int
+	for _, event := range events {
+		if event.Type == models.EventVerified {
+			verified++
+		}
+	}
+	assert.Equal(t, 1, verified)
+	assert.Equal(t, uint64(1), s.orch.verified.Load())
+}
@@ -0,0 +1,96 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+)
+
+// maxReplicas caps how many agents may compute each task of an expression
+const maxReplicas = 7
+
+// replicaAgents counts the agents that can compute a replica: online, not
+// quarantined and seen within the last heartbeats
+func (o *Orchestrator) replicaAgents(ctx context.Context, now time.Time) (int, error) {
+	agents, err := o.storage.Agents(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := now.Add(-agentLiveIntervals * time.Duration(o.cfg.HeartbeatIntervalMS) * time.Millisecond)
+	n := 0
+	for _, agent := range agents {
+		if agent.Status != agentOnline || agent.Quarantined {
+			continue
+		}
+		if o.cfg.HeartbeatIntervalMS > 0 && agent.LastSeenAt.Before(cutoff) {
+			continue
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// settleVote acts on a replicated task the submitted vote decided: the
+// agents outvoted on a completed task are recorded, an expression whose
+// task can reach no quorum fails
+func (o *Orchestrator) settleVote(ctx context.Context, task models.Task) {
+	switch task.Status {
+	case "completed":
+		votes, err := o.storage.TaskVotes(ctx, task.ID)
+		if err != nil {
+			log.Printf("Failed to load votes of task %d: %v", task.ID, err)
+			return
+		}
+		for _, agentID := range storage.CountVotes(votes, task.Replicas, o.verifyTolerance()).Dissenters {
+			o.recordDisagreement(ctx, task, agentID)
+		}
+
+	case "cancelled":
+		failed, err := o.storage.FailExpression(ctx, task.ExpressionID, storage.ReasonNoQuorum)
+		if errors.Is(err, storage.ErrExpressionFinished) {
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to fail expression %d: %v", task.ExpressionID, err)
+			return
+		}
+		log.Printf("Expression %d failed, agents did not agree on task %d", task.ExpressionID, task.ID)
+		o.enqueueWebhooks(ctx, failed)
+		o.publish(ctx, storage.TaskEvent{Type: storage.TaskEventCancelled, ExpressionID: task.ExpressionID})
+	}
+}
+
+// recordDisagreement counts the lost vote of the agent and takes its
+// tasks away once it is quarantined
+func (o *Orchestrator) recordDisagreement(ctx context.Context, task models.Task, agentID string) {
+	agent, err := o.storage.RecordDisagreement(ctx, agentID, o.cfg.QuarantineAfter)
+	if err != nil {
+		log.Printf("Failed to record disagreement of agent %q: %v", agentID, err)
+		return
+	}
+	log.Printf("Agent %q was outvoted on task %d (%d disagreements)", agentID, task.ID, agent.Disagreements)
+
+	if agent.Quarantined {
+		log.Printf("Agent %q is quarantined", agentID)
+		o.requeueAgentTasks(ctx, agentID)
+	}
+}
+
+// requeueAgentTasks hands the tasks leased to a quarantined agent to others
+func (o *Orchestrator) requeueAgentTasks(ctx context.Context, agentID string) {
+	requeued, err := o.storage.ReleaseTasks(ctx, agentID, nil, storage.ReasonQuarantined)
+	if err != nil {
+		log.Printf("Failed to requeue tasks of agent %q: %v", agentID, err)
+		return
+	}
+	if requeued > 0 {
+		log.Printf("Requeued %d tasks of quarantined agent %q", requeued, agentID)
+		o.publish(ctx, storage.TaskEvent{Type: storage.TaskEventReady})
+	}
+}
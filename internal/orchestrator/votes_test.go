@@ -0,0 +1,185 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nais2008/final_project_go_yandex/internal/config"
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+)
+
+// vote claims the only pending task as agentID and submits result
+func (s *testServer) vote(agentID, result string) {
+	s.agent = agentID
+	defer func() { s.agent = "" }()
+
+	rec := s.do(s.orch.TaskHandler, http.MethodGet, "/internal/tasks", "")
+	require.Equal(s.t, http.StatusOK, rec.Code, rec.Body.String())
+	var claimed taskResponse
+	require.NoError(s.t, json.Unmarshal(rec.Body.Bytes(), &claimed))
+
+	rec = s.do(s.orch.TaskHandler, http.MethodPost, "/internal/tasks", `{"id": `+jsonID(claimed.Task.ID)+`, "result": `+result+`}`)
+	require.Equal(s.t, http.StatusOK, rec.Code, rec.Body.String())
+}
+
+// register sends a heartbeat for each of the agents
+func (s *testServer) register(ids ...string) {
+	for _, id := range ids {
+		rec := s.do(s.orch.AgentHeartbeatHandler, http.MethodPost, "/internal/agents/"+id+"/heartbeat", `{"workers": 1}`, "id", id)
+		require.Equal(s.t, http.StatusOK, rec.Code, rec.Body.String())
+	}
+}
+
+func TestRedundantExecution(t *testing.T) {
+	s := newTestServer(t)
+	s.orch = NewOrchestrator(config.Config{QuarantineAfter: 1, ResultCacheSize: 10}, s.orch.storage)
+	ctx := context.Background()
+	s.register("agent-1", "agent-2", "agent-3")
+
+	rec := s.do(s.orch.CalculateHandler, http.MethodPost, "/api/v1/calculate", `{"expression": "2 * 3", "replicas": 8}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+
+	rec = s.do(s.orch.CalculateHandler, http.MethodPost, "/api/v1/calculate", `{"expression": "2 * 3", "replicas": 3}`)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var created calculateResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &created))
+
+	s.vote("agent-1", "6")
+	s.vote("agent-2", "7")
+	expr, err := s.orch.storage.Expression(ctx, created.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "in_progress", expr.Status)
+
+	s.vote("agent-3", "6")
+	expr, err = s.orch.storage.Expression(ctx, created.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "completed", expr.Status)
+	require.NotNil(t, expr.Result)
+	assert.Equal(t, 6.0, *expr.Result)
+
+	// the outvoted agent is quarantined and gets no more tasks
+	agents, err := s.orch.storage.Agents(ctx)
+	require.NoError(t, err)
+	require.Len(t, agents, 3)
+	assert.Equal(t, 1, agents[1].Disagreements)
+	assert.True(t, agents[1].Quarantined)
+	assert.False(t, agents[0].Quarantined)
+
+	s.calculate("1 + 1")
+	s.agent = "agent-2"
+	rec = s.do(s.orch.TaskHandler, http.MethodGet, "/internal/tasks", "")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	s.agent = ""
+
+	rec = s.do(s.orch.QueueAgentHandler, http.MethodPost, "/internal/queue/agents/agent-2/release", "", "id", "agent-2", "action", "release")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	s.orch.cfg.AdminUsers = []string{"alice"}
+	rec = s.do(s.orch.QueueAgentHandler, http.MethodPost, "/internal/queue/agents/agent-2/release", "", "id", "agent-2", "action", "release")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	s.vote("agent-2", "2")
+}
+
+func TestRedundantExecution_Parallel(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	s.register("agent-1", "agent-2", "agent-3")
+
+	// every replica needs an agent of its own
+	rec := s.do(s.orch.CalculateHandler, http.MethodPost, "/api/v1/calculate", `{"expression": "2 * 3", "replicas": 4}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+
+	rec = s.do(s.orch.CalculateHandler, http.MethodPost, "/api/v1/calculate", `{"expression": "2 * 3", "replicas": 3}`)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var created calculateResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &created))
+
+	// the three agents compute the task at the same time
+	var id uint
+	for _, agentID := range []string{"agent-1", "agent-2", "agent-3"} {
+		s.agent = agentID
+		rec = s.do(s.orch.TaskHandler, http.MethodGet, "/internal/tasks", "")
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var claimed taskResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &claimed))
+		assert.Equal(t, agentID, claimed.Task.AgentID)
+		id = claimed.Task.ID
+	}
+	s.agent = "agent-4"
+	rec = s.do(s.orch.TaskHandler, http.MethodGet, "/internal/tasks", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	leased, err := s.orch.storage.LeasedTasks(ctx)
+	require.NoError(t, err)
+	assert.Len(t, leased, 3)
+
+	result := `{"id": ` + jsonID(id) + `, "result": 6}`
+	s.agent = "agent-1"
+	rec = s.do(s.orch.TaskHandler, http.MethodPost, "/internal/tasks", result)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	s.agent = "agent-2"
+	rec = s.do(s.orch.TaskHandler, http.MethodPost, "/internal/tasks", result)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	s.agent = ""
+
+	expr, err := s.orch.storage.Expression(ctx, created.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "completed", expr.Status)
+
+	// the quorum is reached, the third agent is told to stop
+	rec = s.do(s.orch.AgentHeartbeatHandler, http.MethodPost, "/internal/agents/agent-3/heartbeat", `{"workers": 1, "tasks": [`+jsonID(id)+`]}`, "id", "agent-3")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.JSONEq(t, `{"cancel": [`+jsonID(id)+`]}`, rec.Body.String())
+}
+
+func TestRedundantExecution_NoQuorum(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	s.register("agent-1", "agent-2")
+
+	rec := s.do(s.orch.CalculateHandler, http.MethodPost, "/api/v1/calculate", `{"expression": "2 + 2", "replicas": 2}`)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var created calculateResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &created))
+
+	s.vote("agent-1", "4")
+	s.vote("agent-2", "5")
+
+	expr, err := s.orch.storage.Expression(ctx, created.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "error", expr.Status)
+	assert.Equal(t, "cancelled", expr.Tasks[0].Status)
+
+	events, err := s.orch.storage.ExpressionEvents(ctx, created.ID)
+	require.NoError(t, err)
+	var reasons []string
+	for _, event := range events {
+		reasons = append(reasons, event.Detail)
+	}
+	assert.Contains(t, reasons, storage.ReasonNoQuorum)
+}
+
+func TestRedundantExecution_Tolerance(t *testing.T) {
+	s := newTestServer(t)
+	s.orch = NewOrchestrator(config.Config{VerifyTolerance: 1e-6}, s.orch.storage)
+	ctx := context.Background()
+	s.register("agent-1", "agent-2")
+
+	rec := s.do(s.orch.CalculateHandler, http.MethodPost, "/api/v1/calculate", `{"expression": "1 / 3", "replicas": 2}`)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var created calculateResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &created))
+
+	s.vote("agent-1", "0.3333333")
+	s.vote("agent-2", "0.33333333333")
+
+	expr, err := s.orch.storage.Expression(ctx, created.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "completed", expr.Status)
+	require.NotNil(t, expr.Result)
+	assert.InDelta(t, 1.0/3, *expr.Result, 1e-6)
+}
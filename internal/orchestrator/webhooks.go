@@ -0,0 +1,224 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+	"github.com/nais2008/final_project_go_yandex/internal/webhook"
+)
+
+// maxDeliveries caps the delivery list
+const maxDeliveries = 100
+
+type webhookRequest struct {
+	URL string `json:"url"`
+}
+
+type webhookResponse struct {
+	Webhook models.Webhook `json:"webhook"`
+}
+
+type webhooksResponse struct {
+	Webhooks []models.Webhook `json:"webhooks"`
+}
+
+type secretResponse struct {
+	Secret string `json:"secret"`
+}
+
+type deliveriesResponse struct {
+	Deliveries []models.WebhookDelivery `json:"deliveries"`
+}
+
+type deliveryResponse struct {
+	Delivery models.WebhookDelivery `json:"delivery"`
+}
+
+// validWebhookURL reports whether raw is an http(s) URL of a public host
+func (o *Orchestrator) validWebhookURL(ctx context.Context, raw string) bool {
+	return o.webhooks.CheckURL(ctx, raw) == nil
+}
+
+// enqueueWebhooks queues notifications about a finished expression for the
+// account webhooks and the one given with the expression
+func (o *Orchestrator) enqueueWebhooks(ctx context.Context, expr models.Expression) {
+	hooks, err := o.storage.Webhooks(ctx, expr.UserID)
+	if err != nil {
+		log.Printf("Failed to load webhooks of user %d: %v", expr.UserID, err)
+		return
+	}
+
+	urls := []string{expr.WebhookURL}
+	for _, hook := range hooks {
+		urls = append(urls, hook.URL)
+	}
+	if len(urls) == 1 && urls[0] == "" {
+		return
+	}
+
+	// reload for the finish time stored with the status
+	stored, err := o.storage.Expression(ctx, expr.ID)
+	if err != nil {
+		log.Printf("Failed to load expression %d: %v", expr.ID, err)
+		return
+	}
+
+	deliveries, err := webhook.NewDeliveries(stored, urls, time.Now())
+	if err == nil {
+		err = o.storage.EnqueueWebhookDeliveries(ctx, deliveries)
+	}
+	if err != nil {
+		log.Printf("Failed to queue webhooks of expression %d: %v", expr.ID, err)
+	}
+}
+
+// WebhooksHandler lists and registers account webhooks
+func (o *Orchestrator) WebhooksHandler(c echo.Context) error {
+	userID := c.Get("user_id").(uint)
+	ctx := c.Request().Context()
+
+	switch c.Request().Method {
+	case http.MethodGet:
+		hooks, err := o.storage.Webhooks(ctx, userID)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch webhooks"})
+		}
+		return c.JSON(http.StatusOK, webhooksResponse{Webhooks: hooks})
+
+	case http.MethodPost:
+		var req webhookRequest
+		if err := c.Bind(&req); err != nil || !o.validWebhookURL(ctx, req.URL) {
+			return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": "Invalid webhook URL"})
+		}
+
+		hook := models.Webhook{UserID: userID, URL: req.URL}
+		if err := o.storage.CreateWebhook(ctx, &hook); err != nil {
+			if errors.Is(err, storage.ErrWebhookExists) {
+				return c.JSON(http.StatusConflict, map[string]string{"error": "Webhook already registered"})
+			}
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to save webhook"})
+		}
+		return c.JSON(http.StatusCreated, webhookResponse{Webhook: hook})
+
+	default:
+		return c.JSON(http.StatusMethodNotAllowed, map[string]string{"error": "Method not allowed"})
+	}
+}
+
+// DeleteWebhookHandler ...
+func (o *Orchestrator) DeleteWebhookHandler(c echo.Context) error {
+	userID := c.Get("user_id").(uint)
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+	}
+
+	if err := o.storage.DeleteWebhook(c.Request().Context(), userID, uint(id)); err != nil {
+		if errors.Is(err, storage.ErrWebhookNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Webhook not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete webhook"})
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// WebhookSecretHandler returns the signing secret on GET and replaces it on POST
+func (o *Orchestrator) WebhookSecretHandler(c echo.Context) error {
+	userID := c.Get("user_id").(uint)
+	ctx := c.Request().Context()
+
+	switch c.Request().Method {
+	case http.MethodGet:
+		secret, err := o.storage.EnsureWebhookSecret(ctx, userID, webhook.NewSecret())
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch secret"})
+		}
+		return c.JSON(http.StatusOK, secretResponse{Secret: secret})
+
+	case http.MethodPost:
+		secret := webhook.NewSecret()
+		if err := o.storage.SetWebhookSecret(ctx, userID, secret); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to rotate secret"})
+		}
+		return c.JSON(http.StatusOK, secretResponse{Secret: secret})
+
+	default:
+		return c.JSON(http.StatusMethodNotAllowed, map[string]string{"error": "Method not allowed"})
+	}
+}
+
+// WebhookDeliveriesHandler lists the newest deliveries, ?expression_id narrows them down
+func (o *Orchestrator) WebhookDeliveriesHandler(c echo.Context) error {
+	userID := c.Get("user_id").(uint)
+
+	var expressionID uint
+	if raw := c.QueryParam("expression_id"); raw != "" {
+		id, err := strconv.Atoi(raw)
+		if err != nil || id < 1 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid expression_id"})
+		}
+		expressionID = uint(id)
+	}
+
+	deliveries, err := o.storage.WebhookDeliveries(c.Request().Context(), userID, expressionID, maxDeliveries)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch deliveries"})
+	}
+
+	return c.JSON(http.StatusOK, deliveriesResponse{Deliveries: deliveries})
+}
+
+// WebhookDeliveryHandler shows a delivery with every attempt
+func (o *Orchestrator) WebhookDeliveryHandler(c echo.Context) error {
+	delivery, ok, err := o.userDelivery(c)
+	if !ok {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, deliveryResponse{Delivery: delivery})
+}
+
+// RedeliverWebhookHandler queues the delivery again with a fresh attempt budget
+func (o *Orchestrator) RedeliverWebhookHandler(c echo.Context) error {
+	delivery, ok, err := o.userDelivery(c)
+	if !ok {
+		return err
+	}
+
+	if err := o.storage.RedeliverWebhook(c.Request().Context(), delivery.ID, time.Now()); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to redeliver"})
+	}
+
+	return c.NoContent(http.StatusAccepted)
+}
+
+func (o *Orchestrator) userDelivery(c echo.Context) (models.WebhookDelivery, bool, error) {
+	userID := c.Get("user_id").(uint)
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return models.WebhookDelivery{}, false, c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+	}
+
+	delivery, err := o.storage.WebhookDelivery(c.Request().Context(), uint(id))
+	if err != nil {
+		if errors.Is(err, storage.ErrDeliveryNotFound) {
+			return models.WebhookDelivery{}, false, c.JSON(http.StatusNotFound, map[string]string{"error": "Delivery not found"})
+		}
+		return models.WebhookDelivery{}, false, c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch delivery"})
+	}
+	if delivery.UserID != userID {
+		return models.WebhookDelivery{}, false, c.JSON(http.StatusNotFound, map[string]string{"error": "Delivery not found"})
+	}
+
+	return delivery, true, nil
+}
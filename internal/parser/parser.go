@@ -2,6 +2,7 @@ package parser
 
 import (
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 
@@ -49,6 +50,34 @@ func Solve(expr string) (float64, error) {
 	return evaluatePostfix(queue)
 }
 
+// Normalize returns the canonical form of the expression, the same for
+// expressions that differ only in spacing or in how numbers are written
+func Normalize(expr string) (string, error) {
+	tokens, err := tokenize(strings.ReplaceAll(expr, " ", ""))
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	for _, token := range tokens {
+		if num, err := strconv.ParseFloat(token, 64); err == nil {
+			token = strconv.FormatFloat(num, 'g', -1, 64)
+		}
+		b.WriteString(token)
+	}
+
+	return b.String(), nil
+}
+
+// Agree reports whether two results are equal up to the relative tolerance,
+// near zero the tolerance is absolute
+func Agree(a, b, tolerance float64) bool {
+	if a == b {
+		return true
+	}
+	return math.Abs(a-b) <= tolerance*max(1, math.Abs(a), math.Abs(b))
+}
+
 func tokenize(expression string) ([]string, error) {
 	var tokens []string
 	var currentToken string
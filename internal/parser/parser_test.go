@@ -31,6 +31,18 @@ func TestSolve_InvalidExpression(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestNormalize(t *testing.T) {
+	a, err := parser.Normalize(" 2.50 * (1+ 03) ")
+	assert.NoError(t, err)
+	b, err := parser.Normalize("2.5*(1+3)")
+	assert.NoError(t, err)
+	assert.Equal(t, "2.5*(1+3)", a)
+	assert.Equal(t, a, b)
+
+	_, err = parser.Normalize("2 ^ 3")
+	assert.Error(t, err)
+}
+
 func TestIntegration_ParseAndSolve(t *testing.T) {
 	tasks, err := parser.ParseAndCreateTasks("10 / 2 + 3 * 4")
 	assert.NoError(t, err)
@@ -40,3 +52,11 @@ func TestIntegration_ParseAndSolve(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, float64(17), result)
 }
+
+func TestAgree(t *testing.T) {
+	assert.True(t, parser.Agree(0.1+0.2, 0.3, 1e-9))
+	assert.True(t, parser.Agree(1e12, 1e12+1, 1e-9))
+	assert.False(t, parser.Agree(1, 1.001, 1e-9))
+	assert.True(t, parser.Agree(1, 1.001, 1e-2))
+	assert.False(t, parser.Agree(0, 1e-6, 1e-9))
+}
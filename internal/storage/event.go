@@ -0,0 +1,21 @@
+package storage
+
+// TaskEvent ...
+type TaskEvent struct {
+	Type         string `json:"type"`
+	TaskID       uint   `json:"task_id"`
+	ExpressionID uint   `json:"expression_id"`
+}
+
+const (
+	// TaskEventReady ...
+	TaskEventReady = "ready"
+	// TaskEventCompleted ...
+	TaskEventCompleted = "completed"
+	// TaskEventCancelled is sent once per expression whose tasks were cancelled
+	TaskEventCancelled = "cancelled"
+	// TaskEventSubscribed is sent when the listener (re)connects, events may have been missed before it
+	TaskEventSubscribed = "subscribed"
+	// TaskEventUnsubscribed is sent when the listener loses its connection
+	TaskEventUnsubscribed = "unsubscribed"
+)
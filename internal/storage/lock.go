@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"context"
+	"sync"
+)
+
+// LocalLocker grants locks within this process only, for backends that
+// are never shared between orchestrator instances
+type LocalLocker struct {
+	mu   sync.Mutex
+	held map[int64]bool
+}
+
+// TryLock ...
+func (l *LocalLocker) TryLock(ctx context.Context, key int64) (Lock, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.held == nil {
+		l.held = make(map[int64]bool)
+	}
+	if l.held[key] {
+		return nil, ErrLockHeld
+	}
+	l.held[key] = true
+
+	return &localLock{locker: l, key: key, lost: make(chan struct{})}, nil
+}
+
+type localLock struct {
+	locker *LocalLocker
+	key    int64
+	lost   chan struct{}
+	once   sync.Once
+}
+
+// Lost ...
+func (l *localLock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Release ...
+func (l *localLock) Release() error {
+	l.once.Do(func() {
+		l.locker.mu.Lock()
+		delete(l.locker.held, l.key)
+		l.locker.mu.Unlock()
+	})
+	return nil
+}
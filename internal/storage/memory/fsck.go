@@ -0,0 +1,168 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+)
+
+// ScanExpressions ...
+func (s *Storage) ScanExpressions(ctx context.Context, after uint, limit int) ([]models.Expression, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var exprs []models.Expression
+	for id, expr := range s.expressions {
+		if id > after {
+			exprs = append(exprs, expr)
+		}
+	}
+	sort.Slice(exprs, func(i, j int) bool { return exprs[i].ID < exprs[j].ID })
+	if len(exprs) > limit {
+		exprs = exprs[:limit]
+	}
+
+	for i, expr := range exprs {
+		exprs[i] = s.withTasks(expr)
+	}
+	return exprs, nil
+}
+
+// OrphanTasks ...
+func (s *Storage) OrphanTasks(ctx context.Context) ([]models.Task, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var tasks []models.Task
+	for _, id := range s.taskIDs {
+		task := s.tasks[id]
+		if _, ok := s.expressions[task.ExpressionID]; !ok {
+			tasks = append(tasks, copyTask(task))
+		}
+	}
+
+	return tasks, nil
+}
+
+// OrphanExpressions ...
+func (s *Storage) OrphanExpressions(ctx context.Context) ([]models.Expression, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var exprs []models.Expression
+	for _, expr := range s.expressions {
+		if _, ok := s.users[expr.UserID]; !ok {
+			exprs = append(exprs, s.withTasks(expr))
+		}
+	}
+	sort.Slice(exprs, func(i, j int) bool { return exprs[i].ID < exprs[j].ID })
+
+	return exprs, nil
+}
+
+// DeleteTasks ...
+func (s *Storage) DeleteTasks(ctx context.Context, ids []uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deleteTasks(ids)
+	return nil
+}
+
+// deleteTasks forgets the tasks and their events, the caller holds the lock
+func (s *Storage) deleteTasks(ids []uint) {
+	for _, id := range ids {
+		task, ok := s.tasks[id]
+		if !ok {
+			continue
+		}
+		delete(s.tasks, id)
+		delete(s.votes, id)
+		delete(s.leases, id)
+
+		s.exprTasks[task.ExpressionID] = slices.DeleteFunc(s.exprTasks[task.ExpressionID], func(taskID uint) bool { return taskID == id })
+		s.events[task.ExpressionID] = slices.DeleteFunc(s.events[task.ExpressionID], func(event models.ExpressionEvent) bool {
+			return event.TaskID != nil && *event.TaskID == id
+		})
+	}
+	s.taskIDs = slices.DeleteFunc(s.taskIDs, func(id uint) bool {
+		_, ok := s.tasks[id]
+		return !ok
+	})
+}
+
+// DeleteExpressions ...
+func (s *Storage) DeleteExpressions(ctx context.Context, ids []uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, id := range ids {
+		s.deleteTasks(slices.Clone(s.exprTasks[id]))
+		delete(s.exprTasks, id)
+		delete(s.events, id)
+		delete(s.expressions, id)
+	}
+
+	return nil
+}
+
+// RepairTask ...
+func (s *Storage) RepairTask(ctx context.Context, id uint, status string, result *float64) error {
+	const op string = "memory.RepairTask"
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	task, ok := s.tasks[id]
+	if !ok {
+		return fmt.Errorf("%s: %w", op, storage.ErrTaskNotFound)
+	}
+
+	changed := task.Status != status
+	task.Status = status
+	task.Result = copyFloat(result)
+	if status != "pending" && status != "in_progress" {
+		task.LeaseExpiresAt = nil
+		delete(s.leases, id)
+	}
+	s.tasks[id] = task
+	if changed {
+		s.logEvents([]models.ExpressionEvent{storage.RepairEvent(task, time.Now())})
+	}
+
+	return nil
+}
+
+// RepairExpression ...
+func (s *Storage) RepairExpression(ctx context.Context, id uint, status string, result *float64) error {
+	const op string = "memory.RepairExpression"
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expr, ok := s.expressions[id]
+	if !ok {
+		return fmt.Errorf("%s: %w", op, storage.ErrExpressionNotFound)
+	}
+
+	now := time.Now()
+	expr.Status = status
+	expr.Result = copyFloat(result)
+	switch {
+	case !storage.IsFinished(status):
+		expr.FinishedAt = nil
+	case expr.FinishedAt == nil:
+		expr.FinishedAt = timePtr(now)
+	}
+	s.expressions[id] = expr
+	s.logEvents([]models.ExpressionEvent{
+		{ExpressionID: id, Type: models.EventStatus, Status: status, Detail: storage.ReasonRepaired, At: now},
+	})
+
+	return nil
+}
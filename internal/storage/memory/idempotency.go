@@ -0,0 +1,79 @@
+package memory
+
+import (
+	"context"
+	"time"
+
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+)
+
+type idempotencyKey struct {
+	userID uint
+	key    string
+}
+
+// ReserveIdempotencyKey ...
+func (s *Storage) ReserveIdempotencyKey(
+	ctx context.Context,
+	key models.IdempotencyKey,
+	now time.Time,
+) (models.IdempotencyKey, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := idempotencyKey{userID: key.UserID, key: key.Key}
+	if stored, ok := s.idempotencyKeys[id]; ok && stored.ExpiresAt.After(now) {
+		return stored, false, nil
+	}
+	s.idempotencyKeys[id] = key
+
+	return key, true, nil
+}
+
+// CompleteIdempotencyKey ...
+func (s *Storage) CompleteIdempotencyKey(
+	ctx context.Context,
+	userID uint,
+	key string,
+	statusCode int,
+	expressionID uint,
+	expiresAt time.Time,
+) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := idempotencyKey{userID: userID, key: key}
+	if stored, ok := s.idempotencyKeys[id]; ok {
+		stored.StatusCode = statusCode
+		stored.ExpressionID = expressionID
+		stored.ExpiresAt = expiresAt
+		s.idempotencyKeys[id] = stored
+	}
+
+	return nil
+}
+
+// ReleaseIdempotencyKey ...
+func (s *Storage) ReleaseIdempotencyKey(ctx context.Context, userID uint, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.idempotencyKeys, idempotencyKey{userID: userID, key: key})
+	return nil
+}
+
+// DeleteExpiredIdempotencyKeys ...
+func (s *Storage) DeleteExpiredIdempotencyKeys(ctx context.Context, now time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deleted int64
+	for id, key := range s.idempotencyKeys {
+		if !key.ExpiresAt.After(now) {
+			delete(s.idempotencyKeys, id)
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
@@ -0,0 +1,1162 @@
+package memory
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+)
+
+// Storage keeps everything in process memory, data is lost on restart
+type Storage struct {
+	storage.LocalLocker
+
+	mu sync.Mutex
+
+	users       map[uint]models.User
+	expressions map[uint]models.Expression
+	tasks       map[uint]models.Task
+	agents      map[string]models.Agent
+	credentials map[string]models.AgentCredential
+	events      map[uint][]models.ExpressionEvent
+	votes       map[uint][]models.TaskVote
+	// leases are the replica leases of each replicated task
+	leases map[uint][]models.ReplicaLease
+
+	webhooks       map[uint]models.Webhook
+	webhookSecrets map[uint]string
+	deliveries     map[uint]models.WebhookDelivery
+
+	quotas          map[uint]models.Quota
+	idempotencyKeys map[idempotencyKey]models.IdempotencyKey
+
+	// taskIDs keeps every task id in creation order, exprTasks per expression
+	taskIDs   []uint
+	exprTasks map[uint][]uint
+
+	lastUserID       uint
+	lastExpressionID uint
+	lastTaskID       uint
+	lastEventID      uint
+	lastWebhookID    uint
+	lastDeliveryID   uint
+	lastAttemptID    uint
+	lastVoteID       uint
+}
+
+// New ...
+func New() *Storage {
+	return &Storage{
+		users:       make(map[uint]models.User),
+		expressions: make(map[uint]models.Expression),
+		tasks:       make(map[uint]models.Task),
+		agents:      make(map[string]models.Agent),
+		credentials: make(map[string]models.AgentCredential),
+		events:      make(map[uint][]models.ExpressionEvent),
+		votes:       make(map[uint][]models.TaskVote),
+		leases:      make(map[uint][]models.ReplicaLease),
+		exprTasks:   make(map[uint][]uint),
+
+		webhooks:       make(map[uint]models.Webhook),
+		webhookSecrets: make(map[uint]string),
+		deliveries:     make(map[uint]models.WebhookDelivery),
+
+		quotas:          make(map[uint]models.Quota),
+		idempotencyKeys: make(map[idempotencyKey]models.IdempotencyKey),
+	}
+}
+
+// SaveUser ...
+func (s *Storage) SaveUser(
+	ctx context.Context,
+	username string,
+	email string,
+	passHash []byte,
+) (int64, error) {
+	const op string = "memory.SaveUser"
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range s.users {
+		if u.Email == email {
+			return 0, fmt.Errorf("%s: %w", op, storage.ErrUserEmailExists)
+		}
+		if u.Username == username {
+			return 0, fmt.Errorf("%s: %w", op, storage.ErrUsernameExists)
+		}
+	}
+
+	s.lastUserID++
+	s.users[s.lastUserID] = models.User{
+		ID:       s.lastUserID,
+		Username: username,
+		Email:    email,
+		Password: append([]byte(nil), passHash...),
+	}
+
+	return int64(s.lastUserID), nil
+}
+
+// User ...
+func (s *Storage) User(ctx context.Context, login string) (models.User, error) {
+	const op string = "memory.User"
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range s.users {
+		if u.Email == login || u.Username == login {
+			return u, nil
+		}
+	}
+
+	return models.User{}, fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+}
+
+// CreateExpression ...
+func (s *Storage) CreateExpression(ctx context.Context, expr *models.Expression) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.createExpression(expr)
+
+	return nil
+}
+
+func (s *Storage) createExpression(expr *models.Expression) {
+	now := time.Now()
+	s.lastExpressionID++
+	expr.ID = s.lastExpressionID
+	expr.CreatedAt = now
+
+	for i := range expr.Tasks {
+		s.lastTaskID++
+		expr.Tasks[i].ID = s.lastTaskID
+		expr.Tasks[i].ExpressionID = expr.ID
+		expr.Tasks[i].UserID = expr.UserID
+		expr.Tasks[i].Class = expr.Class
+		expr.Tasks[i].Priority = expr.Priority
+		expr.Tasks[i].Replicas = expr.Replicas
+		expr.Tasks[i].CreatedAt = now
+		switch expr.Tasks[i].Status {
+		case "pending":
+			expr.Tasks[i].QueuedAt = timePtr(now)
+		case "completed":
+			expr.Tasks[i].CompletedAt = timePtr(now)
+		}
+		s.tasks[s.lastTaskID] = copyTask(expr.Tasks[i])
+		s.taskIDs = append(s.taskIDs, s.lastTaskID)
+		s.exprTasks[expr.ID] = append(s.exprTasks[expr.ID], s.lastTaskID)
+	}
+
+	stored := *expr
+	stored.Deadline = copyTime(expr.Deadline)
+	stored.Tasks = nil
+	s.expressions[expr.ID] = stored
+	s.logEvents(storage.CreationEvents(expr, now))
+}
+
+// Expression ...
+func (s *Storage) Expression(ctx context.Context, id uint) (models.Expression, error) {
+	const op string = "memory.Expression"
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expr, ok := s.expressions[id]
+	if !ok {
+		return models.Expression{}, fmt.Errorf("%s: %w", op, storage.ErrExpressionNotFound)
+	}
+
+	return s.withTasks(expr), nil
+}
+
+// UserExpressions ...
+func (s *Storage) UserExpressions(ctx context.Context, query storage.ExpressionQuery) ([]models.Expression, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var expressions []models.Expression
+	for _, expr := range s.expressions {
+		if !matches(expr, query) {
+			continue
+		}
+		expr = s.withTasks(expr)
+		if !query.WithTasks {
+			expr.Tasks = nil
+		}
+		expressions = append(expressions, expr)
+	}
+	sort.Slice(expressions, func(i, j int) bool {
+		return before(storage.CursorOf(expressions[i]), storage.CursorOf(expressions[j]), query)
+	})
+	if len(expressions) > query.Limit {
+		expressions = expressions[:query.Limit]
+	}
+
+	return expressions, nil
+}
+
+// matches reports whether expr passes the query filters and lies past its cursor
+func matches(expr models.Expression, query storage.ExpressionQuery) bool {
+	if expr.UserID != query.UserID {
+		return false
+	}
+	if len(query.Statuses) > 0 && !slices.Contains(query.Statuses, expr.Status) {
+		return false
+	}
+	if query.CreatedFrom != nil && expr.CreatedAt.Before(*query.CreatedFrom) {
+		return false
+	}
+	if query.CreatedTo != nil && !expr.CreatedAt.Before(*query.CreatedTo) {
+		return false
+	}
+	if query.ResultMin != nil && (expr.Result == nil || *expr.Result < *query.ResultMin) {
+		return false
+	}
+	if query.ResultMax != nil && (expr.Result == nil || *expr.Result > *query.ResultMax) {
+		return false
+	}
+
+	return query.After == nil || before(*query.After, storage.CursorOf(expr), query)
+}
+
+// before reports whether a comes before b in the query order
+func before(a, b storage.ExpressionCursor, query storage.ExpressionQuery) bool {
+	order := 0
+	switch query.SortBy {
+	case storage.SortByCreatedAt:
+		order = a.CreatedAt.Compare(b.CreatedAt)
+	case storage.SortByResult:
+		// expressions without a result go last in both directions
+		switch {
+		case a.Result == nil && b.Result == nil:
+		case a.Result == nil:
+			return false
+		case b.Result == nil:
+			return true
+		default:
+			order = cmp.Compare(*a.Result, *b.Result)
+		}
+	}
+	if order == 0 {
+		order = cmp.Compare(a.ID, b.ID)
+	}
+	if query.Desc {
+		return order > 0
+	}
+	return order < 0
+}
+
+// UpdateExpression ...
+func (s *Storage) UpdateExpression(ctx context.Context, id uint, status string, result *float64) (bool, error) {
+	const op string = "memory.UpdateExpression"
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expr, ok := s.expressions[id]
+	if !ok {
+		return false, fmt.Errorf("%s: %w", op, storage.ErrExpressionNotFound)
+	}
+
+	if storage.IsFinished(expr.Status) {
+		if expr.Status == status {
+			return false, nil
+		}
+		return false, fmt.Errorf("%s: %w", op, storage.ErrExpressionFinished)
+	}
+	changed := expr.Status != status
+	if changed {
+		now := time.Now()
+		expr.FinishedAt = nil
+		if storage.IsFinished(status) {
+			expr.FinishedAt = timePtr(now)
+		}
+		s.logEvents([]models.ExpressionEvent{
+			{ExpressionID: id, Type: models.EventStatus, Status: status, At: now},
+		})
+	}
+
+	expr.Status = status
+	expr.Result = copyFloat(result)
+	s.expressions[id] = expr
+
+	return changed, nil
+}
+
+// RecordVerification ...
+func (s *Storage) RecordVerification(ctx context.Context, id uint, verification string, localResult *float64, detail string) error {
+	const op string = "memory.RecordVerification"
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expr, ok := s.expressions[id]
+	if !ok {
+		return fmt.Errorf("%s: %w", op, storage.ErrExpressionNotFound)
+	}
+
+	expr.Verification = verification
+	expr.LocalResult = copyFloat(localResult)
+	s.expressions[id] = expr
+	s.logEvents([]models.ExpressionEvent{
+		{ExpressionID: id, Type: models.EventVerified, Status: expr.Status, Detail: detail, At: time.Now()},
+	})
+
+	return nil
+}
+
+// CancelExpression ...
+func (s *Storage) CancelExpression(ctx context.Context, id uint, reason string) (models.Expression, error) {
+	const op string = "memory.CancelExpression"
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expr, ok := s.expressions[id]
+	if !ok {
+		return models.Expression{}, fmt.Errorf("%s: %w", op, storage.ErrExpressionNotFound)
+	}
+	if storage.IsFinished(expr.Status) {
+		return models.Expression{}, fmt.Errorf("%s: %w", op, storage.ErrExpressionFinished)
+	}
+
+	return s.stopExpression(expr, "cancelled", reason, time.Now()), nil
+}
+
+// FailExpression ...
+func (s *Storage) FailExpression(ctx context.Context, id uint, reason string) (models.Expression, error) {
+	const op string = "memory.FailExpression"
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expr, ok := s.expressions[id]
+	if !ok {
+		return models.Expression{}, fmt.Errorf("%s: %w", op, storage.ErrExpressionNotFound)
+	}
+	if storage.IsFinished(expr.Status) {
+		return models.Expression{}, fmt.Errorf("%s: %w", op, storage.ErrExpressionFinished)
+	}
+
+	return s.stopExpression(expr, "error", reason, time.Now()), nil
+}
+
+// StuckExpressions ...
+func (s *Storage) StuckExpressions(ctx context.Context, now time.Time, limit int) ([]models.Expression, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var stuck []models.Expression
+	for _, expr := range s.expressions {
+		if storage.IsFinished(expr.Status) || (expr.Deadline != nil && !expr.Deadline.After(now)) || len(s.exprTasks[expr.ID]) == 0 {
+			continue
+		}
+
+		moving, cancelled := false, false
+		for _, id := range s.exprTasks[expr.ID] {
+			switch s.tasks[id].Status {
+			case "pending", "in_progress":
+				moving = true
+			case "cancelled":
+				cancelled = true
+			}
+		}
+		if !moving || cancelled {
+			stuck = append(stuck, expr)
+		}
+	}
+	sort.Slice(stuck, func(i, j int) bool { return stuck[i].ID < stuck[j].ID })
+	if len(stuck) > limit {
+		stuck = stuck[:limit]
+	}
+
+	for i, expr := range stuck {
+		stuck[i] = s.withTasks(expr)
+	}
+	return stuck, nil
+}
+
+// UnfinishedExpressions ...
+func (s *Storage) UnfinishedExpressions(ctx context.Context, after uint, limit int) ([]uint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ids []uint
+	for id, expr := range s.expressions {
+		if id > after && !storage.IsFinished(expr.Status) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+
+	return ids, nil
+}
+
+// PrioritizeExpression ...
+func (s *Storage) PrioritizeExpression(ctx context.Context, id uint, class string, priority int) (models.Expression, error) {
+	const op string = "memory.PrioritizeExpression"
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expr, ok := s.expressions[id]
+	if !ok {
+		return models.Expression{}, fmt.Errorf("%s: %w", op, storage.ErrExpressionNotFound)
+	}
+	if storage.IsFinished(expr.Status) {
+		return models.Expression{}, fmt.Errorf("%s: %w", op, storage.ErrExpressionFinished)
+	}
+
+	expr.Class = class
+	expr.Priority = priority
+	s.expressions[id] = expr
+	for _, taskID := range s.exprTasks[id] {
+		task := s.tasks[taskID]
+		if task.Status != "pending" && task.Status != "in_progress" {
+			continue
+		}
+		task.Class = class
+		task.Priority = priority
+		s.tasks[taskID] = task
+	}
+
+	return s.withTasks(expr), nil
+}
+
+// ExpireExpressions ...
+func (s *Storage) ExpireExpressions(ctx context.Context, now time.Time, limit int) ([]models.Expression, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var expired []models.Expression
+	for _, expr := range s.expressions {
+		if expr.Deadline != nil && expr.Deadline.Before(now) && !storage.IsFinished(expr.Status) {
+			expired = append(expired, expr)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i].Deadline.Before(*expired[j].Deadline) })
+	if len(expired) > limit {
+		expired = expired[:limit]
+	}
+
+	for i, expr := range expired {
+		expired[i] = s.stopExpression(expr, "timed_out", storage.ReasonDeadline, now)
+	}
+
+	return expired, nil
+}
+
+// stopExpression finishes expr with status and cancels its pending and
+// in_progress tasks, the caller holds the lock
+func (s *Storage) stopExpression(expr models.Expression, status, reason string, at time.Time) models.Expression {
+	events := []models.ExpressionEvent{{ExpressionID: expr.ID, Type: models.EventStatus, Status: status, Detail: reason, At: at}}
+	for _, taskID := range s.exprTasks[expr.ID] {
+		task := s.tasks[taskID]
+		if task.Status != "pending" && task.Status != "in_progress" {
+			continue
+		}
+		task.Status = "cancelled"
+		task.LeaseExpiresAt = nil
+		s.tasks[taskID] = task
+		delete(s.leases, taskID)
+		events = append(events, storage.CancelEvents(task, reason, at)...)
+	}
+
+	expr.Status = status
+	expr.FinishedAt = timePtr(at)
+	s.expressions[expr.ID] = expr
+	s.logEvents(events)
+
+	return s.withTasks(expr)
+}
+
+// ExpressionEvents ...
+func (s *Storage) ExpressionEvents(ctx context.Context, id uint) ([]models.ExpressionEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events := make([]models.ExpressionEvent, len(s.events[id]))
+	for i, event := range s.events[id] {
+		if event.TaskID != nil {
+			taskID := *event.TaskID
+			event.TaskID = &taskID
+		}
+		events[i] = event
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].At.Before(events[j].At) })
+
+	return events, nil
+}
+
+func (s *Storage) logEvents(events []models.ExpressionEvent) {
+	for _, event := range events {
+		s.lastEventID++
+		event.ID = s.lastEventID
+		s.events[event.ExpressionID] = append(s.events[event.ExpressionID], event)
+	}
+}
+
+// ClaimTasks ...
+func (s *Storage) ClaimTasks(ctx context.Context, req storage.ClaimRequest) ([]models.Task, error) {
+	const op string = "memory.ClaimTasks"
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.agents[req.AgentID].Quarantined {
+		return nil, fmt.Errorf("%s: %w", op, storage.ErrAgentQuarantined)
+	}
+
+	var pending []models.Task
+	running := make(map[storage.ShareKey]int)
+	for _, id := range s.taskIDs {
+		task := s.tasks[id]
+		if task.Status == "in_progress" {
+			running[storage.KeyOf(task)]++
+		}
+		if task.Replicas > 1 && (task.Status == "pending" || task.Status == "in_progress") {
+			if storage.ReplicaOpen(task.Replicas, s.replicaHolders(id), req.AgentID) {
+				pending = append(pending, task)
+			}
+			continue
+		}
+		if task.Status == "pending" {
+			pending = append(pending, task)
+		}
+	}
+
+	now := time.Now()
+	var claimed []models.Task
+	for _, task := range storage.Schedule(pending, running, req.Weights, req.Limit) {
+		task.Status = "in_progress"
+		task.LeasedAt = timePtr(now)
+		var leased models.Task
+		if task.Replicas > 1 {
+			// the agents of a replicated task hold it through their own leases
+			lease := models.ReplicaLease{TaskID: task.ID, AgentID: req.AgentID, LeasedAt: now, LeaseExpiresAt: req.LeaseUntil}
+			s.leases[task.ID] = append(s.leases[task.ID], lease)
+			leased = storage.ReplicaTask(task, lease)
+		} else {
+			leaseUntil := req.LeaseUntil
+			task.LeaseExpiresAt = &leaseUntil
+			task.AgentID = req.AgentID
+			leased = task
+		}
+		s.tasks[task.ID] = task
+		s.logEvents([]models.ExpressionEvent{storage.LeaseEvent(leased, now)})
+		claimed = append(claimed, copyTask(leased))
+	}
+
+	if len(claimed) == 0 {
+		return nil, fmt.Errorf("%s: %w", op, storage.ErrTaskNotFound)
+	}
+
+	return claimed, nil
+}
+
+// Tasks ...
+func (s *Storage) Tasks(ctx context.Context, ids []uint) ([]models.Task, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var tasks []models.Task
+	for _, id := range ids {
+		if task, ok := s.tasks[id]; ok {
+			tasks = append(tasks, copyTask(task))
+		}
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].ID < tasks[j].ID })
+
+	return tasks, nil
+}
+
+// CompleteTask ...
+func (s *Storage) CompleteTask(ctx context.Context, res storage.TaskResult) (models.Task, error) {
+	const op string = "memory.CompleteTask"
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	task, ok := s.tasks[res.ID]
+	if !ok {
+		return models.Task{}, fmt.Errorf("%s: %w", op, storage.ErrTaskNotFound)
+	}
+	if task.Status == "cancelled" {
+		return models.Task{}, fmt.Errorf("%s: %w", op, storage.ErrTaskCancelled)
+	}
+	if task.Status != "in_progress" {
+		return models.Task{}, fmt.Errorf("%s: %w", op, storage.ErrTaskNotInProgress)
+	}
+
+	now := time.Now()
+	if task.Replicas > 1 {
+		if !s.dropReplicaLease(task.ID, res.AgentID) {
+			return models.Task{}, fmt.Errorf("%s: %w", op, storage.ErrLeaseNotHeld)
+		}
+		return s.vote(task, res, now), nil
+	}
+	if task.AgentID != res.AgentID {
+		return models.Task{}, fmt.Errorf("%s: %w", op, storage.ErrLeaseNotHeld)
+	}
+
+	task.Status = "completed"
+	task.Result = copyFloat(&res.Result)
+	task.LeaseExpiresAt = nil
+	task.CompletedAt = timePtr(now)
+	if !res.StartedAt.IsZero() {
+		task.StartedAt = timePtr(res.StartedAt)
+	}
+	s.tasks[res.ID] = task
+	s.logEvents(storage.CompletionEvents(task, res.StartedAt, now))
+
+	return copyTask(task), nil
+}
+
+// vote records the result as the vote of the agent, whose replica lease
+// is already dropped, and moves the task on according to the tally, the
+// caller holds the lock
+func (s *Storage) vote(task models.Task, res storage.TaskResult, now time.Time) models.Task {
+	s.lastVoteID++
+	s.votes[task.ID] = append(s.votes[task.ID], models.TaskVote{
+		ID:           s.lastVoteID,
+		TaskID:       task.ID,
+		ExpressionID: task.ExpressionID,
+		AgentID:      res.AgentID,
+		Result:       res.Result,
+		CreatedAt:    now,
+	})
+	tally := storage.CountVotes(s.votes[task.ID], task.Replicas, res.Tolerance)
+	holders := len(s.leases[task.ID])
+
+	voter := task
+	voter.AgentID = res.AgentID
+	s.logEvents(storage.VoteEvents(voter, tally, holders == 0, res.Result, res.StartedAt, now))
+
+	if !res.StartedAt.IsZero() {
+		task.StartedAt = timePtr(res.StartedAt)
+	}
+	switch {
+	case tally.Result != nil:
+		task.Status = "completed"
+		task.Result = copyFloat(tally.Result)
+		task.CompletedAt = timePtr(now)
+	case tally.Failed:
+		task.Status = "cancelled"
+	case holders == 0:
+		task.Status = "pending"
+		task.QueuedAt = timePtr(now)
+	}
+	if tally.Result != nil || tally.Failed {
+		delete(s.leases, task.ID)
+	}
+	s.tasks[task.ID] = task
+
+	return copyTask(task)
+}
+
+// replicaHolders returns the agents that hold or voted on the task, the
+// caller holds the lock
+func (s *Storage) replicaHolders(id uint) []string {
+	var holders []string
+	for _, vote := range s.votes[id] {
+		holders = append(holders, vote.AgentID)
+	}
+	for _, lease := range s.leases[id] {
+		holders = append(holders, lease.AgentID)
+	}
+	return holders
+}
+
+// dropReplicaLease removes the replica lease of the agent and reports
+// whether it held one, the caller holds the lock
+func (s *Storage) dropReplicaLease(id uint, agentID string) bool {
+	i := slices.IndexFunc(s.leases[id], func(lease models.ReplicaLease) bool { return lease.AgentID == agentID })
+	if i < 0 {
+		return false
+	}
+	s.leases[id] = slices.Delete(s.leases[id], i, i+1)
+	if len(s.leases[id]) == 0 {
+		delete(s.leases, id)
+	}
+	return true
+}
+
+// releaseReplicas drops the replica leases of the task that release
+// selects and records the failed attempts, the task goes back to pending
+// once no agent holds it. The caller holds the lock.
+func (s *Storage) releaseReplicas(id uint, reason string, now time.Time, release func(models.ReplicaLease) bool) int64 {
+	task := s.tasks[id]
+	if task.Status != "in_progress" {
+		return 0
+	}
+
+	var released int64
+	for _, lease := range slices.Clone(s.leases[id]) {
+		if !release(lease) {
+			continue
+		}
+		s.dropReplicaLease(id, lease.AgentID)
+		s.logEvents([]models.ExpressionEvent{storage.FailureEvent(storage.ReplicaTask(task, lease), reason, now)})
+		released++
+	}
+	if released == 0 {
+		return 0
+	}
+
+	task.FailedAt = timePtr(now)
+	if len(s.leases[id]) == 0 {
+		task.Status = "pending"
+		task.QueuedAt = timePtr(now)
+		s.logEvents([]models.ExpressionEvent{storage.QueueEvent(task, now)})
+	}
+	s.tasks[id] = task
+
+	return released
+}
+
+// TaskVotes ...
+func (s *Storage) TaskVotes(ctx context.Context, id uint) ([]models.TaskVote, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.Clone(s.votes[id]), nil
+}
+
+// ExtendLeases ...
+func (s *Storage) ExtendLeases(ctx context.Context, agentID string, ids []uint, until time.Time) ([]uint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	held := []uint{}
+	for _, id := range ids {
+		task, ok := s.tasks[id]
+		if !ok || task.Status != "in_progress" {
+			continue
+		}
+
+		if task.Replicas > 1 {
+			i := slices.IndexFunc(s.leases[id], func(lease models.ReplicaLease) bool { return lease.AgentID == agentID })
+			if i < 0 {
+				continue
+			}
+			s.leases[id][i].LeaseExpiresAt = until
+		} else {
+			if task.AgentID != agentID {
+				continue
+			}
+			task.LeaseExpiresAt = &until
+			s.tasks[id] = task
+		}
+		held = append(held, id)
+	}
+	sort.Slice(held, func(i, j int) bool { return held[i] < held[j] })
+
+	return held, nil
+}
+
+// ReapExpiredLeases ...
+func (s *Storage) ReapExpiredLeases(ctx context.Context, now time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var reaped int64
+	for id, task := range s.tasks {
+		if task.Replicas > 1 {
+			reaped += s.releaseReplicas(id, storage.ReasonLeaseExpired, now, func(lease models.ReplicaLease) bool {
+				return lease.LeaseExpiresAt.Before(now)
+			})
+			continue
+		}
+		if task.Status != "in_progress" || task.LeaseExpiresAt == nil || !task.LeaseExpiresAt.Before(now) {
+			continue
+		}
+
+		s.tasks[id] = s.requeue(task, storage.ReasonLeaseExpired, now)
+		reaped++
+	}
+
+	return reaped, nil
+}
+
+// ReleaseTasks ...
+func (s *Storage) ReleaseTasks(ctx context.Context, agentID string, ids []uint, reason string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wanted := make(map[uint]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+
+	now := time.Now()
+	var released int64
+	for id, task := range s.tasks {
+		if ids != nil && !wanted[id] {
+			continue
+		}
+		if task.Replicas > 1 {
+			released += s.releaseReplicas(id, reason, now, func(lease models.ReplicaLease) bool {
+				return lease.AgentID == agentID
+			})
+			continue
+		}
+		if task.Status != "in_progress" || task.AgentID != agentID {
+			continue
+		}
+
+		s.tasks[id] = s.requeue(task, reason, now)
+		released++
+	}
+
+	return released, nil
+}
+
+// QueueDepth ...
+func (s *Storage) QueueDepth(ctx context.Context) (storage.QueueDepth, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var depth storage.QueueDepth
+	for _, task := range s.tasks {
+		switch task.Status {
+		case "pending":
+			depth.Pending++
+			depth.PendingWorkMS += int64(task.OperationTime)
+		case "in_progress":
+			depth.Running++
+		}
+	}
+
+	return depth, nil
+}
+
+// LeasedTasks ...
+func (s *Storage) LeasedTasks(ctx context.Context) ([]models.Task, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.leasedTasks(), nil
+}
+
+// leasedTasks returns the in_progress tasks, a replicated one once for each
+// of its replica leases, the caller holds the lock
+func (s *Storage) leasedTasks() []models.Task {
+	var tasks []models.Task
+	for _, id := range s.taskIDs {
+		task := s.tasks[id]
+		if task.Status != "in_progress" {
+			continue
+		}
+		if task.Replicas <= 1 {
+			tasks = append(tasks, copyTask(task))
+			continue
+		}
+		for _, lease := range s.leases[id] {
+			tasks = append(tasks, copyTask(storage.ReplicaTask(task, lease)))
+		}
+	}
+
+	return tasks
+}
+
+// QueueStats ...
+func (s *Storage) QueueStats(ctx context.Context, query storage.QueueStatsQuery) (storage.QueueStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	end := query.Now.Truncate(time.Minute).Add(time.Minute)
+	start := end.Add(-time.Duration(query.Minutes) * time.Minute)
+
+	var stats storage.QueueStats
+	if query.Minutes > 0 {
+		stats.Throughput = make([]int, query.Minutes)
+	}
+
+	counts := make(map[[2]string]int)
+	backlog := make(map[uint]*storage.UserBacklog)
+	for _, id := range s.taskIDs {
+		task := s.tasks[id]
+		counts[[2]string{task.Status, task.Operation}]++
+
+		switch task.Status {
+		case "pending":
+			if stats.OldestPending == nil || task.QueuedAt.Before(*stats.OldestPending.QueuedAt) {
+				oldest := copyTask(task)
+				stats.OldestPending = &oldest
+			}
+			userBacklog(backlog, task.UserID).Pending++
+		case "in_progress":
+			userBacklog(backlog, task.UserID).Running++
+		case "completed":
+			if task.CompletedAt != nil && !task.CompletedAt.Before(start) && task.CompletedAt.Before(end) {
+				stats.Throughput[int(task.CompletedAt.Sub(start)/time.Minute)]++
+			}
+		}
+	}
+
+	for key, count := range counts {
+		stats.Counts = append(stats.Counts, storage.TaskCount{Status: key[0], Operation: key[1], Count: count})
+	}
+	slices.SortFunc(stats.Counts, func(a, b storage.TaskCount) int {
+		return cmp.Or(cmp.Compare(a.Status, b.Status), cmp.Compare(a.Operation, b.Operation))
+	})
+
+	stats.Leases = storage.LeaseHolders(s.leasedTasks())
+
+	for _, user := range backlog {
+		stats.Backlog = append(stats.Backlog, *user)
+	}
+	slices.SortFunc(stats.Backlog, func(a, b storage.UserBacklog) int {
+		return cmp.Or(cmp.Compare(b.Pending, a.Pending), cmp.Compare(a.UserID, b.UserID))
+	})
+	if query.Users > 0 && len(stats.Backlog) > query.Users {
+		stats.Backlog = stats.Backlog[:query.Users]
+	}
+
+	return stats, nil
+}
+
+func userBacklog(backlog map[uint]*storage.UserBacklog, userID uint) *storage.UserBacklog {
+	user, ok := backlog[userID]
+	if !ok {
+		user = &storage.UserBacklog{UserID: userID}
+		backlog[userID] = user
+	}
+	return user
+}
+
+// RequeueTasks ...
+func (s *Storage) RequeueTasks(ctx context.Context, ids []uint, reason string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var requeued int64
+	for _, id := range ids {
+		task, ok := s.tasks[id]
+		if !ok || task.Status != "in_progress" {
+			continue
+		}
+		if task.Replicas > 1 {
+			requeued += s.releaseReplicas(id, reason, now, func(models.ReplicaLease) bool { return true })
+			continue
+		}
+
+		s.tasks[id] = s.requeue(task, reason, now)
+		requeued++
+	}
+
+	return requeued, nil
+}
+
+// PrioritizeTask ...
+func (s *Storage) PrioritizeTask(ctx context.Context, id uint, class string, priority int) (models.Task, error) {
+	const op string = "memory.PrioritizeTask"
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	task, ok := s.tasks[id]
+	if !ok {
+		return models.Task{}, fmt.Errorf("%s: %w", op, storage.ErrTaskNotFound)
+	}
+	if task.Status != "pending" && task.Status != "in_progress" {
+		return models.Task{}, fmt.Errorf("%s: %w", op, storage.ErrTaskFinished)
+	}
+
+	task.Class = class
+	task.Priority = priority
+	s.tasks[id] = task
+
+	return copyTask(task), nil
+}
+
+// requeue puts the task back to pending, recording the failed attempt
+func (s *Storage) requeue(task models.Task, reason string, now time.Time) models.Task {
+	s.logEvents(storage.RequeueEvents(task, reason, now))
+
+	task.Status = "pending"
+	task.LeaseExpiresAt = nil
+	task.AgentID = ""
+	task.QueuedAt = timePtr(now)
+	task.FailedAt = timePtr(now)
+
+	return task
+}
+
+// SaveAgent ...
+func (s *Storage) SaveAgent(ctx context.Context, agent models.Agent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if stored, ok := s.agents[agent.ID]; ok {
+		agent.Disagreements = stored.Disagreements
+		agent.Quarantined = stored.Quarantined
+	}
+	s.agents[agent.ID] = agent
+	return nil
+}
+
+// Agents ...
+func (s *Storage) Agents(ctx context.Context) ([]models.Agent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	agents := make([]models.Agent, 0, len(s.agents))
+	for _, agent := range s.agents {
+		agents = append(agents, agent)
+	}
+	sort.Slice(agents, func(i, j int) bool { return agents[i].ID < agents[j].ID })
+
+	return agents, nil
+}
+
+// RecordDisagreement ...
+func (s *Storage) RecordDisagreement(ctx context.Context, id string, quarantineAfter int) (models.Agent, error) {
+	const op string = "memory.RecordDisagreement"
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	agent, ok := s.agents[id]
+	if !ok {
+		return models.Agent{}, fmt.Errorf("%s: %w", op, storage.ErrAgentNotFound)
+	}
+
+	agent.Disagreements++
+	if quarantineAfter > 0 && agent.Disagreements >= quarantineAfter {
+		agent.Quarantined = true
+	}
+	s.agents[id] = agent
+
+	return agent, nil
+}
+
+// SetAgentQuarantine ...
+func (s *Storage) SetAgentQuarantine(ctx context.Context, id string, quarantined bool) (models.Agent, error) {
+	const op string = "memory.SetAgentQuarantine"
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	agent, ok := s.agents[id]
+	if !ok {
+		return models.Agent{}, fmt.Errorf("%s: %w", op, storage.ErrAgentNotFound)
+	}
+
+	agent.Quarantined = quarantined
+	if !quarantined {
+		agent.Disagreements = 0
+	}
+	s.agents[id] = agent
+
+	return agent, nil
+}
+
+// SaveAgentCredential ...
+func (s *Storage) SaveAgentCredential(ctx context.Context, credential models.AgentCredential) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.credentials[credential.AgentID] = credential
+	return nil
+}
+
+// AgentCredential ...
+func (s *Storage) AgentCredential(ctx context.Context, agentID string) (models.AgentCredential, error) {
+	const op string = "memory.AgentCredential"
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	credential, ok := s.credentials[agentID]
+	if !ok {
+		return models.AgentCredential{}, fmt.Errorf("%s: %w", op, storage.ErrCredentialNotFound)
+	}
+
+	return credential, nil
+}
+
+// DeleteAgentCredential ...
+func (s *Storage) DeleteAgentCredential(ctx context.Context, agentID string) error {
+	const op string = "memory.DeleteAgentCredential"
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.credentials[agentID]; !ok {
+		return fmt.Errorf("%s: %w", op, storage.ErrCredentialNotFound)
+	}
+	delete(s.credentials, agentID)
+
+	return nil
+}
+
+// ListenTaskEvents ...
+func (s *Storage) ListenTaskEvents(ctx context.Context, handle func(storage.TaskEvent)) error {
+	return storage.ErrNotSupported
+}
+
+// Close ...
+func (s *Storage) Close() error {
+	return nil
+}
+
+func (s *Storage) withTasks(expr models.Expression) models.Expression {
+	expr.Result = copyFloat(expr.Result)
+	expr.FinishedAt = copyTime(expr.FinishedAt)
+	expr.Deadline = copyTime(expr.Deadline)
+	expr.LocalResult = copyFloat(expr.LocalResult)
+	expr.Tasks = nil
+
+	for _, id := range s.exprTasks[expr.ID] {
+		expr.Tasks = append(expr.Tasks, copyTask(s.tasks[id]))
+	}
+
+	return expr
+}
+
+func copyTask(task models.Task) models.Task {
+	task.Arg2 = copyFloat(task.Arg2)
+	task.Result = copyFloat(task.Result)
+	task.Expression = models.Expression{}
+	task.LeaseExpiresAt = copyTime(task.LeaseExpiresAt)
+	task.QueuedAt = copyTime(task.QueuedAt)
+	task.LeasedAt = copyTime(task.LeasedAt)
+	task.StartedAt = copyTime(task.StartedAt)
+	task.CompletedAt = copyTime(task.CompletedAt)
+	task.FailedAt = copyTime(task.FailedAt)
+
+	return task
+}
+
+func copyTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	return timePtr(*t)
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
+
+func copyFloat(f *float64) *float64 {
+	if f == nil {
+		return nil
+	}
+	v := *f
+	return &v
+}
@@ -0,0 +1,98 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+)
+
+// Quota ...
+func (s *Storage) Quota(ctx context.Context, userID uint) (models.Quota, error) {
+	const op string = "memory.Quota"
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	quota, ok := s.quotas[userID]
+	if !ok {
+		return models.Quota{}, fmt.Errorf("%s: %w", op, storage.ErrQuotaNotFound)
+	}
+
+	return quota, nil
+}
+
+// SaveQuota ...
+func (s *Storage) SaveQuota(ctx context.Context, quota models.Quota) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	quota.UpdatedAt = time.Now()
+	s.quotas[quota.UserID] = quota
+
+	return nil
+}
+
+// DeleteQuota ...
+func (s *Storage) DeleteQuota(ctx context.Context, userID uint) error {
+	const op string = "memory.DeleteQuota"
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.quotas[userID]; !ok {
+		return fmt.Errorf("%s: %w", op, storage.ErrQuotaNotFound)
+	}
+	delete(s.quotas, userID)
+
+	return nil
+}
+
+// QuotaUsage ...
+func (s *Storage) QuotaUsage(ctx context.Context, userID uint, minuteStart, dayStart time.Time) (storage.Usage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.quotaUsage(userID, minuteStart, dayStart), nil
+}
+
+// CreateExpressionWithinQuota ...
+func (s *Storage) CreateExpressionWithinQuota(ctx context.Context, expr *models.Expression, minuteStart, dayStart time.Time, check func(storage.Usage) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := check(s.quotaUsage(expr.UserID, minuteStart, dayStart)); err != nil {
+		return err
+	}
+	s.createExpression(expr)
+
+	return nil
+}
+
+func (s *Storage) quotaUsage(userID uint, minuteStart, dayStart time.Time) storage.Usage {
+	var usage storage.Usage
+	for _, expr := range s.expressions {
+		if expr.UserID != userID {
+			continue
+		}
+		if !expr.CreatedAt.Before(minuteStart) {
+			if usage.Recent == 0 || expr.CreatedAt.Before(usage.OldestRecent) {
+				usage.OldestRecent = expr.CreatedAt
+			}
+			usage.Recent++
+		}
+		if expr.Status == "pending" || expr.Status == "in_progress" {
+			usage.Active++
+		}
+	}
+
+	for _, task := range s.tasks {
+		if task.UserID == userID && !task.CreatedAt.Before(dayStart) {
+			usage.TasksToday++
+		}
+	}
+
+	return usage
+}
@@ -0,0 +1,237 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+)
+
+// CreateWebhook ...
+func (s *Storage) CreateWebhook(ctx context.Context, hook *models.Webhook) error {
+	const op string = "memory.CreateWebhook"
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.webhooks {
+		if existing.UserID == hook.UserID && existing.URL == hook.URL {
+			return fmt.Errorf("%s: %w", op, storage.ErrWebhookExists)
+		}
+	}
+
+	s.lastWebhookID++
+	hook.ID = s.lastWebhookID
+	hook.CreatedAt = time.Now()
+	s.webhooks[hook.ID] = *hook
+
+	return nil
+}
+
+// Webhooks ...
+func (s *Storage) Webhooks(ctx context.Context, userID uint) ([]models.Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var hooks []models.Webhook
+	for _, hook := range s.webhooks {
+		if hook.UserID == userID {
+			hooks = append(hooks, hook)
+		}
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].ID < hooks[j].ID })
+
+	return hooks, nil
+}
+
+// DeleteWebhook ...
+func (s *Storage) DeleteWebhook(ctx context.Context, userID, id uint) error {
+	const op string = "memory.DeleteWebhook"
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hook, ok := s.webhooks[id]
+	if !ok || hook.UserID != userID {
+		return fmt.Errorf("%s: %w", op, storage.ErrWebhookNotFound)
+	}
+	delete(s.webhooks, id)
+
+	return nil
+}
+
+// EnsureWebhookSecret ...
+func (s *Storage) EnsureWebhookSecret(ctx context.Context, userID uint, candidate string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if secret, ok := s.webhookSecrets[userID]; ok {
+		return secret, nil
+	}
+	s.webhookSecrets[userID] = candidate
+
+	return candidate, nil
+}
+
+// SetWebhookSecret ...
+func (s *Storage) SetWebhookSecret(ctx context.Context, userID uint, secret string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.webhookSecrets[userID] = secret
+	return nil
+}
+
+// EnqueueWebhookDeliveries ...
+func (s *Storage) EnqueueWebhookDeliveries(ctx context.Context, deliveries []models.WebhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+next:
+	for _, delivery := range deliveries {
+		for _, existing := range s.deliveries {
+			if existing.ExpressionID == delivery.ExpressionID && existing.URL == delivery.URL {
+				continue next
+			}
+		}
+
+		s.lastDeliveryID++
+		delivery.ID = s.lastDeliveryID
+		delivery.NextAttemptAt = copyTime(delivery.NextAttemptAt)
+		delivery.AttemptLog = nil
+		s.deliveries[delivery.ID] = delivery
+	}
+
+	return nil
+}
+
+// ClaimWebhookDeliveries ...
+func (s *Storage) ClaimWebhookDeliveries(
+	ctx context.Context,
+	now, leaseUntil time.Time,
+	limit int,
+) ([]models.WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []models.WebhookDelivery
+	for _, delivery := range s.deliveries {
+		if delivery.Status == models.DeliveryPending && delivery.NextAttemptAt != nil && !delivery.NextAttemptAt.After(now) {
+			due = append(due, delivery)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].NextAttemptAt.Equal(*due[j].NextAttemptAt) {
+			return due[i].NextAttemptAt.Before(*due[j].NextAttemptAt)
+		}
+		return due[i].ID < due[j].ID
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	for i, delivery := range due {
+		delivery.NextAttemptAt = timePtr(leaseUntil)
+		s.deliveries[delivery.ID] = delivery
+		due[i] = copyDelivery(delivery)
+	}
+
+	return due, nil
+}
+
+// RecordWebhookAttempt ...
+func (s *Storage) RecordWebhookAttempt(
+	ctx context.Context,
+	attempt models.WebhookAttempt,
+	status string,
+	nextAttemptAt *time.Time,
+) error {
+	const op string = "memory.RecordWebhookAttempt"
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delivery, ok := s.deliveries[attempt.DeliveryID]
+	if !ok {
+		return fmt.Errorf("%s: %w", op, storage.ErrDeliveryNotFound)
+	}
+
+	s.lastAttemptID++
+	attempt.ID = s.lastAttemptID
+	delivery.AttemptLog = append(delivery.AttemptLog, attempt)
+	delivery.Status = status
+	delivery.Attempts = attempt.Attempt
+	delivery.NextAttemptAt = copyTime(nextAttemptAt)
+	delivery.LastResponseCode = attempt.ResponseCode
+	delivery.LastError = attempt.Error
+	s.deliveries[delivery.ID] = delivery
+
+	return nil
+}
+
+// WebhookDeliveries ...
+func (s *Storage) WebhookDeliveries(ctx context.Context, userID, expressionID uint, limit int) ([]models.WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deliveries []models.WebhookDelivery
+	for _, delivery := range s.deliveries {
+		if delivery.UserID != userID || (expressionID != 0 && delivery.ExpressionID != expressionID) {
+			continue
+		}
+		delivery = copyDelivery(delivery)
+		delivery.AttemptLog = nil
+		deliveries = append(deliveries, delivery)
+	}
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].ID > deliveries[j].ID })
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+
+	return deliveries, nil
+}
+
+// WebhookDelivery ...
+func (s *Storage) WebhookDelivery(ctx context.Context, id uint) (models.WebhookDelivery, error) {
+	const op string = "memory.WebhookDelivery"
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delivery, ok := s.deliveries[id]
+	if !ok {
+		return models.WebhookDelivery{}, fmt.Errorf("%s: %w", op, storage.ErrDeliveryNotFound)
+	}
+
+	return copyDelivery(delivery), nil
+}
+
+// RedeliverWebhook ...
+func (s *Storage) RedeliverWebhook(ctx context.Context, id uint, now time.Time) error {
+	const op string = "memory.RedeliverWebhook"
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delivery, ok := s.deliveries[id]
+	if !ok {
+		return fmt.Errorf("%s: %w", op, storage.ErrDeliveryNotFound)
+	}
+
+	delivery.Status = models.DeliveryPending
+	delivery.Attempts = 0
+	delivery.NextAttemptAt = timePtr(now)
+	s.deliveries[id] = delivery
+
+	return nil
+}
+
+func copyDelivery(delivery models.WebhookDelivery) models.WebhookDelivery {
+	delivery.NextAttemptAt = copyTime(delivery.NextAttemptAt)
+	delivery.AttemptLog = append([]models.WebhookAttempt(nil), delivery.AttemptLog...)
+
+	return delivery
+}
@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+)
+
+// sort keys of an expression listing
+const (
+	SortByID        = "id"
+	SortByCreatedAt = "created_at"
+	SortByResult    = "result"
+)
+
+// ExpressionQuery selects one page of a user's expressions
+type ExpressionQuery struct {
+	UserID uint
+	// Statuses keeps only expressions in one of these statuses when set
+	Statuses []string
+	// CreatedFrom is inclusive, CreatedTo is exclusive
+	CreatedFrom *time.Time
+	CreatedTo   *time.Time
+	// ResultMin and ResultMax are inclusive and skip expressions without a result
+	ResultMin *float64
+	ResultMax *float64
+	// SortBy is one of the SortBy* keys, ties are broken by id in the same
+	// direction. Expressions without a result come last when sorting by it
+	SortBy string
+	Desc   bool
+	// After continues the listing past this expression
+	After *ExpressionCursor
+	Limit int
+	// WithTasks loads the tasks of every expression
+	WithTasks bool
+}
+
+// ExpressionCursor is the sort position of the last expression on a page
+type ExpressionCursor struct {
+	ID        uint
+	CreatedAt time.Time
+	Result    *float64
+}
+
+// CursorOf returns the position of expr in a listing
+func CursorOf(expr models.Expression) ExpressionCursor {
+	return ExpressionCursor{ID: expr.ID, CreatedAt: expr.CreatedAt, Result: expr.Result}
+}
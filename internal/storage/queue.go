@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+)
+
+// QueueDepth summarises the tasks waiting for and held by agents
+type QueueDepth struct {
+	Pending int
+	Running int
+	// PendingWorkMS is the operation time of the pending tasks together
+	PendingWorkMS int64
+}
+
+// QueueStatsQuery ...
+type QueueStatsQuery struct {
+	// Now falls into the last throughput minute
+	Now time.Time
+	// Minutes is the number of throughput buckets
+	Minutes int
+	// Users limits the backlog to the users with the most pending tasks
+	Users int
+}
+
+// TaskCount ...
+type TaskCount struct {
+	Status    string
+	Operation string
+	Count     int
+}
+
+// LeaseHolder summarises the in_progress tasks of one agent
+type LeaseHolder struct {
+	AgentID        string
+	Tasks          int
+	OldestLeasedAt *time.Time
+	NextExpiry     *time.Time
+}
+
+// UserBacklog ...
+type UserBacklog struct {
+	UserID  uint
+	Pending int
+	Running int
+}
+
+// QueueStats is a snapshot of the task queue for operators
+type QueueStats struct {
+	// Counts are sorted by status and operation
+	Counts []TaskCount
+	// OldestPending is the task queued the longest, nil when none is pending
+	OldestPending *models.Task
+	// Leases are sorted by agent
+	Leases []LeaseHolder
+	// Backlog is sorted by pending tasks, most first
+	Backlog []UserBacklog
+	// Throughput counts the tasks completed in each of the query minutes,
+	// oldest first
+	Throughput []int
+}
+
+// LeaseHolders groups in_progress tasks by their agent
+func LeaseHolders(tasks []models.Task) []LeaseHolder {
+	var holders []LeaseHolder
+	index := make(map[string]int)
+	for _, task := range tasks {
+		i, ok := index[task.AgentID]
+		if !ok {
+			i = len(holders)
+			index[task.AgentID] = i
+			holders = append(holders, LeaseHolder{AgentID: task.AgentID})
+		}
+
+		holder := &holders[i]
+		holder.Tasks++
+		if task.LeasedAt != nil && (holder.OldestLeasedAt == nil || task.LeasedAt.Before(*holder.OldestLeasedAt)) {
+			leasedAt := *task.LeasedAt
+			holder.OldestLeasedAt = &leasedAt
+		}
+		if task.LeaseExpiresAt != nil && (holder.NextExpiry == nil || task.LeaseExpiresAt.Before(*holder.NextExpiry)) {
+			expiry := *task.LeaseExpiresAt
+			holder.NextExpiry = &expiry
+		}
+	}
+	slices.SortFunc(holders, func(a, b LeaseHolder) int { return strings.Compare(a.AgentID, b.AgentID) })
+
+	return holders
+}
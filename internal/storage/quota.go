@@ -0,0 +1,15 @@
+package storage
+
+import "time"
+
+// Usage is what a user spent of the quotas
+type Usage struct {
+	// Recent counts the expressions created since the start of the minute
+	// window, OldestRecent is when the first of them was created
+	Recent       int
+	OldestRecent time.Time
+	// Active counts the unfinished expressions
+	Active int
+	// TasksToday counts the tasks created since the start of the day
+	TasksToday int
+}
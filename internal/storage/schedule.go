@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"sort"
+
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+)
+
+// priority classes of an expression
+const (
+	ClassInteractive = "interactive"
+	ClassBatch       = "batch"
+)
+
+// ShareKey is the queue of one user within a priority class
+type ShareKey struct {
+	Class  string
+	UserID uint
+}
+
+// KeyOf returns the queue the task belongs to
+func KeyOf(task models.Task) ShareKey {
+	return ShareKey{Class: task.Class, UserID: task.UserID}
+}
+
+// Schedule picks up to limit pending tasks to hand out next. Classes get
+// running tasks in proportion to their weight (1 when missing), within a
+// class the user with the fewest running tasks goes first, ties go to the
+// higher priority and then the older task. A user's own tasks are taken by
+// priority, then in queue order. running is updated with the picks.
+func Schedule(candidates []models.Task, running map[ShareKey]int, weights map[string]int, limit int) []models.Task {
+	queues := make(map[ShareKey][]models.Task)
+	for _, task := range candidates {
+		key := KeyOf(task)
+		queues[key] = append(queues[key], task)
+	}
+	for _, queue := range queues {
+		sort.Slice(queue, func(i, j int) bool { return before(queue[i], queue[j]) })
+	}
+
+	classRunning := make(map[string]int)
+	for key, n := range running {
+		classRunning[key.Class] += n
+	}
+
+	var picked []models.Task
+	for len(picked) < limit {
+		var (
+			best  ShareKey
+			found bool
+		)
+		for key, queue := range queues {
+			if len(queue) == 0 {
+				continue
+			}
+			if !found || preferred(key, best, queues, running, classRunning, weights) {
+				best, found = key, true
+			}
+		}
+		if !found {
+			break
+		}
+
+		picked = append(picked, queues[best][0])
+		queues[best] = queues[best][1:]
+		running[best]++
+		classRunning[best.Class]++
+	}
+
+	return picked
+}
+
+// preferred reports whether queue a should be served before queue b
+func preferred(a, b ShareKey, queues map[ShareKey][]models.Task, running map[ShareKey]int, classRunning map[string]int, weights map[string]int) bool {
+	if a.Class != b.Class {
+		// compare running/weight without dividing
+		la := (classRunning[a.Class] + 1) * weight(weights, b.Class)
+		lb := (classRunning[b.Class] + 1) * weight(weights, a.Class)
+		if la != lb {
+			return la < lb
+		}
+	} else if running[a] != running[b] {
+		return running[a] < running[b]
+	}
+
+	return before(queues[a][0], queues[b][0])
+}
+
+// before orders tasks by priority, then by queue order
+func before(a, b models.Task) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	return a.ID < b.ID
+}
+
+func weight(weights map[string]int, class string) int {
+	if w := weights[class]; w > 0 {
+		return w
+	}
+	return 1
+}
@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+)
+
+func tasksOf(class string, userID uint, ids ...uint) []models.Task {
+	var tasks []models.Task
+	for _, id := range ids {
+		tasks = append(tasks, models.Task{ID: id, Class: class, UserID: userID})
+	}
+	return tasks
+}
+
+func idsOf(tasks []models.Task) []uint {
+	var ids []uint
+	for _, task := range tasks {
+		ids = append(ids, task.ID)
+	}
+	return ids
+}
+
+func TestSchedule_RoundRobinsUsers(t *testing.T) {
+	candidates := append(tasksOf(ClassInteractive, 1, 1, 2, 3, 4, 5), tasksOf(ClassInteractive, 2, 6, 7)...)
+
+	picked := Schedule(candidates, map[ShareKey]int{}, nil, 5)
+	assert.Equal(t, []uint{1, 6, 2, 7, 3}, idsOf(picked))
+}
+
+func TestSchedule_CountsRunningTasks(t *testing.T) {
+	candidates := append(tasksOf(ClassInteractive, 1, 1, 2), tasksOf(ClassInteractive, 2, 3, 4, 5)...)
+	running := map[ShareKey]int{{Class: ClassInteractive, UserID: 1}: 2}
+
+	picked := Schedule(candidates, running, nil, 3)
+	assert.Equal(t, []uint{3, 4, 1}, idsOf(picked))
+	assert.Equal(t, 3, running[ShareKey{Class: ClassInteractive, UserID: 1}])
+}
+
+func TestSchedule_WeighsClasses(t *testing.T) {
+	candidates := append(tasksOf(ClassBatch, 1, 1, 2, 3, 4), tasksOf(ClassInteractive, 2, 5, 6, 7, 8)...)
+	weights := map[string]int{ClassInteractive: 3, ClassBatch: 1}
+
+	picked := Schedule(candidates, map[ShareKey]int{}, weights, 4)
+	assert.ElementsMatch(t, []uint{1, 5, 6, 7}, idsOf(picked))
+}
+
+func TestSchedule_Priority(t *testing.T) {
+	candidates := tasksOf(ClassInteractive, 1, 1, 2, 3)
+	candidates[2].Priority = 5
+
+	picked := Schedule(candidates, map[ShareKey]int{}, nil, 2)
+	assert.Equal(t, []uint{3, 1}, idsOf(picked))
+}
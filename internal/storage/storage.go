@@ -1,15 +1,315 @@
 package storage
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+)
 
 var (
 	// ErrUserExist ...
 	ErrUserExist = errors.New("user already exist")
+	// ErrUserEmailExists ...
+	ErrUserEmailExists = errors.New("user with this email already exists")
+	// ErrUsernameExists ...
+	ErrUsernameExists = errors.New("user with this username already exists")
 	// ErrUserNotFound ...
 	ErrUserNotFound = errors.New("user not found")
 	// ErrExpressionNotFound ...
 	ErrExpressionNotFound = errors.New("expression not found")
 	// ErrTaskNotFound ...
 	ErrTaskNotFound = errors.New("task not found")
+	// ErrExpressionFinished ...
+	ErrExpressionFinished = errors.New("expression is already finished")
+	// ErrTaskCancelled ...
+	ErrTaskCancelled = errors.New("task is cancelled")
+	// ErrTaskNotInProgress ...
+	ErrTaskNotInProgress = errors.New("task is not in progress")
+	// ErrTaskFinished ...
+	ErrTaskFinished = errors.New("task is already finished")
+	// ErrWebhookNotFound ...
+	ErrWebhookNotFound = errors.New("webhook not found")
+	// ErrWebhookExists ...
+	ErrWebhookExists = errors.New("webhook with this url already exists")
+	// ErrDeliveryNotFound ...
+	ErrDeliveryNotFound = errors.New("webhook delivery not found")
+	// ErrQuotaNotFound ...
+	ErrQuotaNotFound = errors.New("quota not found")
+	// ErrNotSupported ...
+	ErrNotSupported = errors.New("not supported by this storage backend")
+	// ErrAgentNotFound ...
+	ErrAgentNotFound = errors.New("agent not found")
+	// ErrAgentQuarantined ...
+	ErrAgentQuarantined = errors.New("agent is quarantined")
+	// ErrCredentialNotFound ...
+	ErrCredentialNotFound = errors.New("agent credential not found")
+	// ErrLeaseNotHeld ...
+	ErrLeaseNotHeld = errors.New("task is leased to another agent")
+	// ErrLockHeld ...
+	ErrLockHeld = errors.New("lock is held by another process")
 )
 
+// Users ...
+type Users interface {
+	SaveUser(ctx context.Context, username string, email string, passHash []byte) (int64, error)
+	User(ctx context.Context, login string) (models.User, error)
+}
+
+// Expressions ...
+type Expressions interface {
+	// CreateExpression saves the expression together with its tasks
+	CreateExpression(ctx context.Context, expr *models.Expression) error
+	// Expression returns the expression with its tasks
+	Expression(ctx context.Context, id uint) (models.Expression, error)
+	// UserExpressions returns up to query.Limit expressions in query order
+	UserExpressions(ctx context.Context, query ExpressionQuery) ([]models.Expression, error)
+	// UpdateExpression sets the status and result and reports whether this
+	// call changed the status, a status change is recorded in the expression
+	// timeline. A finished expression keeps its status and result, changing
+	// the status fails with ErrExpressionFinished
+	UpdateExpression(ctx context.Context, id uint, status string, result *float64) (bool, error)
+	// CancelExpression moves an unfinished expression to cancelled together
+	// with its pending and in_progress tasks, reason is empty for a
+	// cancellation by the user
+	CancelExpression(ctx context.Context, id uint, reason string) (models.Expression, error)
+	// FailExpression moves an unfinished expression to error together with
+	// its pending and in_progress tasks
+	FailExpression(ctx context.Context, id uint, reason string) (models.Expression, error)
+	// StuckExpressions returns up to limit unfinished expressions, not yet
+	// past their deadline, that no task can move on: every task is finished
+	// or one of them was cancelled
+	StuckExpressions(ctx context.Context, now time.Time, limit int) ([]models.Expression, error)
+	// UnfinishedExpressions returns the ids of up to limit pending and
+	// in_progress expressions with ids above after, in id order
+	UnfinishedExpressions(ctx context.Context, after uint, limit int) ([]uint, error)
+	// PrioritizeExpression moves an unfinished expression and its pending
+	// and in_progress tasks to another class and priority
+	PrioritizeExpression(ctx context.Context, id uint, class string, priority int) (models.Expression, error)
+	// ExpireExpressions moves up to limit unfinished expressions whose
+	// deadline passed before now to timed_out, cancels their tasks and
+	// returns them
+	ExpireExpressions(ctx context.Context, now time.Time, limit int) ([]models.Expression, error)
+	// RecordVerification stores the outcome of checking the result of the
+	// expression and logs it with detail in the timeline
+	RecordVerification(ctx context.Context, id uint, verification string, localResult *float64, detail string) error
+	// ExpressionEvents returns the transition log of the expression, oldest first
+	ExpressionEvents(ctx context.Context, id uint) ([]models.ExpressionEvent, error)
+}
+
+// ClaimRequest ...
+type ClaimRequest struct {
+	Limit      int
+	AgentID    string
+	LeaseUntil time.Time
+	// Weights are the shares of the priority classes, see Schedule
+	Weights map[string]int
+}
+
+// TaskResult ...
+type TaskResult struct {
+	ID     uint
+	Result float64
+	// AgentID is who submits the result, it must hold the lease
+	AgentID string
+	// StartedAt is when the agent began computing, zero if unknown
+	StartedAt time.Time
+	// Tolerance is the relative difference allowed between the votes of
+	// agents that agree on a replicated task
+	Tolerance float64
+}
+
+// Tasks ...
+type Tasks interface {
+	// ClaimTasks takes up to req.Limit pending tasks picked by Schedule and
+	// marks them in_progress, leased to req.AgentID until req.LeaseUntil.
+	// Replicated tasks are only given to named agents that neither hold nor
+	// voted on them yet, each agent gets its own replica lease so up to
+	// Replicas agents compute a task at the same time. A quarantined agent
+	// fails with ErrAgentQuarantined
+	ClaimTasks(ctx context.Context, req ClaimRequest) ([]models.Task, error)
+	// CompleteTask stores the result of an in_progress task leased to
+	// res.AgentID, else it fails with ErrLeaseNotHeld. The result of a
+	// cancelled task fails with ErrTaskCancelled. The result of a
+	// replicated task is a vote of its agent, the task is completed once a
+	// quorum agrees, cancelled when none can, in_progress while other agents
+	// still hold it and pending otherwise
+	CompleteTask(ctx context.Context, res TaskResult) (models.Task, error)
+	// TaskVotes returns the votes cast for the task, oldest first
+	TaskVotes(ctx context.Context, id uint) ([]models.TaskVote, error)
+	// Tasks returns the tasks with the given ids that exist
+	Tasks(ctx context.Context, ids []uint) ([]models.Task, error)
+	// ReleaseTasks takes the given tasks leased to agentID from it, every
+	// task of the agent when ids is nil, and records reason. A task goes
+	// back to pending once no agent holds it.
+	ReleaseTasks(ctx context.Context, agentID string, ids []uint, reason string) (int64, error)
+	// ExtendLeases moves the leases agentID holds on the given in_progress
+	// tasks to until and returns the ids of those the agent still holds
+	ExtendLeases(ctx context.Context, agentID string, ids []uint, until time.Time) ([]uint, error)
+	// ReapExpiredLeases drops the leases that expired before now, tasks no
+	// agent holds any more return to pending
+	ReapExpiredLeases(ctx context.Context, now time.Time) (int64, error)
+	// QueueDepth counts the pending and in_progress tasks
+	QueueDepth(ctx context.Context) (QueueDepth, error)
+	// LeasedTasks returns the in_progress tasks by id, a replicated task
+	// once per agent holding it with that agent's lease, see ReplicaTask
+	LeasedTasks(ctx context.Context) ([]models.Task, error)
+	// QueueStats describes the queue for operators
+	QueueStats(ctx context.Context, query QueueStatsQuery) (QueueStats, error)
+	// RequeueTasks returns the given in_progress tasks to pending whatever
+	// agents hold them
+	RequeueTasks(ctx context.Context, ids []uint, reason string) (int64, error)
+	// PrioritizeTask moves a pending or in_progress task to another class
+	// and priority, a finished one fails with ErrTaskFinished
+	PrioritizeTask(ctx context.Context, id uint, class string, priority int) (models.Task, error)
+}
+
+// Agents ...
+type Agents interface {
+	// SaveAgent creates or updates the agent record, keeping its
+	// disagreements and quarantine
+	SaveAgent(ctx context.Context, agent models.Agent) error
+	Agents(ctx context.Context) ([]models.Agent, error)
+	// RecordDisagreement counts a vote the agent lost and quarantines it
+	// once it lost quarantineAfter of them, 0 never quarantines
+	RecordDisagreement(ctx context.Context, id string, quarantineAfter int) (models.Agent, error)
+	// SetAgentQuarantine quarantines the agent or lets it back, which also
+	// forgets its disagreements
+	SetAgentQuarantine(ctx context.Context, id string, quarantined bool) (models.Agent, error)
+
+	// SaveAgentCredential creates or replaces the token of the agent
+	SaveAgentCredential(ctx context.Context, credential models.AgentCredential) error
+	AgentCredential(ctx context.Context, agentID string) (models.AgentCredential, error)
+	DeleteAgentCredential(ctx context.Context, agentID string) error
+}
+
+// Webhooks ...
+type Webhooks interface {
+	CreateWebhook(ctx context.Context, hook *models.Webhook) error
+	Webhooks(ctx context.Context, userID uint) ([]models.Webhook, error)
+	DeleteWebhook(ctx context.Context, userID, id uint) error
+
+	// EnsureWebhookSecret stores candidate unless the user already has a
+	// secret and returns the stored one
+	EnsureWebhookSecret(ctx context.Context, userID uint, candidate string) (string, error)
+	SetWebhookSecret(ctx context.Context, userID uint, secret string) error
+
+	// EnqueueWebhookDeliveries saves new deliveries, skipping those already
+	// queued for the same expression and URL
+	EnqueueWebhookDeliveries(ctx context.Context, deliveries []models.WebhookDelivery) error
+	// ClaimWebhookDeliveries returns pending deliveries due at now and
+	// postpones them to leaseUntil so that no other sender picks them up
+	ClaimWebhookDeliveries(ctx context.Context, now, leaseUntil time.Time, limit int) ([]models.WebhookDelivery, error)
+	// RecordWebhookAttempt logs an attempt and sets the delivery status,
+	// nextAttemptAt is nil when no retry follows
+	RecordWebhookAttempt(ctx context.Context, attempt models.WebhookAttempt, status string, nextAttemptAt *time.Time) error
+	// WebhookDeliveries lists the newest deliveries of the user, of one
+	// expression when expressionID is not 0
+	WebhookDeliveries(ctx context.Context, userID, expressionID uint, limit int) ([]models.WebhookDelivery, error)
+	// WebhookDelivery returns the delivery with its attempts
+	WebhookDelivery(ctx context.Context, id uint) (models.WebhookDelivery, error)
+	// RedeliverWebhook makes the delivery pending again with a fresh attempt budget
+	RedeliverWebhook(ctx context.Context, id uint, now time.Time) error
+}
+
+// Quotas ...
+type Quotas interface {
+	// Quota returns the overrides of the user, ErrQuotaNotFound when there are none
+	Quota(ctx context.Context, userID uint) (models.Quota, error)
+	// SaveQuota creates or replaces the overrides of the user
+	SaveQuota(ctx context.Context, quota models.Quota) error
+	DeleteQuota(ctx context.Context, userID uint) error
+	// QuotaUsage counts the expressions the user created since minuteStart,
+	// the unfinished ones and the tasks created since dayStart
+	QuotaUsage(ctx context.Context, userID uint, minuteStart, dayStart time.Time) (Usage, error)
+	// CreateExpressionWithinQuota saves the expression unless check rejects
+	// the usage of its user, counted as QuotaUsage does, and returns the
+	// error of check. Creations for the same user wait for each other, so
+	// that concurrent requests cannot all pass the check
+	CreateExpressionWithinQuota(ctx context.Context, expr *models.Expression, minuteStart, dayStart time.Time, check func(Usage) error) error
+}
+
+// IdempotencyKeys ...
+type IdempotencyKeys interface {
+	// ReserveIdempotencyKey saves the key unless the user holds it and it has
+	// not expired at now, it returns the stored key and whether it is new
+	ReserveIdempotencyKey(ctx context.Context, key models.IdempotencyKey, now time.Time) (models.IdempotencyKey, bool, error)
+	// CompleteIdempotencyKey records the answer to the request and keeps the
+	// key until expiresAt
+	CompleteIdempotencyKey(ctx context.Context, userID uint, key string, statusCode int, expressionID uint, expiresAt time.Time) error
+	// ReleaseIdempotencyKey forgets the key of a request that failed
+	ReleaseIdempotencyKey(ctx context.Context, userID uint, key string) error
+	// DeleteExpiredIdempotencyKeys removes the keys expired before now
+	DeleteExpiredIdempotencyKeys(ctx context.Context, now time.Time) (int64, error)
+}
+
+// Lock ...
+type Lock interface {
+	// Lost is closed when the lock can no longer be guaranteed, e.g. its session died
+	Lost() <-chan struct{}
+	Release() error
+}
+
+// Locker ...
+type Locker interface {
+	// TryLock takes the lock without waiting, ErrLockHeld if someone else holds it
+	TryLock(ctx context.Context, key int64) (Lock, error)
+}
+
+// Storage ...
+type Storage interface {
+	Users
+	Expressions
+	Tasks
+	Agents
+	Webhooks
+	Quotas
+	IdempotencyKeys
+	Locker
+
+	// ListenTaskEvents passes task changes made by any process to handle until
+	// ctx is done; backends without cross-process events return ErrNotSupported
+	ListenTaskEvents(ctx context.Context, handle func(TaskEvent)) error
+	Close() error
+}
+
+// Migration ...
+type Migration struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"applied_at"`
+}
+
+// Migrator is implemented by backends with a versioned schema
+type Migrator interface {
+	// Migrate applies every pending migration and returns the applied ones
+	Migrate(ctx context.Context) ([]Migration, error)
+	// Rollback reverts the last steps applied migrations
+	Rollback(ctx context.Context, steps int) ([]Migration, error)
+	// MigrationStatus lists known migrations, AppliedAt is nil for pending ones
+	MigrationStatus(ctx context.Context) ([]Migration, error)
+}
+
+// Checker is implemented by backends that can be scanned for rows that
+// disagree with each other, see internal/fsck
+type Checker interface {
+	// ScanExpressions returns up to limit expressions with ids above after,
+	// in id order with their tasks
+	ScanExpressions(ctx context.Context, after uint, limit int) ([]models.Expression, error)
+	// OrphanTasks returns the tasks whose expression does not exist
+	OrphanTasks(ctx context.Context) ([]models.Task, error)
+	// OrphanExpressions returns the expressions whose user does not exist
+	OrphanExpressions(ctx context.Context) ([]models.Expression, error)
+
+	DeleteTasks(ctx context.Context, ids []uint) error
+	// DeleteExpressions removes the expressions with their tasks and events
+	DeleteExpressions(ctx context.Context, ids []uint) error
+	// RepairTask overwrites the status and result of the task, a finished
+	// status drops its lease; the change is recorded in the timeline
+	RepairTask(ctx context.Context, id uint, status string, result *float64) error
+	// RepairExpression overwrites the status and result of the expression
+	// without the checks of UpdateExpression; the change is recorded in the
+	// timeline
+	RepairExpression(ctx context.Context, id uint, status string, result *float64) error
+}
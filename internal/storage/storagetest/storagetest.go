@@ -0,0 +1,1313 @@
+// Package storagetest holds behaviour checks shared by every storage backend
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+)
+
+// Run ...
+func Run(t *testing.T, open func(t *testing.T) storage.Storage) {
+	t.Run("Users", func(t *testing.T) { testUsers(t, open(t)) })
+	t.Run("Expressions", func(t *testing.T) { testExpressions(t, open(t)) })
+	t.Run("ListExpressions", func(t *testing.T) { testListExpressions(t, open(t)) })
+	t.Run("RecordVerification", func(t *testing.T) { testRecordVerification(t, open(t)) })
+	t.Run("CancelExpression", func(t *testing.T) { testCancelExpression(t, open(t)) })
+	t.Run("ExpireExpressions", func(t *testing.T) { testExpireExpressions(t, open(t)) })
+	t.Run("ClaimAndComplete", func(t *testing.T) { testClaimAndComplete(t, open(t)) })
+	t.Run("FairClaim", func(t *testing.T) { testFairClaim(t, open(t)) })
+	t.Run("QueueDepth", func(t *testing.T) { testQueueDepth(t, open(t)) })
+	t.Run("ReapExpiredLeases", func(t *testing.T) { testReapExpiredLeases(t, open(t)) })
+	t.Run("ExtendLeases", func(t *testing.T) { testExtendLeases(t, open(t)) })
+	t.Run("ReleaseTasks", func(t *testing.T) { testReleaseTasks(t, open(t)) })
+	t.Run("QueueStats", func(t *testing.T) { testQueueStats(t, open(t)) })
+	t.Run("QueueActions", func(t *testing.T) { testQueueActions(t, open(t)) })
+	t.Run("StuckExpressions", func(t *testing.T) { testStuckExpressions(t, open(t)) })
+	t.Run("UnfinishedExpressions", func(t *testing.T) { testUnfinishedExpressions(t, open(t)) })
+	t.Run("Repair", func(t *testing.T) { testRepair(t, open(t)) })
+	t.Run("Agents", func(t *testing.T) { testAgents(t, open(t)) })
+	t.Run("Votes", func(t *testing.T) { testVotes(t, open(t)) })
+	t.Run("ReplicaLeases", func(t *testing.T) { testReplicaLeases(t, open(t)) })
+	t.Run("Quarantine", func(t *testing.T) { testQuarantine(t, open(t)) })
+	t.Run("AgentCredentials", func(t *testing.T) { testAgentCredentials(t, open(t)) })
+	t.Run("Timeline", func(t *testing.T) { testTimeline(t, open(t)) })
+	t.Run("CachedTasks", func(t *testing.T) { testCachedTasks(t, open(t)) })
+	t.Run("Webhooks", func(t *testing.T) { testWebhooks(t, open(t)) })
+	t.Run("WebhookDeliveries", func(t *testing.T) { testWebhookDeliveries(t, open(t)) })
+	t.Run("Quotas", func(t *testing.T) { testQuotas(t, open(t)) })
+	t.Run("IdempotencyKeys", func(t *testing.T) { testIdempotencyKeys(t, open(t)) })
+	t.Run("Locks", func(t *testing.T) { testLocks(t, open(t)) })
+}
+
+// NewUser saves a user and returns its id
+func NewUser(t *testing.T, st storage.Storage, name string) uint {
+	id, err := st.SaveUser(context.Background(), name, name+"@example.com", []byte("hash"))
+	require.NoError(t, err)
+
+	return uint(id)
+}
+
+// NewExpression saves an in_progress expression with tasks for the given operations
+func NewExpression(t *testing.T, st storage.Storage, userID uint, ops ...string) models.Expression {
+	expr := models.Expression{Expr: "test", Status: "in_progress", UserID: userID}
+	for i, op := range ops {
+		arg2 := 1.0
+		expr.Tasks = append(expr.Tasks, models.Task{
+			Arg1:          float64(i),
+			Arg2:          &arg2,
+			Operation:     op,
+			Status:        "pending",
+			OperationTime: 1,
+			Order:         i,
+		})
+	}
+	require.NoError(t, st.CreateExpression(context.Background(), &expr))
+
+	return expr
+}
+
+// complete moves the expression to completed with the given result
+func complete(t *testing.T, st storage.Storage, id uint, result *float64) {
+	_, err := st.UpdateExpression(context.Background(), id, "completed", result)
+	require.NoError(t, err)
+}
+
+func testUsers(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+
+	id := NewUser(t, st, "alice")
+
+	_, err := st.SaveUser(ctx, "alice", "other@example.com", []byte("hash"))
+	assert.True(t, errors.Is(err, storage.ErrUsernameExists), err)
+	_, err = st.SaveUser(ctx, "bob", "alice@example.com", []byte("hash"))
+	assert.True(t, errors.Is(err, storage.ErrUserEmailExists), err)
+
+	byName, err := st.User(ctx, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, id, byName.ID)
+	assert.Equal(t, []byte("hash"), byName.Password)
+
+	byEmail, err := st.User(ctx, "alice@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, id, byEmail.ID)
+
+	_, err = st.User(ctx, "nobody")
+	assert.True(t, errors.Is(err, storage.ErrUserNotFound), err)
+}
+
+func testExpressions(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	alice := NewUser(t, st, "alice")
+	bob := NewUser(t, st, "bob")
+
+	expr := NewExpression(t, st, alice, "+", "*")
+	NewExpression(t, st, bob, "-")
+	assert.NotZero(t, expr.ID)
+
+	got, err := st.Expression(ctx, expr.ID)
+	require.NoError(t, err)
+	assert.Equal(t, alice, got.UserID)
+	require.Len(t, got.Tasks, 2)
+	assert.Equal(t, "+", got.Tasks[0].Operation)
+	assert.Equal(t, expr.ID, got.Tasks[1].ExpressionID)
+
+	list, err := st.UserExpressions(ctx, storage.ExpressionQuery{UserID: alice, Limit: 10, WithTasks: true})
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.Len(t, list[0].Tasks, 2)
+
+	result := 42.0
+	changed, err := st.UpdateExpression(ctx, expr.ID, "completed", &result)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	got, err = st.Expression(ctx, expr.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "completed", got.Status)
+	require.NotNil(t, got.Result)
+	assert.Equal(t, 42.0, *got.Result)
+
+	_, err = st.Expression(ctx, 9999)
+	assert.True(t, errors.Is(err, storage.ErrExpressionNotFound), err)
+}
+
+func testListExpressions(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	alice := NewUser(t, st, "alice")
+
+	// results 3, nil, 1, 2 for ids in creation order
+	var ids []uint
+	for _, result := range []*float64{ptr(3.0), nil, ptr(1.0), ptr(2.0)} {
+		expr := NewExpression(t, st, alice, "+")
+		ids = append(ids, expr.ID)
+		if result != nil {
+			complete(t, st, expr.ID, result)
+		}
+	}
+	NewExpression(t, st, NewUser(t, st, "bob"), "+")
+
+	// pages walks the whole listing two expressions at a time
+	pages := func(query storage.ExpressionQuery) []uint {
+		query.UserID = alice
+		query.Limit = 2
+
+		var got []uint
+		for {
+			page, err := st.UserExpressions(ctx, query)
+			require.NoError(t, err)
+			for _, expr := range page {
+				got = append(got, expr.ID)
+			}
+			if len(page) < query.Limit {
+				return got
+			}
+			cursor := storage.CursorOf(page[len(page)-1])
+			query.After = &cursor
+		}
+	}
+
+	assert.Equal(t, ids, pages(storage.ExpressionQuery{SortBy: storage.SortByID}))
+	assert.Equal(t, []uint{ids[3], ids[2], ids[1], ids[0]}, pages(storage.ExpressionQuery{SortBy: storage.SortByCreatedAt, Desc: true}))
+	assert.Equal(t, []uint{ids[2], ids[3], ids[0], ids[1]}, pages(storage.ExpressionQuery{SortBy: storage.SortByResult}))
+	assert.Equal(t, []uint{ids[0], ids[3], ids[2], ids[1]}, pages(storage.ExpressionQuery{SortBy: storage.SortByResult, Desc: true}))
+
+	assert.Equal(t, []uint{ids[1]}, pages(storage.ExpressionQuery{Statuses: []string{"in_progress"}}))
+	assert.Equal(t, []uint{ids[0], ids[3]}, pages(storage.ExpressionQuery{ResultMin: ptr(2.0), ResultMax: ptr(3.0)}))
+
+	first, err := st.Expression(ctx, ids[0])
+	require.NoError(t, err)
+	last, err := st.Expression(ctx, ids[3])
+	require.NoError(t, err)
+	assert.Equal(t, ids[:3], pages(storage.ExpressionQuery{CreatedFrom: &first.CreatedAt, CreatedTo: &last.CreatedAt}))
+
+	page, err := st.UserExpressions(ctx, storage.ExpressionQuery{UserID: alice, Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, page, 1)
+	assert.Empty(t, page[0].Tasks)
+}
+
+func testCancelExpression(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	expr := NewExpression(t, st, NewUser(t, st, "alice"), "+", "-", "*")
+
+	claimed, err := st.ClaimTasks(ctx, storage.ClaimRequest{Limit: 2, AgentID: "agent-1", LeaseUntil: time.Now().Add(time.Minute)})
+	require.NoError(t, err)
+	require.Len(t, claimed, 2)
+	_, err = st.CompleteTask(ctx, storage.TaskResult{ID: claimed[0].ID, Result: 1, AgentID: claimed[0].AgentID})
+	require.NoError(t, err)
+
+	cancelled, err := st.CancelExpression(ctx, expr.ID, "")
+	require.NoError(t, err)
+	assert.Equal(t, "cancelled", cancelled.Status)
+	assert.NotNil(t, cancelled.FinishedAt)
+	require.Len(t, cancelled.Tasks, 3)
+
+	tasks, err := st.Tasks(ctx, []uint{expr.Tasks[0].ID, expr.Tasks[1].ID, expr.Tasks[2].ID, 9999})
+	require.NoError(t, err)
+	require.Len(t, tasks, 3)
+	assert.Equal(t, "completed", tasks[0].Status)
+	assert.Equal(t, "cancelled", tasks[1].Status)
+	assert.Equal(t, "agent-1", tasks[1].AgentID)
+	assert.Equal(t, "cancelled", tasks[2].Status)
+
+	_, err = st.CompleteTask(ctx, storage.TaskResult{ID: claimed[1].ID, Result: 1, AgentID: claimed[1].AgentID})
+	assert.True(t, errors.Is(err, storage.ErrTaskCancelled), err)
+	_, err = st.ClaimTasks(ctx, storage.ClaimRequest{Limit: 1, AgentID: "agent-2", LeaseUntil: time.Now().Add(time.Minute)})
+	assert.True(t, errors.Is(err, storage.ErrTaskNotFound), err)
+
+	_, err = st.CancelExpression(ctx, expr.ID, "")
+	assert.True(t, errors.Is(err, storage.ErrExpressionFinished), err)
+	_, err = st.UpdateExpression(ctx, expr.ID, "in_progress", nil)
+	assert.True(t, errors.Is(err, storage.ErrExpressionFinished), err)
+	_, err = st.CancelExpression(ctx, 9999, "")
+	assert.True(t, errors.Is(err, storage.ErrExpressionNotFound), err)
+
+	events, err := st.ExpressionEvents(ctx, expr.ID)
+	require.NoError(t, err)
+	var cancelledTasks int
+	for _, event := range events {
+		if event.Type == models.EventCancelled {
+			cancelledTasks++
+		}
+	}
+	assert.Equal(t, 2, cancelledTasks)
+}
+
+func testExpireExpressions(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	user := NewUser(t, st, "alice")
+	now := time.Now()
+
+	withDeadline := func(deadline time.Time) models.Expression {
+		expr := models.Expression{Expr: "1+1", Status: "in_progress", UserID: user, Deadline: &deadline}
+		expr.Tasks = []models.Task{{Arg1: 1, Operation: "+", Status: "pending", OperationTime: 1}}
+		require.NoError(t, st.CreateExpression(ctx, &expr))
+		return expr
+	}
+	overdue := withDeadline(now.Add(-time.Minute))
+	later := withDeadline(now.Add(time.Minute))
+	NewExpression(t, st, user, "+")
+
+	expired, err := st.ExpireExpressions(ctx, time.Now(), 10)
+	require.NoError(t, err)
+	require.Len(t, expired, 1)
+	assert.Equal(t, overdue.ID, expired[0].ID)
+	assert.Equal(t, "timed_out", expired[0].Status)
+	assert.NotNil(t, expired[0].FinishedAt)
+	require.Len(t, expired[0].Tasks, 1)
+	assert.Equal(t, "cancelled", expired[0].Tasks[0].Status)
+
+	expired, err = st.ExpireExpressions(ctx, time.Now(), 10)
+	require.NoError(t, err)
+	assert.Empty(t, expired)
+
+	got, err := st.Expression(ctx, later.ID)
+	require.NoError(t, err)
+	require.NotNil(t, got.Deadline)
+	assert.WithinDuration(t, *later.Deadline, *got.Deadline, time.Millisecond)
+	assert.Equal(t, "in_progress", got.Status)
+
+	events, err := st.ExpressionEvents(ctx, overdue.ID)
+	require.NoError(t, err)
+	last := events[len(events)-1]
+	assert.Equal(t, storage.ReasonDeadline, last.Detail)
+}
+
+func testClaimAndComplete(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	user := NewUser(t, st, "alice")
+	expr := NewExpression(t, st, user, "+", "-", "*")
+
+	leaseUntil := time.Now().Add(time.Minute)
+	claimed, err := st.ClaimTasks(ctx, storage.ClaimRequest{Limit: 2, AgentID: "agent-1", LeaseUntil: leaseUntil})
+	require.NoError(t, err)
+	require.Len(t, claimed, 2)
+	assert.Equal(t, expr.Tasks[0].ID, claimed[0].ID)
+	assert.Equal(t, "in_progress", claimed[0].Status)
+	assert.Equal(t, "agent-1", claimed[0].AgentID)
+	require.NotNil(t, claimed[0].LeaseExpiresAt)
+
+	rest, err := st.ClaimTasks(ctx, storage.ClaimRequest{Limit: 5, AgentID: "agent-1", LeaseUntil: leaseUntil})
+	require.NoError(t, err)
+	require.Len(t, rest, 1)
+	assert.Equal(t, expr.Tasks[2].ID, rest[0].ID)
+
+	_, err = st.ClaimTasks(ctx, storage.ClaimRequest{Limit: 1, AgentID: "agent-1", LeaseUntil: leaseUntil})
+	assert.True(t, errors.Is(err, storage.ErrTaskNotFound), err)
+
+	// only the agent holding the lease may submit the result
+	_, err = st.CompleteTask(ctx, storage.TaskResult{ID: claimed[0].ID, Result: 7, AgentID: "intruder"})
+	assert.True(t, errors.Is(err, storage.ErrLeaseNotHeld), err)
+
+	task, err := st.CompleteTask(ctx, storage.TaskResult{ID: claimed[0].ID, Result: 7, AgentID: claimed[0].AgentID})
+	require.NoError(t, err)
+	assert.Equal(t, "completed", task.Status)
+	assert.Equal(t, expr.ID, task.ExpressionID)
+
+	_, err = st.CompleteTask(ctx, storage.TaskResult{ID: claimed[0].ID, Result: 8, AgentID: claimed[0].AgentID})
+	assert.True(t, errors.Is(err, storage.ErrTaskNotInProgress), err)
+	_, err = st.CompleteTask(ctx, storage.TaskResult{ID: 9999, Result: 1})
+	assert.True(t, errors.Is(err, storage.ErrTaskNotFound), err)
+
+	got, err := st.Expression(ctx, expr.ID)
+	require.NoError(t, err)
+	require.NotNil(t, got.Tasks[0].Result)
+	assert.Equal(t, 7.0, *got.Tasks[0].Result)
+}
+
+func testFairClaim(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	alice := NewUser(t, st, "alice")
+	bob := NewUser(t, st, "bob")
+
+	big := NewExpression(t, st, alice, "+", "+", "+", "+")
+	small := NewExpression(t, st, bob, "-")
+	assert.Equal(t, bob, small.Tasks[0].UserID)
+
+	claim := func(limit int) []models.Task {
+		tasks, err := st.ClaimTasks(ctx, storage.ClaimRequest{Limit: limit, AgentID: "agent-1", LeaseUntil: time.Now().Add(time.Minute)})
+		require.NoError(t, err)
+		return tasks
+	}
+
+	first := claim(1)
+	require.Len(t, first, 1)
+	assert.Equal(t, big.Tasks[0].ID, first[0].ID)
+
+	// alice already runs a task, bob is served before her second one
+	second := claim(2)
+	require.Len(t, second, 2)
+	assert.ElementsMatch(t, []uint{small.Tasks[0].ID, big.Tasks[1].ID}, []uint{second[0].ID, second[1].ID})
+	assert.Len(t, claim(10), 2)
+}
+
+func testQueueDepth(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	user := NewUser(t, st, "alice")
+	NewExpression(t, st, user, "+", "-", "*")
+
+	depth, err := st.QueueDepth(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, storage.QueueDepth{Pending: 3, PendingWorkMS: 3}, depth)
+
+	claimed, err := st.ClaimTasks(ctx, storage.ClaimRequest{Limit: 2, AgentID: "agent-1", LeaseUntil: time.Now().Add(time.Minute)})
+	require.NoError(t, err)
+	_, err = st.CompleteTask(ctx, storage.TaskResult{ID: claimed[0].ID, Result: 1, AgentID: claimed[0].AgentID})
+	require.NoError(t, err)
+
+	depth, err = st.QueueDepth(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, storage.QueueDepth{Pending: 1, Running: 1, PendingWorkMS: 1}, depth)
+}
+
+func testReapExpiredLeases(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	user := NewUser(t, st, "alice")
+	NewExpression(t, st, user, "+", "-")
+	now := time.Now()
+
+	expired, err := st.ClaimTasks(ctx, storage.ClaimRequest{Limit: 1, AgentID: "agent-1", LeaseUntil: now.Add(-time.Second)})
+	require.NoError(t, err)
+	_, err = st.ClaimTasks(ctx, storage.ClaimRequest{Limit: 1, AgentID: "agent-1", LeaseUntil: now.Add(time.Minute)})
+	require.NoError(t, err)
+
+	reaped, err := st.ReapExpiredLeases(ctx, now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), reaped)
+
+	again, err := st.ClaimTasks(ctx, storage.ClaimRequest{Limit: 5, AgentID: "agent-1", LeaseUntil: now.Add(time.Minute)})
+	require.NoError(t, err)
+	require.Len(t, again, 1)
+	assert.Equal(t, expired[0].ID, again[0].ID)
+}
+
+func testExtendLeases(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	user := NewUser(t, st, "alice")
+	expr := models.Expression{Expr: "test", Status: "in_progress", UserID: user, Tasks: []models.Task{
+		{Arg1: 1, Arg2: ptr(2.0), Operation: "+", Status: "pending", OperationTime: 5000},
+		{Arg1: 3, Arg2: ptr(4.0), Operation: "-", Status: "pending", OperationTime: 5000},
+		{Arg1: 5, Arg2: ptr(6.0), Operation: "*", Status: "pending", OperationTime: 5000},
+	}}
+	require.NoError(t, st.CreateExpression(ctx, &expr))
+	now := time.Now()
+
+	// the lease is shorter than the operation
+	lease := time.Second
+	mine, err := st.ClaimTasks(ctx, storage.ClaimRequest{Limit: 2, AgentID: "agent-1", LeaseUntil: now.Add(lease)})
+	require.NoError(t, err)
+	require.Len(t, mine, 2)
+	theirs, err := st.ClaimTasks(ctx, storage.ClaimRequest{Limit: 1, AgentID: "agent-2", LeaseUntil: now.Add(lease)})
+	require.NoError(t, err)
+	require.Len(t, theirs, 1)
+
+	// heartbeats while the tasks run keep agent-1's leases alive, agent-2
+	// sends none and loses its task
+	var reaped int64
+	for at := now; at.Before(now.Add(5 * time.Second)); at = at.Add(lease / 2) {
+		held, err := st.ExtendLeases(ctx, "agent-1", []uint{mine[0].ID, mine[1].ID, theirs[0].ID}, at.Add(lease))
+		require.NoError(t, err)
+		assert.Equal(t, []uint{mine[0].ID, mine[1].ID}, held)
+
+		n, err := st.ReapExpiredLeases(ctx, at.Add(lease/4))
+		require.NoError(t, err)
+		reaped += n
+	}
+	assert.Equal(t, int64(1), reaped)
+
+	tasks, err := st.Tasks(ctx, []uint{mine[0].ID, mine[1].ID, theirs[0].ID})
+	require.NoError(t, err)
+	assert.Equal(t, "in_progress", tasks[0].Status)
+	assert.Equal(t, "in_progress", tasks[1].Status)
+	assert.Equal(t, "pending", tasks[2].Status)
+
+	_, err = st.CompleteTask(ctx, storage.TaskResult{ID: mine[0].ID, Result: 3, AgentID: "agent-1"})
+	require.NoError(t, err)
+	held, err := st.ExtendLeases(ctx, "agent-1", []uint{mine[0].ID, mine[1].ID}, now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, []uint{mine[1].ID}, held)
+
+	held, err = st.ExtendLeases(ctx, "agent-1", nil, now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Empty(t, held)
+}
+
+func testReleaseTasks(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	user := NewUser(t, st, "alice")
+	NewExpression(t, st, user, "+", "-", "*")
+	leaseUntil := time.Now().Add(time.Minute)
+
+	mine, err := st.ClaimTasks(ctx, storage.ClaimRequest{Limit: 2, AgentID: "agent-1", LeaseUntil: leaseUntil})
+	require.NoError(t, err)
+	_, err = st.ClaimTasks(ctx, storage.ClaimRequest{Limit: 1, AgentID: "agent-2", LeaseUntil: leaseUntil})
+	require.NoError(t, err)
+
+	released, err := st.ReleaseTasks(ctx, "agent-1", []uint{mine[1].ID}, storage.ReasonReleased)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), released)
+
+	again, err := st.ClaimTasks(ctx, storage.ClaimRequest{Limit: 5, AgentID: "agent-3", LeaseUntil: leaseUntil})
+	require.NoError(t, err)
+	require.Len(t, again, 1)
+	assert.Equal(t, mine[1].ID, again[0].ID)
+
+	released, err = st.ReleaseTasks(ctx, "agent-1", nil, storage.ReasonReleased)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), released)
+
+	released, err = st.ReleaseTasks(ctx, "agent-1", nil, storage.ReasonReleased)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), released)
+}
+
+func testQueueStats(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	alice := NewUser(t, st, "alice")
+	bob := NewUser(t, st, "bob")
+	NewExpression(t, st, alice, "+", "-", "*")
+	NewExpression(t, st, bob, "+")
+	leaseUntil := time.Now().Add(time.Minute)
+
+	claimed, err := st.ClaimTasks(ctx, storage.ClaimRequest{Limit: 2, AgentID: "agent-1", LeaseUntil: leaseUntil})
+	require.NoError(t, err)
+	require.Len(t, claimed, 2)
+	_, err = st.CompleteTask(ctx, storage.TaskResult{ID: claimed[0].ID, Result: 1, AgentID: claimed[0].AgentID})
+	require.NoError(t, err)
+
+	stats, err := st.QueueStats(ctx, storage.QueueStatsQuery{Now: time.Now(), Minutes: 5})
+	require.NoError(t, err)
+
+	byStatus := map[string]int{}
+	for _, count := range stats.Counts {
+		byStatus[count.Status] += count.Count
+	}
+	assert.Equal(t, map[string]int{"pending": 2, "in_progress": 1, "completed": 1}, byStatus)
+
+	require.NotNil(t, stats.OldestPending)
+	assert.Equal(t, "pending", stats.OldestPending.Status)
+
+	require.Len(t, stats.Leases, 1)
+	assert.Equal(t, "agent-1", stats.Leases[0].AgentID)
+	assert.Equal(t, 1, stats.Leases[0].Tasks)
+	require.NotNil(t, stats.Leases[0].NextExpiry)
+	assert.WithinDuration(t, leaseUntil, *stats.Leases[0].NextExpiry, time.Second)
+
+	require.Len(t, stats.Backlog, 2)
+	assert.Equal(t, alice, stats.Backlog[0].UserID)
+	assert.Equal(t, 2, stats.Backlog[0].Pending+stats.Backlog[1].Pending)
+	assert.Equal(t, 1, stats.Backlog[0].Running+stats.Backlog[1].Running)
+
+	require.Len(t, stats.Throughput, 5)
+	total := 0
+	for _, completed := range stats.Throughput {
+		total += completed
+	}
+	assert.Equal(t, 1, total)
+
+	stats, err = st.QueueStats(ctx, storage.QueueStatsQuery{Now: time.Now(), Users: 1})
+	require.NoError(t, err)
+	assert.Len(t, stats.Backlog, 1)
+	assert.Empty(t, stats.Throughput)
+}
+
+func testQueueActions(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	user := NewUser(t, st, "alice")
+	expr := NewExpression(t, st, user, "+", "-")
+	leaseUntil := time.Now().Add(time.Minute)
+
+	claimed, err := st.ClaimTasks(ctx, storage.ClaimRequest{Limit: 1, AgentID: "agent-1", LeaseUntil: leaseUntil})
+	require.NoError(t, err)
+	require.Len(t, claimed, 1)
+
+	// pending tasks are not requeued
+	requeued, err := st.RequeueTasks(ctx, []uint{expr.Tasks[0].ID, expr.Tasks[1].ID}, storage.ReasonRequeued)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), requeued)
+
+	depth, err := st.QueueDepth(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, depth.Pending)
+
+	task, err := st.PrioritizeTask(ctx, claimed[0].ID, storage.ClassBatch, 5)
+	require.NoError(t, err)
+	assert.Equal(t, storage.ClassBatch, task.Class)
+	assert.Equal(t, 5, task.Priority)
+
+	prioritized, err := st.PrioritizeExpression(ctx, expr.ID, storage.ClassInteractive, 7)
+	require.NoError(t, err)
+	assert.Equal(t, storage.ClassInteractive, prioritized.Class)
+	assert.Equal(t, 7, prioritized.Priority)
+	for _, task := range prioritized.Tasks {
+		assert.Equal(t, storage.ClassInteractive, task.Class)
+		assert.Equal(t, 7, task.Priority)
+	}
+
+	_, err = st.CancelExpression(ctx, expr.ID, storage.ReasonDropped)
+	require.NoError(t, err)
+
+	_, err = st.PrioritizeExpression(ctx, expr.ID, storage.ClassBatch, 1)
+	assert.True(t, errors.Is(err, storage.ErrExpressionFinished), err)
+	_, err = st.PrioritizeTask(ctx, claimed[0].ID, storage.ClassBatch, 1)
+	assert.True(t, errors.Is(err, storage.ErrTaskFinished), err)
+	_, err = st.PrioritizeTask(ctx, 9999, storage.ClassBatch, 1)
+	assert.True(t, errors.Is(err, storage.ErrTaskNotFound), err)
+
+	events, err := st.ExpressionEvents(ctx, expr.ID)
+	require.NoError(t, err)
+	details := map[string]bool{}
+	for _, event := range events {
+		details[event.Detail] = true
+	}
+	assert.True(t, details[storage.ReasonRequeued])
+	assert.True(t, details[storage.ReasonDropped])
+}
+
+func testStuckExpressions(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	user := NewUser(t, st, "alice")
+	done := NewExpression(t, st, user, "+")
+	NewExpression(t, st, user, "-")
+	now := time.Now()
+
+	claimed, err := st.ClaimTasks(ctx, storage.ClaimRequest{Limit: 1, AgentID: "agent-1", LeaseUntil: now.Add(time.Minute)})
+	require.NoError(t, err)
+	require.Len(t, claimed, 1)
+	require.Equal(t, done.Tasks[0].ID, claimed[0].ID)
+	_, err = st.CompleteTask(ctx, storage.TaskResult{ID: claimed[0].ID, Result: 1, AgentID: claimed[0].AgentID})
+	require.NoError(t, err)
+
+	broken := models.Expression{Expr: "test", Status: "in_progress", UserID: user, Tasks: []models.Task{
+		{Arg1: 2, Operation: "+", Status: "cancelled", OperationTime: 1},
+	}}
+	require.NoError(t, st.CreateExpression(ctx, &broken))
+
+	stuck, err := st.StuckExpressions(ctx, now, 10)
+	require.NoError(t, err)
+	require.Len(t, stuck, 2)
+	assert.Equal(t, done.ID, stuck[0].ID)
+	assert.Len(t, stuck[0].Tasks, 1)
+	assert.Equal(t, broken.ID, stuck[1].ID)
+
+	stuck, err = st.StuckExpressions(ctx, now, 1)
+	require.NoError(t, err)
+	assert.Len(t, stuck, 1)
+
+	failed, err := st.FailExpression(ctx, broken.ID, storage.ReasonUnfinishable)
+	require.NoError(t, err)
+	assert.Equal(t, "error", failed.Status)
+	assert.NotNil(t, failed.FinishedAt)
+	for _, task := range failed.Tasks {
+		assert.Equal(t, "cancelled", task.Status)
+	}
+
+	_, err = st.FailExpression(ctx, broken.ID, storage.ReasonUnfinishable)
+	assert.True(t, errors.Is(err, storage.ErrExpressionFinished), err)
+
+	stuck, err = st.StuckExpressions(ctx, now, 10)
+	require.NoError(t, err)
+	require.Len(t, stuck, 1)
+	assert.Equal(t, done.ID, stuck[0].ID)
+
+	leased, err := st.LeasedTasks(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, leased)
+}
+
+func testUnfinishedExpressions(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	user := NewUser(t, st, "alice")
+	first := NewExpression(t, st, user, "+")
+	done := NewExpression(t, st, user, "-")
+	last := NewExpression(t, st, user, "*")
+	complete(t, st, done.ID, ptr(1.0))
+
+	ids, err := st.UnfinishedExpressions(ctx, 0, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []uint{first.ID, last.ID}, ids)
+
+	ids, err = st.UnfinishedExpressions(ctx, 0, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []uint{first.ID}, ids)
+
+	ids, err = st.UnfinishedExpressions(ctx, first.ID, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []uint{last.ID}, ids)
+}
+
+func testRecordVerification(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	user := NewUser(t, st, "alice")
+	expr := NewExpression(t, st, user, "+")
+	complete(t, st, expr.ID, ptr(5.0))
+
+	require.NoError(t, st.RecordVerification(ctx, expr.ID, "mismatch", ptr(3.0), "distributed 5, local 3"))
+	assert.True(t, errors.Is(st.RecordVerification(ctx, 9999, "match", nil, ""), storage.ErrExpressionNotFound))
+
+	got, err := st.Expression(ctx, expr.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "completed", got.Status)
+	assert.Equal(t, "mismatch", got.Verification)
+	require.NotNil(t, got.LocalResult)
+	assert.Equal(t, 3.0, *got.LocalResult)
+	require.NotNil(t, got.Result)
+	assert.Equal(t, 5.0, *got.Result)
+
+	events, err := st.ExpressionEvents(ctx, expr.ID)
+	require.NoError(t, err)
+	require.NotEmpty(t, events)
+	last := events[len(events)-1]
+	assert.Equal(t, models.EventVerified, last.Type)
+	assert.Equal(t, "completed", last.Status)
+	assert.Equal(t, "distributed 5, local 3", last.Detail)
+}
+
+func testRepair(t *testing.T, st storage.Storage) {
+	checker, ok := st.(storage.Checker)
+	if !ok {
+		t.Skip("backend cannot be checked")
+	}
+
+	ctx := context.Background()
+	user := NewUser(t, st, "alice")
+	expr := NewExpression(t, st, user, "+", "-")
+
+	require.NoError(t, checker.RepairTask(ctx, expr.Tasks[0].ID, "cancelled", nil))
+	require.NoError(t, checker.RepairExpression(ctx, expr.ID, "completed", ptr(3.0)))
+	assert.True(t, errors.Is(checker.RepairTask(ctx, 9999, "cancelled", nil), storage.ErrTaskNotFound))
+
+	got, err := st.Expression(ctx, expr.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "completed", got.Status)
+	require.NotNil(t, got.Result)
+	assert.Equal(t, 3.0, *got.Result)
+	assert.NotNil(t, got.FinishedAt)
+	assert.Equal(t, "cancelled", got.Tasks[0].Status)
+	assert.Equal(t, "pending", got.Tasks[1].Status)
+
+	events, err := st.ExpressionEvents(ctx, expr.ID)
+	require.NoError(t, err)
+	repaired := 0
+	for _, event := range events {
+		if event.Detail == storage.ReasonRepaired {
+			repaired++
+		}
+	}
+	assert.Equal(t, 2, repaired)
+
+	scanned, err := checker.ScanExpressions(ctx, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, scanned, 1)
+	assert.Len(t, scanned[0].Tasks, 2)
+
+	require.NoError(t, checker.DeleteExpressions(ctx, []uint{expr.ID}))
+	_, err = st.Expression(ctx, expr.ID)
+	assert.True(t, errors.Is(err, storage.ErrExpressionNotFound), err)
+	tasks, err := st.Tasks(ctx, []uint{expr.Tasks[0].ID, expr.Tasks[1].ID})
+	require.NoError(t, err)
+	assert.Empty(t, tasks)
+}
+
+func testAgents(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	seen := time.Now().UTC().Truncate(time.Second)
+
+	require.NoError(t, st.SaveAgent(ctx, models.Agent{ID: "b", Workers: 2, Status: "online", LastSeenAt: seen}))
+	require.NoError(t, st.SaveAgent(ctx, models.Agent{ID: "a", Workers: 4, Status: "online", LastSeenAt: seen}))
+	require.NoError(t, st.SaveAgent(ctx, models.Agent{ID: "b", Workers: 2, Status: "offline", LastSeenAt: seen}))
+
+	agents, err := st.Agents(ctx)
+	require.NoError(t, err)
+	require.Len(t, agents, 2)
+	assert.Equal(t, "a", agents[0].ID)
+	assert.Equal(t, 4, agents[0].Workers)
+	assert.Equal(t, "offline", agents[1].Status)
+	assert.True(t, seen.Equal(agents[1].LastSeenAt))
+}
+
+func testVotes(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	user := NewUser(t, st, "alice")
+	expr := models.Expression{Expr: "2 * 3", Status: "in_progress", UserID: user, Class: storage.ClassInteractive, Replicas: 3}
+	arg2 := 3.0
+	expr.Tasks = []models.Task{{Arg1: 2, Arg2: &arg2, Operation: "*", Status: "pending", OperationTime: 1}}
+	require.NoError(t, st.CreateExpression(ctx, &expr))
+	id := expr.Tasks[0].ID
+	assert.Equal(t, 3, expr.Tasks[0].Replicas)
+
+	claim := func(agentID string) (models.Task, error) {
+		tasks, err := st.ClaimTasks(ctx, storage.ClaimRequest{Limit: 1, AgentID: agentID, LeaseUntil: time.Now().Add(time.Minute)})
+		if err != nil {
+			return models.Task{}, err
+		}
+		return tasks[0], nil
+	}
+
+	// an anonymous agent cannot vote
+	_, err := claim("")
+	assert.True(t, errors.Is(err, storage.ErrTaskNotFound), err)
+
+	_, err = claim("agent-1")
+	require.NoError(t, err)
+	task, err := st.CompleteTask(ctx, storage.TaskResult{ID: id, Result: 6, AgentID: "agent-1"})
+	require.NoError(t, err)
+	assert.Equal(t, "pending", task.Status)
+	assert.Nil(t, task.Result)
+
+	// each agent votes once
+	_, err = claim("agent-1")
+	assert.True(t, errors.Is(err, storage.ErrTaskNotFound), err)
+	_, err = claim("agent-2")
+	require.NoError(t, err)
+	task, err = st.CompleteTask(ctx, storage.TaskResult{ID: id, Result: 7, AgentID: "agent-2"})
+	require.NoError(t, err)
+	assert.Equal(t, "pending", task.Status)
+
+	_, err = claim("agent-3")
+	require.NoError(t, err)
+	task, err = st.CompleteTask(ctx, storage.TaskResult{ID: id, Result: 6, AgentID: "agent-3"})
+	require.NoError(t, err)
+	assert.Equal(t, "completed", task.Status)
+	require.NotNil(t, task.Result)
+	assert.Equal(t, 6.0, *task.Result)
+
+	votes, err := st.TaskVotes(ctx, id)
+	require.NoError(t, err)
+	require.Len(t, votes, 3)
+	assert.Equal(t, "agent-2", votes[1].AgentID)
+	assert.Equal(t, 7.0, votes[1].Result)
+	assert.Equal(t, []string{"agent-2"}, storage.CountVotes(votes, 3, 0).Dissenters)
+
+	got, err := st.Expression(ctx, expr.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "completed", got.Tasks[0].Status)
+
+	events, err := st.ExpressionEvents(ctx, expr.ID)
+	require.NoError(t, err)
+	voted := 0
+	for _, event := range events {
+		if event.Type == models.EventVoted {
+			voted++
+		}
+	}
+	assert.Equal(t, 3, voted)
+}
+
+func testReplicaLeases(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	user := NewUser(t, st, "alice")
+	replicated := func(replicas int) uint {
+		expr := models.Expression{Expr: "2 * 3", Status: "in_progress", UserID: user, Class: storage.ClassInteractive, Replicas: replicas}
+		arg2 := 3.0
+		expr.Tasks = []models.Task{{Arg1: 2, Arg2: &arg2, Operation: "*", Status: "pending", OperationTime: 1}}
+		require.NoError(t, st.CreateExpression(ctx, &expr))
+		return expr.Tasks[0].ID
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	claim := func(agentID string) (models.Task, error) {
+		tasks, err := st.ClaimTasks(ctx, storage.ClaimRequest{Limit: 1, AgentID: agentID, LeaseUntil: now.Add(time.Minute)})
+		if err != nil {
+			return models.Task{}, err
+		}
+		return tasks[0], nil
+	}
+	leaseHolders := func() []string {
+		leased, err := st.LeasedTasks(ctx)
+		require.NoError(t, err)
+		var agents []string
+		for _, task := range leased {
+			agents = append(agents, task.AgentID)
+		}
+		return agents
+	}
+	status := func(id uint) string {
+		tasks, err := st.Tasks(ctx, []uint{id})
+		require.NoError(t, err)
+		require.Len(t, tasks, 1)
+		return tasks[0].Status
+	}
+
+	// the replicas go to distinct agents at the same time
+	id := replicated(3)
+	for _, agentID := range []string{"agent-1", "agent-2", "agent-3"} {
+		task, err := claim(agentID)
+		require.NoError(t, err)
+		assert.Equal(t, id, task.ID)
+		assert.Equal(t, "in_progress", task.Status)
+		assert.Equal(t, agentID, task.AgentID)
+		require.NotNil(t, task.LeaseExpiresAt)
+		assert.True(t, now.Add(time.Minute).Equal(*task.LeaseExpiresAt))
+	}
+	_, err := claim("agent-1")
+	assert.True(t, errors.Is(err, storage.ErrTaskNotFound), err)
+	_, err = claim("agent-4")
+	assert.True(t, errors.Is(err, storage.ErrTaskNotFound), err)
+	assert.Equal(t, "in_progress", status(id))
+	assert.Equal(t, []string{"agent-1", "agent-2", "agent-3"}, leaseHolders())
+
+	stats, err := st.QueueStats(ctx, storage.QueueStatsQuery{Now: now})
+	require.NoError(t, err)
+	assert.Len(t, stats.Leases, 3)
+
+	_, err = st.CompleteTask(ctx, storage.TaskResult{ID: id, Result: 6, AgentID: "agent-4"})
+	assert.True(t, errors.Is(err, storage.ErrLeaseNotHeld), err)
+
+	// expired replicas free their slots, the task stays with agent-2
+	held, err := st.ExtendLeases(ctx, "agent-2", []uint{id}, now.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, []uint{id}, held)
+	reaped, err := st.ReapExpiredLeases(ctx, now.Add(2*time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), reaped)
+	assert.Equal(t, "in_progress", status(id))
+	assert.Equal(t, []string{"agent-2"}, leaseHolders())
+	held, err = st.ExtendLeases(ctx, "agent-1", []uint{id}, now.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, held)
+
+	_, err = claim("agent-4")
+	require.NoError(t, err)
+	_, err = claim("agent-1")
+	require.NoError(t, err)
+	released, err := st.ReleaseTasks(ctx, "agent-4", nil, storage.ReasonReleased)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), released)
+
+	// a vote keeps the task in progress while others compute it
+	task, err := st.CompleteTask(ctx, storage.TaskResult{ID: id, Result: 6, AgentID: "agent-2"})
+	require.NoError(t, err)
+	assert.Equal(t, "in_progress", task.Status)
+	task, err = st.CompleteTask(ctx, storage.TaskResult{ID: id, Result: 6, AgentID: "agent-1"})
+	require.NoError(t, err)
+	assert.Equal(t, "completed", task.Status)
+	assert.Empty(t, leaseHolders())
+
+	// a task nobody holds any more goes back to the queue
+	id = replicated(2)
+	_, err = claim("agent-1")
+	require.NoError(t, err)
+	released, err = st.ReleaseTasks(ctx, "agent-1", []uint{id}, storage.ReasonReleased)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), released)
+	assert.Equal(t, "pending", status(id))
+
+	_, err = claim("agent-1")
+	require.NoError(t, err)
+	_, err = claim("agent-2")
+	require.NoError(t, err)
+	requeued, err := st.RequeueTasks(ctx, []uint{id}, storage.ReasonRequeued)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), requeued)
+	assert.Equal(t, "pending", status(id))
+	assert.Empty(t, leaseHolders())
+
+	// cancelling the expression takes the task from its agents
+	task, err = claim("agent-1")
+	require.NoError(t, err)
+	_, err = st.CancelExpression(ctx, task.ExpressionID, "")
+	require.NoError(t, err)
+	held, err = st.ExtendLeases(ctx, "agent-1", []uint{id}, now.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, held)
+	assert.Empty(t, leaseHolders())
+}
+
+func testQuarantine(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	user := NewUser(t, st, "alice")
+	NewExpression(t, st, user, "+")
+	seen := time.Now().UTC().Truncate(time.Second)
+	require.NoError(t, st.SaveAgent(ctx, models.Agent{ID: "agent-1", Workers: 1, Status: "online", LastSeenAt: seen}))
+
+	_, err := st.RecordDisagreement(ctx, "nobody", 1)
+	assert.True(t, errors.Is(err, storage.ErrAgentNotFound), err)
+
+	agent, err := st.RecordDisagreement(ctx, "agent-1", 2)
+	require.NoError(t, err)
+	assert.Equal(t, 1, agent.Disagreements)
+	assert.False(t, agent.Quarantined)
+	agent, err = st.RecordDisagreement(ctx, "agent-1", 2)
+	require.NoError(t, err)
+	assert.Equal(t, 2, agent.Disagreements)
+	assert.True(t, agent.Quarantined)
+
+	// a heartbeat does not lift the quarantine
+	require.NoError(t, st.SaveAgent(ctx, models.Agent{ID: "agent-1", Workers: 1, Status: "online", LastSeenAt: seen}))
+	agents, err := st.Agents(ctx)
+	require.NoError(t, err)
+	require.Len(t, agents, 1)
+	assert.True(t, agents[0].Quarantined)
+	assert.Equal(t, 2, agents[0].Disagreements)
+
+	_, err = st.ClaimTasks(ctx, storage.ClaimRequest{Limit: 1, AgentID: "agent-1", LeaseUntil: time.Now().Add(time.Minute)})
+	assert.True(t, errors.Is(err, storage.ErrAgentQuarantined), err)
+
+	agent, err = st.SetAgentQuarantine(ctx, "agent-1", false)
+	require.NoError(t, err)
+	assert.False(t, agent.Quarantined)
+	assert.Equal(t, 0, agent.Disagreements)
+	_, err = st.ClaimTasks(ctx, storage.ClaimRequest{Limit: 1, AgentID: "agent-1", LeaseUntil: time.Now().Add(time.Minute)})
+	require.NoError(t, err)
+}
+
+func testAgentCredentials(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	created := time.Now().UTC().Truncate(time.Second)
+
+	_, err := st.AgentCredential(ctx, "agent-1")
+	assert.True(t, errors.Is(err, storage.ErrCredentialNotFound), err)
+
+	require.NoError(t, st.SaveAgentCredential(ctx, models.AgentCredential{AgentID: "agent-1", TokenHash: "old", CreatedAt: created}))
+	require.NoError(t, st.SaveAgentCredential(ctx, models.AgentCredential{AgentID: "agent-1", TokenHash: "new", CreatedAt: created}))
+	credential, err := st.AgentCredential(ctx, "agent-1")
+	require.NoError(t, err)
+	assert.Equal(t, "new", credential.TokenHash)
+	assert.True(t, created.Equal(credential.CreatedAt))
+
+	require.NoError(t, st.DeleteAgentCredential(ctx, "agent-1"))
+	assert.True(t, errors.Is(st.DeleteAgentCredential(ctx, "agent-1"), storage.ErrCredentialNotFound))
+	_, err = st.AgentCredential(ctx, "agent-1")
+	assert.True(t, errors.Is(err, storage.ErrCredentialNotFound), err)
+}
+
+func testTimeline(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	user := NewUser(t, st, "alice")
+	expr := NewExpression(t, st, user, "+")
+	require.NotNil(t, expr.Tasks[0].QueuedAt)
+	leaseUntil := time.Now().Add(time.Minute)
+
+	_, err := st.ClaimTasks(ctx, storage.ClaimRequest{Limit: 1, AgentID: "agent-1", LeaseUntil: leaseUntil})
+	require.NoError(t, err)
+	_, err = st.ReleaseTasks(ctx, "agent-1", nil, storage.ReasonReleased)
+	require.NoError(t, err)
+	_, err = st.ClaimTasks(ctx, storage.ClaimRequest{Limit: 1, AgentID: "agent-2", LeaseUntil: leaseUntil})
+	require.NoError(t, err)
+
+	startedAt := time.Now().UTC()
+	task, err := st.CompleteTask(ctx, storage.TaskResult{ID: expr.Tasks[0].ID, Result: 2, AgentID: "agent-2", StartedAt: startedAt})
+	require.NoError(t, err)
+	assert.Equal(t, "agent-2", task.AgentID)
+	changed, err := st.UpdateExpression(ctx, expr.ID, "completed", &task.Arg1)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	// a second finisher changes nothing and logs nothing
+	changed, err = st.UpdateExpression(ctx, expr.ID, "completed", &task.Arg1)
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	got, err := st.Expression(ctx, expr.ID)
+	require.NoError(t, err)
+	assert.False(t, got.CreatedAt.IsZero())
+	assert.NotNil(t, got.FinishedAt)
+	stored := got.Tasks[0]
+	for _, at := range []*time.Time{stored.QueuedAt, stored.LeasedAt, stored.StartedAt, stored.CompletedAt, stored.FailedAt} {
+		assert.NotNil(t, at)
+	}
+	assert.WithinDuration(t, startedAt, *stored.StartedAt, time.Millisecond)
+
+	events, err := st.ExpressionEvents(ctx, expr.ID)
+	require.NoError(t, err)
+
+	var types []string
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	assert.ElementsMatch(t, []string{
+		models.EventCreated, models.EventQueued,
+		models.EventLeased, models.EventFailed, models.EventQueued,
+		models.EventLeased, models.EventStarted, models.EventCompleted,
+		models.EventStatus,
+	}, types)
+	assert.Equal(t, models.EventCreated, types[0])
+	assert.Equal(t, models.EventStatus, types[len(types)-1])
+}
+
+func testCachedTasks(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	user := NewUser(t, st, "alice")
+
+	arg2 := 3.0
+	result := 5.0
+	expr := models.Expression{Expr: "2+3", Status: "in_progress", UserID: user, Tasks: []models.Task{
+		{Arg1: 2, Arg2: &arg2, Operation: "+", Status: "completed", Result: &result, OperationTime: 1},
+	}}
+	require.NoError(t, st.CreateExpression(ctx, &expr))
+
+	got, err := st.Expression(ctx, expr.ID)
+	require.NoError(t, err)
+	require.Len(t, got.Tasks, 1)
+	assert.Equal(t, "completed", got.Tasks[0].Status)
+	assert.NotNil(t, got.Tasks[0].CompletedAt)
+	assert.Nil(t, got.Tasks[0].QueuedAt)
+
+	_, err = st.ClaimTasks(ctx, storage.ClaimRequest{Limit: 1, AgentID: "agent-1", LeaseUntil: time.Now().Add(time.Minute)})
+	assert.True(t, errors.Is(err, storage.ErrTaskNotFound))
+
+	events, err := st.ExpressionEvents(ctx, expr.ID)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, models.EventCompleted, events[1].Type)
+	assert.Equal(t, storage.ReasonCached, events[1].Detail)
+}
+
+func testWebhooks(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	alice := NewUser(t, st, "alice")
+	bob := NewUser(t, st, "bob")
+
+	hook := models.Webhook{UserID: alice, URL: "http://example.com/hook"}
+	require.NoError(t, st.CreateWebhook(ctx, &hook))
+	assert.NotZero(t, hook.ID)
+
+	dup := models.Webhook{UserID: alice, URL: hook.URL}
+	assert.True(t, errors.Is(st.CreateWebhook(ctx, &dup), storage.ErrWebhookExists))
+	require.NoError(t, st.CreateWebhook(ctx, &models.Webhook{UserID: bob, URL: hook.URL}))
+
+	hooks, err := st.Webhooks(ctx, alice)
+	require.NoError(t, err)
+	require.Len(t, hooks, 1)
+	assert.Equal(t, hook.URL, hooks[0].URL)
+
+	assert.True(t, errors.Is(st.DeleteWebhook(ctx, bob, hook.ID), storage.ErrWebhookNotFound))
+	require.NoError(t, st.DeleteWebhook(ctx, alice, hook.ID))
+	hooks, err = st.Webhooks(ctx, alice)
+	require.NoError(t, err)
+	assert.Empty(t, hooks)
+
+	secret, err := st.EnsureWebhookSecret(ctx, alice, "first")
+	require.NoError(t, err)
+	assert.Equal(t, "first", secret)
+	secret, err = st.EnsureWebhookSecret(ctx, alice, "second")
+	require.NoError(t, err)
+	assert.Equal(t, "first", secret)
+
+	require.NoError(t, st.SetWebhookSecret(ctx, alice, "rotated"))
+	secret, err = st.EnsureWebhookSecret(ctx, alice, "third")
+	require.NoError(t, err)
+	assert.Equal(t, "rotated", secret)
+}
+
+func testQuotas(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	alice := NewUser(t, st, "alice")
+	bob := NewUser(t, st, "bob")
+
+	_, err := st.Quota(ctx, alice)
+	assert.True(t, errors.Is(err, storage.ErrQuotaNotFound))
+	assert.True(t, errors.Is(st.DeleteQuota(ctx, alice), storage.ErrQuotaNotFound))
+
+	require.NoError(t, st.SaveQuota(ctx, models.Quota{UserID: alice, ExpressionsPerMinute: ptr(10)}))
+	require.NoError(t, st.SaveQuota(ctx, models.Quota{UserID: alice, TasksPerDay: ptr(0)}))
+	quota, err := st.Quota(ctx, alice)
+	require.NoError(t, err)
+	assert.Nil(t, quota.ExpressionsPerMinute)
+	assert.Nil(t, quota.ActiveExpressions)
+	require.NotNil(t, quota.TasksPerDay)
+	assert.Equal(t, 0, *quota.TasksPerDay)
+
+	require.NoError(t, st.DeleteQuota(ctx, alice))
+	_, err = st.Quota(ctx, alice)
+	assert.True(t, errors.Is(err, storage.ErrQuotaNotFound))
+
+	before := time.Now().Add(-time.Second)
+	first := NewExpression(t, st, alice, "+", "-")
+	NewExpression(t, st, alice, "*")
+	NewExpression(t, st, bob, "/")
+	complete(t, st, first.ID, ptr(1.0))
+
+	usage, err := st.QuotaUsage(ctx, alice, before, before)
+	require.NoError(t, err)
+	assert.Equal(t, 2, usage.Recent)
+	assert.WithinDuration(t, first.CreatedAt, usage.OldestRecent, time.Millisecond)
+	assert.Equal(t, 1, usage.Active)
+	assert.Equal(t, 3, usage.TasksToday)
+
+	later := time.Now().Add(time.Second)
+	usage, err = st.QuotaUsage(ctx, alice, later, later)
+	require.NoError(t, err)
+	assert.Equal(t, storage.Usage{Active: 1}, usage)
+
+	// concurrent creations see each other, only what fits the limit is saved
+	errLimit := errors.New("limit")
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			expr := models.Expression{Expr: "1 + 1", Status: "in_progress", UserID: bob, Tasks: []models.Task{
+				{Arg1: 1, Arg2: ptr(1.0), Operation: "+", Status: "pending", OperationTime: 1},
+			}}
+			errs[i] = st.CreateExpressionWithinQuota(ctx, &expr, before, before, func(usage storage.Usage) error {
+				if usage.Recent >= 4 {
+					return errLimit
+				}
+				return nil
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	created := 0
+	for _, err := range errs {
+		if err == nil {
+			created++
+		} else {
+			assert.True(t, errors.Is(err, errLimit), err)
+		}
+	}
+	assert.Equal(t, 3, created)
+	usage, err = st.QuotaUsage(ctx, bob, before, before)
+	require.NoError(t, err)
+	assert.Equal(t, 4, usage.Recent)
+	assert.Equal(t, 4, usage.TasksToday)
+}
+
+func testWebhookDeliveries(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	user := NewUser(t, st, "alice")
+	expr := NewExpression(t, st, user, "+")
+	now := time.Now().UTC().Truncate(time.Second)
+
+	delivery := func(url string) models.WebhookDelivery {
+		return models.WebhookDelivery{
+			UserID:        user,
+			ExpressionID:  expr.ID,
+			URL:           url,
+			Event:         "expression.completed",
+			Payload:       "{}",
+			Status:        models.DeliveryPending,
+			NextAttemptAt: &now,
+			CreatedAt:     now,
+		}
+	}
+
+	require.NoError(t, st.EnqueueWebhookDeliveries(ctx, []models.WebhookDelivery{delivery("http://a"), delivery("http://b")}))
+	// another instance finishing the same expression must not send twice
+	require.NoError(t, st.EnqueueWebhookDeliveries(ctx, []models.WebhookDelivery{delivery("http://a")}))
+
+	listed, err := st.WebhookDeliveries(ctx, user, expr.ID, 10)
+	require.NoError(t, err)
+	require.Len(t, listed, 2)
+	assert.Equal(t, "http://b", listed[0].URL)
+
+	claimed, err := st.ClaimWebhookDeliveries(ctx, now, now.Add(time.Minute), 10)
+	require.NoError(t, err)
+	require.Len(t, claimed, 2)
+
+	again, err := st.ClaimWebhookDeliveries(ctx, now, now.Add(time.Minute), 10)
+	require.NoError(t, err)
+	assert.Empty(t, again)
+
+	retryAt := now.Add(time.Second)
+	first := claimed[0]
+	require.NoError(t, st.RecordWebhookAttempt(ctx, models.WebhookAttempt{
+		DeliveryID: first.ID, Attempt: 1, At: now, ResponseCode: 500, Error: "unexpected status 500",
+	}, models.DeliveryPending, &retryAt))
+	require.NoError(t, st.RecordWebhookAttempt(ctx, models.WebhookAttempt{
+		DeliveryID: claimed[1].ID, Attempt: 1, At: now, ResponseCode: 200,
+	}, models.DeliverySucceeded, nil))
+
+	due, err := st.ClaimWebhookDeliveries(ctx, retryAt, retryAt.Add(time.Minute), 10)
+	require.NoError(t, err)
+	require.Len(t, due, 1)
+	assert.Equal(t, first.ID, due[0].ID)
+	assert.Equal(t, 1, due[0].Attempts)
+
+	require.NoError(t, st.RecordWebhookAttempt(ctx, models.WebhookAttempt{
+		DeliveryID: first.ID, Attempt: 2, At: retryAt, ResponseCode: 200,
+	}, models.DeliverySucceeded, nil))
+
+	got, err := st.WebhookDelivery(ctx, first.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.DeliverySucceeded, got.Status)
+	assert.Equal(t, 2, got.Attempts)
+	assert.Equal(t, 200, got.LastResponseCode)
+	require.Len(t, got.AttemptLog, 2)
+	assert.Equal(t, 500, got.AttemptLog[0].ResponseCode)
+
+	require.NoError(t, st.RedeliverWebhook(ctx, first.ID, now))
+	due, err = st.ClaimWebhookDeliveries(ctx, now, now.Add(time.Minute), 10)
+	require.NoError(t, err)
+	require.Len(t, due, 1)
+	assert.Equal(t, 0, due[0].Attempts)
+
+	_, err = st.WebhookDelivery(ctx, 9999)
+	assert.True(t, errors.Is(err, storage.ErrDeliveryNotFound))
+}
+
+func testIdempotencyKeys(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	alice := NewUser(t, st, "alice")
+	bob := NewUser(t, st, "bob")
+	now := time.Now()
+
+	reserve := func(userID uint, hash string, at time.Time) (models.IdempotencyKey, bool) {
+		key := models.IdempotencyKey{UserID: userID, Key: "k1", RequestHash: hash, CreatedAt: at, ExpiresAt: at.Add(time.Minute)}
+		stored, created, err := st.ReserveIdempotencyKey(ctx, key, at)
+		require.NoError(t, err)
+		return stored, created
+	}
+
+	_, created := reserve(alice, "a", now)
+	assert.True(t, created)
+	stored, created := reserve(alice, "b", now)
+	assert.False(t, created)
+	assert.Equal(t, "a", stored.RequestHash)
+	assert.Zero(t, stored.StatusCode)
+	_, created = reserve(bob, "b", now)
+	assert.True(t, created, "keys are per user")
+
+	expr := NewExpression(t, st, alice, "+")
+	require.NoError(t, st.CompleteIdempotencyKey(ctx, alice, "k1", 201, expr.ID, now.Add(time.Hour)))
+	stored, created = reserve(alice, "a", now.Add(30*time.Minute))
+	assert.False(t, created)
+	assert.Equal(t, 201, stored.StatusCode)
+	assert.Equal(t, expr.ID, stored.ExpressionID)
+
+	// an expired key is taken over
+	stored, created = reserve(alice, "c", now.Add(2*time.Hour))
+	assert.True(t, created)
+	assert.Equal(t, "c", stored.RequestHash)
+
+	require.NoError(t, st.ReleaseIdempotencyKey(ctx, alice, "k1"))
+	_, created = reserve(alice, "d", now)
+	assert.True(t, created)
+
+	deleted, err := st.DeleteExpiredIdempotencyKeys(ctx, now.Add(2*time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), deleted)
+}
+
+func testLocks(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+
+	lock, err := st.TryLock(ctx, 42)
+	require.NoError(t, err)
+
+	_, err = st.TryLock(ctx, 42)
+	assert.True(t, errors.Is(err, storage.ErrLockHeld), err)
+
+	other, err := st.TryLock(ctx, 43)
+	require.NoError(t, err)
+	require.NoError(t, other.Release())
+
+	require.NoError(t, lock.Release())
+	lock, err = st.TryLock(ctx, 42)
+	require.NoError(t, err)
+	require.NoError(t, lock.Release())
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"slices"
+	"time"
+
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+)
+
+// reasons recorded with the task events
+const (
+	ReasonLeaseExpired = "lease expired"
+	ReasonReleased     = "released by agent"
+	ReasonDeadline     = "deadline exceeded"
+	ReasonCached       = "cached result"
+	ReasonRequeued     = "requeued by admin"
+	ReasonDropped      = "dropped by admin"
+	ReasonOrphaned     = "agent is gone"
+	ReasonUnfinishable = "a task was cancelled"
+	ReasonRepaired     = "repaired by fsck"
+	ReasonNoQuorum     = "no quorum"
+	ReasonQuarantined  = "agent quarantined"
+)
+
+// FinishedStatuses are the final expression statuses
+var FinishedStatuses = []string{"completed", "error", "cancelled", "timed_out"}
+
+// IsFinished reports whether an expression status is final
+func IsFinished(status string) bool {
+	return slices.Contains(FinishedStatuses, status)
+}
+
+// CancelEvents record that the unfinished task was dropped with its
+// expression, reason is empty for a cancellation by the user
+func CancelEvents(task models.Task, reason string, at time.Time) []models.ExpressionEvent {
+	return []models.ExpressionEvent{taskEvent(task, models.EventCancelled, "cancelled", reason, at)}
+}
+
+// CreationEvents are the timeline entries of a newly saved expression,
+// tasks saved completed took their result from the cache
+func CreationEvents(expr *models.Expression, at time.Time) []models.ExpressionEvent {
+	events := []models.ExpressionEvent{
+		{ExpressionID: expr.ID, Type: models.EventCreated, Status: expr.Status, At: at},
+	}
+	for _, task := range expr.Tasks {
+		switch task.Status {
+		case "pending":
+			events = append(events, taskEvent(task, models.EventQueued, "pending", "", at))
+		case "completed":
+			events = append(events, taskEvent(task, models.EventCompleted, "completed", ReasonCached, at))
+		}
+	}
+
+	return events
+}
+
+// LeaseEvent records that the task was handed to its agent
+func LeaseEvent(task models.Task, at time.Time) models.ExpressionEvent {
+	return taskEvent(task, models.EventLeased, "in_progress", "", at)
+}
+
+// CompletionEvents record when the agent started and finished the task
+func CompletionEvents(task models.Task, startedAt time.Time, at time.Time) []models.ExpressionEvent {
+	var events []models.ExpressionEvent
+	if !startedAt.IsZero() {
+		events = append(events, taskEvent(task, models.EventStarted, "in_progress", "", startedAt))
+	}
+
+	return append(events, taskEvent(task, models.EventCompleted, "completed", "", at))
+}
+
+// RequeueEvents record a failed attempt of the task and its return to the queue
+func RequeueEvents(task models.Task, reason string, at time.Time) []models.ExpressionEvent {
+	return []models.ExpressionEvent{FailureEvent(task, reason, at), QueueEvent(task, at)}
+}
+
+// FailureEvent records that the agent of the task gave up on it
+func FailureEvent(task models.Task, reason string, at time.Time) models.ExpressionEvent {
+	return taskEvent(task, models.EventFailed, "in_progress", reason, at)
+}
+
+// QueueEvent records the return of the task to the queue
+func QueueEvent(task models.Task, at time.Time) models.ExpressionEvent {
+	queued := taskEvent(task, models.EventQueued, "pending", "", at)
+	queued.AgentID = ""
+	return queued
+}
+
+// RepairEvent records the status the consistency checker gave the task
+func RepairEvent(task models.Task, at time.Time) models.ExpressionEvent {
+	typ := models.EventStatus
+	if task.Status == "cancelled" {
+		typ = models.EventCancelled
+	}
+	return taskEvent(task, typ, task.Status, ReasonRepaired, at)
+}
+
+func taskEvent(task models.Task, typ, status, detail string, at time.Time) models.ExpressionEvent {
+	id := task.ID
+	return models.ExpressionEvent{
+		ExpressionID: task.ExpressionID,
+		TaskID:       &id,
+		Type:         typ,
+		Status:       status,
+		AgentID:      task.AgentID,
+		Detail:       detail,
+		At:           at,
+	}
+}
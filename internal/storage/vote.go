@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+	"github.com/nais2008/final_project_go_yandex/internal/parser"
+)
+
+// Quorum is how many agreeing votes accept the result of a task computed
+// by replicas agents, a strict majority
+func Quorum(replicas int) int {
+	return replicas/2 + 1
+}
+
+// Tally is the state of the vote on a replicated task
+type Tally struct {
+	// Result is what a quorum agreed on, nil while undecided
+	Result *float64
+	// Failed is set when no result can reach a quorum any more
+	Failed bool
+	// Dissenters are the agents that voted against Result
+	Dissenters []string
+}
+
+// CountVotes tallies the votes cast so far for a task computed by replicas
+// agents. Results agree when parser.Agree accepts them with the relative
+// tolerance, a vote counts for every result it agrees with.
+func CountVotes(votes []models.TaskVote, replicas int, tolerance float64) Tally {
+	quorum := Quorum(replicas)
+
+	var tally Tally
+	best := 0
+	for _, candidate := range votes {
+		agreeing := 0
+		for _, vote := range votes {
+			if parser.Agree(candidate.Result, vote.Result, tolerance) {
+				agreeing++
+			}
+		}
+		if agreeing > best {
+			best = agreeing
+			if best >= quorum {
+				result := candidate.Result
+				tally.Result = &result
+			}
+		}
+	}
+
+	if tally.Result == nil {
+		tally.Failed = best+replicas-len(votes) < quorum
+		return tally
+	}
+	for _, vote := range votes {
+		if !parser.Agree(vote.Result, *tally.Result, tolerance) {
+			tally.Dissenters = append(tally.Dissenters, vote.AgentID)
+		}
+	}
+
+	return tally
+}
+
+// ReplicaTask is the replicated task as the agent holding lease sees it
+func ReplicaTask(task models.Task, lease models.ReplicaLease) models.Task {
+	task.Status = "in_progress"
+	task.AgentID = lease.AgentID
+	leasedAt, expiresAt := lease.LeasedAt, lease.LeaseExpiresAt
+	task.LeasedAt = &leasedAt
+	task.LeaseExpiresAt = &expiresAt
+	return task
+}
+
+// VoteEvents record the vote of the agent holding the task and what it
+// led to: the task is completed, cancelled without a quorum or, when no
+// other agent holds it, queued for the next agent
+func VoteEvents(task models.Task, tally Tally, queued bool, result float64, startedAt, at time.Time) []models.ExpressionEvent {
+	var events []models.ExpressionEvent
+	if !startedAt.IsZero() {
+		events = append(events, taskEvent(task, models.EventStarted, "in_progress", "", startedAt))
+	}
+	events = append(events, taskEvent(task, models.EventVoted, "in_progress", strconv.FormatFloat(result, 'g', -1, 64), at))
+
+	switch {
+	case tally.Result != nil:
+		events = append(events, taskEvent(task, models.EventCompleted, "completed", "", at))
+	case tally.Failed:
+		events = append(events, taskEvent(task, models.EventCancelled, "cancelled", ReasonNoQuorum, at))
+	case queued:
+		events = append(events, QueueEvent(task, at))
+	}
+
+	return events
+}
+
+// ReplicaOpen reports whether agentID may take a replica of a task computed
+// by replicas agents, holders are the agents that hold or voted on it
+func ReplicaOpen(replicas int, holders []string, agentID string) bool {
+	return agentID != "" && len(holders) < replicas && !slices.Contains(holders, agentID)
+}
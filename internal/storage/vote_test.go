@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+)
+
+func votesOf(results ...float64) []models.TaskVote {
+	var votes []models.TaskVote
+	for i, result := range results {
+		votes = append(votes, models.TaskVote{AgentID: string(rune('a' + i)), Result: result})
+	}
+	return votes
+}
+
+func TestQuorum(t *testing.T) {
+	assert.Equal(t, 1, Quorum(1))
+	assert.Equal(t, 2, Quorum(2))
+	assert.Equal(t, 2, Quorum(3))
+	assert.Equal(t, 3, Quorum(4))
+	assert.Equal(t, 3, Quorum(5))
+}
+
+func TestCountVotes(t *testing.T) {
+	tally := CountVotes(votesOf(6), 3, 0)
+	assert.Nil(t, tally.Result)
+	assert.False(t, tally.Failed)
+
+	// one agent disagrees, the third vote can still settle it
+	tally = CountVotes(votesOf(6, 7), 3, 0)
+	assert.Nil(t, tally.Result)
+	assert.False(t, tally.Failed)
+
+	tally = CountVotes(votesOf(6, 7, 6), 3, 0)
+	require.NotNil(t, tally.Result)
+	assert.Equal(t, 6.0, *tally.Result)
+	assert.Equal(t, []string{"b"}, tally.Dissenters)
+
+	tally = CountVotes(votesOf(6, 7, 8), 3, 0)
+	assert.Nil(t, tally.Result)
+	assert.True(t, tally.Failed)
+
+	// both of two replicas have to agree
+	tally = CountVotes(votesOf(6, 7), 2, 0)
+	assert.True(t, tally.Failed)
+	tally = CountVotes(votesOf(6, 6), 2, 0)
+	require.NotNil(t, tally.Result)
+	assert.Empty(t, tally.Dissenters)
+
+	// results within the tolerance agree
+	tally = CountVotes(votesOf(0.3, 0.30000000000000004, 0.4), 3, 0)
+	assert.True(t, tally.Failed)
+	tally = CountVotes(votesOf(0.3, 0.30000000000000004, 0.4), 3, 1e-9)
+	require.NotNil(t, tally.Result)
+	assert.Equal(t, 0.3, *tally.Result)
+	assert.Equal(t, []string{"c"}, tally.Dissenters)
+}
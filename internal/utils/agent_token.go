@@ -0,0 +1,33 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+)
+
+// GenerateAgentToken ...
+func GenerateAgentToken() (string, error) {
+	const op string = "utils.GenerateAgentToken"
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// HashAgentToken returns the hex SHA-256 of the token, which is what the
+// orchestrator stores
+func HashAgentToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CompareAgentToken reports whether the token matches the stored hash
+func CompareAgentToken(hash, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(HashAgentToken(token))) == 1
+}
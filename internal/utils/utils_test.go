@@ -48,3 +48,15 @@ func TestVerifyJWT_Invalid(t *testing.T) {
 	_, err := utils.VerifyJWT("invalid_token")
 	assert.Error(t, err)
 }
+
+func TestAgentToken(t *testing.T) {
+	token, err := utils.GenerateAgentToken()
+	assert.NoError(t, err)
+	assert.Len(t, token, 64)
+
+	hash := utils.HashAgentToken(token)
+	assert.NotEqual(t, token, hash)
+	assert.True(t, utils.CompareAgentToken(hash, token))
+	assert.False(t, utils.CompareAgentToken(hash, token+"0"))
+	assert.False(t, utils.CompareAgentToken("", token))
+}
@@ -0,0 +1,269 @@
+// Package webhook notifies user URLs about finished expressions
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nais2008/final_project_go_yandex/internal/config"
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+	"github.com/nais2008/final_project_go_yandex/internal/storage"
+)
+
+// events sent to webhooks
+const (
+	EventCompleted = "expression.completed"
+	EventFailed    = "expression.failed"
+	EventCancelled = "expression.cancelled"
+	EventTimedOut  = "expression.timed_out"
+)
+
+// headers of a delivery request
+const (
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderDelivery  = "X-Webhook-Delivery"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+// batchSize is how many deliveries one pass of the sender posts at once
+const batchSize = 10
+
+// Payload is the JSON body posted to a webhook
+type Payload struct {
+	Event      string            `json:"event"`
+	Expression PayloadExpression `json:"expression"`
+}
+
+// PayloadExpression ...
+type PayloadExpression struct {
+	ID         uint       `json:"id"`
+	Expression string     `json:"expression"`
+	Status     string     `json:"status"`
+	Result     *float64   `json:"result"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// NewSecret generates a signing secret
+func NewSecret() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("webhook: read random: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+// Sign returns the signature header value for a payload: the hex HMAC-SHA256
+// of "<timestamp>.<body>" keyed with the user's secret
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a signature produced by Sign
+func Verify(secret string, timestamp int64, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
+
+// Backoff is the pause before retry number attempt+1: base doubled per
+// failed attempt, capped at max
+func Backoff(attempt int, base, max time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		return max
+	}
+	return delay
+}
+
+// NewDeliveries builds one delivery per distinct URL for a finished expression
+func NewDeliveries(expr models.Expression, urls []string, now time.Time) ([]models.WebhookDelivery, error) {
+	event := EventFailed
+	switch expr.Status {
+	case "completed":
+		event = EventCompleted
+	case "cancelled":
+		event = EventCancelled
+	case "timed_out":
+		event = EventTimedOut
+	}
+
+	body, err := json.Marshal(Payload{
+		Event: event,
+		Expression: PayloadExpression{
+			ID:         expr.ID,
+			Expression: expr.Expr,
+			Status:     expr.Status,
+			Result:     expr.Result,
+			CreatedAt:  expr.CreatedAt,
+			FinishedAt: expr.FinishedAt,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var deliveries []models.WebhookDelivery
+	for _, url := range urls {
+		if url == "" || seen[url] {
+			continue
+		}
+		seen[url] = true
+
+		next := now
+		deliveries = append(deliveries, models.WebhookDelivery{
+			UserID:        expr.UserID,
+			ExpressionID:  expr.ID,
+			URL:           url,
+			Event:         event,
+			Payload:       string(body),
+			Status:        models.DeliveryPending,
+			NextAttemptAt: &next,
+			CreatedAt:     now,
+		})
+	}
+
+	return deliveries, nil
+}
+
+// Sender posts due deliveries and schedules retries with exponential backoff
+type Sender struct {
+	store       storage.Webhooks
+	guard       *Guard
+	client      *http.Client
+	timeout     time.Duration
+	maxAttempts int
+	retryBase   time.Duration
+	retryMax    time.Duration
+}
+
+// NewSender ...
+func NewSender(store storage.Webhooks, cfg config.Config) *Sender {
+	timeout := time.Duration(cfg.WebhookTimeoutMS) * time.Millisecond
+	guard := NewGuard(cfg.WebhookAllowedNets)
+	return &Sender{
+		store:       store,
+		guard:       guard,
+		client:      guard.Client(timeout),
+		timeout:     timeout,
+		maxAttempts: cfg.WebhookMaxAttempts,
+		retryBase:   time.Duration(cfg.WebhookRetryBaseMS) * time.Millisecond,
+		retryMax:    time.Duration(cfg.WebhookRetryMaxMS) * time.Millisecond,
+	}
+}
+
+// CheckURL validates a webhook URL before it is registered, see Guard
+func (s *Sender) CheckURL(ctx context.Context, raw string) error {
+	return s.guard.CheckURL(ctx, raw)
+}
+
+// Run posts every delivery that is due, it is meant to run as a leader duty
+func (s *Sender) Run(ctx context.Context) error {
+	for {
+		now := time.Now()
+		// a sender that dies mid-request leaves the delivery to be retried
+		// once this lease passes
+		deliveries, err := s.store.ClaimWebhookDeliveries(ctx, now, now.Add(2*s.timeout), batchSize)
+		if err != nil {
+			return err
+		}
+		if len(deliveries) == 0 {
+			return nil
+		}
+
+		var wg sync.WaitGroup
+		for _, delivery := range deliveries {
+			wg.Add(1)
+			go func(delivery models.WebhookDelivery) {
+				defer wg.Done()
+				s.deliver(ctx, delivery)
+			}(delivery)
+		}
+		wg.Wait()
+
+		if len(deliveries) < batchSize || ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *Sender) deliver(ctx context.Context, delivery models.WebhookDelivery) {
+	attempt := models.WebhookAttempt{DeliveryID: delivery.ID, Attempt: delivery.Attempts + 1, At: time.Now()}
+
+	code, err := s.post(ctx, delivery)
+	attempt.DurationMS = time.Since(attempt.At).Milliseconds()
+	attempt.ResponseCode = code
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+
+	status := models.DeliverySucceeded
+	var next *time.Time
+	if err != nil {
+		status = models.DeliveryFailed
+		// a forbidden address stays forbidden
+		if attempt.Attempt < s.maxAttempts && !errors.Is(err, ErrForbiddenAddress) {
+			status = models.DeliveryPending
+			at := time.Now().Add(Backoff(attempt.Attempt, s.retryBase, s.retryMax))
+			next = &at
+		}
+		log.Printf("Webhook delivery %d to %s failed (attempt %d): %v", delivery.ID, delivery.URL, attempt.Attempt, err)
+	}
+
+	if err := s.store.RecordWebhookAttempt(ctx, attempt, status, next); err != nil {
+		log.Printf("Failed to record webhook delivery %d: %v", delivery.ID, err)
+	}
+}
+
+// post sends the payload signed with the user's current secret
+func (s *Sender) post(ctx context.Context, delivery models.WebhookDelivery) (int, error) {
+	secret, err := s.store.EnsureWebhookSecret(ctx, delivery.UserID, NewSecret())
+	if err != nil {
+		return 0, fmt.Errorf("load secret: %w", err)
+	}
+
+	body := []byte(delivery.Payload)
+	timestamp := time.Now().Unix()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, delivery.Event)
+	req.Header.Set(HeaderDelivery, strconv.FormatUint(uint64(delivery.ID), 10))
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(secret, timestamp, body))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,168 @@
+package webhook
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nais2008/final_project_go_yandex/internal/config"
+	"github.com/nais2008/final_project_go_yandex/internal/models"
+	"github.com/nais2008/final_project_go_yandex/internal/storage/memory"
+)
+
+func TestBackoff(t *testing.T) {
+	assert.Equal(t, time.Second, Backoff(1, time.Second, time.Minute))
+	assert.Equal(t, 4*time.Second, Backoff(3, time.Second, time.Minute))
+	assert.Equal(t, time.Minute, Backoff(20, time.Second, time.Minute))
+}
+
+func TestSignAndVerify(t *testing.T) {
+	sig := Sign("secret", 100, []byte("body"))
+	assert.True(t, Verify("secret", 100, []byte("body"), sig))
+	assert.False(t, Verify("secret", 101, []byte("body"), sig))
+	assert.False(t, Verify("other", 100, []byte("body"), sig))
+}
+
+func TestNewDeliveries(t *testing.T) {
+	now := time.Now()
+	deliveries, err := NewDeliveries(models.Expression{ID: 1, UserID: 2, Status: "error"},
+		[]string{"", "http://a", "http://a", "http://b"}, now)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 2)
+	assert.Equal(t, EventFailed, deliveries[0].Event)
+	assert.Equal(t, models.DeliveryPending, deliveries[0].Status)
+	assert.Contains(t, deliveries[0].Payload, `"event":"expression.failed"`)
+}
+
+func TestSender_RetriesUntilDelivered(t *testing.T) {
+	ctx := context.Background()
+	st := memory.New()
+	secret, err := st.EnsureWebhookSecret(ctx, 1, "secret")
+	require.NoError(t, err)
+
+	var (
+		mu    sync.Mutex
+		calls int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+
+		body, _ := io.ReadAll(r.Body)
+		ts, _ := strconv.ParseInt(r.Header.Get(HeaderTimestamp), 10, 64)
+		assert.True(t, Verify(secret, ts, body, r.Header.Get(HeaderSignature)))
+		assert.Equal(t, EventCompleted, r.Header.Get(HeaderEvent))
+
+		if calls == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	result := 3.0
+	deliveries, err := NewDeliveries(models.Expression{ID: 1, UserID: 1, Status: "completed", Result: &result},
+		[]string{srv.URL}, time.Now())
+	require.NoError(t, err)
+	require.NoError(t, st.EnqueueWebhookDeliveries(ctx, deliveries))
+
+	sender := NewSender(st, config.Config{
+		WebhookTimeoutMS:   1000,
+		WebhookMaxAttempts: 3,
+		WebhookRetryBaseMS: 1,
+		WebhookRetryMaxMS:  1,
+		WebhookAllowedNets: []string{"127.0.0.1"},
+	})
+
+	require.NoError(t, sender.Run(ctx))
+	got, err := st.WebhookDelivery(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, models.DeliveryPending, got.Status)
+	assert.Equal(t, 500, got.LastResponseCode)
+
+	time.Sleep(5 * time.Millisecond)
+	require.NoError(t, sender.Run(ctx))
+	got, err = st.WebhookDelivery(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, models.DeliverySucceeded, got.Status)
+	assert.Equal(t, 2, got.Attempts)
+	require.Len(t, got.AttemptLog, 2)
+}
+
+func TestGuard_Allowed(t *testing.T) {
+	guard := NewGuard([]string{"10.1.0.0/16", "127.0.0.2", "bogus"})
+
+	for addr, allowed := range map[string]bool{
+		"93.184.216.34":   true,
+		"2606:4700::1111": true,
+		"127.0.0.1":       false,
+		"::1":             false,
+		"0.0.0.0":         false,
+		"10.0.0.1":        false,
+		"172.16.5.4":      false,
+		"192.168.1.1":     false,
+		"100.64.0.1":      false,
+		"169.254.169.254": false,
+		"fe80::1":         false,
+		"fd00::1":         false,
+		"::ffff:10.0.0.1": false,
+		"10.1.2.3":        true,
+		"127.0.0.2":       true,
+	} {
+		assert.Equal(t, allowed, guard.Allowed(netip.MustParseAddr(addr)), addr)
+	}
+}
+
+func TestGuard_CheckURL(t *testing.T) {
+	ctx := context.Background()
+	guard := NewGuard(nil)
+
+	assert.NoError(t, guard.CheckURL(ctx, "https://93.184.216.34/hook"))
+	assert.ErrorIs(t, guard.CheckURL(ctx, "ftp://93.184.216.34/hook"), ErrInvalidURL)
+	assert.ErrorIs(t, guard.CheckURL(ctx, "http:///hook"), ErrInvalidURL)
+	for _, raw := range []string{
+		"http://127.0.0.1:8080/hook",
+		"http://[::1]/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://10.0.0.5/hook",
+		"http://localhost/hook",
+	} {
+		assert.ErrorIs(t, guard.CheckURL(ctx, raw), ErrForbiddenAddress, raw)
+	}
+}
+
+func TestSender_RefusesPrivateAddresses(t *testing.T) {
+	ctx := context.Background()
+	st := memory.New()
+
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	defer srv.Close()
+
+	// what the name resolved to at registration does not matter, the
+	// address connected to is checked
+	deliveries, err := NewDeliveries(models.Expression{ID: 1, UserID: 1, Status: "completed"}, []string{srv.URL}, time.Now())
+	require.NoError(t, err)
+	require.NoError(t, st.EnqueueWebhookDeliveries(ctx, deliveries))
+
+	sender := NewSender(st, config.Config{WebhookTimeoutMS: 1000, WebhookMaxAttempts: 3})
+	require.NoError(t, sender.Run(ctx))
+
+	got, err := st.WebhookDelivery(ctx, 1)
+	require.NoError(t, err)
+	assert.Zero(t, calls)
+	assert.Equal(t, models.DeliveryFailed, got.Status)
+	require.Len(t, got.AttemptLog, 1)
+	assert.Contains(t, got.AttemptLog[0].Error, ErrForbiddenAddress.Error())
+}